@@ -0,0 +1,178 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package adaptive implements a limiter which throttles rate-based workloads
+// accordingly to server load. It allows running workloads against production-like
+// systems more safely.
+//
+// Limiter periodically (accordingly to Config.PollInterval) polls load source. When
+// polled load exceeds Config.Threshold, the rate factor is halved (but no less than
+// minimal factor). When load is below the threshold, the factor is increased
+// gradually until it reaches 1 (rate is not throttled). Workloads consult the limiter
+// and multiply their configured rate by the factor. Nil limiter never throttles.
+package adaptive
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"golang.org/x/time/rate"
+	"math"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultQuery defines query used for polling load by default, it returns number of active backends.
+	DefaultQuery = "SELECT count(*) FROM pg_stat_activity WHERE state = 'active' AND pid <> pg_backend_pid()"
+	// minFactor defines lower limit of rate factor, workloads are never stopped completely.
+	minFactor = 0.05
+	// increaseStep defines how much factor is increased when load is below threshold.
+	increaseStep = 0.1
+)
+
+// Source defines source of server load signal.
+type Source interface {
+	Load(ctx context.Context) (float64, error)
+}
+
+// querySource implements Source interface using query which returns single number.
+type querySource struct {
+	pool  db.DB
+	query string
+}
+
+// NewQuerySource creates load source which executes passed query. Query must return single numeric value.
+func NewQuerySource(pool db.DB, query string) Source {
+	return &querySource{pool: pool, query: query}
+}
+
+// Load executes query and returns its result.
+func (s *querySource) Load(ctx context.Context) (float64, error) {
+	rows, err := s.pool.Query(ctx, s.query)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var load float64
+	for rows.Next() {
+		err = rows.Scan(&load)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return load, rows.Err()
+}
+
+// Config defines configuration settings for adaptive limiter.
+type Config struct {
+	// Threshold defines load value above which workloads are throttled.
+	Threshold float64
+	// PollInterval defines interval between polling load source.
+	PollInterval time.Duration
+}
+
+// validate method checks limiter configuration settings.
+func (c Config) validate() error {
+	if c.Threshold <= 0 {
+		return noisia.NewConfigError("Threshold", noisia.ErrInvalidValue, "threshold must be positive")
+	}
+
+	if c.PollInterval <= 0 {
+		return noisia.NewConfigError("PollInterval", noisia.ErrInvalidDuration, "poll interval must be positive")
+	}
+
+	return nil
+}
+
+// Limiter defines adaptive limiter which computes rate factor depending on server load.
+type Limiter struct {
+	config Config
+	source Source
+	logger log.Logger
+	// factor defines current rate factor stored as float64 bits, should be accessed atomically.
+	factor uint64
+}
+
+// NewLimiter creates new adaptive limiter which polls passed load source.
+func NewLimiter(config Config, source Source, logger log.Logger) (*Limiter, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Limiter{config: config, source: source, logger: logger, factor: math.Float64bits(1)}, nil
+}
+
+// Run polls load source until context is done.
+func (l *Limiter) Run(ctx context.Context) {
+	ticker := time.NewTicker(l.config.PollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			err := l.poll(ctx)
+			if err != nil && ctx.Err() == nil {
+				l.logger.Warnf("adaptive limiter: poll load failed: %s", err)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// poll queries current load and adjusts rate factor.
+func (l *Limiter) poll(ctx context.Context) error {
+	load, err := l.source.Load(ctx)
+	if err != nil {
+		return err
+	}
+
+	l.adjust(ctx, load)
+	return nil
+}
+
+// adjust decreases rate factor if load exceeds threshold, otherwise increases it.
+func (l *Limiter) adjust(ctx context.Context, load float64) {
+	current := l.Factor()
+	next := current
+
+	if load > l.config.Threshold {
+		next = math.Max(current/2, minFactor)
+	} else {
+		next = math.Min(current+increaseStep, 1)
+	}
+
+	if next != current {
+		atomic.StoreUint64(&l.factor, math.Float64bits(next))
+		events.Emit(ctx, "adaptive", "load %.2f, rate factor changed from %.2f to %.2f", load, current, next)
+	}
+}
+
+// Factor returns current rate factor between minimal factor and 1. Nil limiter returns 1.
+func (l *Limiter) Factor() float64 {
+	if l == nil {
+		return 1
+	}
+
+	return math.Float64frombits(atomic.LoadUint64(&l.factor))
+}
+
+// Scale returns passed rate multiplied by current rate factor.
+func (l *Limiter) Scale(r float64) float64 {
+	return r * l.Factor()
+}
+
+// Apply updates limit of passed rate limiter accordingly to base rate and current rate factor.
+func (l *Limiter) Apply(limiter *rate.Limiter, r float64) {
+	want := rate.Limit(l.Scale(r))
+	if limiter.Limit() != want {
+		limiter.SetLimit(want)
+	}
+}
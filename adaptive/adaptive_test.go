@@ -0,0 +1,94 @@
+package adaptive
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/time/rate"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Threshold: 10, PollInterval: time.Second}},
+		{valid: false, config: Config{Threshold: 0, PollInterval: time.Second}},
+		{valid: false, config: Config{Threshold: 10, PollInterval: 0}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestLimiter_poll(t *testing.T) {
+	source := &fakeSource{}
+	l, err := NewLimiter(Config{Threshold: 10, PollInterval: time.Second}, source, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	limiter := rate.NewLimiter(rate.Limit(100), 1)
+	l.Apply(limiter, 100)
+	assert.Equal(t, rate.Limit(100), limiter.Limit())
+
+	// High load, effective rate drops.
+	source.load = 20
+	assert.NoError(t, l.poll(context.Background()))
+	assert.Equal(t, 0.5, l.Factor())
+	l.Apply(limiter, 100)
+	assert.Equal(t, rate.Limit(50), limiter.Limit())
+
+	// Factor never drops below minimal factor.
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, l.poll(context.Background()))
+	}
+	assert.Equal(t, minFactor, l.Factor())
+
+	// Load recovered, effective rate ramps back up.
+	source.load = 5
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, l.poll(context.Background()))
+	}
+	assert.Equal(t, 1.0, l.Factor())
+	l.Apply(limiter, 100)
+	assert.Equal(t, rate.Limit(100), limiter.Limit())
+
+	// Errors of source don't change factor.
+	source.err = fmt.Errorf("example error")
+	assert.Error(t, l.poll(context.Background()))
+	assert.Equal(t, 1.0, l.Factor())
+}
+
+func TestLimiter_nil(t *testing.T) {
+	var l *Limiter
+	assert.Equal(t, 1.0, l.Factor())
+	assert.Equal(t, 10.0, l.Scale(10))
+}
+
+func TestQuerySource_Load(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	load, err := NewQuerySource(pool, DefaultQuery).Load(context.Background())
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, load, float64(0))
+}
+
+// fakeSource implements Source interface and returns predefined load.
+type fakeSource struct {
+	load float64
+	err  error
+}
+
+func (s *fakeSource) Load(context.Context) (float64, error) {
+	return s.load, s.err
+}
@@ -0,0 +1,236 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package advisorylocks defines implementation of workload which produces contention
+// on advisory locks. This reproduces application-level locking, where waiting sessions
+// are blocked by advisory locks instead of table or row locks.
+//
+// Before starting the workload, the necessary number of workers is started (accordingly
+// to Config.Jobs). Each worker connects to the database using dedicated connection (session
+// level locks are bound to connection) and in a loop acquires random lock from a small pool
+// of keys using pg_advisory_lock(), holds it for Config.HoldTime and then releases it using
+// pg_advisory_unlock(). The size of the pool is defined by Config.KeySpace, the smaller the
+// pool the more workers wait for each other. All keys belong to dedicated namespace, so locks
+// acquired by the workload don't intersect with locks acquired by applications.
+// Workload duration is controlled by context created outside and passed to Run method. When
+// context expires, workers stop and close their connections, releasing held locks.
+package advisorylocks
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// lockNamespace defines first key of two-keys advisory locks used by the workload.
+const lockNamespace = 1852795251
+
+// Config defines configuration settings for advisory locks workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for acquiring locks.
+	Jobs uint16
+	// KeySpace defines number of distinct lock keys workers contend on.
+	KeySpace uint16
+	// HoldTime defines how long acquired lock is held before release.
+	HoldTime time.Duration
+	// Databases defines databases which workers connect to accordingly to workers indexes, empty
+	// name means the database from connection string.
+	Databases []string
+	// Seed defines seed of random choices of lock keys, current time is used if zero.
+	Seed int64
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	err := db.ValidateWorkerDatabases(c.Databases, c.Jobs)
+	if err != nil {
+		return noisia.NewConfigError("Databases", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.KeySpace < 1 {
+		return noisia.NewConfigError("KeySpace", noisia.ErrInvalidValue, "key space must be greater than zero")
+	}
+
+	if c.HoldTime <= 0 {
+		return noisia.NewConfigError("HoldTime", noisia.ErrInvalidDuration, "hold time must be positive")
+	}
+
+	err = db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	return nil
+}
+
+// stats defines counters of acquired and released locks.
+type stats struct {
+	// acquired defines number of acquired locks.
+	acquired int64
+	// released defines number of released locks.
+	released int64
+	// waitTime defines total time spent waiting for locks, in milliseconds.
+	waitTime int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "advisorylocks"
+}
+
+// Stats returns counters of acquired and released locks, and total time spent waiting for locks.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"acquired":     atomic.LoadInt64(&w.stats.acquired),
+		"released":     atomic.LoadInt64(&w.stats.released),
+		"wait_time_ms": atomic.LoadInt64(&w.stats.waitTime),
+	}
+}
+
+// Run method starts workers and waits until they finish.
+func (w *workload) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		opts := db.ConnOptions{Workload: w.Name(), Database: db.WorkerDatabase(w.config.Databases, i), Role: w.config.Role, SearchPath: w.config.SearchPath}
+		rnd := random.New(w.config.Seed, i)
+
+		go func() {
+			err := runWorker(ctx, w.config, opts, rnd, &w.stats)
+			if err != nil {
+				w.logger.Warnf("advisorylocks worker failed: %s", err)
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	w.logger.Infof("acquired %d advisory locks, waited for locks %d ms in total", atomic.LoadInt64(&w.stats.acquired), atomic.LoadInt64(&w.stats.waitTime))
+
+	return nil
+}
+
+// runWorker connects to the database using passed options and starts locks loop.
+func runWorker(ctx context.Context, config Config, opts db.ConnOptions, rnd *rand.Rand, st *stats) error {
+	conn, err := db.ConnectWithOptions(ctx, config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
+
+	// Closing connection also releases locks which might be held when context is done.
+	defer func() { _ = conn.Close() }()
+
+	return startLoop(ctx, conn, config, rnd, st)
+}
+
+// startLoop acquires random locks from key space, holds and releases them in a loop until
+// context is done. Keys are taken from passed random source. Acquired and released locks are
+// recorded into passed stats.
+func startLoop(ctx context.Context, conn db.Conn, config Config, rnd *rand.Rand, st *stats) error {
+	for {
+		key := rnd.Intn(int(config.KeySpace))
+
+		start := time.Now()
+		err := lock(ctx, conn, key)
+		if err != nil {
+			// Waiting for lock is interrupted by context.
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		atomic.AddInt64(&st.acquired, 1)
+		atomic.AddInt64(&st.waitTime, time.Since(start).Milliseconds())
+		events.Emit(ctx, "advisorylocks", "acquired lock %d", key)
+
+		// Hold the lock. When context is done, the lock is released by closing the connection.
+		timer := time.NewTimer(config.HoldTime)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return nil
+		}
+
+		err = unlock(ctx, conn, key)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		atomic.AddInt64(&st.released, 1)
+	}
+}
+
+// lock acquires session-level advisory lock with passed key, waiting if necessary.
+func lock(ctx context.Context, conn db.Conn, key int) error {
+	_, _, err := conn.Exec(ctx, "SELECT pg_advisory_lock($1, $2)", lockNamespace, key)
+	return err
+}
+
+// unlock releases session-level advisory lock with passed key.
+func unlock(ctx context.Context, conn db.Conn, key int) error {
+	rows, err := conn.Query(ctx, "SELECT pg_advisory_unlock($1, $2)", lockNamespace, key)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ok bool
+	for rows.Next() {
+		err = rows.Scan(&ok)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("advisory lock %d is not held", key)
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package advisorylocks
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, KeySpace: 1, HoldTime: time.Second}},
+		{valid: false, config: Config{Jobs: 1, KeySpace: 1, HoldTime: time.Second, Databases: []string{"", "db1"}}},
+		{valid: false, config: Config{Jobs: 0, KeySpace: 1, HoldTime: time.Second}},
+		{valid: false, config: Config{Jobs: 1, KeySpace: 0, HoldTime: time.Second}},
+		{valid: false, config: Config{Jobs: 1, KeySpace: 1, HoldTime: 0}},
+		{valid: false, config: Config{Jobs: 1, KeySpace: 1, HoldTime: time.Second, SearchPath: "app,,public"}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 4, KeySpace: 2, HoldTime: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	stats := w.Stats()
+	assert.Greater(t, stats["acquired"], int64(0))
+	assert.Greater(t, stats["released"], int64(0))
+	// Workers wait for each other, because there are less keys than workers.
+	assert.Greater(t, stats["wait_time_ms"], int64(0))
+}
+
+func Test_runWorker(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	st := &stats{}
+	assert.NoError(t, runWorker(ctx, Config{Conninfo: db.TestConninfo, KeySpace: 1, HoldTime: 10 * time.Millisecond}, db.ConnOptions{}, random.New(0, 0), st))
+	assert.Greater(t, st.acquired, int64(0))
+
+	// Locks are released when worker is finished.
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	rows, err := pool.Query(context.Background(), "SELECT count(*) FROM pg_locks WHERE locktype = 'advisory' AND classid = $1", lockNamespace)
+	assert.NoError(t, err)
+
+	var n int
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&n))
+	}
+	rows.Close()
+	assert.Equal(t, 0, n)
+}
+
+func Test_startLoop_fakeConn(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	conn := &lockConn{held: map[int]bool{}}
+	st := &stats{}
+	assert.NoError(t, startLoop(ctx, conn, Config{KeySpace: 4, HoldTime: 10 * time.Millisecond}, random.New(0, 0), st))
+
+	// Each acquired lock is released, except the one held when context is done.
+	assert.Greater(t, st.acquired, int64(1))
+	assert.Equal(t, st.acquired-1, st.released)
+	assert.Len(t, conn.held, 1)
+	for key := range conn.held {
+		assert.Less(t, key, 4)
+	}
+}
+
+func Test_unlock(t *testing.T) {
+	conn := &lockConn{held: map[int]bool{}}
+
+	assert.NoError(t, lock(context.Background(), conn, 1))
+	assert.NoError(t, unlock(context.Background(), conn, 1))
+	assert.Error(t, unlock(context.Background(), conn, 1))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, KeySpace: 1, HoldTime: time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "advisorylocks", w.Name())
+}
+
+// lockConn implements db.Conn interface and emulates advisory locks.
+type lockConn struct {
+	held map[int]bool
+}
+
+func (c *lockConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *lockConn) Exec(_ context.Context, _ string, args ...interface{}) (int64, string, error) {
+	c.held[args[1].(int)] = true
+	return 0, "", nil
+}
+
+func (c *lockConn) Query(_ context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	key := args[1].(int)
+	ok := c.held[key]
+	delete(c.held, key)
+	return &boolRows{value: ok}, nil
+}
+
+func (c *lockConn) Close() error {
+	return nil
+}
+
+// boolRows implements db.Rows interface with single row containing boolean value.
+type boolRows struct {
+	value bool
+	done  bool
+}
+
+func (r *boolRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *boolRows) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = r.value
+	return nil
+}
+
+func (r *boolRows) Err() error {
+	return nil
+}
+
+func (r *boolRows) Close() {}
@@ -0,0 +1,206 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package analyzeload defines implementation of workload which runs ANALYZE on tables in a
+// tight loop. Frequent ANALYZE stresses statistics collection and makes planner statistics
+// change constantly, this reproduces incidents related to plan instability.
+//
+// Before start, target tables are resolved: tables specified in Config.Tables are checked they
+// exist, if no tables specified the most written tables are used. Next, the necessary number of
+// workers is started (accordingly to Config.Jobs). Each worker analyzes one of target tables
+// chosen randomly, accordingly to rate specified in Config.Rate. Note, only owner of the table
+// (or superuser) could analyze it, other tables are skipped by Postgres with a warning.
+package analyzeload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/targeting"
+	"github.com/lesovsky/noisia/workerpool"
+	"math/rand"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maxTargetTables defines max number of the most written tables analyzed when no tables specified.
+const maxTargetTables = 5
+
+// Config defines configuration settings for analyze workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for analyzing tables.
+	Jobs uint16
+	// Rate defines rate of ANALYZE per second (per single worker).
+	Rate float64
+	// Tables defines names of analyzed tables, optionally schema-qualified. If empty, the most
+	// written tables are analyzed.
+	Tables []string
+	// Seed defines seed of random choices of tables, current time is used if zero.
+	Seed int64
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	for _, t := range c.Tables {
+		if strings.TrimSpace(t) == "" {
+			return noisia.NewConfigError("Tables", noisia.ErrInvalidValue, "table name must not be empty")
+		}
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// analyzes defines number of executed ANALYZE, it is updated atomically.
+	analyzes int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "analyzeload"
+}
+
+// Stats returns number of executed ANALYZE.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"analyzes": atomic.LoadInt64(&w.analyzes),
+	}
+}
+
+// Run method connects to Postgres, resolves target tables and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	tables, err := targetTables(ctx, pool, w.config.Tables)
+	if err != nil {
+		return err
+	}
+
+	if len(tables) == 0 {
+		w.logger.Warnf("analyzeload: no tables found, skip")
+		return nil
+	}
+
+	w.logger.Infof("analyzeload: analyze tables %s", strings.Join(tables, ", "))
+
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		rnd := random.New(w.config.Seed, i)
+		ratelimit.Run(ctx, w.config.Rate, nil, func(ctx context.Context) error {
+			return analyzeTable(ctx, pool, tables, rnd, &w.analyzes)
+		}, w.logger)
+	})
+
+	w.logger.Infof("analyzeload finished: %d analyzes", atomic.LoadInt64(&w.analyzes))
+
+	return nil
+}
+
+// targetTables returns quoted names of tables which should be analyzed. Passed names are resolved
+// using regclass, so nonexistent tables are rejected. If no names passed, the most written tables
+// are returned.
+func targetTables(ctx context.Context, pool db.DB, names []string) ([]string, error) {
+	if len(names) == 0 {
+		tables, err := targeting.TopWriteTables(ctx, pool, maxTargetTables)
+		if err != nil {
+			return nil, err
+		}
+
+		return targeting.QuotedNames(tables), nil
+	}
+
+	tables := make([]string, 0, len(names))
+	for _, name := range names {
+		table, err := resolveTable(ctx, pool, strings.TrimSpace(name))
+		if err != nil {
+			return nil, fmt.Errorf("resolve table %s failed: %s", name, err)
+		}
+
+		tables = append(tables, table)
+	}
+
+	return tables, nil
+}
+
+// resolveTable returns quoted, schema-qualified (if necessary) name of passed table.
+func resolveTable(ctx context.Context, q db.Querier, name string) (string, error) {
+	rows, err := q.Query(ctx, "SELECT $1::regclass::text", name)
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var table string
+	for rows.Next() {
+		err = rows.Scan(&table)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return table, rows.Err()
+}
+
+// analyzeTable analyzes one of passed tables chosen randomly using passed source. Executed ANALYZE
+// are counted.
+func analyzeTable(ctx context.Context, pool db.DB, tables []string, rnd *rand.Rand, analyzes *int64) error {
+	table := tables[rnd.Intn(len(tables))]
+
+	_, _, err := pool.Exec(ctx, "ANALYZE "+table)
+	if err != nil {
+		return fmt.Errorf("analyze %s failed: %s", table, err)
+	}
+
+	atomic.AddInt64(analyzes, 1)
+	events.Emit(ctx, "analyzeload", "analyzed %s", table)
+
+	return nil
+}
@@ -0,0 +1,139 @@
+package analyzeload
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, Tables: []string{"public.example"}}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Tables: []string{"example", " "}}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_analyze (a int)")
+	assert.NoError(t, err)
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_analyze")
+		assert.NoError(t, err)
+	}()
+	_, _, err = pool.Exec(context.Background(), "INSERT INTO noisia_test_analyze SELECT generate_series(1, 10000)")
+	assert.NoError(t, err)
+
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 10, Tables: []string{"noisia_test_analyze"}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["analyzes"], int64(0))
+
+	// Table has been analyzed, its statistics is available for planner.
+	rows, err := pool.Query(context.Background(), "SELECT analyze_count FROM pg_stat_user_tables WHERE relname = 'noisia_test_analyze'")
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&n))
+	}
+	assert.Greater(t, n, int64(0))
+}
+
+func Test_targetTables(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), `CREATE TABLE "noisia.test.analyze" (a int)`)
+	assert.NoError(t, err)
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), `DROP TABLE "noisia.test.analyze"`)
+		assert.NoError(t, err)
+	}()
+
+	// Names are quoted, so they are safe to use in queries.
+	got, err := targetTables(context.Background(), pool, []string{`"noisia.test.analyze"`})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"noisia.test.analyze"`}, got)
+
+	// Nonexistent tables are rejected.
+	_, err = targetTables(context.Background(), pool, []string{"noisia_test_nonexistent"})
+	assert.Error(t, err)
+
+	// The most written tables are used if no tables specified.
+	_, err = targetTables(context.Background(), pool, nil)
+	assert.NoError(t, err)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "analyzeload", w.Name())
+}
+
+func Test_analyzeTable(t *testing.T) {
+	pool := &recordDB{}
+	rnd := random.New(42, 0)
+	tables := []string{`"public"."t1"`, `"public"."t2"`}
+
+	var n int64
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, analyzeTable(context.Background(), pool, tables, rnd, &n))
+	}
+	assert.Equal(t, int64(20), n)
+	assert.Contains(t, pool.queries, `ANALYZE "public"."t1"`)
+	assert.Contains(t, pool.queries, `ANALYZE "public"."t2"`)
+
+	// Failed ANALYZE is not counted.
+	pool.err = errors.New("permission denied")
+	assert.Error(t, analyzeTable(context.Background(), pool, tables, rnd, &n))
+	assert.Equal(t, int64(20), n)
+}
+
+// recordDB implements db.DB interface, records executed queries and returns configured error.
+type recordDB struct {
+	queries []string
+	err     error
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) { return nil, d.err }
+func (d *recordDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	d.queries = append(d.queries, sql)
+	return 0, "", d.err
+}
+func (d *recordDB) Query(_ context.Context, sql string, _ ...interface{}) (db.Rows, error) {
+	d.queries = append(d.queries, sql)
+	return nil, d.err
+}
+func (d *recordDB) Close() {}
@@ -0,0 +1,344 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package checksumload defines implementation of workload which exercises the data
+// checksums monitoring path without corrupting any data.
+//
+// The workload periodically (accordingly to Config.Interval) reads checksum failures
+// counters from pg_stat_database. When the counters grow, a warning is logged and an
+// event is emitted, the same way as monitoring would alert about damaged pages. If
+// Config.PageInspect is enabled, the workload also creates a small fixture table and
+// reads its raw pages using pageinspect extension, checking pages headers are valid.
+// Note, checksums stored in headers of pages cached in shared buffers are not reliable,
+// hence they are not compared. The fixture table is dropped when the workload is finished.
+// The workload is strictly read-only regarding existing data. It is skipped gracefully
+// if Postgres doesn't support checksum counters (versions before 12), and pages
+// inspection is disabled if pageinspect extension is not installed or there are no
+// privileges for using it. Extensions are never created by the workload.
+package checksumload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultInterval defines default interval between checks.
+	defaultInterval = time.Second
+	// fixtureTable defines name of the table which pages are inspected.
+	fixtureTable = "_noisia_checksumload_workload"
+	// fixtureRows defines number of rows in fixture table, enough for filling a few pages.
+	fixtureRows = 1000
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures at the end.
+	defaultCleanupTimeout = 10 * time.Second
+)
+
+// Config defines configuration settings for checksumload workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Interval defines interval between checks, if zero the default interval is used.
+	Interval time.Duration
+	// PageInspect defines whether pages of fixture table should be inspected using pageinspect extension.
+	PageInspect bool
+	// CleanupTimeout defines max time allowed for cleanup fixtures at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Interval < 0 {
+		return noisia.NewConfigError("Interval", noisia.ErrInvalidDuration, "interval must not be negative")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	stats  stats
+}
+
+// stats defines counters of performed checks, counters are updated atomically.
+type stats struct {
+	// checks defines number of performed checks of checksum failures counters.
+	checks int64
+	// failures defines number of checksum failures observed during the workload.
+	failures int64
+	// pages defines number of inspected pages.
+	pages int64
+	// invalid defines number of inspected pages with invalid headers.
+	invalid int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "checksumload"
+}
+
+// Stats returns counters of performed checks, observed failures and inspected pages.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"checks":   atomic.LoadInt64(&w.stats.checks),
+		"failures": atomic.LoadInt64(&w.stats.failures),
+		"pages":    atomic.LoadInt64(&w.stats.pages),
+		"invalid":  atomic.LoadInt64(&w.stats.invalid),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	ok, err := checksumCountersSupported(ctx, w.pool)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		w.logger.Warn("checksumload: checksum failures counters are not supported by Postgres, skip")
+		return nil
+	}
+
+	inspect := w.config.PageInspect
+	if inspect {
+		inspect, err = w.prepare(ctx)
+		if err != nil {
+			return err
+		}
+
+		// Cleanup in the end.
+		defer func() {
+			err := w.cleanup()
+			if err != nil {
+				w.logger.Warnf("checksumload cleanup failed: %s", err)
+			}
+		}()
+	}
+
+	return w.startLoop(ctx, inspect)
+}
+
+// prepare method checks pages inspection is possible and creates fixture table. Returns false
+// if pages could not be inspected.
+func (w *workload) prepare(ctx context.Context) (bool, error) {
+	var installed bool
+	err := queryValue(ctx, w.pool, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pageinspect')", &installed)
+	if err != nil {
+		return false, err
+	}
+
+	if !installed {
+		w.logger.Warn("checksumload: pageinspect extension is not installed, skip pages inspection")
+		return false, nil
+	}
+
+	_, _, err = w.pool.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id INT, payload TEXT)", fixtureTable))
+	if err != nil {
+		return false, err
+	}
+
+	_, _, err = w.pool.Exec(ctx, fmt.Sprintf("INSERT INTO %s SELECT g, md5(g::text) FROM generate_series(1, %d) g", fixtureTable, fixtureRows))
+	if err != nil {
+		return false, err
+	}
+
+	// Make sure there are privileges for reading raw pages.
+	_, err = inspectPages(ctx, w.pool)
+	if err != nil {
+		w.logger.Warnf("checksumload: inspect pages failed: %s, skip pages inspection", err)
+		return false, nil
+	}
+
+	return true, nil
+}
+
+// cleanup method drops fixture table after workload has been done.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", fixtureTable))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// startLoop checks checksum failures counters (and pages checksums, if enabled) each interval until context is done.
+func (w *workload) startLoop(ctx context.Context, inspect bool) error {
+	prev, err := checksumFailures(ctx, w.pool)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(w.config.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return nil
+		}
+
+		cur, err := checksumFailures(ctx, w.pool)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		atomic.AddInt64(&w.stats.checks, 1)
+
+		if cur > prev {
+			atomic.AddInt64(&w.stats.failures, cur-prev)
+			w.logger.Warnf("checksumload: %d new checksum failures detected", cur-prev)
+			events.Emit(ctx, "checksumload", "detected %d checksum failures", cur-prev)
+		}
+		prev = cur
+
+		if inspect {
+			pages, err := inspectPages(ctx, w.pool)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+
+			atomic.AddInt64(&w.stats.pages, int64(len(pages)))
+			for _, invalid := range pages {
+				if invalid {
+					atomic.AddInt64(&w.stats.invalid, 1)
+					w.logger.Warnf("checksumload: invalid page header in %s", fixtureTable)
+					events.Emit(ctx, "checksumload", "invalid page header in %s", fixtureTable)
+				}
+			}
+		}
+	}
+}
+
+// checksumCountersSupported returns true if Postgres has checksum failures counters (since Postgres 12).
+func checksumCountersSupported(ctx context.Context, pool db.DB) (bool, error) {
+	var version int
+	err := queryValue(ctx, pool, "SELECT current_setting('server_version_num')::int", &version)
+	if err != nil {
+		return false, err
+	}
+
+	return version >= 120000, nil
+}
+
+// checksumFailures returns total number of checksum failures detected in all databases.
+func checksumFailures(ctx context.Context, pool db.DB) (int64, error) {
+	var n int64
+	err := queryValue(ctx, pool, "SELECT coalesce(sum(checksum_failures), 0)::bigint FROM pg_stat_database", &n)
+	if err != nil {
+		return 0, err
+	}
+
+	return n, nil
+}
+
+// inspectPages reads raw pages of fixture table and checks their headers. Returns list of inspected
+// pages where true means invalid header.
+func inspectPages(ctx context.Context, pool db.DB) ([]bool, error) {
+	q := fmt.Sprintf("SELECT h.lower > h.upper OR h.upper > h.special OR h.pagesize <> current_setting('block_size')::int "+
+		"FROM generate_series(0, pg_relation_size('%[1]s') / current_setting('block_size')::int - 1) n, "+
+		"LATERAL page_header(get_raw_page('%[1]s', n::int)) h", fixtureTable)
+
+	rows, err := pool.Query(ctx, q)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pages []bool
+	for rows.Next() {
+		var invalid bool
+		err = rows.Scan(&invalid)
+		if err != nil {
+			return nil, err
+		}
+		pages = append(pages, invalid)
+	}
+
+	return pages, rows.Err()
+}
+
+// queryValue executes query which returns single value and scans it into dest.
+func queryValue(ctx context.Context, pool db.DB, q string, dest interface{}) error {
+	rows, err := pool.Query(ctx, q)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	if !rows.Next() {
+		if err := rows.Err(); err != nil {
+			return err
+		}
+		return fmt.Errorf("no rows returned")
+	}
+
+	err = rows.Scan(dest)
+	if err != nil {
+		return err
+	}
+
+	return rows.Err()
+}
@@ -0,0 +1,133 @@
+package checksumload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{}},
+		{valid: true, config: Config{Interval: time.Second, PageInspect: true}},
+		{valid: false, config: Config{Interval: -time.Second}},
+		{valid: false, config: Config{SearchPath: "app,,public"}},
+		{valid: false, config: Config{PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// Pages inspection requires pageinspect extension and privileges, skip if not available.
+	var installed bool
+	assert.NoError(t, queryValue(context.Background(), pool, "SELECT EXISTS (SELECT 1 FROM pg_extension WHERE extname = 'pageinspect')", &installed))
+	if !installed {
+		t.Skip("pageinspect extension is not installed")
+	}
+
+	ok, err := checksumCountersSupported(context.Background(), pool)
+	assert.NoError(t, err)
+	if !ok {
+		t.Skip("checksum failures counters are not supported")
+	}
+
+	config := Config{Conninfo: db.TestConninfo, Interval: 100 * time.Millisecond, PageInspect: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	st := w.Stats()
+	assert.Greater(t, st["checks"], int64(0))
+	assert.Greater(t, st["pages"], int64(0))
+	assert.Equal(t, int64(0), st["invalid"])
+}
+
+// counterDB implements db.DB interface and returns predefined values of checksum failures counter.
+type counterDB struct {
+	mu     sync.Mutex
+	values []int64
+}
+
+func (d *counterDB) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (d *counterDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (d *counterDB) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := d.values[0]
+	if len(d.values) > 1 {
+		d.values = d.values[1:]
+	}
+	return &counterRows{value: v}, nil
+}
+func (d *counterDB) Close() {}
+
+// counterRows implements db.Rows interface with single value.
+type counterRows struct {
+	value int64
+	done  bool
+}
+
+func (r *counterRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *counterRows) Scan(dest ...interface{}) error {
+	*dest[0].(*int64) = r.value
+	return nil
+}
+
+func (r *counterRows) Err() error { return nil }
+func (r *counterRows) Close()     {}
+
+func TestWorkload_startLoop_failures(t *testing.T) {
+	w := &workload{
+		config: Config{Interval: 10 * time.Millisecond},
+		logger: log.NewDefaultLogger("error"),
+		pool:   &counterDB{values: []int64{5, 5, 7, 7, 10}},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, w.startLoop(ctx, false))
+
+	st := w.Stats()
+	assert.Greater(t, st["checks"], int64(4))
+	assert.Equal(t, int64(5), st["failures"]) // failures observed since start: 5 -> 10
+	assert.Equal(t, int64(0), st["pages"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "checksumload", w.Name())
+}
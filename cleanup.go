@@ -0,0 +1,76 @@
+package noisia
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"sort"
+	"strings"
+)
+
+// CleanupResult describes result of fixtures cleanup.
+type CleanupResult struct {
+	// Dropped defines fixture tables which have been dropped.
+	Dropped []string
+	// Absent defines fixture tables which don't exist.
+	Absent []string
+	// Failed defines fixture tables which have not been dropped due to errors.
+	Failed map[string]error
+}
+
+// Cleanup connects to Postgres and drops fixture tables of all workloads, e.g. left behind by
+// crashed run. Only tables listed in workloads descriptors are dropped, other tables are never
+// touched. All tables are attempted even if some of them have failed, error is returned if any
+// of tables has failed.
+func Cleanup(ctx context.Context, conninfo string) (CleanupResult, error) {
+	conn, err := db.Connect(ctx, conninfo)
+	if err != nil {
+		return CleanupResult{}, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	var tables []string
+	for _, d := range Workloads() {
+		tables = append(tables, d.Fixtures...)
+	}
+
+	return dropTables(ctx, conn, tables)
+}
+
+// dropTables drops passed tables using passed connection and returns result of each table.
+func dropTables(ctx context.Context, conn db.Conn, tables []string) (CleanupResult, error) {
+	result := CleanupResult{Failed: map[string]error{}}
+
+	for _, table := range tables {
+		exists, err := db.TableExists(ctx, conn, table)
+		if err != nil {
+			result.Failed[table] = err
+			continue
+		}
+
+		if !exists {
+			result.Absent = append(result.Absent, table)
+			continue
+		}
+
+		_, _, err = conn.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", db.QuoteIdentifier(table)))
+		if err != nil {
+			result.Failed[table] = err
+			continue
+		}
+
+		result.Dropped = append(result.Dropped, table)
+	}
+
+	if len(result.Failed) > 0 {
+		failed := make([]string, 0, len(result.Failed))
+		for table, err := range result.Failed {
+			failed = append(failed, fmt.Sprintf("%s: %s", table, err))
+		}
+		sort.Strings(failed)
+
+		return result, fmt.Errorf("drop tables failed: %s", strings.Join(failed, "; "))
+	}
+
+	return result, nil
+}
@@ -0,0 +1,107 @@
+package noisia
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCleanup(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// Stale fixture left by previous run and user's table with similar name.
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS _noisia_deadlocks_workload (id int)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS _noisia_user_table (id int)")
+	assert.NoError(t, err)
+	defer func() { _, _, _ = pool.Exec(context.Background(), "DROP TABLE _noisia_user_table") }()
+
+	result, err := Cleanup(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	assert.Contains(t, result.Dropped, "_noisia_deadlocks_workload")
+	assert.Empty(t, result.Failed)
+
+	exists, err := db.TableExists(context.Background(), pool, "_noisia_deadlocks_workload")
+	assert.NoError(t, err)
+	assert.False(t, exists)
+
+	exists, err = db.TableExists(context.Background(), pool, "_noisia_user_table")
+	assert.NoError(t, err)
+	assert.True(t, exists)
+}
+
+func Test_dropTables(t *testing.T) {
+	conn := &tablesConn{
+		exists: map[string]bool{"_noisia_hotrow_workload": true, "_noisia_toastload_workload": true},
+		fail:   "_noisia_toastload_workload",
+	}
+
+	result, err := dropTables(context.Background(), conn, []string{"_noisia_hotrow_workload", "_noisia_deadlocks_workload", "_noisia_toastload_workload"})
+	assert.Error(t, err)
+	assert.Equal(t, []string{"_noisia_hotrow_workload"}, result.Dropped)
+	assert.Equal(t, []string{"_noisia_deadlocks_workload"}, result.Absent)
+	assert.Len(t, result.Failed, 1)
+	assert.Error(t, result.Failed["_noisia_toastload_workload"])
+
+	// All tables are processed, no errors.
+	result, err = dropTables(context.Background(), &tablesConn{}, []string{"_noisia_hotrow_workload", "_noisia_deadlocks_workload"})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_noisia_hotrow_workload", "_noisia_deadlocks_workload"}, result.Absent)
+	assert.Empty(t, result.Failed)
+}
+
+// tablesConn implements db.Conn interface and emulates existing tables. Dropping table
+// specified in fail returns error.
+type tablesConn struct {
+	exists map[string]bool
+	fail   string
+}
+
+func (c *tablesConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *tablesConn) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	if c.fail != "" && sql == fmt.Sprintf("DROP TABLE IF EXISTS %s", db.QuoteIdentifier(c.fail)) {
+		return 0, "", fmt.Errorf("permission denied")
+	}
+	return 0, "", nil
+}
+
+func (c *tablesConn) Query(_ context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	name := args[0].(string)
+	return &boolRows{value: c.exists[name[1:len(name)-1]]}, nil
+}
+
+func (c *tablesConn) Close() error {
+	return nil
+}
+
+// boolRows implements db.Rows interface with single row containing boolean value.
+type boolRows struct {
+	value bool
+	done  bool
+}
+
+func (r *boolRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *boolRows) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = r.value
+	return nil
+}
+
+func (r *boolRows) Err() error {
+	return nil
+}
+
+func (r *boolRows) Close() {}
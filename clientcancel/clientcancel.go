@@ -0,0 +1,186 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package clientcancel defines implementation of workload which starts long queries and
+// cancels them from the client side. This reproduces "canceling statement due to user
+// request" errors produced by applications with client-side timeouts, and exercises
+// handling of cancel requests by Postgres (or connection pooler).
+//
+// The necessary number of workers is started (accordingly to Config.Jobs). Each worker
+// starts pg_sleep() queries accordingly to rate specified in Config.Rate. Each query is
+// cancelled after random delay between Config.CancelAfterMin and Config.CancelAfterMax
+// by cancelling query's context, which makes driver to send cancel request to Postgres.
+// Queries sleep longer than the max delay, so they are always cancelled.
+package clientcancel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/workerpool"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// sleepMargin defines how much longer than max cancel delay queries sleep.
+const sleepMargin = 1 * time.Second
+
+// Config defines configuration settings for client cancel workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for starting queries.
+	Jobs uint16
+	// Rate defines queries rate produced per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// CancelAfterMin defines lower threshold of delay before query is cancelled.
+	CancelAfterMin time.Duration
+	// CancelAfterMax defines upper threshold of delay before query is cancelled.
+	CancelAfterMax time.Duration
+	// Seed defines seed of random cancel delays, current time is used if zero.
+	Seed int64
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CancelAfterMin <= 0 || c.CancelAfterMax <= 0 {
+		return noisia.NewConfigError("CancelAfterMin", noisia.ErrInvalidRange, "min and max cancel delay must be greater than zero")
+	}
+
+	if c.CancelAfterMin > c.CancelAfterMax {
+		return noisia.NewConfigError("CancelAfterMin", noisia.ErrInvalidRange, "min cancel delay must be less or equal to max cancel delay")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// cancelled defines number of queries cancelled by the workload.
+	cancelled int64
+	// completed defines number of queries which have been finished before cancellation.
+	completed int64
+	// errors defines number of queries failed due to other reasons.
+	errors int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "clientcancel"
+}
+
+// Stats returns counters of cancelled, completed and failed queries.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"cancelled": atomic.LoadInt64(&w.stats.cancelled),
+		"completed": atomic.LoadInt64(&w.stats.completed),
+		"errors":    atomic.LoadInt64(&w.stats.errors),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	sleep := w.config.CancelAfterMax + sleepMargin
+
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		rnd := random.New(w.config.Seed, i)
+		ratelimit.RunWorker(ctx, w.config.Rate, w.config.Scheduler, i, func(ctx context.Context) error {
+			delay := randomDelay(rnd, w.config.CancelAfterMin, w.config.CancelAfterMax)
+			return cancelQuery(ctx, pool, sleep, delay, &w.stats)
+		}, w.logger)
+	})
+
+	w.logger.Infof("clientcancel finished: %d queries cancelled, %d completed, %d failed",
+		atomic.LoadInt64(&w.stats.cancelled), atomic.LoadInt64(&w.stats.completed), atomic.LoadInt64(&w.stats.errors))
+
+	return nil
+}
+
+// cancelQuery starts query sleeping for passed time and cancels it after passed delay. Outcome
+// of the query is counted in passed stats.
+func cancelQuery(ctx context.Context, pool db.DB, sleep, delay time.Duration, st *stats) error {
+	qctx, cancel := context.WithTimeout(ctx, delay)
+	defer cancel()
+
+	_, _, err := pool.Exec(qctx, "SELECT pg_sleep($1)", sleep.Seconds())
+
+	// Queries interrupted by the workload's end are not counted.
+	if ctx.Err() != nil {
+		return nil
+	}
+
+	switch {
+	case err == nil:
+		atomic.AddInt64(&st.completed, 1)
+		return nil
+	case errors.Is(qctx.Err(), context.DeadlineExceeded):
+		atomic.AddInt64(&st.cancelled, 1)
+		events.Emit(ctx, "clientcancel", "cancelled query after %s", delay)
+		return nil
+	default:
+		atomic.AddInt64(&st.errors, 1)
+		return fmt.Errorf("query failed: %s", err)
+	}
+}
+
+// randomDelay returns random delay between min and max.
+func randomDelay(rnd *rand.Rand, minDelay, maxDelay time.Duration) time.Duration {
+	// Increment range up to 1 due to rand.Int63n() never return max value.
+	return minDelay + time.Duration(rnd.Int63n(int64(maxDelay-minDelay)+1))
+}
@@ -0,0 +1,113 @@
+package clientcancel
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Millisecond}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Second}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Second}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Second}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: 0, CancelAfterMax: time.Second}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Second, CancelAfterMax: time.Millisecond}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Millisecond, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Millisecond, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 10, CancelAfterMin: 10 * time.Millisecond, CancelAfterMax: 50 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["cancelled"], int64(0))
+	assert.Equal(t, int64(0), w.Stats()["errors"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1, CancelAfterMin: time.Millisecond, CancelAfterMax: time.Millisecond}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "clientcancel", w.Name())
+}
+
+func Test_cancelQuery(t *testing.T) {
+	st := &stats{}
+
+	// Query sleeping longer than the delay is cancelled.
+	assert.NoError(t, cancelQuery(context.Background(), sleepDB{}, time.Second, 10*time.Millisecond, st))
+	assert.Equal(t, stats{cancelled: 1}, *st)
+
+	// Query finished before the delay is not cancelled.
+	assert.NoError(t, cancelQuery(context.Background(), sleepDB{}, 10*time.Millisecond, time.Second, st))
+	assert.Equal(t, stats{cancelled: 1, completed: 1}, *st)
+
+	// Other errors are counted and returned.
+	assert.Error(t, cancelQuery(context.Background(), sleepDB{err: errors.New("permission denied")}, time.Second, time.Second, st))
+	assert.Equal(t, stats{cancelled: 1, completed: 1, errors: 1}, *st)
+
+	// Queries interrupted by the end of the workload are not counted.
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, cancelQuery(ctx, sleepDB{}, time.Second, time.Second, st))
+	assert.Equal(t, stats{cancelled: 1, completed: 1, errors: 1}, *st)
+}
+
+func Test_randomDelay(t *testing.T) {
+	rnd := random.New(0, 0)
+	for i := 0; i < 1000; i++ {
+		d := randomDelay(rnd, 10*time.Millisecond, 20*time.Millisecond)
+		assert.GreaterOrEqual(t, int64(d), int64(10*time.Millisecond))
+		assert.LessOrEqual(t, int64(d), int64(20*time.Millisecond))
+	}
+
+	assert.Equal(t, time.Second, randomDelay(rnd, time.Second, time.Second))
+}
+
+// sleepDB implements db.DB interface, its queries sleep for duration passed as the first argument
+// or until context is done. Configured error is returned immediately.
+type sleepDB struct {
+	err error
+}
+
+func (d sleepDB) Begin(context.Context) (db.Tx, error) { return nil, d.err }
+func (d sleepDB) Exec(ctx context.Context, _ string, args ...interface{}) (int64, string, error) {
+	if d.err != nil {
+		return 0, "", d.err
+	}
+
+	timer := time.NewTimer(time.Duration(args[0].(float64) * float64(time.Second)))
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return 0, "SELECT 1", nil
+	case <-ctx.Done():
+		return 0, "", ctx.Err()
+	}
+}
+func (d sleepDB) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, d.err }
+func (d sleepDB) Close()                                                         {}
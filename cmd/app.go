@@ -2,15 +2,47 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/advisorylocks"
+	"github.com/lesovsky/noisia/analyzeload"
+	"github.com/lesovsky/noisia/checksumload"
+	"github.com/lesovsky/noisia/clientcancel"
+	"github.com/lesovsky/noisia/customsql"
+	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/deadlocks"
+	"github.com/lesovsky/noisia/diskfill"
 	"github.com/lesovsky/noisia/failconns"
 	"github.com/lesovsky/noisia/forkconns"
+	"github.com/lesovsky/noisia/hotrow"
+	"github.com/lesovsky/noisia/idleconns"
 	"github.com/lesovsky/noisia/idlexacts"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/logicaldecode"
+	"github.com/lesovsky/noisia/notifyload"
+	"github.com/lesovsky/noisia/orphanload"
+	"github.com/lesovsky/noisia/plancacheload"
+	"github.com/lesovsky/noisia/poolerload"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
 	"github.com/lesovsky/noisia/rollbacks"
+	"github.com/lesovsky/noisia/scenario"
+	"github.com/lesovsky/noisia/serialfailures"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/lesovsky/noisia/statsload"
 	"github.com/lesovsky/noisia/tempfiles"
 	"github.com/lesovsky/noisia/terminate"
+	"github.com/lesovsky/noisia/toastload"
 	"github.com/lesovsky/noisia/waitxacts"
+	"github.com/lesovsky/noisia/walsenderload"
+	"io"
+	"os"
+	"strconv"
+	"strings"
 	"sync"
 	"time"
 )
@@ -18,20 +50,71 @@ import (
 type config struct {
 	logger                log.Logger
 	postgresConninfo      string
+	compareConninfo       string
+	poolerMode            string
+	role                  string
+	searchPath            string
+	poolAcquireTimeout    time.Duration
+	requireDatabaseName   string
+	cleanStart            bool
+	allowDestructive      bool
+	force                 bool
+	workerDatabases       []string
 	jobs                  uint16 // max 65535
 	duration              time.Duration
+	seed                  int64
+	scheduler             string
+	schedulerBurstOn      time.Duration
+	schedulerBurstOff     time.Duration
+	cleanupTimeout        time.Duration
+	watchdogMultiple      float64
+	warmupConns           uint16
+	summaryJSON           bool
+	sink                  sink.Sink
+	statsInterval         time.Duration
+	statsStream           io.Writer
+	configFile            string
+	reloadSignals         <-chan os.Signal
+	scenario              string
+	adaptive              bool
+	adaptiveThreshold     float64
+	adaptivePollInterval  time.Duration
+	adaptiveQuery         string
+	adaptiveLimiter       *adaptive.Limiter
 	idleXacts             bool
 	idleXactsNaptimeMin   time.Duration
 	idleXactsNaptimeMax   time.Duration
+	idleXactsDistribution string
+	idleXactsWeight       uint16
+	idleXactsHoldLock     bool
+	idleXactsIsolation    string
+	idleXactsWakeInterval time.Duration
+	idleXactsCommitTemp   bool
 	rollbacks             bool
 	rollbacksRate         float64
+	rollbacksWeight       uint16
+	rollbacksSQLStates    []string
+	rollbacksStrict       bool
 	waitXacts             bool
 	waitXactsFixture      bool
 	waitXactsLocktimeMin  time.Duration
 	waitXactsLocktimeMax  time.Duration
+	waitXactsNoFallback   bool
+	waitXactsIsolation    string
+	waitXactsWeight       uint16
 	deadlocks             bool
+	deadlocksLockDelay    time.Duration
+	deadlocksIsolation    string
+	deadlocksWeight       uint16
+	deadlocksTable        string
+	deadlocksPayloadSize  int
 	tempFiles             bool
 	tempFilesRate         float64
+	tempFilesWeight       uint16
+	tempFilesQuery        string
+	tempFilesSampleInt    time.Duration
+	tempFilesExceedLimit  bool
+	tempFilesMaxInflight  uint16
 	terminate             bool
 	terminateInterval     time.Duration
 	terminateRate         uint16
@@ -41,198 +124,855 @@ type config struct {
 	terminateUser         string
 	terminateDatabase     string
 	terminateAppName      string
+	terminateEscalate     bool
+	terminateEscalateWait time.Duration
+	terminateMaxTotal     int
+	terminateSnapshot     bool
 	failconns             bool
+	failconnsHoldTime     time.Duration
+	failconnsReleaseRatio float64
+	failconnsInterval     time.Duration
+	failconnsMinInterval  time.Duration
+	failconnsGrowFactor   float64
+	failconnsShrinkFactor float64
+	failconnsCapacity     int
 	forkconns             bool
 	forkconnsRate         uint16
+	forkconnsWeight       uint16
+	hotrow                bool
+	hotrowRate            float64
+	hotrowWeight          uint16
+	toastload             bool
+	toastloadRate         float64
+	toastloadValueSizeKB  uint32
+	toastloadWeight       uint16
+	idleconns             bool
+	idleconnsCount        uint16
+	idleconnsKeepalive    time.Duration
+	plancacheload         bool
+	plancacheloadStmts    uint16
+	plancacheloadRate     float64
+	plancacheloadReplan   bool
+	plancacheloadWeight   uint16
+	orphanload            bool
+	orphanloadRate        float64
+	orphanloadWeight      uint16
+	poolerload            bool
+	poolerloadClients     uint16
+	poolerloadHoldTime    time.Duration
+	poolerloadAdminDB     string
+	checksumload          bool
+	checksumloadInterval  time.Duration
+	checksumloadInspect   bool
+	advisorylocks         bool
+	advisorylocksKeySpace uint16
+	advisorylocksHoldTime time.Duration
+	advisorylocksWeight   uint16
+	notifyload            bool
+	notifyloadRate        float64
+	notifyloadPayloadSize uint16
+	notifyloadChannel     string
+	notifyloadWeight      uint16
+	serialfailures        bool
+	serialfailuresRate    float64
+	serialfailuresWeight  uint16
+	customsql             bool
+	customsqlStatements   []string
+	customsqlRate         float64
+	customsqlInXact       bool
+	customsqlWeight       uint16
+	statsload             bool
+	statsloadRate         float64
+	statsloadResetRatio   float64
+	statsloadAllowReset   bool
+	statsloadWeight       uint16
+	walsenderload         bool
+	walsenderloadSlot     string
+	walsenderloadStall    time.Duration
+	clientcancel          bool
+	clientcancelRate      float64
+	clientcancelAfterMin  time.Duration
+	clientcancelAfterMax  time.Duration
+	clientcancelWeight    uint16
+	diskfill              bool
+	diskfillTargetSize    uint32
+	diskfillRate          float64
+	diskfillAllowFull     bool
+	logicaldecode         bool
+	logicaldecodeSlot     string
+	logicaldecodeRate     float64
+	logicaldecodeWeight   uint16
+	analyzeload           bool
+	analyzeloadRate       float64
+	analyzeloadTables     []string
+	analyzeloadWeight     uint16
+	workloadDurations     map[string]time.Duration
+	workloadOffsets       map[string]time.Duration
 }
 
 func runApplication(ctx context.Context, c config, log log.Logger) error {
-	ctx, cancel := context.WithTimeout(ctx, c.duration)
-	defer cancel()
-
-	var wg sync.WaitGroup
-
-	if c.idleXacts {
-		log.Info("start idle transactions workload")
-		wg.Add(1)
-		go func() {
-			err := startIdleXactsWorkload(ctx, c, log)
+	// Refuse to run if connected database is not allowed.
+	if c.requireDatabaseName != "" {
+		for _, conninfo := range clusterConninfos(c) {
+			err := checkDatabaseName(ctx, conninfo, c.requireDatabaseName)
 			if err != nil {
-				log.Errorf("idle transactions workload failed: %s", err)
+				return err
 			}
-			wg.Done()
-		}()
+		}
 	}
 
-	if c.rollbacks {
-		log.Infof("start rollbacks workload for %s", c.duration)
-		wg.Add(1)
-		go func() {
-			err := startRollbacksWorkload(ctx, c, log)
+	// Drop fixtures left by previous runs (e.g. crashed), they might affect workloads.
+	if c.cleanStart {
+		log.Info("drop fixtures left by previous runs")
+		for _, conninfo := range clusterConninfos(c) {
+			result, err := noisia.Cleanup(ctx, conninfo)
 			if err != nil {
-				log.Errorf("rollbacks workload failed: %s", err)
+				return fmt.Errorf("clean start failed: %s", err)
 			}
-			wg.Done()
-		}()
+			if len(result.Dropped) > 0 {
+				log.Infof("dropped fixtures: %s", strings.Join(result.Dropped, ", "))
+			}
+		}
 	}
 
-	if c.waitXacts {
-		log.Info("start wait xacts workload")
-		wg.Add(1)
-		go func() {
-			err := startWaitxactsWorkload(ctx, c, log)
-			if err != nil {
-				log.Errorf("wait xacts workload failed: %s", err)
-			}
-			wg.Done()
-		}()
+	// In scenario mode duration is defined by the scenario's timeline.
+	if c.scenario == "" {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.duration)
+		defer cancel()
+
+		stop := startWatchdog(watchdogLimit(c.duration, c.cleanupTimeout, c.watchdogMultiple), log, watchdogExit(c, log))
+		defer stop()
 	}
 
-	if c.deadlocks {
-		log.Info("start deadlocks workload")
-		wg.Add(1)
-		go func() {
-			err := startDeadlocksWorkload(ctx, c, log)
-			if err != nil {
-				log.Errorf("deadlocks workload failed: %s", err)
-			}
-			wg.Done()
-		}()
+	// Start adaptive limiter which throttles rate-based workloads accordingly to server load.
+	if c.adaptive {
+		pool, err := db.NewPostgresDB(ctx, c.postgresConninfo)
+		if err != nil {
+			return err
+		}
+		defer pool.Close()
+
+		limiter, err := adaptive.NewLimiter(
+			adaptive.Config{Threshold: c.adaptiveThreshold, PollInterval: c.adaptivePollInterval},
+			adaptive.NewQuerySource(pool, c.adaptiveQuery),
+			log,
+		)
+		if err != nil {
+			return err
+		}
+
+		go limiter.Run(ctx)
+		c.adaptiveLimiter = limiter
 	}
 
-	if c.tempFiles {
-		log.Info("start temp files workload")
-		wg.Add(1)
-		go func() {
-			err := startTempFilesWorkload(ctx, c, log)
-			if err != nil {
-				log.Errorf("temp files workload failed: %s", err)
-			}
-			wg.Done()
-		}()
+	if c.scenario != "" {
+		return runScenario(ctx, c, log)
 	}
 
-	if c.terminate {
-		log.Info("start terminate backends workload")
-		wg.Add(1)
-		go func() {
-			err := startTerminateWorkload(ctx, c, log)
-			if err != nil {
-				log.Errorf("terminate backends workload failed: %s", err)
-			}
-			wg.Done()
-		}()
+	workloads, err := newWorkloads(c, log)
+	if err != nil {
+		return err
 	}
 
-	if c.failconns {
-		log.Info("start failconns backends workload")
-		wg.Add(1)
-		go func() {
-			err := startFailconnsWorkload(ctx, c, log)
-			if err != nil {
-				log.Errorf("failconns backends workload failed: %s", err)
-			}
-			wg.Done()
-		}()
+	err = verifyDestructive(workloads, c.allowDestructive)
+	if err != nil {
+		return err
 	}
 
-	if c.forkconns {
-		log.Info("start fork connections workload")
+	err = verifyPoolerMode(workloads, c.poolerMode)
+	if err != nil {
+		return err
+	}
+
+	err = checkStandby(ctx, c.postgresConninfo, workloads)
+	if err != nil {
+		return err
+	}
+
+	// In comparison mode the same workloads are run against the second cluster.
+	if c.compareConninfo != "" {
+		workloads, err = addCompareWorkloads(ctx, c, workloads, log)
+		if err != nil {
+			return err
+		}
+	}
+
+	exporter, err := startStatsExport(ctx, c.sink, c.statsStream, c.statsInterval, workloads, log)
+	if err != nil {
+		return fmt.Errorf("write stats failed: %s", err)
+	}
+
+	if c.configFile != "" {
+		go watchReload(ctx, c, workloads, log)
+	}
+
+	runErr := runWorkloads(ctx, c, workloads, log)
+
+	err = exporter.stop()
+	if err != nil {
+		return fmt.Errorf("write stats failed: %s", err)
+	}
+
+	switch {
+	case c.summaryJSON:
+		err = writeSummary(os.Stdout, workloads)
+	case c.compareConninfo != "":
+		err = writeComparison(os.Stdout, workloads)
+	}
+	if err != nil {
+		return err
+	}
+
+	return runErr
+}
+
+// runWorkloads runs passed workloads concurrently within their time windows and waits until all
+// of them are finished. If some workloads failed, *noisia.RunError is returned.
+func runWorkloads(ctx context.Context, c config, workloads []noisia.Workload, log log.Logger) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = map[string]error{}
+	)
+
+	for _, w := range workloads {
+		offset, duration := c.workloadOffsets[w.Name()], c.workloadDurations[w.Name()]
+		if duration == 0 {
+			duration = c.duration - offset
+		}
+
+		log.Infof("start %s workload in %s for %s", workloadLabel(w), offset, duration)
 		wg.Add(1)
-		go func() {
-			err := startForkconnsWorkload(ctx, c, log)
+		go func(w noisia.Workload) {
+			err := runWorkload(ctx, w, offset, duration)
 			if err != nil {
-				log.Errorf("fork connections workload failed: %s", err)
+				log.Errorf("%s workload failed: %s", workloadLabel(w), err)
+				mu.Lock()
+				errs[workloadLabel(w)] = err
+				mu.Unlock()
 			}
 			wg.Done()
-		}()
+		}(w)
 	}
 
 	wg.Wait()
 
+	if len(errs) > 0 {
+		return &noisia.RunError{Errs: errs}
+	}
+
 	return nil
 }
 
-// startIdleXactsWorkload start generating workload with idle transactions.
-func startIdleXactsWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := idlexacts.NewWorkload(
-		idlexacts.Config{
-			Conninfo:   c.postgresConninfo,
-			Jobs:       c.jobs,
-			NaptimeMin: c.idleXactsNaptimeMin,
-			NaptimeMax: c.idleXactsNaptimeMax,
-		}, logger,
-	)
+// runWorkload runs workload within its own time window: the workload is started after offset and
+// runs for specified duration using context derived from passed context. The workload is stopped
+// when passed context is done, even if its duration is not elapsed.
+func runWorkload(ctx context.Context, w noisia.Workload, offset, duration time.Duration) error {
+	if offset > 0 {
+		t := time.NewTimer(offset)
+		defer t.Stop()
+
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, duration)
+	defer cancel()
+
+	return w.Run(ctx)
+}
+
+// parseWorkloadDurations parses per-workload durations specified as pairs of workload name and duration.
+func parseWorkloadDurations(values map[string]string) (map[string]time.Duration, error) {
+	durations := make(map[string]time.Duration, len(values))
+	for name, v := range values {
+		if _, ok := constructors[name]; !ok {
+			return nil, fmt.Errorf("unknown workload: %s", name)
+		}
+
+		d, err := time.ParseDuration(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid duration of %s workload: %s", name, err)
+		}
+
+		if d < 0 {
+			return nil, fmt.Errorf("duration of %s workload must not be negative", name)
+		}
+
+		durations[name] = d
+	}
+
+	return durations, nil
+}
+
+// limitWorkerDatabases returns mapping of workers to databases limited by passed number of jobs. When
+// jobs budget is split between workloads, workers beyond the workload's share are not started and
+// their databases are not used.
+func limitWorkerDatabases(databases []string, jobs uint16) []string {
+	if len(databases) > int(jobs) {
+		return databases[:jobs]
+	}
+
+	return databases
+}
+
+// parseWorkerDatabases parses mapping of workers indexes to databases specified as comma-separated
+// pairs of worker index and database name, e.g. "0:db1,1:db1,2:db2". Returns list of databases where
+// position of database is the index of worker, unmapped workers have empty database names.
+func parseWorkerDatabases(s string) ([]string, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	mapping := map[int]string{}
+	maxIndex := -1
+	for _, pair := range strings.Split(s, ",") {
+		parts := strings.SplitN(strings.TrimSpace(pair), ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("invalid mapping '%s', expected worker index and database name separated by colon", pair)
+		}
+
+		i, err := strconv.ParseUint(parts[0], 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid worker index '%s': %s", parts[0], err)
+		}
+
+		if parts[1] == "" {
+			return nil, fmt.Errorf("database name of worker %d must be specified", i)
+		}
+
+		if _, ok := mapping[int(i)]; ok {
+			return nil, fmt.Errorf("worker %d is mapped more than once", i)
+		}
+
+		mapping[int(i)] = parts[1]
+		if int(i) > maxIndex {
+			maxIndex = int(i)
+		}
+	}
+
+	databases := make([]string, maxIndex+1)
+	for i, name := range mapping {
+		databases[i] = name
+	}
+
+	return databases, nil
+}
+
+// runScenario reads timeline from scenario file and runs workloads accordingly to it.
+func runScenario(ctx context.Context, c config, log log.Logger) error {
+	f, err := os.Open(c.scenario)
 	if err != nil {
 		return err
 	}
 
-	return workload.Run(ctx)
-}
+	entries, err := scenario.ParseTimeline(f)
+	_ = f.Close()
+	if err != nil {
+		return fmt.Errorf("parse scenario failed: %s", err)
+	}
 
-func startRollbacksWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := rollbacks.NewWorkload(
-		rollbacks.Config{
-			Conninfo: c.postgresConninfo,
-			Jobs:     c.jobs,
-			Rate:     c.rollbacksRate,
-		}, logger,
-	)
+	steps, err := newScenarioSteps(entries, c, log)
 	if err != nil {
 		return err
 	}
 
-	return workload.Run(ctx)
-}
+	workloads := make([]noisia.Workload, 0, len(steps))
+	for _, step := range steps {
+		workloads = append(workloads, step.Workload)
+	}
 
-func startWaitxactsWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := waitxacts.NewWorkload(
-		waitxacts.Config{
-			Conninfo:    c.postgresConninfo,
-			Jobs:        c.jobs,
-			Fixture:     c.waitXactsFixture,
-			LocktimeMin: c.waitXactsLocktimeMin,
-			LocktimeMax: c.waitXactsLocktimeMax,
-		}, logger,
-	)
+	err = verifyDestructive(workloads, c.allowDestructive)
 	if err != nil {
 		return err
 	}
 
-	return workload.Run(ctx)
-}
+	err = verifyPoolerMode(workloads, c.poolerMode)
+	if err != nil {
+		return err
+	}
 
-func startDeadlocksWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := deadlocks.NewWorkload(
-		deadlocks.Config{
-			Conninfo: c.postgresConninfo,
-			Jobs:     c.jobs,
-		}, logger,
-	)
+	err = checkStandby(ctx, c.postgresConninfo, workloads)
 	if err != nil {
 		return err
 	}
 
-	return workload.Run(ctx)
+	s, err := scenario.NewScheduler(steps, log)
+	if err != nil {
+		return err
+	}
+
+	exporter, err := startStatsExport(ctx, c.sink, c.statsStream, c.statsInterval, workloads, log)
+	if err != nil {
+		return fmt.Errorf("write stats failed: %s", err)
+	}
+
+	if c.configFile != "" {
+		go watchReload(ctx, c, workloads, log)
+	}
+
+	stop := startWatchdog(watchdogLimit(s.Duration(), c.cleanupTimeout, c.watchdogMultiple), log, watchdogExit(c, log))
+	defer stop()
+
+	log.Infof("start scenario for %s", s.Duration())
+	runErr := s.Run(ctx)
+
+	err = exporter.stop()
+	if err != nil {
+		return fmt.Errorf("write stats failed: %s", err)
+	}
+
+	if c.summaryJSON {
+		err = writeSummary(os.Stdout, workloads)
+		if err != nil {
+			return err
+		}
+	}
+
+	return runErr
 }
 
-func startTempFilesWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := tempfiles.NewWorkload(
-		tempfiles.Config{
-			Conninfo: c.postgresConninfo,
-			Jobs:     c.jobs,
-			Rate:     c.tempFilesRate,
-		}, logger,
-	)
+// newScenarioSteps creates workloads referenced in timeline entries. Workloads are configured using
+// common settings.
+func newScenarioSteps(entries []scenario.Entry, c config, logger log.Logger) ([]scenario.Step, error) {
+	steps := make([]scenario.Step, 0, len(entries))
+	for _, e := range entries {
+		fn, ok := constructors[e.Workload]
+		if !ok {
+			return nil, fmt.Errorf("unknown workload: %s", e.Workload)
+		}
+
+		w, err := fn(c, logger)
+		if err != nil {
+			return nil, err
+		}
+
+		steps = append(steps, scenario.Step{Start: e.Start, Duration: e.Duration, Workload: w})
+	}
+
+	return steps, nil
+}
+
+// workloadSummary defines summary of work performed by single workload.
+type workloadSummary struct {
+	Name    string       `json:"name"`
+	Cluster string       `json:"cluster,omitempty"`
+	Stats   noisia.Stats `json:"stats"`
+}
+
+// writeSummary writes summary of work performed by workloads in JSON format.
+func writeSummary(w io.Writer, workloads []noisia.Workload) error {
+	summary := make([]workloadSummary, 0, len(workloads))
+	for _, wl := range workloads {
+		summary = append(summary, workloadSummary{Name: wl.Name(), Cluster: workloadCluster(wl), Stats: wl.Stats()})
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(summary)
+}
+
+// newRunID returns random identifier of the run used for correlation of log messages and events.
+func newRunID() string {
+	b := make([]byte, 6)
+	_, err := rand.Read(b)
 	if err != nil {
-		return err
+		// Unique enough for telling apart runs written to the same output.
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+const (
+	// schedulerConstant defines constant rate pacing of workloads.
+	schedulerConstant = "constant"
+	// schedulerPoisson defines Poisson arrivals pacing of workloads.
+	schedulerPoisson = "poisson"
+	// schedulerBurst defines on/off bursts pacing of workloads.
+	schedulerBurst = "burst"
+)
+
+// validateScheduler checks settings of pacing scheduler.
+func validateScheduler(c config) error {
+	switch c.scheduler {
+	case "", schedulerConstant, schedulerPoisson:
+		return nil
+	case schedulerBurst:
+		if c.schedulerBurstOn <= 0 || c.schedulerBurstOff <= 0 {
+			return fmt.Errorf("burst on and off periods must be greater than zero")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown scheduler: %s", c.scheduler)
+	}
+}
+
+// schedulerFactory returns factory of pacing schedulers for rate-based workloads. Schedulers pace calls
+// accordingly to the current rate of workload, so rate changes and adaptive limiter are applied.
+// Random delays of Poisson scheduler depend on the seed, so runs with the same seed have the same pacing.
+func schedulerFactory(c config) ratelimit.SchedulerFactory {
+	switch c.scheduler {
+	case schedulerPoisson:
+		return func(worker int) ratelimit.Scheduler {
+			return ratelimit.NewPoissonScheduler(random.New(c.seed, worker))
+		}
+	case schedulerBurst:
+		return func(int) ratelimit.Scheduler {
+			return ratelimit.NewBurstScheduler(c.schedulerBurstOn, c.schedulerBurstOff)
+		}
+	default:
+		return func(int) ratelimit.Scheduler {
+			return ratelimit.NewConstantScheduler()
+		}
+	}
+}
+
+// constructors defines workloads constructors by workloads names.
+var constructors = map[string]func(config, log.Logger) (noisia.Workload, error){
+	"advisorylocks":  newAdvisorylocksWorkload,
+	"analyzeload":    newAnalyzeloadWorkload,
+	"checksumload":   newChecksumloadWorkload,
+	"clientcancel":   newClientcancelWorkload,
+	"customsql":      newCustomsqlWorkload,
+	"deadlocks":      newDeadlocksWorkload,
+	"diskfill":       newDiskfillWorkload,
+	"failconns":      newFailconnsWorkload,
+	"forkconns":      newForkconnsWorkload,
+	"hotrow":         newHotrowWorkload,
+	"idleconns":      newIdleconnsWorkload,
+	"idlexacts":      newIdleXactsWorkload,
+	"logicaldecode":  newLogicaldecodeWorkload,
+	"notifyload":     newNotifyloadWorkload,
+	"orphanload":     newOrphanloadWorkload,
+	"plancacheload":  newPlancacheloadWorkload,
+	"poolerload":     newPoolerloadWorkload,
+	"rollbacks":      newRollbacksWorkload,
+	"serialfailures": newSerialfailuresWorkload,
+	"statsload":      newStatsloadWorkload,
+	"tempfiles":      newTempFilesWorkload,
+	"terminate":      newTerminateWorkload,
+	"toastload":      newToastloadWorkload,
+	"waitxacts":      newWaitxactsWorkload,
+	"walsenderload":  newWalsenderloadWorkload,
+}
+
+// workloadEntry defines constructor of enabled workload and its share of jobs budget.
+type workloadEntry struct {
+	// name defines name of the workload.
+	name        string
+	constructor func(config, log.Logger) (noisia.Workload, error)
+	// useJobs defines whether workload runs with jobs.
+	useJobs bool
+	// weight defines workload intensity relative to other workloads, zero means not specified.
+	weight uint16
+}
+
+// newWorkloads creates workloads enabled in config.
+func newWorkloads(c config, logger log.Logger) ([]noisia.Workload, error) {
+	entries := enabledWorkloads(c)
+	jobs := distributeJobs(c.jobs, entries)
+
+	workloads := make([]noisia.Workload, 0, len(entries))
+	for i, e := range entries {
+		wc := c
+		wc.jobs = jobs[i]
+		wc.workerDatabases = limitWorkerDatabases(c.workerDatabases, jobs[i])
+
+		w, err := e.constructor(wc, logger)
+		if err != nil {
+			return nil, err
+		}
+		workloads = append(workloads, w)
+	}
+
+	return workloads, nil
+}
+
+// enabledWorkloads returns entries of workloads enabled in config.
+func enabledWorkloads(c config) []workloadEntry {
+	var entries []workloadEntry
+
+	if c.idleXacts {
+		entries = append(entries, workloadEntry{"idlexacts", newIdleXactsWorkload, true, c.idleXactsWeight})
+	}
+	if c.rollbacks {
+		entries = append(entries, workloadEntry{"rollbacks", newRollbacksWorkload, true, c.rollbacksWeight})
+	}
+	if c.waitXacts {
+		entries = append(entries, workloadEntry{"waitxacts", newWaitxactsWorkload, true, c.waitXactsWeight})
+	}
+	if c.deadlocks {
+		entries = append(entries, workloadEntry{"deadlocks", newDeadlocksWorkload, true, c.deadlocksWeight})
+	}
+	if c.tempFiles {
+		entries = append(entries, workloadEntry{"tempfiles", newTempFilesWorkload, true, c.tempFilesWeight})
+	}
+	if c.terminate {
+		entries = append(entries, workloadEntry{"terminate", newTerminateWorkload, false, 0})
+	}
+	if c.failconns {
+		entries = append(entries, workloadEntry{"failconns", newFailconnsWorkload, false, 0})
+	}
+	if c.forkconns {
+		entries = append(entries, workloadEntry{"forkconns", newForkconnsWorkload, true, c.forkconnsWeight})
+	}
+	if c.hotrow {
+		entries = append(entries, workloadEntry{"hotrow", newHotrowWorkload, true, c.hotrowWeight})
+	}
+	if c.toastload {
+		entries = append(entries, workloadEntry{"toastload", newToastloadWorkload, true, c.toastloadWeight})
+	}
+	if c.idleconns {
+		entries = append(entries, workloadEntry{"idleconns", newIdleconnsWorkload, false, 0})
+	}
+	if c.plancacheload {
+		entries = append(entries, workloadEntry{"plancacheload", newPlancacheloadWorkload, true, c.plancacheloadWeight})
+	}
+	if c.orphanload {
+		entries = append(entries, workloadEntry{"orphanload", newOrphanloadWorkload, true, c.orphanloadWeight})
+	}
+	if c.poolerload {
+		entries = append(entries, workloadEntry{"poolerload", newPoolerloadWorkload, false, 0})
+	}
+	if c.checksumload {
+		entries = append(entries, workloadEntry{"checksumload", newChecksumloadWorkload, false, 0})
+	}
+	if c.advisorylocks {
+		entries = append(entries, workloadEntry{"advisorylocks", newAdvisorylocksWorkload, true, c.advisorylocksWeight})
+	}
+	if c.notifyload {
+		entries = append(entries, workloadEntry{"notifyload", newNotifyloadWorkload, true, c.notifyloadWeight})
+	}
+	if c.serialfailures {
+		entries = append(entries, workloadEntry{"serialfailures", newSerialfailuresWorkload, true, c.serialfailuresWeight})
+	}
+	if c.customsql {
+		entries = append(entries, workloadEntry{"customsql", newCustomsqlWorkload, true, c.customsqlWeight})
+	}
+	if c.statsload {
+		entries = append(entries, workloadEntry{"statsload", newStatsloadWorkload, true, c.statsloadWeight})
+	}
+	if c.walsenderload {
+		entries = append(entries, workloadEntry{"walsenderload", newWalsenderloadWorkload, false, 0})
+	}
+	if c.clientcancel {
+		entries = append(entries, workloadEntry{"clientcancel", newClientcancelWorkload, true, c.clientcancelWeight})
+	}
+	if c.diskfill {
+		entries = append(entries, workloadEntry{"diskfill", newDiskfillWorkload, false, 0})
+	}
+	if c.logicaldecode {
+		entries = append(entries, workloadEntry{"logicaldecode", newLogicaldecodeWorkload, true, c.logicaldecodeWeight})
+	}
+	if c.analyzeload {
+		entries = append(entries, workloadEntry{"analyzeload", newAnalyzeloadWorkload, true, c.analyzeloadWeight})
+	}
+
+	return entries
+}
+
+// distributeJobs returns number of jobs for each workload entry. If no weights are specified
+// each workload gets the whole jobs budget, otherwise the budget is split between workloads
+// which run with jobs accordingly to their weights (unspecified weights are treated as 1).
+func distributeJobs(budget uint16, entries []workloadEntry) []uint16 {
+	jobs := make([]uint16, len(entries))
+	for i := range jobs {
+		jobs[i] = budget
+	}
+
+	var weighted bool
+	for _, e := range entries {
+		if e.useJobs && e.weight > 0 {
+			weighted = true
+		}
+	}
+
+	if !weighted {
+		return jobs
+	}
+
+	var (
+		idx     []int
+		weights []uint16
+	)
+	for i, e := range entries {
+		if !e.useJobs {
+			continue
+		}
+
+		w := e.weight
+		if w == 0 {
+			w = 1
+		}
+
+		idx = append(idx, i)
+		weights = append(weights, w)
+	}
+
+	for i, n := range splitJobs(budget, weights) {
+		jobs[idx[i]] = n
+	}
+
+	return jobs
+}
+
+// splitJobs splits jobs budget proportionally to weights using the largest remainder method.
+// Each weight gets at least one job, hence the result might exceed too small budget.
+func splitJobs(budget uint16, weights []uint16) []uint16 {
+	var total int
+	for _, w := range weights {
+		total += int(w)
+	}
+
+	result := make([]uint16, len(weights))
+	if total == 0 {
+		return result
+	}
+
+	remainders := make([]int, len(weights))
+	left := int(budget)
+	for i, w := range weights {
+		share := int(budget) * int(w)
+		result[i] = uint16(share / total)
+		remainders[i] = share % total
+		left -= int(result[i])
+	}
+
+	// Give the rest of jobs to weights with the largest remainders, the first ones win in case of a tie.
+	for ; left > 0; left-- {
+		best := 0
+		for i := range remainders {
+			if remainders[i] > remainders[best] {
+				best = i
+			}
+		}
+		result[best]++
+		remainders[best] = -1
+	}
+
+	for i := range result {
+		if result[i] == 0 {
+			result[i] = 1
+		}
 	}
 
-	return workload.Run(ctx)
+	return result
+}
+
+// newIdleXactsWorkload creates workload with idle transactions.
+func newIdleXactsWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return idlexacts.NewWorkload(
+		idlexacts.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			NaptimeMin:         c.idleXactsNaptimeMin,
+			NaptimeMax:         c.idleXactsNaptimeMax,
+			Distribution:       c.idleXactsDistribution,
+			PoolerMode:         c.poolerMode,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+			HoldLock:           c.idleXactsHoldLock,
+			Isolation:          c.idleXactsIsolation,
+			WakeInterval:       c.idleXactsWakeInterval,
+			CommitTempTables:   c.idleXactsCommitTemp,
+			Seed:               c.seed,
+			CleanupTimeout:     c.cleanupTimeout,
+		}, logger,
+	)
+}
+
+func newRollbacksWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return rollbacks.NewWorkload(
+		rollbacks.Config{
+			Conninfo:           c.postgresConninfo,
+			CleanupTimeout:     c.cleanupTimeout,
+			Jobs:               c.jobs,
+			Rate:               c.rollbacksRate,
+			PoolerMode:         c.poolerMode,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+			Adaptive:           c.adaptiveLimiter,
+			SQLStates:          c.rollbacksSQLStates,
+			Strict:             c.rollbacksStrict,
+			Databases:          c.workerDatabases,
+			Seed:               c.seed,
+			Scheduler:          schedulerFactory(c),
+		}, logger,
+	)
+}
+
+func newWaitxactsWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return waitxacts.NewWorkload(
+		waitxacts.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Fixture:            c.waitXactsFixture,
+			LocktimeMin:        c.waitXactsLocktimeMin,
+			LocktimeMax:        c.waitXactsLocktimeMax,
+			CleanupTimeout:     c.cleanupTimeout,
+			PoolerMode:         c.poolerMode,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+			Isolation:          c.waitXactsIsolation,
+			NoFixtureFallback:  c.waitXactsNoFallback,
+			MinConns:           c.warmupConns,
+			Seed:               c.seed,
+		}, logger,
+	)
 }
 
-func startTerminateWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := terminate.NewWorkload(
+func newDeadlocksWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return deadlocks.NewWorkload(
+		deadlocks.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			CleanupTimeout:     c.cleanupTimeout,
+			LockDelay:          c.deadlocksLockDelay,
+			PoolerMode:         c.poolerMode,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+			Isolation:          c.deadlocksIsolation,
+			Seed:               c.seed,
+			TableName:          c.deadlocksTable,
+			PayloadSize:        c.deadlocksPayloadSize,
+		}, logger,
+	)
+}
+
+func newTempFilesWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return tempfiles.NewWorkload(
+		tempfiles.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.tempFilesRate,
+			Query:              c.tempFilesQuery,
+			SampleInterval:     c.tempFilesSampleInt,
+			ExceedTempLimit:    c.tempFilesExceedLimit,
+			MaxInflight:        c.tempFilesMaxInflight,
+			PoolerMode:         c.poolerMode,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+			Adaptive:           c.adaptiveLimiter,
+			Databases:          c.workerDatabases,
+			MinConns:           c.warmupConns,
+			CleanupTimeout:     c.cleanupTimeout,
+			Scheduler:          schedulerFactory(c),
+		}, logger,
+	)
+}
+
+func newTerminateWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return terminate.NewWorkload(
 		terminate.Config{
 			Conninfo:             c.postgresConninfo,
 			Interval:             c.terminateInterval,
@@ -243,39 +983,318 @@ func startTerminateWorkload(ctx context.Context, c config, logger log.Logger) er
 			User:                 c.terminateUser,
 			Database:             c.terminateDatabase,
 			ApplicationName:      c.terminateAppName,
+			Escalate:             c.terminateEscalate,
+			EscalateDelay:        c.terminateEscalateWait,
+			MaxTotal:             c.terminateMaxTotal,
+			SnapshotMode:         c.terminateSnapshot,
+			Force:                c.force,
+			PoolerMode:           c.poolerMode,
+			Role:                 c.role,
+			SearchPath:           c.searchPath,
+			PoolAcquireTimeout:   c.poolAcquireTimeout,
+			Scheduler:            schedulerFactory(c),
 		}, logger,
 	)
-	if err != nil {
-		return err
-	}
-
-	return workload.Run(ctx)
 }
 
-func startFailconnsWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := failconns.NewWorkload(
+func newFailconnsWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return failconns.NewWorkload(
 		failconns.Config{
-			Conninfo: c.postgresConninfo,
+			Conninfo:       c.postgresConninfo,
+			CleanupTimeout: c.cleanupTimeout,
+			HoldTime:       c.failconnsHoldTime,
+			ReleaseRatio:   c.failconnsReleaseRatio,
+			Interval:       c.failconnsInterval,
+			MinInterval:    c.failconnsMinInterval,
+			GrowFactor:     c.failconnsGrowFactor,
+			ShrinkFactor:   c.failconnsShrinkFactor,
+			Capacity:       c.failconnsCapacity,
+			Role:           c.role,
+			SearchPath:     c.searchPath,
 		}, logger,
 	)
-	if err != nil {
-		return err
+}
+
+func newForkconnsWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return forkconns.NewWorkload(
+		forkconns.Config{
+			Conninfo:   c.postgresConninfo,
+			Rate:       c.forkconnsRate,
+			Force:      c.force,
+			Jobs:       c.jobs,
+			Adaptive:   c.adaptiveLimiter,
+			Databases:  c.workerDatabases,
+			Scheduler:  schedulerFactory(c),
+			Role:       c.role,
+			SearchPath: c.searchPath,
+		}, logger,
+	)
+}
+
+func newHotrowWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return hotrow.NewWorkload(
+		hotrow.Config{
+			Conninfo:           c.postgresConninfo,
+			CleanupTimeout:     c.cleanupTimeout,
+			Jobs:               c.jobs,
+			Rate:               c.hotrowRate,
+			Scheduler:          schedulerFactory(c),
+			Adaptive:           c.adaptiveLimiter,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newToastloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return toastload.NewWorkload(
+		toastload.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.toastloadRate,
+			Scheduler:          schedulerFactory(c),
+			Adaptive:           c.adaptiveLimiter,
+			ValueSizeKB:        c.toastloadValueSizeKB,
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newIdleconnsWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return idleconns.NewWorkload(
+		idleconns.Config{
+			Conninfo:          c.postgresConninfo,
+			Count:             c.idleconnsCount,
+			KeepaliveInterval: c.idleconnsKeepalive,
+			Role:              c.role,
+			SearchPath:        c.searchPath,
+		}, logger,
+	)
+}
+
+func newPlancacheloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return plancacheload.NewWorkload(
+		plancacheload.Config{
+			Conninfo:             c.postgresConninfo,
+			Jobs:                 c.jobs,
+			StatementsPerSession: c.plancacheloadStmts,
+			Rate:                 c.plancacheloadRate,
+			Scheduler:            schedulerFactory(c),
+			Adaptive:             c.adaptiveLimiter,
+			Replan:               c.plancacheloadReplan,
+			Seed:                 c.seed,
+			CleanupTimeout:       c.cleanupTimeout,
+			Role:                 c.role,
+			SearchPath:           c.searchPath,
+		}, logger,
+	)
+}
+
+func newOrphanloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return orphanload.NewWorkload(
+		orphanload.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.orphanloadRate,
+			Scheduler:          schedulerFactory(c),
+			Adaptive:           c.adaptiveLimiter,
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newPoolerloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	// Clients use transaction pooling mode, where session settings would leak to other clients.
+	if c.role != "" || c.searchPath != "" {
+		return nil, noisia.NewConfigError("Role", noisia.ErrInvalidValue, "role and search_path are not supported by poolerload workload")
 	}
 
-	return workload.Run(ctx)
+	return poolerload.NewWorkload(
+		poolerload.Config{
+			Conninfo:      c.postgresConninfo,
+			Clients:       c.poolerloadClients,
+			HoldTime:      c.poolerloadHoldTime,
+			AdminDatabase: c.poolerloadAdminDB,
+		}, logger,
+	)
 }
 
-func startForkconnsWorkload(ctx context.Context, c config, logger log.Logger) error {
-	workload, err := forkconns.NewWorkload(
-		forkconns.Config{
-			Conninfo: c.postgresConninfo,
-			Rate:     c.forkconnsRate,
-			Jobs:     c.jobs,
+func newChecksumloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return checksumload.NewWorkload(
+		checksumload.Config{
+			Conninfo:           c.postgresConninfo,
+			Interval:           c.checksumloadInterval,
+			PageInspect:        c.checksumloadInspect,
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
 		}, logger,
 	)
-	if err != nil {
-		return err
+}
+
+func newAdvisorylocksWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return advisorylocks.NewWorkload(
+		advisorylocks.Config{
+			Conninfo:   c.postgresConninfo,
+			Jobs:       c.jobs,
+			KeySpace:   c.advisorylocksKeySpace,
+			HoldTime:   c.advisorylocksHoldTime,
+			Databases:  c.workerDatabases,
+			Seed:       c.seed,
+			Role:       c.role,
+			SearchPath: c.searchPath,
+		}, logger,
+	)
+}
+
+func newNotifyloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return notifyload.NewWorkload(
+		notifyload.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.notifyloadRate,
+			Scheduler:          schedulerFactory(c),
+			PayloadSize:        c.notifyloadPayloadSize,
+			Channel:            c.notifyloadChannel,
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newSerialfailuresWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return serialfailures.NewWorkload(
+		serialfailures.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.serialfailuresRate,
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newCustomsqlWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return customsql.NewWorkload(
+		customsql.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.customsqlRate,
+			Scheduler:          schedulerFactory(c),
+			Statements:         c.customsqlStatements,
+			InTransaction:      c.customsqlInXact,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newStatsloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return statsload.NewWorkload(
+		statsload.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.statsloadRate,
+			Scheduler:          schedulerFactory(c),
+			ResetRatio:         c.statsloadResetRatio,
+			AllowReset:         c.statsloadAllowReset,
+			Seed:               c.seed,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newWalsenderloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	// Replication connections don't execute SQL, so session settings could not be set.
+	if c.role != "" || c.searchPath != "" {
+		return nil, noisia.NewConfigError("Role", noisia.ErrInvalidValue, "role and search_path are not supported by walsenderload workload")
 	}
 
-	return workload.Run(ctx)
+	return walsenderload.NewWorkload(
+		walsenderload.Config{
+			Conninfo:  c.postgresConninfo,
+			SlotName:  c.walsenderloadSlot,
+			StallTime: c.walsenderloadStall,
+		}, logger,
+	)
+}
+
+func newClientcancelWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return clientcancel.NewWorkload(
+		clientcancel.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.clientcancelRate,
+			Scheduler:          schedulerFactory(c),
+			CancelAfterMin:     c.clientcancelAfterMin,
+			CancelAfterMax:     c.clientcancelAfterMax,
+			Seed:               c.seed,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newDiskfillWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return diskfill.NewWorkload(
+		diskfill.Config{
+			Conninfo:           c.postgresConninfo,
+			CleanupTimeout:     c.cleanupTimeout,
+			TargetBytes:        int64(c.diskfillTargetSize) * 1024 * 1024,
+			Rate:               c.diskfillRate,
+			Scheduler:          schedulerFactory(c),
+			Adaptive:           c.adaptiveLimiter,
+			AllowFull:          c.diskfillAllowFull,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newLogicaldecodeWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return logicaldecode.NewWorkload(
+		logicaldecode.Config{
+			Conninfo:           c.postgresConninfo,
+			SlotName:           c.logicaldecodeSlot,
+			Jobs:               c.jobs,
+			Rate:               c.logicaldecodeRate,
+			Scheduler:          schedulerFactory(c),
+			CleanupTimeout:     c.cleanupTimeout,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
+}
+
+func newAnalyzeloadWorkload(c config, logger log.Logger) (noisia.Workload, error) {
+	return analyzeload.NewWorkload(
+		analyzeload.Config{
+			Conninfo:           c.postgresConninfo,
+			Jobs:               c.jobs,
+			Rate:               c.analyzeloadRate,
+			Tables:             c.analyzeloadTables,
+			Seed:               c.seed,
+			Role:               c.role,
+			SearchPath:         c.searchPath,
+			PoolAcquireTimeout: c.poolAcquireTimeout,
+		}, logger,
+	)
 }
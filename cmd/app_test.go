@@ -0,0 +1,269 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/scenario"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+// fakeWorkload implements noisia.Workload with predefined stats.
+type fakeWorkload struct {
+	name  string
+	stats noisia.Stats
+}
+
+func (w fakeWorkload) Run(context.Context) error { return nil }
+func (w fakeWorkload) Name() string              { return w.name }
+func (w fakeWorkload) Stats() noisia.Stats       { return w.stats }
+
+func Test_writeSummary(t *testing.T) {
+	workloads := []noisia.Workload{
+		fakeWorkload{name: "rollbacks", stats: noisia.Stats{"commits": 0, "rollbacks": 10}},
+		fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 2}},
+	}
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeSummary(buf, workloads))
+
+	var got []workloadSummary
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, []workloadSummary{
+		{Name: "rollbacks", Stats: noisia.Stats{"commits": 0, "rollbacks": 10}},
+		{Name: "terminate", Stats: noisia.Stats{"signalled": 2}},
+	}, got)
+}
+
+func Test_writeSummary_enabled(t *testing.T) {
+	c := config{
+		jobs:                1,
+		idleXacts:           true,
+		idleXactsNaptimeMin: time.Second,
+		idleXactsNaptimeMax: 2 * time.Second,
+		rollbacks:           true,
+		rollbacksRate:       1,
+	}
+
+	workloads, err := newWorkloads(c, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeSummary(buf, workloads))
+
+	var got []workloadSummary
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Len(t, got, 2)
+	assert.Equal(t, "idlexacts", got[0].Name)
+	assert.Equal(t, noisia.Stats{"xacts": 0}, got[0].Stats)
+	assert.Equal(t, "rollbacks", got[1].Name)
+	assert.Equal(t, noisia.Stats{"commits": 0, "rollbacks": 0, "unexpected": 0}, got[1].Stats)
+}
+
+func Test_splitJobs(t *testing.T) {
+	testcases := []struct {
+		budget  uint16
+		weights []uint16
+		want    []uint16
+	}{
+		{budget: 10, weights: []uint16{4, 1}, want: []uint16{8, 2}},
+		{budget: 10, weights: []uint16{1, 1, 1}, want: []uint16{4, 3, 3}},
+		{budget: 10, weights: []uint16{2, 1, 2}, want: []uint16{4, 2, 4}},
+		{budget: 10, weights: []uint16{5}, want: []uint16{10}},
+		{budget: 2, weights: []uint16{1, 1, 1}, want: []uint16{1, 1, 1}},
+		{budget: 10, weights: []uint16{}, want: []uint16{}},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, splitJobs(tc.budget, tc.weights))
+	}
+}
+
+func Test_distributeJobs(t *testing.T) {
+	// No weights specified, each workload gets the whole budget.
+	entries := []workloadEntry{{useJobs: true}, {useJobs: false}, {useJobs: true}}
+	assert.Equal(t, []uint16{10, 10, 10}, distributeJobs(10, entries))
+
+	// Weighted, workloads without jobs are not accounted, unspecified weight treated as 1.
+	entries = []workloadEntry{{useJobs: true, weight: 4}, {useJobs: false}, {useJobs: true}}
+	assert.Equal(t, []uint16{8, 10, 2}, distributeJobs(10, entries))
+}
+
+func Test_newScenarioSteps(t *testing.T) {
+	c := config{
+		jobs:                1,
+		idleXactsNaptimeMin: time.Second,
+		idleXactsNaptimeMax: 2 * time.Second,
+		rollbacksRate:       1,
+	}
+
+	steps, err := newScenarioSteps([]scenario.Entry{
+		{Start: 0, Duration: 30 * time.Second, Workload: "idlexacts"},
+		{Start: 10 * time.Second, Duration: 10 * time.Second, Workload: "rollbacks"},
+	}, c, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Len(t, steps, 2)
+	assert.Equal(t, "idlexacts", steps[0].Workload.Name())
+	assert.Equal(t, 10*time.Second, steps[1].Start)
+	assert.Equal(t, "rollbacks", steps[1].Workload.Name())
+
+	_, err = newScenarioSteps([]scenario.Entry{{Duration: time.Second, Workload: "unknown"}}, c, log.NewDefaultLogger("error"))
+	assert.Error(t, err)
+}
+
+func Test_constructors(t *testing.T) {
+	for _, d := range noisia.Workloads() {
+		_, ok := constructors[d.Name]
+		assert.True(t, ok, d.Name)
+	}
+	assert.Len(t, constructors, len(noisia.Workloads()))
+}
+
+// blockingWorkload implements noisia.Workload which runs until context is done and records its run window.
+type blockingWorkload struct {
+	fakeWorkload
+	started, stopped time.Time
+}
+
+func (w *blockingWorkload) Run(ctx context.Context) error {
+	w.started = time.Now()
+	<-ctx.Done()
+	w.stopped = time.Now()
+	return nil
+}
+
+func Test_runWorkload(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Workload with shorter duration stops before the global deadline.
+	start := time.Now()
+	w := &blockingWorkload{}
+	assert.NoError(t, runWorkload(ctx, w, 100*time.Millisecond, 200*time.Millisecond))
+	assert.GreaterOrEqual(t, int64(w.started.Sub(start)), int64(100*time.Millisecond))
+	assert.Less(t, int64(w.stopped.Sub(start)), int64(500*time.Millisecond))
+	assert.NoError(t, ctx.Err())
+
+	// Workload is not started if the global deadline exceeded during offset.
+	w = &blockingWorkload{}
+	assert.NoError(t, runWorkload(ctx, w, 2*time.Second, time.Second))
+	assert.True(t, w.started.IsZero())
+}
+
+// failingWorkload implements noisia.Workload which fails immediately.
+type failingWorkload struct {
+	fakeWorkload
+}
+
+func (w failingWorkload) Run(context.Context) error { return errors.New("connection refused") }
+
+func Test_runWorkloads(t *testing.T) {
+	c := config{duration: 100 * time.Millisecond}
+	logger := log.NewDefaultLogger("error")
+
+	assert.NoError(t, runWorkloads(context.Background(), c, []noisia.Workload{fakeWorkload{name: "rollbacks"}}, logger))
+
+	// Only failed workloads are reported.
+	err := runWorkloads(context.Background(), c, []noisia.Workload{
+		fakeWorkload{name: "rollbacks"},
+		failingWorkload{fakeWorkload{name: "terminate"}},
+	}, logger)
+	assert.EqualError(t, err, "workloads failed: terminate: connection refused")
+	assert.Equal(t, exitWorkload, exitCode(err))
+}
+
+func Test_parseWorkerDatabases(t *testing.T) {
+	got, err := parseWorkerDatabases("0:db1,1:db1, 3:db2")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"db1", "db1", "", "db2"}, got)
+
+	got, err = parseWorkerDatabases("")
+	assert.NoError(t, err)
+	assert.Nil(t, got)
+
+	for _, v := range []string{"db1", "x:db1", "-1:db1", "0:", "0:db1,0:db2"} {
+		_, err = parseWorkerDatabases(v)
+		assert.Error(t, err)
+	}
+}
+
+func Test_limitWorkerDatabases(t *testing.T) {
+	databases := []string{"db1", "", "db2"}
+	assert.Equal(t, []string{"db1"}, limitWorkerDatabases(databases, 1))
+	assert.Equal(t, databases, limitWorkerDatabases(databases, 3))
+	assert.Equal(t, databases, limitWorkerDatabases(databases, 5))
+	assert.Nil(t, limitWorkerDatabases(nil, 2))
+}
+
+func Test_newWorkloads_databases(t *testing.T) {
+	// Mapping fits into jobs budget, but not into share of the weighted workload.
+	c := config{
+		jobs:                4,
+		idleXacts:           true,
+		idleXactsNaptimeMin: time.Second,
+		idleXactsNaptimeMax: 2 * time.Second,
+		idleXactsWeight:     3,
+		rollbacks:           true,
+		rollbacksRate:       1,
+		rollbacksWeight:     1,
+		workerDatabases:     []string{"db1", "db2", "db3", "db4"},
+	}
+
+	workloads, err := newWorkloads(c, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Len(t, workloads, 2)
+}
+
+func Test_parseWorkloadDurations(t *testing.T) {
+	got, err := parseWorkloadDurations(map[string]string{"terminate": "1m", "idlexacts": "0s"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]time.Duration{"terminate": time.Minute, "idlexacts": 0}, got)
+
+	for _, v := range []map[string]string{{"unknown": "1m"}, {"terminate": "invalid"}, {"terminate": "-1m"}} {
+		_, err = parseWorkloadDurations(v)
+		assert.Error(t, err)
+	}
+}
+
+func Test_schedulerFactory(t *testing.T) {
+	assert.IsType(t, &ratelimit.ConstantScheduler{}, schedulerFactory(config{scheduler: schedulerConstant})(0))
+	assert.IsType(t, &ratelimit.ConstantScheduler{}, schedulerFactory(config{})(0))
+
+	f := schedulerFactory(config{scheduler: schedulerPoisson, seed: 1})
+	assert.IsType(t, &ratelimit.PoissonScheduler{}, f(0))
+	// The same seed and worker make the same pacing.
+	assert.Equal(t, f(1).Next(10), f(1).Next(10))
+
+	f = schedulerFactory(config{scheduler: schedulerBurst, schedulerBurstOn: time.Second, schedulerBurstOff: time.Second})
+	assert.IsType(t, &ratelimit.BurstScheduler{}, f(0))
+	assert.Equal(t, 100*time.Millisecond, f(0).Next(10))
+}
+
+func Test_validateScheduler(t *testing.T) {
+	assert.NoError(t, validateScheduler(config{scheduler: schedulerConstant}))
+	assert.NoError(t, validateScheduler(config{scheduler: schedulerPoisson}))
+	assert.NoError(t, validateScheduler(config{scheduler: schedulerBurst, schedulerBurstOn: time.Second, schedulerBurstOff: time.Second}))
+	assert.Error(t, validateScheduler(config{scheduler: schedulerBurst, schedulerBurstOn: time.Second}))
+	assert.Error(t, validateScheduler(config{scheduler: "sine"}))
+}
+
+func Test_newRunID(t *testing.T) {
+	id := newRunID()
+	assert.Len(t, id, 12)
+	assert.NotEqual(t, id, newRunID())
+}
+
+func Test_sessionSettingsUnsupported(t *testing.T) {
+	// Role and search_path could not be applied by replication and pooler client connections.
+	_, err := newWalsenderloadWorkload(config{role: "app"}, log.NewDefaultLogger("error"))
+	assert.Equal(t, exitConfig, exitCode(err))
+
+	_, err = newPoolerloadWorkload(config{searchPath: "app"}, log.NewDefaultLogger("error"))
+	assert.Equal(t, exitConfig, exitCode(err))
+}
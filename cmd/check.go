@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"io"
+)
+
+// serverInfo defines properties of Postgres server reported by connectivity check.
+type serverInfo struct {
+	version        string
+	database       string
+	user           string
+	recovery       bool
+	maxConnections int
+}
+
+// privilegeCheck defines a privilege required by a workload and query which checks it.
+type privilegeCheck struct {
+	// description defines human-readable description of the privilege.
+	description string
+	// query defines query which returns true if the privilege is granted.
+	query string
+}
+
+var (
+	createTableCheck = privilegeCheck{
+		description: "create tables in current schema",
+		query:       "SELECT coalesce(has_schema_privilege(current_schema(), 'CREATE'), false)",
+	}
+	tempTableCheck = privilegeCheck{
+		description: "create temporary tables",
+		query:       "SELECT has_database_privilege(current_database(), 'TEMPORARY')",
+	}
+	replicationCheck = privilegeCheck{
+		description: "replication attribute",
+		query:       "SELECT rolreplication OR rolsuper FROM pg_roles WHERE rolname = current_user",
+	}
+	signalBackendCheck = privilegeCheck{
+		description: "signal other backends (pg_signal_backend)",
+		query:       "SELECT pg_has_role(current_user, 'pg_signal_backend', 'MEMBER')",
+	}
+	statsResetCheck = privilegeCheck{
+		description: "execute pg_stat_reset()",
+		query:       "SELECT has_function_privilege('pg_stat_reset()', 'EXECUTE')",
+	}
+)
+
+// workloadChecks returns privilege checks required by workload with passed name.
+func workloadChecks(c config, name string) []privilegeCheck {
+	switch name {
+	case "checksumload", "deadlocks", "diskfill", "hotrow", "rollbacks", "serialfailures", "toastload", "waitxacts":
+		return []privilegeCheck{createTableCheck}
+	case "logicaldecode":
+		return []privilegeCheck{createTableCheck, replicationCheck}
+	case "orphanload", "plancacheload":
+		return []privilegeCheck{tempTableCheck}
+	case "walsenderload":
+		return []privilegeCheck{replicationCheck}
+	case "terminate":
+		return []privilegeCheck{signalBackendCheck}
+	case "statsload":
+		if c.statsloadResetRatio > 0 {
+			return []privilegeCheck{statsResetCheck}
+		}
+	}
+
+	return nil
+}
+
+// runCheck connects to Postgres, prints server info and results of preflight and privilege checks
+// of requested workloads. No load is generated. Returns error if any of checks failed.
+func runCheck(ctx context.Context, w io.Writer, c config, logger log.Logger) error {
+	workloads, err := newWorkloads(c, logger)
+	if err != nil {
+		return err
+	}
+
+	conn, err := db.ConnectWithOptions(ctx, c.postgresConninfo, db.ConnOptions{Workload: "check", Role: c.role, SearchPath: c.searchPath})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	info, err := queryServerInfo(ctx, conn)
+	if err != nil {
+		return fmt.Errorf("query server info failed: %s", err)
+	}
+
+	err = printServerInfo(w, info)
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	report := func(name string, description string, err error) error {
+		status := "ok"
+		if err != nil {
+			status = fmt.Sprintf("failed: %s", err)
+			failed++
+		}
+		_, werr := fmt.Fprintf(w, "  %s: %s: %s\n", name, description, status)
+		return werr
+	}
+
+	_, err = fmt.Fprintln(w, "checks:")
+	if err != nil {
+		return err
+	}
+
+	if c.requireDatabaseName != "" {
+		err = report("preflight", "database name", verifyDatabaseName(ctx, conn, c.requireDatabaseName))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = report("preflight", "hot standby", verifyStandby(ctx, conn, workloads))
+	if err != nil {
+		return err
+	}
+
+	err = report("preflight", "pooler mode", verifyPoolerMode(workloads, c.poolerMode))
+	if err != nil {
+		return err
+	}
+
+	for _, wl := range workloads {
+		for _, pc := range workloadChecks(c, wl.Name()) {
+			err = report(wl.Name(), pc.description, checkPrivilege(ctx, conn, pc))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed", failed)
+	}
+
+	return nil
+}
+
+// queryServerInfo returns properties of Postgres server used by passed connection.
+func queryServerInfo(ctx context.Context, q db.Querier) (serverInfo, error) {
+	rows, err := q.Query(ctx, "SELECT version(), current_database(), current_user, pg_is_in_recovery(), current_setting('max_connections')::int")
+	if err != nil {
+		return serverInfo{}, err
+	}
+	defer rows.Close()
+
+	var info serverInfo
+	for rows.Next() {
+		err = rows.Scan(&info.version, &info.database, &info.user, &info.recovery, &info.maxConnections)
+		if err != nil {
+			return serverInfo{}, err
+		}
+	}
+
+	return info, rows.Err()
+}
+
+// printServerInfo prints properties of Postgres server.
+func printServerInfo(w io.Writer, info serverInfo) error {
+	_, err := fmt.Fprintf(w, "server version: %s\ncurrent database: %s\ncurrent user: %s\nin recovery: %t\nmax connections: %d\n",
+		info.version, info.database, info.user, info.recovery, info.maxConnections,
+	)
+	return err
+}
+
+// checkPrivilege executes query of passed check and returns error if the privilege is not granted.
+func checkPrivilege(ctx context.Context, q db.Querier, pc privilegeCheck) error {
+	rows, err := q.Query(ctx, pc.query)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var ok bool
+	for rows.Next() {
+		err = rows.Scan(&ok)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	if !ok {
+		return fmt.Errorf("not granted")
+	}
+
+	return nil
+}
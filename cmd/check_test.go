@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_workloadChecks(t *testing.T) {
+	c := config{}
+	assert.Equal(t, []privilegeCheck{createTableCheck}, workloadChecks(c, "rollbacks"))
+	assert.Equal(t, []privilegeCheck{createTableCheck, replicationCheck}, workloadChecks(c, "logicaldecode"))
+	assert.Equal(t, []privilegeCheck{signalBackendCheck}, workloadChecks(c, "terminate"))
+	assert.Nil(t, workloadChecks(c, "idlexacts"))
+
+	// Resetting statistics is checked only when resets are requested.
+	assert.Nil(t, workloadChecks(c, "statsload"))
+	c.statsloadResetRatio = 0.1
+	assert.Equal(t, []privilegeCheck{statsResetCheck}, workloadChecks(c, "statsload"))
+}
+
+func Test_printServerInfo(t *testing.T) {
+	buf := &bytes.Buffer{}
+	err := printServerInfo(buf, serverInfo{version: "PostgreSQL 14.1", database: "noisia_fixtures", user: "noisia", recovery: true, maxConnections: 100})
+	assert.NoError(t, err)
+	assert.Equal(t, "server version: PostgreSQL 14.1\ncurrent database: noisia_fixtures\ncurrent user: noisia\nin recovery: true\nmax connections: 100\n", buf.String())
+}
+
+func Test_checkPrivilege(t *testing.T) {
+	assert.NoError(t, checkPrivilege(context.Background(), &recoveryConn{recovery: true}, createTableCheck))
+	assert.Error(t, checkPrivilege(context.Background(), &recoveryConn{recovery: false}, createTableCheck))
+}
+
+func Test_runCheck(t *testing.T) {
+	c := config{
+		postgresConninfo:  db.TestConninfo,
+		rollbacks:         true,
+		rollbacksRate:     1,
+		terminate:         true,
+		terminateRate:     1,
+		terminateInterval: time.Second,
+		jobs:              1,
+	}
+
+	buf := &bytes.Buffer{}
+	err := runCheck(context.Background(), buf, c, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Contains(t, buf.String(), "server version: PostgreSQL")
+	assert.Contains(t, buf.String(), "current database: ")
+	assert.Contains(t, buf.String(), "current user: ")
+	assert.Contains(t, buf.String(), "in recovery: false")
+	assert.Contains(t, buf.String(), "max connections: ")
+	assert.Contains(t, buf.String(), "rollbacks: create tables in current schema: ok")
+	assert.Contains(t, buf.String(), "terminate: signal other backends (pg_signal_backend): ok")
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"io"
+	"sort"
+	"text/tabwriter"
+)
+
+// Labels of clusters compared in comparison mode.
+const (
+	clusterA = "a"
+	clusterB = "b"
+)
+
+// clusterWorkload wraps workload which is run against one of compared clusters.
+type clusterWorkload struct {
+	noisia.Workload
+	cluster string
+}
+
+// Run starts wrapped workload with context tagged by the cluster, so latencies and events
+// recorded by the workload are tagged by the cluster, e.g. 'deadlocks@b'.
+func (w clusterWorkload) Run(ctx context.Context) error {
+	return w.Workload.Run(events.WithCluster(ctx, w.cluster))
+}
+
+// clusterConninfos returns connection strings of all clusters used by the application.
+func clusterConninfos(c config) []string {
+	if c.compareConninfo == "" {
+		return []string{c.postgresConninfo}
+	}
+
+	return []string{c.postgresConninfo, c.compareConninfo}
+}
+
+// addCompareWorkloads tags passed workloads by the first cluster, creates the same workloads for
+// the second cluster and returns workloads of both clusters.
+func addCompareWorkloads(ctx context.Context, c config, workloads []noisia.Workload, logger log.Logger) ([]noisia.Workload, error) {
+	c.postgresConninfo = c.compareConninfo
+
+	compare, err := newWorkloads(c, logger)
+	if err != nil {
+		return nil, err
+	}
+
+	err = checkStandby(ctx, c.postgresConninfo, compare)
+	if err != nil {
+		return nil, fmt.Errorf("cluster %s: %w", clusterB, err)
+	}
+
+	return append(tagCluster(workloads, clusterA), tagCluster(compare, clusterB)...), nil
+}
+
+// tagCluster wraps passed workloads by specified cluster.
+func tagCluster(workloads []noisia.Workload, cluster string) []noisia.Workload {
+	tagged := make([]noisia.Workload, 0, len(workloads))
+	for _, w := range workloads {
+		tagged = append(tagged, clusterWorkload{Workload: w, cluster: cluster})
+	}
+
+	return tagged
+}
+
+// workloadCluster returns cluster of the workload, empty string is returned outside of comparison mode.
+func workloadCluster(w noisia.Workload) string {
+	if cw, ok := w.(clusterWorkload); ok {
+		return cw.cluster
+	}
+
+	return ""
+}
+
+// workloadLabel returns name of the workload tagged by its cluster, e.g. 'rollbacks@b'. Outside of
+// comparison mode the name is returned as is.
+func workloadLabel(w noisia.Workload) string {
+	if cluster := workloadCluster(w); cluster != "" {
+		return w.Name() + "@" + cluster
+	}
+
+	return w.Name()
+}
+
+// unwrapWorkload returns workload wrapped by cluster, or passed workload if it is not wrapped.
+func unwrapWorkload(w noisia.Workload) noisia.Workload {
+	if cw, ok := w.(clusterWorkload); ok {
+		return cw.Workload
+	}
+
+	return w
+}
+
+// writeComparison writes stats of workloads of compared clusters side by side, with difference
+// between the second and the first cluster.
+func writeComparison(w io.Writer, workloads []noisia.Workload) error {
+	var names []string
+	stats := map[string]map[string]noisia.Stats{}
+	for _, wl := range workloads {
+		if _, ok := stats[wl.Name()]; !ok {
+			names = append(names, wl.Name())
+			stats[wl.Name()] = map[string]noisia.Stats{}
+		}
+		stats[wl.Name()][workloadCluster(wl)] = wl.Stats()
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintf(tw, "WORKLOAD\tMETRIC\t%s\t%s\tDIFF\n", clusterA, clusterB)
+
+	for _, name := range names {
+		a, b := stats[name][clusterA], stats[name][clusterB]
+
+		// Sort metrics of both clusters for stable output.
+		seen := map[string]bool{}
+		var metrics []string
+		for _, s := range []noisia.Stats{a, b} {
+			for m := range s {
+				if !seen[m] {
+					seen[m] = true
+					metrics = append(metrics, m)
+				}
+			}
+		}
+		sort.Strings(metrics)
+
+		for _, m := range metrics {
+			_, _ = fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%+d\n", name, m, a[m], b[m], b[m]-a[m])
+		}
+	}
+
+	return tw.Flush()
+}
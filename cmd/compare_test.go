@@ -0,0 +1,135 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_workloadLabel(t *testing.T) {
+	w := fakeWorkload{name: "rollbacks"}
+	assert.Equal(t, "rollbacks", workloadLabel(w))
+	assert.Equal(t, "", workloadCluster(w))
+	assert.Equal(t, w, unwrapWorkload(w))
+
+	tagged := tagCluster([]noisia.Workload{w}, clusterB)
+	assert.Len(t, tagged, 1)
+	assert.Equal(t, "rollbacks", tagged[0].Name())
+	assert.Equal(t, "rollbacks@b", workloadLabel(tagged[0]))
+	assert.Equal(t, clusterB, workloadCluster(tagged[0]))
+	assert.Equal(t, w, unwrapWorkload(tagged[0]))
+}
+
+func Test_clusterWorkload_Run(t *testing.T) {
+	r := &sink.Recorder{}
+	sink.Set(r)
+	defer sink.Set(nil)
+	events.SetSink(sink.EventsWriter(r))
+	defer events.SetSink(nil)
+
+	w := recordingWorkload{fakeWorkload{name: "deadlocks"}}
+	workloads := append(tagCluster([]noisia.Workload{w}, clusterA), tagCluster([]noisia.Workload{w}, clusterB)...)
+	for _, wl := range workloads {
+		assert.NoError(t, wl.Run(context.Background()))
+	}
+
+	// Latencies and events are tagged by cluster the same way as counters.
+	var latencies, emitted []string
+	for _, rec := range r.Records(sink.KindLatency) {
+		latencies = append(latencies, rec.Workload)
+	}
+	for _, rec := range r.Records(sink.KindEvent) {
+		emitted = append(emitted, rec.Workload)
+	}
+	assert.Equal(t, []string{"deadlocks@a", "deadlocks@b"}, latencies)
+	assert.Equal(t, []string{"deadlocks@a", "deadlocks@b"}, emitted)
+
+	// Outside of comparison mode names are not tagged.
+	assert.NoError(t, w.Run(context.Background()))
+	assert.Equal(t, "deadlocks", r.Records(sink.KindLatency)[2].Workload)
+}
+
+// recordingWorkload implements noisia.Workload which records single latency and event when run.
+type recordingWorkload struct {
+	fakeWorkload
+}
+
+func (w recordingWorkload) Run(ctx context.Context) error {
+	sink.Latency(ctx, w.Name(), "deadlock", time.Millisecond)
+	events.Emit(ctx, w.Name(), "deadlock detected")
+	return nil
+}
+
+func Test_writeComparison(t *testing.T) {
+	workloads := append(
+		tagCluster([]noisia.Workload{
+			fakeWorkload{name: "tempfiles", stats: noisia.Stats{"temp_bytes": 1000}},
+			fakeWorkload{name: "rollbacks", stats: noisia.Stats{"commits": 10, "rollbacks": 5}},
+		}, clusterA),
+		tagCluster([]noisia.Workload{
+			fakeWorkload{name: "tempfiles", stats: noisia.Stats{"temp_bytes": 600}},
+			fakeWorkload{name: "rollbacks", stats: noisia.Stats{"commits": 12, "rollbacks": 5}},
+		}, clusterB)...,
+	)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeComparison(buf, workloads))
+	assert.Equal(t, `WORKLOAD   METRIC      a     b    DIFF
+tempfiles  temp_bytes  1000  600  -400
+rollbacks  commits     10    12   +2
+rollbacks  rollbacks   5     5    +0
+`, buf.String())
+}
+
+func Test_writeSummary_cluster(t *testing.T) {
+	workloads := append(
+		tagCluster([]noisia.Workload{fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 2}}}, clusterA),
+		tagCluster([]noisia.Workload{fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 3}}}, clusterB)...,
+	)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, writeSummary(buf, workloads))
+
+	var got []workloadSummary
+	assert.NoError(t, json.Unmarshal(buf.Bytes(), &got))
+	assert.Equal(t, []workloadSummary{
+		{Name: "terminate", Cluster: clusterA, Stats: noisia.Stats{"signalled": 2}},
+		{Name: "terminate", Cluster: clusterB, Stats: noisia.Stats{"signalled": 3}},
+	}, got)
+}
+
+func Test_addCompareWorkloads(t *testing.T) {
+	// The same database is used as both clusters.
+	c := config{
+		postgresConninfo: db.TestConninfo,
+		compareConninfo:  db.TestConninfo,
+		jobs:             2,
+		duration:         2 * time.Second,
+		rollbacks:        true,
+		rollbacksRate:    10,
+	}
+	logger := log.NewDefaultLogger("error")
+
+	workloads, err := newWorkloads(c, logger)
+	assert.NoError(t, err)
+
+	workloads, err = addCompareWorkloads(context.Background(), c, workloads, logger)
+	assert.NoError(t, err)
+	assert.Len(t, workloads, 2)
+
+	assert.NoError(t, runWorkloads(context.Background(), c, workloads, logger))
+
+	// Stats are collected for each cluster.
+	for i, cluster := range []string{clusterA, clusterB} {
+		assert.Equal(t, cluster, workloadCluster(workloads[i]))
+		assert.Greater(t, workloads[i].Stats()["commits"]+workloads[i].Stats()["rollbacks"], int64(0))
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// conninfoEnv defines environment variable used for passing connection string.
+const conninfoEnv = "NOISIA_POSTGRES_CONNINFO"
+
+// resolveConninfo returns connection string accordingly to precedence: explicitly specified
+// connection string, content of the connection string file, NOISIA_POSTGRES_CONNINFO environment
+// variable. Empty string is returned if nothing is specified, in this case connection settings are
+// taken from libpq environment variables (PGHOST, PGUSER, PGPASSFILE, etc.) when connecting.
+func resolveConninfo(conninfo string, file string, getenv func(string) string) (string, error) {
+	if conninfo != "" {
+		return conninfo, nil
+	}
+
+	if file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return "", fmt.Errorf("read conninfo file failed: %w", err)
+		}
+
+		return strings.TrimSpace(string(data)), nil
+	}
+
+	return getenv(conninfoEnv), nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_resolveConninfo(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "conninfo")
+	assert.NoError(t, os.WriteFile(file, []byte("host=file password=secret\n"), 0600))
+
+	getenv := func(key string) string {
+		if key == conninfoEnv {
+			return "host=env"
+		}
+		return ""
+	}
+
+	testcases := []struct {
+		conninfo string
+		file     string
+		want     string
+	}{
+		{conninfo: "host=flag", file: file, want: "host=flag"},
+		{conninfo: "", file: file, want: "host=file password=secret"},
+		{conninfo: "", file: "", want: "host=env"},
+	}
+
+	for _, tc := range testcases {
+		got, err := resolveConninfo(tc.conninfo, tc.file, getenv)
+		assert.NoError(t, err)
+		assert.Equal(t, tc.want, got)
+	}
+
+	// Nothing specified, libpq environment is used.
+	got, err := resolveConninfo("", "", func(string) string { return "" })
+	assert.NoError(t, err)
+	assert.Equal(t, "", got)
+
+	_, err = resolveConninfo("", filepath.Join(t.TempDir(), "missing"), getenv)
+	assert.Error(t, err)
+}
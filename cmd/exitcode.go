@@ -0,0 +1,49 @@
+package main
+
+import (
+	"errors"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+)
+
+// Exit codes of the application, they allow scripts and CI jobs to distinguish what happened.
+const (
+	// exitOK means all workloads finished, or shutdown has been requested by signal.
+	exitOK = 0
+	// exitFailure means unclassified failure, or shutdown has been forced.
+	exitFailure = 1
+	// exitConfig means invalid flags or workloads configuration.
+	exitConfig = 2
+	// exitConnect means connecting to Postgres failed.
+	exitConnect = 3
+	// exitWorkload means at least one workload failed at runtime.
+	exitWorkload = 4
+)
+
+// exitCode returns exit code which reflects passed error returned by the application.
+func exitCode(err error) int {
+	if err == nil {
+		return exitOK
+	}
+
+	var sigErr signalError
+	if errors.As(err, &sigErr) {
+		return exitOK
+	}
+
+	var cfgErr *noisia.ConfigError
+	if errors.As(err, &cfgErr) {
+		return exitConfig
+	}
+
+	if errors.Is(err, db.ErrConnect) {
+		return exitConnect
+	}
+
+	var runErr *noisia.RunError
+	if errors.As(err, &runErr) {
+		return exitWorkload
+	}
+
+	return exitFailure
+}
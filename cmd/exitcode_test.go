@@ -0,0 +1,30 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/stretchr/testify/assert"
+	"syscall"
+	"testing"
+)
+
+func Test_exitCode(t *testing.T) {
+	testcases := []struct {
+		err  error
+		want int
+	}{
+		{err: nil, want: exitOK},
+		{err: signalError{sig: syscall.SIGINT}, want: exitOK},
+		{err: noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero"), want: exitConfig},
+		{err: fmt.Errorf("check standby failed: %w", db.ErrConnect), want: exitConnect},
+		{err: &noisia.RunError{Errs: map[string]error{"terminate": errors.New("permission denied")}}, want: exitWorkload},
+		{err: &noisia.RunError{Errs: map[string]error{"terminate": db.ErrConnect}}, want: exitConnect},
+		{err: errors.New("write stats failed"), want: exitFailure},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, exitCode(tc.err), tc.err)
+	}
+}
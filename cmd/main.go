@@ -3,11 +3,18 @@ package main
 import (
 	"context"
 	"fmt"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/sink"
 	"gopkg.in/alecthomas/kingpin.v2"
+	"io"
+	"net/http"
 	"os"
 	"os/signal"
-	"sync"
+	"strings"
 	"syscall"
 )
 
@@ -18,22 +25,86 @@ var (
 func main() {
 	var (
 		showVersion           = kingpin.Flag("version", "show version and exit").Default().Bool()
-		logLevel              = kingpin.Flag("log-level", "Log level: info, warn, error").Default("info").Envar("NOISIA_LOG_LEVEL").Enum("info", "warn", "error")
-		postgresConninfo      = kingpin.Flag("conninfo", "Postgres connection string (DSN or URL), must be specified explicitly").Default("").Envar("NOISIA_POSTGRES_CONNINFO").String()
+		logLevel              = kingpin.Flag("log-level", "Log level: debug, info, warn, error").Default("info").Envar("NOISIA_LOG_LEVEL").Enum("debug", "info", "warn", "error")
+		runID                 = kingpin.Flag("run-id", "Identifier of the run added to all log messages and events; generated if not specified").Default("").Envar("NOISIA_RUN_ID").String()
+		pgxLogLevel           = kingpin.Flag("pgx-log-level", "Log level of pgx driver messages routed into log, for debugging connections: trace, debug, info, warn, error, off").Default("off").Envar("NOISIA_PGX_LOG_LEVEL").Enum("trace", "debug", "info", "warn", "error", "off")
+		postgresConninfo      = kingpin.Flag("conninfo", "Postgres connection string (DSN or URL), must be specified explicitly (env: NOISIA_POSTGRES_CONNINFO)").Default("").String()
+		conninfoFile          = kingpin.Flag("conninfo-file", "Read Postgres connection string from file").Default("").Envar("NOISIA_POSTGRES_CONNINFO_FILE").String()
+		compareConninfo       = kingpin.Flag("compare-conninfo", "Connection string of the second Postgres cluster, the same workloads are run against both clusters and their stats are compared").Default("").Envar("NOISIA_COMPARE_CONNINFO").String()
+		eventsFile            = kingpin.Flag("events-file", "Write events about performed actions as JSON lines into file").Default("").Envar("NOISIA_EVENTS_FILE").String()
+		eventsWebhook         = kingpin.Flag("events-webhook", "Post notable events as JSON to webhook URL, e.g. for integration with incident tooling").Default("").Envar("NOISIA_EVENTS_WEBHOOK").String()
+		eventsWebhookFilter   = kingpin.Flag("events-webhook.filter", "Regexp matched against '<workload>: <action>' of events posted to webhook, empty value matches all events").Default(sink.DefaultWebhookFilter).Envar("NOISIA_EVENTS_WEBHOOK_FILTER").String()
+		listTargets           = kingpin.Flag("list-targets", "Print tables which would be chosen by workloads and exit").Default("false").Bool()
+		listTargetsTop        = kingpin.Flag("list-targets.top", "Number of tables printed by --list-targets").Default("5").Int()
+		checkOnly             = kingpin.Flag("check-only", "Connect to Postgres, print server info and privilege checks of requested workloads and exit without generating load").Default("false").Bool()
+		summaryJSON           = kingpin.Flag("summary-json", "Print summary of performed work in JSON format at exit").Default("false").Envar("NOISIA_SUMMARY_JSON").Bool()
+		configFile            = kingpin.Flag("config-file", "Read flags from file, one flag per line; rates and jobs are reloaded from the file on SIGHUP").Default("").Envar("NOISIA_CONFIG_FILE").String()
+		statsCSVFile          = kingpin.Flag("stats-csv", "Write statistics of workloads in CSV format into file at exit").Default("").Envar("NOISIA_STATS_CSV").String()
+		statsCSVInterval      = kingpin.Flag("stats-csv.interval", "Interval between periodic samples of statistics written into sinks (CSV, results file, metrics, log), zero means only final statistics").Default("0s").Envar("NOISIA_STATS_CSV_INTERVAL").Duration()
+		resultsFile           = kingpin.Flag("results-file", "Write statistics, events and latencies of workloads as JSON lines into file").Default("").Envar("NOISIA_RESULTS_FILE").String()
+		metricsListen         = kingpin.Flag("metrics-listen", "Address for exposing statistics, events and latencies of workloads in Prometheus text format, e.g. :9100").Default("").Envar("NOISIA_METRICS_LISTEN").String()
+		statsStream           = kingpin.Flag("stats-stream", "Write current statistics of workloads to stdout as JSON lines each --stats-csv.interval").Default("false").Envar("NOISIA_STATS_STREAM").Bool()
+		statsLog              = kingpin.Flag("stats-log", "Write statistics and latencies of workloads into log").Default("false").Envar("NOISIA_STATS_LOG").Bool()
+		adaptiveMode          = kingpin.Flag("adaptive", "Throttle rate of rollbacks, tempfiles, forkconns, hotrow, toastload, diskfill, orphanload and plancacheload workloads when server load exceeds threshold").Default("false").Envar("NOISIA_ADAPTIVE").Bool()
+		adaptiveThreshold     = kingpin.Flag("adaptive.threshold", "Server load value above which workloads are throttled").Default("10").Envar("NOISIA_ADAPTIVE_THRESHOLD").Float64()
+		adaptivePollInterval  = kingpin.Flag("adaptive.poll-interval", "Interval between polling server load").Default("1s").Envar("NOISIA_ADAPTIVE_POLL_INTERVAL").Duration()
+		adaptiveQuery         = kingpin.Flag("adaptive.query", "Query which returns server load as single number").Default(adaptive.DefaultQuery).Envar("NOISIA_ADAPTIVE_QUERY").String()
+		scenarioFile          = kingpin.Flag("scenario", "Run workloads accordingly to timeline from JSON file, duration and workloads flags are ignored").Default("").Envar("NOISIA_SCENARIO").String()
+		requireDatabaseName   = kingpin.Flag("require-database-name", "Refuse to run unless connected database name matches the regular expression").Default("").Envar("NOISIA_REQUIRE_DATABASE_NAME").String()
+		allowDestructive      = kingpin.Flag("allow-destructive", "Allow running destructive workloads which affect other clients or the whole server: diskfill, failconns, poolerload, statsload, terminate").Default("false").Envar("NOISIA_ALLOW_DESTRUCTIVE").Bool()
+		cleanStart            = kingpin.Flag("clean-start", "Drop fixture tables left by previous runs before starting workloads").Default("false").Envar("NOISIA_CLEAN_START").Bool()
+		force                 = kingpin.Flag("force", "Allow settings exceeding sanity limits, e.g. very high forkconns and terminate rates").Default("false").Envar("NOISIA_FORCE").Bool()
+		workerDatabases       = kingpin.Flag("worker-databases", "Mapping of workers indexes to databases, e.g. 0:db1,1:db1,2:db2 (rollbacks, tempfiles, forkconns, advisorylocks)").Default("").Envar("NOISIA_WORKER_DATABASES").String()
+		poolerMode            = kingpin.Flag("pooler-mode", "Pooling mode of connection pooler used between noisia and Postgres: session, transaction").Default("").Envar("NOISIA_POOLER_MODE").Enum("", "session", "transaction")
+		role                  = kingpin.Flag("role", "Role set using SET ROLE after connecting (all workloads except walsenderload and poolerload)").Default("").Envar("NOISIA_ROLE").String()
+		poolAcquireTimeout    = kingpin.Flag("pool-acquire-timeout", "Max time of waiting for a free connection of the pool, zero means waiting until the end (workloads using connections pools)").Default("0s").Envar("NOISIA_POOL_ACQUIRE_TIMEOUT").Duration()
+		searchPath            = kingpin.Flag("search-path", "Comma-separated list of schemas set as search_path after connecting (all workloads except walsenderload and poolerload)").Default("").Envar("NOISIA_SEARCH_PATH").String()
 		jobs                  = kingpin.Flag("jobs", "Run workload with specified number of workers").Default("1").Envar("NOISIA_JOBS").Uint16()
 		duration              = kingpin.Flag("duration", "Duration of tests").Default("10s").Envar("NOISIA_DURATION").Duration()
+		seed                  = kingpin.Flag("seed", "Seed of random decisions made by workloads, runs with the same seed make the same decisions; generated if not specified").Default("0").Envar("NOISIA_SEED").Int64()
+		scheduler             = kingpin.Flag("scheduler", "Pacing of queries of rate-based workloads: constant, poisson, burst").Default("constant").Envar("NOISIA_SCHEDULER").Enum("constant", "poisson", "burst")
+		schedulerBurstOn      = kingpin.Flag("scheduler.burst-on", "Period when queries are executed with workloads rates in burst mode").Default("10s").Envar("NOISIA_SCHEDULER_BURST_ON").Duration()
+		schedulerBurstOff     = kingpin.Flag("scheduler.burst-off", "Period when no queries are executed in burst mode").Default("10s").Envar("NOISIA_SCHEDULER_BURST_OFF").Duration()
+		workloadDurations     = kingpin.Flag("workload-duration", "Run workload for specified duration instead of whole duration of tests, e.g. terminate=1m (could be repeated)").StringMap()
+		workloadOffsets       = kingpin.Flag("workload-offset", "Start workload after specified offset from the beginning of tests, e.g. terminate=9m (could be repeated)").StringMap()
+		cleanupTimeout        = kingpin.Flag("cleanup-timeout", "Max time allowed for fixtures cleanup").Default("10s").Envar("NOISIA_CLEANUP_TIMEOUT").Duration()
+		watchdogMultiple      = kingpin.Flag("watchdog-multiple", "Force exit if the run is not finished within duration multiplied by this value (but not earlier than duration plus two cleanup timeouts), zero disables watchdog").Default("2").Envar("NOISIA_WATCHDOG_MULTIPLE").Float64()
+		warmupConns           = kingpin.Flag("warmup-conns", "Number of connections established in workloads pools before the run (tempfiles per worker, waitxacts), zero disables warmup").Default("0").Envar("NOISIA_WARMUP_CONNS").Uint16()
+		shutdownGracePeriod   = kingpin.Flag("shutdown-grace-period", "Max time allowed for finishing workloads after the first signal, the second signal forces exit").Default("30s").Envar("NOISIA_SHUTDOWN_GRACE_PERIOD").Duration()
 		idleXacts             = kingpin.Flag("idle-xacts", "Run idle transactions workload").Default("false").Envar("NOISIA_IDLE_XACTS").Bool()
 		idleXactsNaptimeMin   = kingpin.Flag("idle-xacts.naptime-min", "Min transactions naptime").Default("5s").Envar("NOISIA_IDLE_XACTS_NAPTIME_MIN").Duration()
 		idleXactsNaptimeMax   = kingpin.Flag("idle-xacts.naptime-max", "Max transactions naptime").Default("20s").Envar("NOISIA_IDLE_XACTS_NAPTIME_MAX").Duration()
+		idleXactsDistribution = kingpin.Flag("idle-xacts.distribution", "Distribution of transactions naptime: uniform, exponential").Default("uniform").Envar("NOISIA_IDLE_XACTS_DISTRIBUTION").Enum("uniform", "exponential")
+		idleXactsWeight       = kingpin.Flag("idle-xacts.weight", "Idle transactions workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_IDLE_XACTS_WEIGHT").Uint16()
+		idleXactsHoldLock     = kingpin.Flag("idle-xacts.hold-lock", "Lock a row of hot-write table in idle transactions, concurrent writers of the row get blocked").Default("false").Envar("NOISIA_IDLE_XACTS_HOLD_LOCK").Bool()
+		idleXactsWakeInterval = kingpin.Flag("idle-xacts.wake-interval", "Interval of executing short statement in idle transactions, backends flip between active and idle in transaction states (default: 0s, always idle)").Default("0s").Envar("NOISIA_IDLE_XACTS_WAKE_INTERVAL").Duration()
+		idleXactsCommitTemp   = kingpin.Flag("idle-xacts.commit-temp-tables", "Commit idle transactions keeping temporary tables in workers sessions, usage of temporary schemas grows").Default("false").Envar("NOISIA_IDLE_XACTS_COMMIT_TEMP_TABLES").Bool()
+		idleXactsIsolation    = kingpin.Flag("idle-xacts.isolation", "Isolation level of idle transactions: read-committed, repeatable-read, serializable (default: database default)").Default("").Envar("NOISIA_IDLE_XACTS_ISOLATION").Enum("", "read-committed", "repeatable-read", "serializable")
 		rollbacks             = kingpin.Flag("rollbacks", "Run rollbacks workload").Default("false").Envar("NOISIA_ROLLBACKS").Bool()
 		rollbacksRate         = kingpin.Flag("rollbacks.rate", "Rollbacks rate per second (per worker)").Default("1").Envar("NOISIA_ROLLBACKS_RATE").Float64()
+		rollbacksWeight       = kingpin.Flag("rollbacks.weight", "Rollbacks workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_ROLLBACKS_WEIGHT").Uint16()
+		rollbacksSQLStates    = kingpin.Flag("rollbacks.sqlstate", "SQLSTATE code or condition name of errors to produce, could be repeated (default: all)").Envar("NOISIA_ROLLBACKS_SQLSTATE").Strings()
+		rollbacksStrict       = kingpin.Flag("rollbacks.strict", "Check that produced errors have expected SQLSTATE codes").Default("false").Envar("NOISIA_ROLLBACKS_STRICT").Bool()
 		waitXacts             = kingpin.Flag("wait-xacts", "Run waiting transactions workload").Default("false").Envar("NOISIA_IDLE_XACTS").Bool()
 		waitXactsFixture      = kingpin.Flag("wait-xacts.fixture", "Run workload using fixture table").Default("false").Envar("NOISIA_WAIT_XACTS_FIXTURE").Bool()
 		waitXactsLocktimeMin  = kingpin.Flag("wait-xacts.locktime-min", "Min transactions locking time").Default("5s").Envar("NOISIA_WAIT_XACTS_LOCKTIME_MIN").Duration()
 		waitXactsLocktimeMax  = kingpin.Flag("wait-xacts.locktime-max", "Max transactions locking time").Default("20s").Envar("NOISIA_WAIT_XACTS_LOCKTIME_MAX").Duration()
+		waitXactsNoFallback   = kingpin.Flag("wait-xacts.no-fixture-fallback", "Fail instead of switching to fixture table when no tables for locking found").Default("false").Envar("NOISIA_WAIT_XACTS_NO_FIXTURE_FALLBACK").Bool()
+		waitXactsIsolation    = kingpin.Flag("wait-xacts.isolation", "Isolation level of locking transactions: read-committed, repeatable-read, serializable (default: database default)").Default("").Envar("NOISIA_WAIT_XACTS_ISOLATION").Enum("", "read-committed", "repeatable-read", "serializable")
+		waitXactsWeight       = kingpin.Flag("wait-xacts.weight", "Waiting transactions workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_WAIT_XACTS_WEIGHT").Uint16()
 		deadlocks             = kingpin.Flag("deadlocks", "Run deadlocks workload").Default("false").Envar("NOISIA_DEADLOCKS").Bool()
+		deadlocksLockDelay    = kingpin.Flag("deadlocks.lock-delay", "Initial (and minimal) delay between updates in deadlock transactions, tuned automatically accordingly to rate of missed deadlocks").Default("10ms").Envar("NOISIA_DEADLOCKS_LOCK_DELAY").Duration()
+		deadlocksIsolation    = kingpin.Flag("deadlocks.isolation", "Isolation level of deadlock transactions: read-committed, repeatable-read, serializable (default: database default)").Default("").Envar("NOISIA_DEADLOCKS_ISOLATION").Enum("", "read-committed", "repeatable-read", "serializable")
+		deadlocksTable        = kingpin.Flag("deadlocks.table", "Name of the working table created by deadlocks workload").Default("_noisia_deadlocks_workload").Envar("NOISIA_DEADLOCKS_TABLE").String()
+		deadlocksPayloadSize  = kingpin.Flag("deadlocks.payload-size", "Size of random text payload of rows used in deadlocks, in bytes").Default("32").Envar("NOISIA_DEADLOCKS_PAYLOAD_SIZE").Int()
+		deadlocksWeight       = kingpin.Flag("deadlocks.weight", "Deadlocks workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_DEADLOCKS_WEIGHT").Uint16()
 		tempFiles             = kingpin.Flag("tempfiles", "Run temporary files workload").Default("false").Envar("NOISIA_TEMP_FILES").Bool()
 		tempFilesRate         = kingpin.Flag("tempfiles.rate", "Number of queries per second (per worker)").Default("1").Envar("NOISIA_TEMP_FILES_RATE").Float64()
+		tempFilesWeight       = kingpin.Flag("tempfiles.weight", "Temp files workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_TEMPFILES_WEIGHT").Uint16()
+		tempFilesQuery        = kingpin.Flag("tempfiles.query", "SELECT query which produces temp files (default: cross join of pg_class sorted randomly)").Default("").Envar("NOISIA_TEMPFILES_QUERY").String()
+		tempFilesSampleInt    = kingpin.Flag("tempfiles.sample-interval", "Interval between samples of temp bytes statistics used for reporting temp bytes rate").Default("1s").Envar("NOISIA_TEMPFILES_SAMPLE_INTERVAL").Duration()
+		tempFilesMaxInflight  = kingpin.Flag("tempfiles.max-inflight", "Max number of queries executed concurrently by each worker, queries are skipped when the limit is reached, zero means no limit").Default("100").Envar("NOISIA_TEMPFILES_MAX_INFLIGHT").Uint16()
+		tempFilesExceedLimit  = kingpin.Flag("tempfiles.exceed-temp-limit", "Set low temp_file_limit for queries, so they fail with temp_file_limit errors (requires privilege to set temp_file_limit)").Default("false").Envar("NOISIA_TEMPFILES_EXCEED_TEMP_LIMIT").Bool()
 		terminate             = kingpin.Flag("terminate", "Run terminate workload").Default("false").Envar("NOISIA_TERMINATE").Bool()
 		terminateRate         = kingpin.Flag("terminate.rate", "Number of backends/queries terminate per interval").Default("1").Envar("NOISIA_TERMINATE_RATE").Uint16()
 		terminateInterval     = kingpin.Flag("terminate.interval", "Time interval of single round of termination").Default("1s").Envar("NOISIA_TERMINATE_INTERVAL").Duration()
@@ -43,36 +114,352 @@ func main() {
 		terminateUser         = kingpin.Flag("terminate.user", "Terminate backends handled by specific user").Default("").Envar("NOISIA_TERMINATE_USER").String()
 		terminateDatabase     = kingpin.Flag("terminate.database", "Terminate backends connected to specific database").Default("").Envar("NOISIA_TERMINATE_DATABASE").String()
 		terminateAppName      = kingpin.Flag("terminate.appname", "Terminate backends created from specific applications").Default("").Envar("NOISIA_TERMINATE_APPNAME").String()
+		terminateEscalate     = kingpin.Flag("terminate.escalate", "Cancel queries first and terminate backends if they are still present after delay").Default("false").Envar("NOISIA_TERMINATE_ESCALATE").Bool()
+		terminateEscalateWait = kingpin.Flag("terminate.escalate-delay", "Time interval between cancel and terminate in escalate mode").Default("1s").Envar("NOISIA_TERMINATE_ESCALATE_DELAY").Duration()
+		terminateMaxTotal     = kingpin.Flag("terminate.max-total", "Max number of signalled backends, when reached the workload stops; zero means unlimited").Default("0").Envar("NOISIA_TERMINATE_MAX_TOTAL").Int()
+		terminateSnapshot     = kingpin.Flag("terminate.snapshot-mode", "Signal backends round-robin over snapshot of matching backends taken each interval, instead of random choice").Default("false").Envar("NOISIA_TERMINATE_SNAPSHOT_MODE").Bool()
 		failconns             = kingpin.Flag("failconns", "Run connections exhaustion workload").Default("false").Envar("NOISIA_FAILCONNS").Bool()
+		failconnsHoldTime     = kingpin.Flag("failconns.hold-time", "Interval after which a part of held connections is released, zero means hold until the end").Default("0s").Envar("NOISIA_FAILCONNS_HOLD_TIME").Duration()
+		failconnsReleaseRatio = kingpin.Flag("failconns.release-ratio", "Fraction of held connections released every hold time").Default("0").Envar("NOISIA_FAILCONNS_RELEASE_RATIO").Float64()
+		failconnsInterval     = kingpin.Flag("failconns.interval", "Base interval between making new connections").Default("50ms").Envar("NOISIA_FAILCONNS_INTERVAL").Duration()
+		failconnsMinInterval  = kingpin.Flag("failconns.min-interval", "Lower limit of interval reduced after successful connections, zero means base interval").Default("0s").Envar("NOISIA_FAILCONNS_MIN_INTERVAL").Duration()
+		failconnsGrowFactor   = kingpin.Flag("failconns.grow-factor", "Factor of increasing interval after failed connection").Default("2").Envar("NOISIA_FAILCONNS_GROW_FACTOR").Float64()
+		failconnsShrinkFactor = kingpin.Flag("failconns.shrink-factor", "Factor of reducing interval after successful connection").Default("2").Envar("NOISIA_FAILCONNS_SHRINK_FACTOR").Float64()
+		failconnsCapacity     = kingpin.Flag("failconns.capacity", "Initial capacity of held connections list, zero means derived from max_connections").Default("0").Envar("NOISIA_FAILCONNS_CAPACITY").Int()
 		forkconns             = kingpin.Flag("forkconns", "Run queries in dedicated connections").Default("false").Envar("NOISIA_FORKCONNS").Bool()
 		forkconnsRate         = kingpin.Flag("forkconns.rate", "Number of connections made per second").Default("1").Envar("NOISIA_FORKCONNS_RATE").Uint16()
+		forkconnsWeight       = kingpin.Flag("forkconns.weight", "Fork connections workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_FORKCONNS_WEIGHT").Uint16()
+		hotrow                = kingpin.Flag("hotrow", "Run hot row updates workload").Default("false").Envar("NOISIA_HOTROW").Bool()
+		hotrowRate            = kingpin.Flag("hotrow.rate", "Hot row updates rate per second (per worker)").Default("10").Envar("NOISIA_HOTROW_RATE").Float64()
+		hotrowWeight          = kingpin.Flag("hotrow.weight", "Hot row workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_HOTROW_WEIGHT").Uint16()
+		toastload             = kingpin.Flag("toastload", "Run large TOAST-able values inserts workload").Default("false").Envar("NOISIA_TOASTLOAD").Bool()
+		toastloadRate         = kingpin.Flag("toastload.rate", "Large values inserts rate per second (per worker)").Default("1").Envar("NOISIA_TOASTLOAD_RATE").Float64()
+		toastloadValueSizeKB  = kingpin.Flag("toastload.value-size", "Size of inserted values, in kilobytes").Default("1024").Envar("NOISIA_TOASTLOAD_VALUE_SIZE").Uint32()
+		toastloadWeight       = kingpin.Flag("toastload.weight", "TOAST load workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_TOASTLOAD_WEIGHT").Uint16()
+		idleconns             = kingpin.Flag("idleconns", "Run idle connections workload").Default("false").Envar("NOISIA_IDLECONNS").Bool()
+		idleconnsCount        = kingpin.Flag("idleconns.count", "Number of held idle connections").Default("100").Envar("NOISIA_IDLECONNS_COUNT").Uint16()
+		idleconnsKeepalive    = kingpin.Flag("idleconns.keepalive-interval", "Interval between keepalive queries in held connections").Default("30s").Envar("NOISIA_IDLECONNS_KEEPALIVE_INTERVAL").Duration()
+		plancacheload         = kingpin.Flag("plancacheload", "Run prepared statements workload which stresses plans cache").Default("false").Envar("NOISIA_PLANCACHELOAD").Bool()
+		plancacheloadStmts    = kingpin.Flag("plancacheload.statements", "Number of prepared statements created in each session").Default("100").Envar("NOISIA_PLANCACHELOAD_STATEMENTS").Uint16()
+		plancacheloadRate     = kingpin.Flag("plancacheload.rate", "Prepared statements executions rate per second (per worker)").Default("10").Envar("NOISIA_PLANCACHELOAD_RATE").Float64()
+		plancacheloadReplan   = kingpin.Flag("plancacheload.replan", "Execute DDL after each round of executions for forcing replanning").Default("false").Envar("NOISIA_PLANCACHELOAD_REPLAN").Bool()
+		plancacheloadWeight   = kingpin.Flag("plancacheload.weight", "Plans cache workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_PLANCACHELOAD_WEIGHT").Uint16()
+		orphanload            = kingpin.Flag("orphanload", "Run workload which terminates sessions holding temporary objects, leaving temporary schemas behind").Default("false").Envar("NOISIA_ORPHANLOAD").Bool()
+		orphanloadRate        = kingpin.Flag("orphanload.rate", "Terminated sessions rate per second (per worker)").Default("1").Envar("NOISIA_ORPHANLOAD_RATE").Float64()
+		orphanloadWeight      = kingpin.Flag("orphanload.weight", "Orphaned temporary schemas workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_ORPHANLOAD_WEIGHT").Uint16()
+		poolerload            = kingpin.Flag("poolerload", "Run workload which overflows connection pooler's pool and queues its clients").Default("false").Envar("NOISIA_POOLERLOAD").Bool()
+		poolerloadClients     = kingpin.Flag("poolerload.clients", "Number of client connections opened to the pooler, should be greater than pool size").Default("100").Envar("NOISIA_POOLERLOAD_CLIENTS").Uint16()
+		poolerloadHoldTime    = kingpin.Flag("poolerload.hold-time", "Duration of queries which hold server connections of the pool").Default("1s").Envar("NOISIA_POOLERLOAD_HOLD_TIME").Duration()
+		poolerloadAdminDB     = kingpin.Flag("poolerload.admin-database", "Database of the pooler's admin console used for SHOW POOLS, e.g. 'console' for Odyssey").Default("pgbouncer").Envar("NOISIA_POOLERLOAD_ADMIN_DATABASE").String()
+		checksumload          = kingpin.Flag("checksumload", "Run read-only data checksums monitoring workload").Default("false").Envar("NOISIA_CHECKSUMLOAD").Bool()
+		checksumloadInterval  = kingpin.Flag("checksumload.interval", "Interval between checks of checksum failures").Default("1s").Envar("NOISIA_CHECKSUMLOAD_INTERVAL").Duration()
+		checksumloadInspect   = kingpin.Flag("checksumload.pageinspect", "Inspect pages of fixture table using pageinspect extension (should be installed)").Default("false").Envar("NOISIA_CHECKSUMLOAD_PAGEINSPECT").Bool()
+		advisorylocks         = kingpin.Flag("advisorylocks", "Run advisory locks contention workload").Default("false").Envar("NOISIA_ADVISORYLOCKS").Bool()
+		advisorylocksKeySpace = kingpin.Flag("advisorylocks.keyspace", "Number of distinct lock keys, the smaller the key space the higher the contention").Default("4").Envar("NOISIA_ADVISORYLOCKS_KEYSPACE").Uint16()
+		advisorylocksHoldTime = kingpin.Flag("advisorylocks.hold-time", "Time acquired lock is held before release").Default("100ms").Envar("NOISIA_ADVISORYLOCKS_HOLD_TIME").Duration()
+		advisorylocksWeight   = kingpin.Flag("advisorylocks.weight", "Advisory locks workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_ADVISORYLOCKS_WEIGHT").Uint16()
+		notifyload            = kingpin.Flag("notifyload", "Run notifications workload which stresses notifications queue").Default("false").Envar("NOISIA_NOTIFYLOAD").Bool()
+		notifyloadRate        = kingpin.Flag("notifyload.rate", "Notifications rate per second (per worker)").Default("100").Envar("NOISIA_NOTIFYLOAD_RATE").Float64()
+		notifyloadPayloadSize = kingpin.Flag("notifyload.payload-size", "Size of notification payload, in bytes (max 7999)").Default("1024").Envar("NOISIA_NOTIFYLOAD_PAYLOAD_SIZE").Uint16()
+		notifyloadChannel     = kingpin.Flag("notifyload.channel", "Name of the channel notifications are sent to").Default("noisia").Envar("NOISIA_NOTIFYLOAD_CHANNEL").String()
+		notifyloadWeight      = kingpin.Flag("notifyload.weight", "Notifications workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_NOTIFYLOAD_WEIGHT").Uint16()
+		serialfailures        = kingpin.Flag("serialfailures", "Run serialization failures workload").Default("false").Envar("NOISIA_SERIALFAILURES").Bool()
+		serialfailuresRate    = kingpin.Flag("serialfailures.rate", "Pairs of conflicting serializable transactions per second (per worker)").Default("1").Envar("NOISIA_SERIALFAILURES_RATE").Float64()
+		serialfailuresWeight  = kingpin.Flag("serialfailures.weight", "Serialization failures workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_SERIALFAILURES_WEIGHT").Uint16()
+		customsql             = kingpin.Flag("customsql", "Run custom SQL workload which executes user-provided statements").Default("false").Envar("NOISIA_CUSTOMSQL").Bool()
+		customsqlStatements   = kingpin.Flag("customsql.statement", "SQL statement executed by custom SQL workload (could be repeated)").Strings()
+		customsqlFile         = kingpin.Flag("customsql.file", "Read statements of custom SQL workload from file, one statement per line").Default("").Envar("NOISIA_CUSTOMSQL_FILE").String()
+		customsqlRate         = kingpin.Flag("customsql.rate", "Executions of all statements per second (per worker)").Default("1").Envar("NOISIA_CUSTOMSQL_RATE").Float64()
+		customsqlInXact       = kingpin.Flag("customsql.in-transaction", "Execute statements within single transaction").Default("false").Envar("NOISIA_CUSTOMSQL_IN_TRANSACTION").Bool()
+		customsqlWeight       = kingpin.Flag("customsql.weight", "Custom SQL workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_CUSTOMSQL_WEIGHT").Uint16()
+		statsload             = kingpin.Flag("statsload", "Run statistics workload which reads statistics views in a tight loop").Default("false").Envar("NOISIA_STATSLOAD").Bool()
+		statsloadRate         = kingpin.Flag("statsload.rate", "Statistics queries rate per second (per worker)").Default("10").Envar("NOISIA_STATSLOAD_RATE").Float64()
+		statsloadResetRatio   = kingpin.Flag("statsload.reset-ratio", "Probability of resetting statistics of the whole database instead of reading, from 0 to 1 (requires --statsload.allow-reset)").Default("0").Envar("NOISIA_STATSLOAD_RESET_RATIO").Float64()
+		statsloadAllowReset   = kingpin.Flag("statsload.allow-reset", "Allow resetting statistics of the whole database with pg_stat_reset()").Default("false").Envar("NOISIA_STATSLOAD_ALLOW_RESET").Bool()
+		statsloadWeight       = kingpin.Flag("statsload.weight", "Statistics workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_STATSLOAD_WEIGHT").Uint16()
+		walsenderload         = kingpin.Flag("walsenderload", "Run replication connection workload which stalls consuming of WAL stream (requires replication privileges)").Default("false").Envar("NOISIA_WALSENDERLOAD").Bool()
+		walsenderloadSlot     = kingpin.Flag("walsenderload.slot-name", "Name of temporary physical replication slot").Default("noisia_walsenderload").Envar("NOISIA_WALSENDERLOAD_SLOT_NAME").String()
+		walsenderloadStall    = kingpin.Flag("walsenderload.stall-time", "Time when replication stream is not consumed, use values greater than wal_sender_timeout for reproducing replication timeouts").Default("90s").Envar("NOISIA_WALSENDERLOAD_STALL_TIME").Duration()
+		clientcancel          = kingpin.Flag("clientcancel", "Run client cancel workload which cancels long queries from the client side").Default("false").Envar("NOISIA_CLIENTCANCEL").Bool()
+		clientcancelRate      = kingpin.Flag("clientcancel.rate", "Cancelled queries rate per second (per worker)").Default("1").Envar("NOISIA_CLIENTCANCEL_RATE").Float64()
+		clientcancelAfterMin  = kingpin.Flag("clientcancel.cancel-after-min", "Min delay before query is cancelled").Default("100ms").Envar("NOISIA_CLIENTCANCEL_CANCEL_AFTER_MIN").Duration()
+		clientcancelAfterMax  = kingpin.Flag("clientcancel.cancel-after-max", "Max delay before query is cancelled").Default("1s").Envar("NOISIA_CLIENTCANCEL_CANCEL_AFTER_MAX").Duration()
+		clientcancelWeight    = kingpin.Flag("clientcancel.weight", "Client cancel workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_CLIENTCANCEL_WEIGHT").Uint16()
+		diskfill              = kingpin.Flag("diskfill", "Run disk fill workload which consumes disk space up to specified size").Default("false").Envar("NOISIA_DISKFILL").Bool()
+		diskfillTargetSize    = kingpin.Flag("diskfill.target-size", "Growth of the database, in megabytes; could not exceed 10240 unless filling is allowed").Default("1024").Envar("NOISIA_DISKFILL_TARGET_SIZE").Uint32()
+		diskfillRate          = kingpin.Flag("diskfill.rate", "Inserts rate per second, each insert writes up to 1MB").Default("10").Envar("NOISIA_DISKFILL_RATE").Float64()
+		diskfillAllowFull     = kingpin.Flag("diskfill.allow-full", "Allow exceeding safety cap and filling the volume, zero target size means until disk is full").Default("false").Envar("NOISIA_DISKFILL_ALLOW_FULL").Bool()
+		logicaldecode         = kingpin.Flag("logicaldecode", "Run logical decoding workload which decodes generated changes using logical replication slots (requires wal_level = logical)").Default("false").Envar("NOISIA_LOGICALDECODE").Bool()
+		logicaldecodeSlot     = kingpin.Flag("logicaldecode.slot-name", "Prefix of logical replication slots names, each worker uses its own slot").Default("noisia_logicaldecode").Envar("NOISIA_LOGICALDECODE_SLOT_NAME").String()
+		logicaldecodeRate     = kingpin.Flag("logicaldecode.rate", "Changes generated and decoded per second (per worker)").Default("1").Envar("NOISIA_LOGICALDECODE_RATE").Float64()
+		logicaldecodeWeight   = kingpin.Flag("logicaldecode.weight", "Logical decoding workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_LOGICALDECODE_WEIGHT").Uint16()
+		analyzeload           = kingpin.Flag("analyzeload", "Run analyze workload which runs ANALYZE on tables in a tight loop").Default("false").Envar("NOISIA_ANALYZELOAD").Bool()
+		analyzeloadRate       = kingpin.Flag("analyzeload.rate", "ANALYZE rate per second (per worker)").Default("1").Envar("NOISIA_ANALYZELOAD_RATE").Float64()
+		analyzeloadTables     = kingpin.Flag("analyzeload.table", "Table analyzed by the workload, optionally schema-qualified (could be repeated, default: the most written tables)").Envar("NOISIA_ANALYZELOAD_TABLE").Strings()
+		analyzeloadWeight     = kingpin.Flag("analyzeload.weight", "Analyze workload share of jobs budget relative to other workloads, zero means not specified").Default("0").Envar("NOISIA_ANALYZELOAD_WEIGHT").Uint16()
 	)
 	kingpin.Parse()
 
+	// Flags from config file are parsed together with command line flags, the same flag must not be specified twice.
+	if *configFile != "" {
+		args, err := kingpin.ExpandArgsFromFile(*configFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "read config file failed: %s\n", err)
+			os.Exit(exitConfig)
+		}
+		kingpin.MustParse(kingpin.CommandLine.Parse(append(args, os.Args[1:]...)))
+	}
+
 	if *showVersion {
 		fmt.Printf("%s %s %s-%s\n", appName, gitTag, gitCommit, gitBranch)
 		os.Exit(0)
 	}
 
-	logger := log.NewDefaultLogger(*logLevel)
+	if *runID == "" {
+		*runID = newRunID()
+	}
+
+	logger := log.NewRunLogger(*logLevel, *runID)
+	events.SetRunID(*runID)
+
+	err := db.SetDriverLogger(logger, *pgxLogLevel)
+	if err != nil {
+		logger.Errorf("configure driver logging failed: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	// All results of workloads are written into composite sink.
+	var sinks []sink.Sink
+
+	if *eventsFile != "" {
+		f, err := os.OpenFile(*eventsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Errorf("open events file failed: %s", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+
+		sinks = append(sinks, sink.NewEventsSink(events.NewJSONSink(f)))
+	}
+
+	if *eventsWebhook != "" {
+		s, err := sink.NewWebhookSink(sink.WebhookConfig{URL: *eventsWebhook, Filter: *eventsWebhookFilter}, logger)
+		if err != nil {
+			logger.Errorf("configure events webhook failed: %s", err)
+			os.Exit(exitConfig)
+		}
+		defer func() {
+			s.Close()
+			if n := s.Dropped(); n > 0 {
+				logger.Warnf("%d events have not been delivered to webhook", n)
+			}
+		}()
+
+		sinks = append(sinks, s)
+	}
+
+	if *statsCSVFile != "" {
+		f, err := os.Create(*statsCSVFile)
+		if err != nil {
+			logger.Errorf("create stats file failed: %s", err)
+			os.Exit(1)
+		}
+		defer func() {
+			if err := f.Close(); err != nil {
+				logger.Warnf("close stats file failed: %s", err)
+			}
+		}()
+
+		s, err := sink.NewCSVSink(f)
+		if err != nil {
+			logger.Errorf("write stats file failed: %s", err)
+			os.Exit(1)
+		}
+		sinks = append(sinks, s)
+	}
+
+	if *resultsFile != "" {
+		f, err := os.OpenFile(*resultsFile, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Errorf("open results file failed: %s", err)
+			os.Exit(1)
+		}
+		defer func() { _ = f.Close() }()
+
+		sinks = append(sinks, sink.NewJSONSink(f))
+	}
+
+	if *metricsListen != "" {
+		s := sink.NewPrometheusSink()
+		go func() {
+			err := http.ListenAndServe(*metricsListen, s)
+			if err != nil {
+				logger.Warnf("serve metrics failed: %s", err)
+			}
+		}()
+		sinks = append(sinks, s)
+	}
+
+	if *statsLog {
+		sinks = append(sinks, sink.NewLogSink(logger))
+	}
+
+	results := sink.Multi(sinks...)
+	if results != nil {
+		sink.Set(results)
+		events.SetSink(sink.EventsWriter(results))
+	}
+
+	durations, err := parseWorkloadDurations(*workloadDurations)
+	if err != nil {
+		logger.Errorf("parse workloads durations failed: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	offsets, err := parseWorkloadDurations(*workloadOffsets)
+	if err != nil {
+		logger.Errorf("parse workloads offsets failed: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	databases, err := parseWorkerDatabases(*workerDatabases)
+	if err != nil {
+		logger.Errorf("parse workers databases failed: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	err = db.ValidateWorkerDatabases(databases, *jobs)
+	if err != nil {
+		logger.Errorf("invalid workers databases: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	// Role and search_path are applied by all workloads, including ones which are not aware of pooler mode.
+	err = db.ValidateRole(*poolerMode, *role)
+	if err != nil {
+		logger.Errorf("invalid role: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	err = db.ValidateSearchPath(*poolerMode, *searchPath)
+	if err != nil {
+		logger.Errorf("invalid search_path: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	conninfo, err := resolveConninfo(*postgresConninfo, *conninfoFile, os.Getenv)
+	if err != nil {
+		logger.Errorf("resolve conninfo failed: %s", err)
+		os.Exit(exitConfig)
+	}
+	logger.Debugf("using conninfo: %s", db.RedactConninfo(conninfo))
+
+	if *watchdogMultiple != 0 && *watchdogMultiple < 1 {
+		logger.Errorf("watchdog multiple must be zero or at least 1")
+		os.Exit(exitConfig)
+	}
+
+	if *compareConninfo != "" && *scenarioFile != "" {
+		logger.Errorf("comparison mode is not supported in scenario mode")
+		os.Exit(exitConfig)
+	}
+
+	var stream io.Writer
+	if *statsStream {
+		if *statsCSVInterval <= 0 {
+			logger.Errorf("streaming statistics requires positive --stats-csv.interval")
+			os.Exit(exitConfig)
+		}
+		stream = os.Stdout
+	}
+
+	statements, err := resolveStatements(*customsqlStatements, *customsqlFile)
+	if err != nil {
+		logger.Errorf("resolve custom statements failed: %s", err)
+		os.Exit(exitConfig)
+	}
+
+	if *listTargets {
+		err := runListTargets(context.Background(), os.Stdout, conninfo, *listTargetsTop)
+		if err != nil {
+			logger.Errorf("list targets failed: %s", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	// Log the seed, so the run could be reproduced.
+	if *seed == 0 {
+		*seed = random.NewSeed()
+	}
+	logger.Infof("using seed %d", *seed)
 
 	config := config{
 		logger:                logger,
-		postgresConninfo:      *postgresConninfo,
+		postgresConninfo:      conninfo,
+		compareConninfo:       *compareConninfo,
+		poolerMode:            *poolerMode,
+		role:                  *role,
+		searchPath:            *searchPath,
+		poolAcquireTimeout:    *poolAcquireTimeout,
+		requireDatabaseName:   *requireDatabaseName,
+		cleanStart:            *cleanStart,
+		allowDestructive:      *allowDestructive,
+		force:                 *force,
+		workerDatabases:       databases,
 		jobs:                  *jobs,
 		duration:              *duration,
+		seed:                  *seed,
+		scheduler:             *scheduler,
+		schedulerBurstOn:      *schedulerBurstOn,
+		schedulerBurstOff:     *schedulerBurstOff,
+		cleanupTimeout:        *cleanupTimeout,
+		watchdogMultiple:      *watchdogMultiple,
+		warmupConns:           *warmupConns,
+		summaryJSON:           *summaryJSON,
+		configFile:            *configFile,
+		sink:                  results,
+		statsInterval:         *statsCSVInterval,
+		statsStream:           stream,
+		scenario:              *scenarioFile,
+		adaptive:              *adaptiveMode,
+		adaptiveThreshold:     *adaptiveThreshold,
+		adaptivePollInterval:  *adaptivePollInterval,
+		adaptiveQuery:         *adaptiveQuery,
 		idleXacts:             *idleXacts,
 		idleXactsNaptimeMin:   *idleXactsNaptimeMin,
 		idleXactsNaptimeMax:   *idleXactsNaptimeMax,
+		idleXactsDistribution: *idleXactsDistribution,
+		idleXactsWeight:       *idleXactsWeight,
+		idleXactsHoldLock:     *idleXactsHoldLock,
+		idleXactsIsolation:    *idleXactsIsolation,
+		idleXactsWakeInterval: *idleXactsWakeInterval,
+		idleXactsCommitTemp:   *idleXactsCommitTemp,
 		rollbacks:             *rollbacks,
 		rollbacksRate:         *rollbacksRate,
+		rollbacksWeight:       *rollbacksWeight,
+		rollbacksSQLStates:    *rollbacksSQLStates,
+		rollbacksStrict:       *rollbacksStrict,
 		waitXacts:             *waitXacts,
 		waitXactsFixture:      *waitXactsFixture,
 		waitXactsLocktimeMin:  *waitXactsLocktimeMin,
 		waitXactsLocktimeMax:  *waitXactsLocktimeMax,
+		waitXactsNoFallback:   *waitXactsNoFallback,
+		waitXactsIsolation:    *waitXactsIsolation,
+		waitXactsWeight:       *waitXactsWeight,
 		deadlocks:             *deadlocks,
+		deadlocksLockDelay:    *deadlocksLockDelay,
+		deadlocksIsolation:    *deadlocksIsolation,
+		deadlocksWeight:       *deadlocksWeight,
+		deadlocksTable:        *deadlocksTable,
+		deadlocksPayloadSize:  *deadlocksPayloadSize,
 		tempFiles:             *tempFiles,
 		tempFilesRate:         *tempFilesRate,
+		tempFilesWeight:       *tempFilesWeight,
+		tempFilesQuery:        *tempFilesQuery,
+		tempFilesSampleInt:    *tempFilesSampleInt,
+		tempFilesExceedLimit:  *tempFilesExceedLimit,
+		tempFilesMaxInflight:  *tempFilesMaxInflight,
 		terminate:             *terminate,
 		terminateRate:         *terminateRate,
 		terminateInterval:     *terminateInterval,
@@ -82,46 +469,138 @@ func main() {
 		terminateUser:         *terminateUser,
 		terminateDatabase:     *terminateDatabase,
 		terminateAppName:      *terminateAppName,
+		terminateEscalate:     *terminateEscalate,
+		terminateEscalateWait: *terminateEscalateWait,
+		terminateMaxTotal:     *terminateMaxTotal,
+		terminateSnapshot:     *terminateSnapshot,
 		failconns:             *failconns,
+		failconnsHoldTime:     *failconnsHoldTime,
+		failconnsReleaseRatio: *failconnsReleaseRatio,
+		failconnsInterval:     *failconnsInterval,
+		failconnsMinInterval:  *failconnsMinInterval,
+		failconnsGrowFactor:   *failconnsGrowFactor,
+		failconnsShrinkFactor: *failconnsShrinkFactor,
+		failconnsCapacity:     *failconnsCapacity,
 		forkconns:             *forkconns,
 		forkconnsRate:         *forkconnsRate,
+		forkconnsWeight:       *forkconnsWeight,
+		hotrow:                *hotrow,
+		hotrowRate:            *hotrowRate,
+		hotrowWeight:          *hotrowWeight,
+		toastload:             *toastload,
+		toastloadRate:         *toastloadRate,
+		toastloadValueSizeKB:  *toastloadValueSizeKB,
+		toastloadWeight:       *toastloadWeight,
+		idleconns:             *idleconns,
+		idleconnsCount:        *idleconnsCount,
+		idleconnsKeepalive:    *idleconnsKeepalive,
+		plancacheload:         *plancacheload,
+		plancacheloadStmts:    *plancacheloadStmts,
+		plancacheloadRate:     *plancacheloadRate,
+		plancacheloadReplan:   *plancacheloadReplan,
+		plancacheloadWeight:   *plancacheloadWeight,
+		orphanload:            *orphanload,
+		orphanloadRate:        *orphanloadRate,
+		orphanloadWeight:      *orphanloadWeight,
+		poolerload:            *poolerload,
+		poolerloadClients:     *poolerloadClients,
+		poolerloadHoldTime:    *poolerloadHoldTime,
+		poolerloadAdminDB:     *poolerloadAdminDB,
+		checksumload:          *checksumload,
+		checksumloadInterval:  *checksumloadInterval,
+		checksumloadInspect:   *checksumloadInspect,
+		advisorylocks:         *advisorylocks,
+		advisorylocksKeySpace: *advisorylocksKeySpace,
+		advisorylocksHoldTime: *advisorylocksHoldTime,
+		advisorylocksWeight:   *advisorylocksWeight,
+		notifyload:            *notifyload,
+		notifyloadRate:        *notifyloadRate,
+		notifyloadPayloadSize: *notifyloadPayloadSize,
+		notifyloadChannel:     *notifyloadChannel,
+		notifyloadWeight:      *notifyloadWeight,
+		serialfailures:        *serialfailures,
+		serialfailuresRate:    *serialfailuresRate,
+		serialfailuresWeight:  *serialfailuresWeight,
+		customsql:             *customsql,
+		customsqlStatements:   statements,
+		customsqlRate:         *customsqlRate,
+		customsqlInXact:       *customsqlInXact,
+		customsqlWeight:       *customsqlWeight,
+		statsload:             *statsload,
+		statsloadRate:         *statsloadRate,
+		statsloadResetRatio:   *statsloadResetRatio,
+		statsloadAllowReset:   *statsloadAllowReset,
+		statsloadWeight:       *statsloadWeight,
+		walsenderload:         *walsenderload,
+		walsenderloadSlot:     *walsenderloadSlot,
+		walsenderloadStall:    *walsenderloadStall,
+		clientcancel:          *clientcancel,
+		clientcancelRate:      *clientcancelRate,
+		clientcancelAfterMin:  *clientcancelAfterMin,
+		clientcancelAfterMax:  *clientcancelAfterMax,
+		clientcancelWeight:    *clientcancelWeight,
+		diskfill:              *diskfill,
+		diskfillTargetSize:    *diskfillTargetSize,
+		diskfillRate:          *diskfillRate,
+		diskfillAllowFull:     *diskfillAllowFull,
+		logicaldecode:         *logicaldecode,
+		logicaldecodeSlot:     *logicaldecodeSlot,
+		logicaldecodeRate:     *logicaldecodeRate,
+		logicaldecodeWeight:   *logicaldecodeWeight,
+		analyzeload:           *analyzeload,
+		analyzeloadRate:       *analyzeloadRate,
+		analyzeloadTables:     *analyzeloadTables,
+		analyzeloadWeight:     *analyzeloadWeight,
+		workloadDurations:     durations,
+		workloadOffsets:       offsets,
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
+	err = validateScheduler(config)
+	if err != nil {
+		logger.Errorf("invalid scheduler settings: %s", err)
+		os.Exit(exitConfig)
+	}
 
-	var wg sync.WaitGroup
-	doExit := make(chan error, 2)
+	if *checkOnly {
+		err := runCheck(context.Background(), os.Stdout, config, logger)
+		if err != nil {
+			logger.Errorf("check failed: %s", err)
+			os.Exit(exitCode(err))
+		}
+		os.Exit(0)
+	}
 
-	// Run signal listener.
-	go func() {
-		doExit <- listenSignals()
-		cancel()
-	}()
+	signals := make(chan os.Signal, 2)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
 
-	// Run application.
-	wg.Add(1)
-	go func() {
-		doExit <- runApplication(ctx, config, logger)
-		cancel()
-		wg.Done()
-	}()
+	if *configFile != "" {
+		reload := make(chan os.Signal, 1)
+		signal.Notify(reload, syscall.SIGHUP)
+		config.reloadSignals = reload
+	}
 
-	// Waiting for signal or application done.
-	rc := <-doExit
+	// Run application, waiting for application done or shutdown.
+	forced, rc := runWithShutdown(context.Background(), signals, *shutdownGracePeriod, func(ctx context.Context) error {
+		return runApplication(ctx, config, logger)
+	})
 
-	// Waiting until goroutines finish.
-	wg.Wait()
+	if forced {
+		logger.Errorf("shutdown forced: %s", rc)
+		if tables := fixtures(config); len(tables) > 0 {
+			logger.Warnf("fixtures might be left behind, drop them manually: %s", strings.Join(tables, ", "))
+		}
+		os.Exit(exitFailure)
+	}
 
-	// Print last message and return.
-	if rc != nil {
-		logger.Infof("shutdown: %s", rc)
-	} else {
+	// Print last message and exit with code reflecting what happened.
+	code := exitCode(rc)
+	switch {
+	case rc == nil:
 		logger.Info("shutdown: done")
+	case code == exitOK:
+		logger.Infof("shutdown: %s", rc)
+	default:
+		logger.Errorf("shutdown: %s", rc)
+		os.Exit(code)
 	}
 }
-
-func listenSignals() error {
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, syscall.SIGINT, syscall.SIGTERM)
-	return fmt.Errorf("got %s", <-c)
-}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"regexp"
+	"strings"
+)
+
+// checkDatabaseName connects to Postgres and checks the name of connected database matches
+// passed pattern. This is a guardrail against running workloads on wrong database by mistake.
+func checkDatabaseName(ctx context.Context, conninfo string, pattern string) error {
+	conn, err := db.Connect(ctx, conninfo)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return verifyDatabaseName(ctx, conn, pattern)
+}
+
+// verifyDatabaseName checks the name of database used by connection matches passed regular expression.
+func verifyDatabaseName(ctx context.Context, conn db.Conn, pattern string) error {
+	re, err := regexp.Compile(pattern)
+	if err != nil {
+		return noisia.NewConfigError("RequireDatabaseName", noisia.ErrInvalidValue, "invalid database name pattern: %s", err)
+	}
+
+	rows, err := conn.Query(ctx, "SELECT current_database()")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var name string
+	for rows.Next() {
+		err = rows.Scan(&name)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	if !re.MatchString(name) {
+		return noisia.NewConfigError("RequireDatabaseName", noisia.ErrInvalidValue, "database '%s' doesn't match required pattern '%s', refuse to run", name, pattern)
+	}
+
+	return nil
+}
+
+// checkStandby connects to Postgres and checks passed workloads could be run against it. Workloads
+// which modify data can't be run against hot standby, refuse to run them instead of failing with
+// "cannot execute ... in a read-only transaction" errors in the middle of the run.
+func checkStandby(ctx context.Context, conninfo string, workloads []noisia.Workload) error {
+	// Don't connect when all workloads are read-only.
+	if len(writeWorkloads(workloads)) == 0 {
+		return nil
+	}
+
+	conn, err := db.Connect(ctx, conninfo)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	return verifyStandby(ctx, conn, workloads)
+}
+
+// verifyStandby returns error if Postgres used by connection is a hot standby and some of passed workloads modify data.
+func verifyStandby(ctx context.Context, conn db.Conn, workloads []noisia.Workload) error {
+	names := writeWorkloads(workloads)
+	if len(names) == 0 {
+		return nil
+	}
+
+	recovery, err := db.IsInRecovery(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	if recovery {
+		return fmt.Errorf("postgres is in recovery (hot standby), workloads modifying data can't be run: %s", strings.Join(names, ", "))
+	}
+
+	return nil
+}
+
+// verifyDestructive returns error if some of passed workloads are destructive and running them
+// is not acknowledged.
+func verifyDestructive(workloads []noisia.Workload, allowed bool) error {
+	if allowed {
+		return nil
+	}
+
+	names := destructiveWorkloads(workloads)
+	if len(names) == 0 {
+		return nil
+	}
+
+	return noisia.NewConfigError("AllowDestructive", noisia.ErrInvalidValue, "destructive workloads requested: %s; they affect other clients or the whole server, use --allow-destructive to confirm running them", strings.Join(names, ", "))
+}
+
+// verifyPoolerMode returns error if connection pooler works in transaction pooling mode and some of
+// passed workloads rely on session state, which is lost when server connection is returned to the pool.
+func verifyPoolerMode(workloads []noisia.Workload, mode string) error {
+	if mode != db.PoolerModeTransaction {
+		return nil
+	}
+
+	names := sessionWorkloads(workloads)
+	if len(names) == 0 {
+		return nil
+	}
+
+	return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "workloads relying on session state requested: %s; they don't work in transaction pooling mode, connect them to Postgres directly or use session pooling", strings.Join(names, ", "))
+}
+
+// destructiveWorkloads returns names of passed workloads which are destructive.
+func destructiveWorkloads(workloads []noisia.Workload) []string {
+	destructive := map[string]bool{}
+	for _, d := range noisia.Workloads() {
+		destructive[d.Name] = d.Destructive
+	}
+
+	var names []string
+	for _, w := range workloads {
+		if destructive[w.Name()] {
+			names = append(names, w.Name())
+		}
+	}
+
+	return names
+}
+
+// writeWorkloads returns names of passed workloads which modify data.
+func writeWorkloads(workloads []noisia.Workload) []string {
+	readOnly := map[string]bool{}
+	for _, d := range noisia.Workloads() {
+		readOnly[d.Name] = d.ReadOnly
+	}
+
+	var names []string
+	for _, w := range workloads {
+		if !readOnly[w.Name()] {
+			names = append(names, w.Name())
+		}
+	}
+
+	return names
+}
+
+// sessionWorkloads returns names of passed workloads which rely on session state.
+func sessionWorkloads(workloads []noisia.Workload) []string {
+	session := map[string]bool{}
+	for _, d := range noisia.Workloads() {
+		session[d.Name] = d.SessionDependent
+	}
+
+	var names []string
+	for _, w := range workloads {
+		if session[w.Name()] {
+			names = append(names, w.Name())
+		}
+	}
+
+	return names
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func Test_verifyDatabaseName(t *testing.T) {
+	testcases := []struct {
+		valid   bool
+		name    string
+		pattern string
+	}{
+		{valid: true, name: "noisia_fixtures", pattern: "^noisia_"},
+		{valid: true, name: "test", pattern: "^(test|staging)$"},
+		{valid: false, name: "production", pattern: "^noisia_"},
+		{valid: false, name: "test", pattern: "^(invalid"},
+	}
+
+	for _, tc := range testcases {
+		err := verifyDatabaseName(context.Background(), &nameConn{name: tc.name}, tc.pattern)
+		if tc.valid {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+			assert.Equal(t, exitConfig, exitCode(err))
+		}
+	}
+}
+
+func Test_runApplication_requireDatabaseName(t *testing.T) {
+	c := config{
+		postgresConninfo:    db.TestConninfo,
+		requireDatabaseName: "^production_only$",
+		rollbacks:           true,
+		rollbacksRate:       1,
+		jobs:                1,
+	}
+
+	err := runApplication(context.Background(), c, log.NewDefaultLogger("error"))
+	assert.Error(t, err)
+	assert.Equal(t, exitConfig, exitCode(err))
+}
+
+func Test_verifyStandby(t *testing.T) {
+	write := []noisia.Workload{fakeWorkload{name: "terminate"}, fakeWorkload{name: "rollbacks"}}
+	readOnly := []noisia.Workload{fakeWorkload{name: "terminate"}, fakeWorkload{name: "forkconns"}}
+
+	// Write workloads fail preflight against standby.
+	err := verifyStandby(context.Background(), &recoveryConn{recovery: true}, write)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "rollbacks")
+	assert.NotContains(t, err.Error(), "terminate")
+
+	assert.NoError(t, verifyStandby(context.Background(), &recoveryConn{recovery: true}, readOnly))
+	assert.NoError(t, verifyStandby(context.Background(), &recoveryConn{recovery: false}, write))
+}
+
+func Test_verifyDestructive(t *testing.T) {
+	destructive := []noisia.Workload{fakeWorkload{name: "rollbacks"}, fakeWorkload{name: "terminate"}}
+	safe := []noisia.Workload{fakeWorkload{name: "rollbacks"}, fakeWorkload{name: "idlexacts"}}
+
+	// Destructive workloads are refused without acknowledgment.
+	err := verifyDestructive(destructive, false)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "terminate")
+	assert.NotContains(t, err.Error(), "rollbacks")
+	assert.Contains(t, err.Error(), "--allow-destructive")
+	assert.Equal(t, exitConfig, exitCode(err))
+
+	assert.NoError(t, verifyDestructive(destructive, true))
+	assert.NoError(t, verifyDestructive(safe, false))
+}
+
+func Test_verifyPoolerMode(t *testing.T) {
+	session := []noisia.Workload{fakeWorkload{name: "rollbacks"}, fakeWorkload{name: "plancacheload"}, fakeWorkload{name: "idleconns"}}
+	safe := []noisia.Workload{fakeWorkload{name: "rollbacks"}, fakeWorkload{name: "tempfiles"}}
+
+	// Session-dependent workloads are refused in transaction pooling mode.
+	err := verifyPoolerMode(session, db.PoolerModeTransaction)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "plancacheload, idleconns")
+	assert.NotContains(t, err.Error(), "rollbacks")
+	assert.Equal(t, exitConfig, exitCode(err))
+
+	assert.NoError(t, verifyPoolerMode(session, db.PoolerModeSession))
+	assert.NoError(t, verifyPoolerMode(session, ""))
+	assert.NoError(t, verifyPoolerMode(safe, db.PoolerModeTransaction))
+}
+
+func Test_runApplication_poolerMode(t *testing.T) {
+	c := config{
+		postgresConninfo:   db.TestConninfo,
+		poolerMode:         db.PoolerModeTransaction,
+		plancacheload:      true,
+		plancacheloadStmts: 10,
+		plancacheloadRate:  1,
+		jobs:               1,
+		duration:           100 * time.Millisecond,
+	}
+
+	// Workload is refused before connecting to Postgres.
+	err := runApplication(context.Background(), c, log.NewDefaultLogger("error"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "workloads relying on session state requested: plancacheload")
+}
+
+func Test_runApplication_destructive(t *testing.T) {
+	c := config{
+		postgresConninfo:  db.TestConninfo,
+		terminate:         true,
+		terminateRate:     1,
+		terminateInterval: time.Second,
+		jobs:              1,
+		duration:          100 * time.Millisecond,
+	}
+
+	// Workload is refused before connecting to Postgres.
+	err := runApplication(context.Background(), c, log.NewDefaultLogger("error"))
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "destructive workloads requested: terminate")
+
+	c.allowDestructive = true
+	assert.NoError(t, runApplication(context.Background(), c, log.NewDefaultLogger("error")))
+}
+
+// recoveryConn implements db.Conn interface and returns predefined result of pg_is_in_recovery().
+type recoveryConn struct {
+	nameConn
+	recovery bool
+}
+
+func (c *recoveryConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return &recoveryRows{recovery: c.recovery}, nil
+}
+
+// recoveryRows implements db.Rows interface with single row containing recovery status.
+type recoveryRows struct {
+	nameRows
+	recovery bool
+}
+
+func (r *recoveryRows) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = r.recovery
+	return nil
+}
+
+func Test_runApplication_cleanStart(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// Stale fixture left by previous run.
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS _noisia_hotrow_workload (id int)")
+	assert.NoError(t, err)
+
+	// Forkconns doesn't use fixtures, so the table could be dropped only at start.
+	c := config{
+		postgresConninfo: db.TestConninfo,
+		cleanStart:       true,
+		forkconns:        true,
+		forkconnsRate:    1,
+		jobs:             1,
+		duration:         time.Second,
+	}
+	assert.NoError(t, runApplication(context.Background(), c, log.NewDefaultLogger("error")))
+
+	rows, err := pool.Query(context.Background(), "SELECT to_regclass('_noisia_hotrow_workload') IS NULL")
+	assert.NoError(t, err)
+
+	var dropped bool
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&dropped))
+	}
+	rows.Close()
+	assert.True(t, dropped)
+}
+
+// nameConn implements db.Conn interface and returns predefined database name.
+type nameConn struct {
+	name string
+}
+
+func (c *nameConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *nameConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (c *nameConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return &nameRows{name: c.name}, nil
+}
+
+func (c *nameConn) Close() error {
+	return nil
+}
+
+// nameRows implements db.Rows interface with single row containing database name.
+type nameRows struct {
+	name string
+	done bool
+}
+
+func (r *nameRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *nameRows) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = r.name
+	return nil
+}
+
+func (r *nameRows) Err() error {
+	return nil
+}
+
+func (r *nameRows) Close() {}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+	"strconv"
+	"strings"
+)
+
+// rateSetter defines workload which rate could be changed while it is running.
+type rateSetter interface {
+	SetRate(r float64) error
+}
+
+// jobsSetter defines workload which number of workers could be changed while it is running.
+type jobsSetter interface {
+	SetJobs(jobs uint16) error
+}
+
+// reloadableRates defines flags of rates which could be changed on running workloads, mapped to workloads names.
+var reloadableRates = map[string]string{
+	"forkconns.rate": "forkconns",
+	"rollbacks.rate": "rollbacks",
+	"tempfiles.rate": "tempfiles",
+	"terminate.rate": "terminate",
+}
+
+// readConfigFile reads flags from config file, one flag per line, and returns values of flags by names.
+func readConfigFile(path string) (map[string]string, error) {
+	args, err := kingpin.ExpandArgsFromFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return parseFlagArgs(args)
+}
+
+// parseFlagArgs parses flags specified as '--name=value' or '--name' (boolean flags) and returns values
+// of flags by names.
+func parseFlagArgs(args []string) (map[string]string, error) {
+	values := make(map[string]string, len(args))
+	for _, arg := range args {
+		if !strings.HasPrefix(arg, "--") {
+			return nil, fmt.Errorf("invalid flag '%s', expected --name=value", arg)
+		}
+
+		parts := strings.SplitN(strings.TrimPrefix(arg, "--"), "=", 2)
+		if len(parts) == 1 {
+			values[parts[0]] = "true"
+		} else {
+			values[parts[0]] = parts[1]
+		}
+	}
+
+	return values, nil
+}
+
+// watchReload re-reads config file on each reload signal and applies changed settings to running
+// workloads, until context is done.
+func watchReload(ctx context.Context, c config, workloads []noisia.Workload, log log.Logger) {
+	path := c.configFile
+	prev, err := readConfigFile(path)
+	if err != nil {
+		log.Warnf("read config file failed: %s", err)
+	}
+
+	for {
+		select {
+		case <-c.reloadSignals:
+			next, err := readConfigFile(path)
+			if err != nil {
+				log.Warnf("reload config file failed: %s", err)
+				continue
+			}
+
+			log.Infof("reload config file %s", path)
+			applyReload(c, prev, next, workloads, log)
+			prev = next
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// applyReload applies flags which values have been changed to running workloads. Only rates, jobs
+// and weights could be changed, changes of other flags are ignored. Passed config defines settings
+// used at startup.
+func applyReload(c config, prev, next map[string]string, workloads []noisia.Workload, log log.Logger) {
+	var jobsChanged bool
+	for name, value := range next {
+		if prev[name] == value {
+			continue
+		}
+
+		switch {
+		case name == "jobs" || strings.HasSuffix(name, ".weight"):
+			jobsChanged = true
+		case reloadableRates[name] != "":
+			r, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				log.Warnf("invalid value of %s: %s, ignored", name, err)
+				continue
+			}
+
+			for _, w := range workloads {
+				if s, ok := unwrapWorkload(w).(rateSetter); ok && w.Name() == reloadableRates[name] {
+					err := s.SetRate(r)
+					if err != nil {
+						log.Warnf("set rate of %s workload failed: %s", w.Name(), err)
+						continue
+					}
+					log.Infof("rate of %s workload changed to %g", w.Name(), r)
+				}
+			}
+		default:
+			log.Warnf("%s could not be changed without restart, ignored", name)
+		}
+	}
+
+	if jobsChanged {
+		err := reloadJobs(c, next, workloads, log)
+		if err != nil {
+			log.Warnf("%s, jobs are not changed", err)
+		}
+	}
+}
+
+// reloadJobs splits jobs budget between running workloads accordingly to their weights in the same
+// way as at startup, and applies the split to workloads which support it. Budget and weights
+// missing in reloaded flags are taken from passed config.
+func reloadJobs(c config, next map[string]string, workloads []noisia.Workload, log log.Logger) error {
+	budget := c.jobs
+	if value, ok := next["jobs"]; ok {
+		v, err := strconv.ParseUint(value, 10, 16)
+		if err != nil {
+			return fmt.Errorf("invalid value of jobs: %s", err)
+		}
+		budget = uint16(v)
+	}
+
+	if budget < 1 {
+		return fmt.Errorf("jobs must be greater than zero")
+	}
+
+	err := db.ValidateWorkerDatabases(c.workerDatabases, budget)
+	if err != nil {
+		return err
+	}
+
+	// In scenario mode each workload runs with the whole budget.
+	shares := map[string]uint16{}
+	if c.scenario == "" {
+		entries := enabledWorkloads(c)
+		for i := range entries {
+			value, ok := next[weightFlag(entries[i].name)]
+			if !ok {
+				continue
+			}
+
+			v, err := strconv.ParseUint(value, 10, 16)
+			if err != nil {
+				return fmt.Errorf("invalid value of %s: %s", weightFlag(entries[i].name), err)
+			}
+			entries[i].weight = uint16(v)
+		}
+
+		for i, n := range distributeJobs(budget, entries) {
+			shares[entries[i].name] = n
+		}
+
+		// Workloads get databases of workers within their startup share only, additional workers
+		// would connect to the default database instead of mapped one.
+		initial := enabledWorkloads(c)
+		for i, n := range distributeJobs(c.jobs, initial) {
+			name := initial[i].name
+			if shares[name] > n && len(c.workerDatabases) > int(n) && mapsWorkerDatabases(name) {
+				return fmt.Errorf("jobs of %s workload could not be increased over %d, databases are mapped to %d workers, restart is required", name, n, len(c.workerDatabases))
+			}
+		}
+	}
+
+	for _, w := range workloads {
+		s, ok := unwrapWorkload(w).(jobsSetter)
+		if !ok {
+			continue
+		}
+
+		jobs, ok := shares[w.Name()]
+		if !ok {
+			jobs = budget
+		}
+
+		err := s.SetJobs(jobs)
+		if err != nil {
+			log.Warnf("set jobs of %s workload failed: %s", w.Name(), err)
+			continue
+		}
+		log.Infof("jobs of %s workload changed to %d", w.Name(), jobs)
+	}
+
+	return nil
+}
+
+// mapsWorkerDatabases returns true if workload with passed name connects workers to mapped databases.
+func mapsWorkerDatabases(name string) bool {
+	for _, d := range noisia.Workloads() {
+		if d.Name != name {
+			continue
+		}
+		for _, f := range d.Fields {
+			if f.Name == "Databases" {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// weightFlag returns name of the flag which defines weight of workload with passed name.
+func weightFlag(name string) string {
+	switch name {
+	case "idlexacts":
+		return "idle-xacts.weight"
+	case "waitxacts":
+		return "wait-xacts.weight"
+	default:
+		return name + ".weight"
+	}
+}
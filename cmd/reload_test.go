@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_parseFlagArgs(t *testing.T) {
+	got, err := parseFlagArgs([]string{"--rollbacks", "--rollbacks.rate=10", "--jobs=4", "--rollbacks.sqlstate=a=b"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"rollbacks": "true", "rollbacks.rate": "10", "jobs": "4", "rollbacks.sqlstate": "a=b"}, got)
+
+	_, err = parseFlagArgs([]string{"rollbacks.rate"})
+	assert.Error(t, err)
+}
+
+func Test_readConfigFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "noisia.flags")
+	assert.NoError(t, os.WriteFile(path, []byte("--rollbacks\n--rollbacks.rate=5\n"), 0600))
+
+	got, err := readConfigFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"rollbacks": "true", "rollbacks.rate": "5"}, got)
+
+	_, err = readConfigFile(filepath.Join(dir, "missing"))
+	assert.Error(t, err)
+}
+
+// tunableWorkload implements noisia.Workload which records changes of rate and jobs.
+type tunableWorkload struct {
+	name string
+	rate float64
+	jobs uint16
+}
+
+func (w *tunableWorkload) Run(context.Context) error { return nil }
+func (w *tunableWorkload) Name() string              { return w.name }
+func (w *tunableWorkload) Stats() noisia.Stats       { return noisia.Stats{} }
+func (w *tunableWorkload) SetRate(r float64) error {
+	if r <= 0 {
+		return errors.New("invalid rate")
+	}
+	w.rate = r
+	return nil
+}
+func (w *tunableWorkload) SetJobs(jobs uint16) error { w.jobs = jobs; return nil }
+
+func Test_applyReload(t *testing.T) {
+	rollbacks := &tunableWorkload{name: "rollbacks", rate: 1, jobs: 1}
+	tempfiles := &tunableWorkload{name: "tempfiles", rate: 1, jobs: 1}
+	workloads := []noisia.Workload{rollbacks, tempfiles, fakeWorkload{name: "idlexacts"}}
+	c := config{jobs: 1, rollbacks: true, tempFiles: true, idleXacts: true}
+
+	prev := map[string]string{"rollbacks.rate": "1", "tempfiles.rate": "1", "duration": "10s"}
+	next := map[string]string{"rollbacks.rate": "20", "tempfiles.rate": "1", "duration": "1m", "jobs": "3"}
+
+	applyReload(c, prev, next, workloads, log.NewDefaultLogger("error"))
+	assert.Equal(t, float64(20), rollbacks.rate)
+	assert.Equal(t, float64(1), tempfiles.rate)
+	assert.Equal(t, uint16(3), rollbacks.jobs)
+	assert.Equal(t, uint16(3), tempfiles.jobs)
+
+	// Invalid values are ignored.
+	applyReload(c, next, map[string]string{"rollbacks.rate": "0", "jobs": "invalid"}, workloads, log.NewDefaultLogger("error"))
+	assert.Equal(t, float64(20), rollbacks.rate)
+	assert.Equal(t, uint16(3), rollbacks.jobs)
+}
+
+func Test_applyReload_weights(t *testing.T) {
+	rollbacks := &tunableWorkload{name: "rollbacks", rate: 1}
+	tempfiles := &tunableWorkload{name: "tempfiles", rate: 1}
+	idlexacts := &tunableWorkload{name: "idlexacts", rate: 1}
+	workloads := []noisia.Workload{idlexacts, rollbacks, tempfiles}
+	c := config{jobs: 8, rollbacks: true, rollbacksWeight: 3, tempFiles: true, tempFilesWeight: 1, idleXacts: true}
+
+	// Budget is split accordingly to weights specified at startup (unspecified weight is 1).
+	applyReload(c, map[string]string{"jobs": "8"}, map[string]string{"jobs": "10"}, workloads, log.NewDefaultLogger("error"))
+	assert.Equal(t, uint16(6), rollbacks.jobs)
+	assert.Equal(t, uint16(2), tempfiles.jobs)
+	assert.Equal(t, uint16(2), idlexacts.jobs)
+
+	// Reloaded weights take precedence.
+	applyReload(c, map[string]string{"jobs": "10"}, map[string]string{"jobs": "10", "idle-xacts.weight": "3"}, workloads, log.NewDefaultLogger("error"))
+	assert.Equal(t, uint16(4), rollbacks.jobs)
+	assert.Equal(t, uint16(2), tempfiles.jobs)
+	assert.Equal(t, uint16(4), idlexacts.jobs)
+
+	// Budget smaller than mapping of workers to databases is refused.
+	c.workerDatabases = []string{"db1", "db1", "db2"}
+	applyReload(c, map[string]string{"jobs": "10"}, map[string]string{"jobs": "2"}, workloads, log.NewDefaultLogger("error"))
+	assert.Equal(t, uint16(4), rollbacks.jobs)
+}
+
+func Test_reloadJobs_databases(t *testing.T) {
+	rollbacks := &tunableWorkload{name: "rollbacks", jobs: 2}
+	idlexacts := &tunableWorkload{name: "idlexacts", jobs: 2}
+	workloads := []noisia.Workload{idlexacts, rollbacks}
+	c := config{jobs: 4, rollbacks: true, rollbacksWeight: 1, idleXacts: true, idleXactsWeight: 1, workerDatabases: []string{"db1", "db2", "db3"}}
+
+	// Rollbacks got databases of two workers at startup, the third mapped database would be lost.
+	assert.Error(t, reloadJobs(c, map[string]string{"jobs": "6"}, workloads, log.NewDefaultLogger("error")))
+	assert.Equal(t, uint16(2), rollbacks.jobs)
+	assert.Equal(t, uint16(2), idlexacts.jobs)
+
+	// Workload without mapped databases could grow.
+	assert.NoError(t, reloadJobs(c, map[string]string{"jobs": "6", "rollbacks.weight": "1", "idle-xacts.weight": "2"}, workloads, log.NewDefaultLogger("error")))
+	assert.Equal(t, uint16(2), rollbacks.jobs)
+	assert.Equal(t, uint16(4), idlexacts.jobs)
+
+	// All mapped databases have been passed at startup.
+	c.workerDatabases = []string{"db1", "db2"}
+	assert.NoError(t, reloadJobs(c, map[string]string{"jobs": "6"}, workloads, log.NewDefaultLogger("error")))
+	assert.Equal(t, uint16(3), rollbacks.jobs)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"os"
+	"time"
+)
+
+// signalError describes shutdown requested by signal, it is not considered as a failure.
+type signalError struct {
+	sig os.Signal
+}
+
+func (e signalError) Error() string {
+	return fmt.Sprintf("got %s", e.sig)
+}
+
+// runWithShutdown runs passed function and handles shutdown signals in two phases. The first
+// signal cancels context passed to the function and waits until the function returns, giving
+// workloads time for cleaning up fixtures. If the function doesn't return within the grace
+// period or the second signal is received, shutdown is forced. Returns whether shutdown has
+// been forced and the reason of shutdown, error returned by the function takes precedence over the signal.
+func runWithShutdown(ctx context.Context, signals <-chan os.Signal, grace time.Duration, run func(context.Context) error) (bool, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	done := make(chan error, 1)
+	go func() {
+		done <- run(ctx)
+	}()
+
+	var rc error
+	select {
+	case err := <-done:
+		return false, err
+	case sig := <-signals:
+		rc = signalError{sig: sig}
+		cancel()
+	}
+
+	t := time.NewTimer(grace)
+	defer t.Stop()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			return false, err
+		}
+		return false, rc
+	case sig := <-signals:
+		return true, fmt.Errorf("got %s again", sig)
+	case <-t.C:
+		return true, fmt.Errorf("cleanup not finished within %s", grace)
+	}
+}
+
+// fixtures returns tables created by enabled workloads, these tables might be left behind
+// when shutdown is forced. In scenario mode fixtures of all workloads are returned.
+func fixtures(c config) []string {
+	enabled := map[string]bool{
+		"checksumload":   c.checksumload && c.checksumloadInspect,
+		"deadlocks":      c.deadlocks,
+		"diskfill":       c.diskfill,
+		"hotrow":         c.hotrow,
+		"logicaldecode":  c.logicaldecode,
+		"rollbacks":      c.rollbacks,
+		"serialfailures": c.serialfailures,
+		"toastload":      c.toastload,
+		"waitxacts":      c.waitXacts,
+	}
+
+	var tables []string
+	for _, d := range noisia.Workloads() {
+		if c.scenario != "" || enabled[d.Name] {
+			// Working table of deadlocks workload could be renamed.
+			if d.Name == "deadlocks" && c.deadlocksTable != "" {
+				tables = append(tables, c.deadlocksTable)
+				continue
+			}
+			tables = append(tables, d.Fixtures...)
+		}
+	}
+
+	return tables
+}
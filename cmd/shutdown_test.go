@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func Test_runWithShutdown(t *testing.T) {
+	// Application finished itself.
+	forced, err := runWithShutdown(context.Background(), make(chan os.Signal), time.Second, func(context.Context) error { return nil })
+	assert.False(t, forced)
+	assert.NoError(t, err)
+
+	// First signal, application finished cleanup within grace period.
+	signals := make(chan os.Signal, 2)
+	signals <- syscall.SIGINT
+	forced, err = runWithShutdown(context.Background(), signals, time.Second, func(ctx context.Context) error {
+		<-ctx.Done()
+		return nil
+	})
+	assert.False(t, forced)
+	assert.EqualError(t, err, "got interrupt")
+
+	// First signal, application failed during cleanup.
+	signals = make(chan os.Signal, 2)
+	signals <- syscall.SIGINT
+	forced, err = runWithShutdown(context.Background(), signals, time.Second, func(ctx context.Context) error {
+		<-ctx.Done()
+		return errors.New("drop fixtures failed")
+	})
+	assert.False(t, forced)
+	assert.EqualError(t, err, "drop fixtures failed")
+
+	// Application is stuck, second signal forces shutdown.
+	signals = make(chan os.Signal, 2)
+	signals <- syscall.SIGINT
+	signals <- syscall.SIGTERM
+	stuck := make(chan struct{})
+	defer close(stuck)
+
+	forced, err = runWithShutdown(context.Background(), signals, time.Minute, func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	assert.True(t, forced)
+	assert.EqualError(t, err, "got terminated again")
+
+	// Application is stuck, grace period exceeded.
+	signals = make(chan os.Signal, 1)
+	signals <- syscall.SIGINT
+	forced, err = runWithShutdown(context.Background(), signals, 100*time.Millisecond, func(context.Context) error {
+		<-stuck
+		return nil
+	})
+	assert.True(t, forced)
+	assert.Error(t, err)
+}
+
+func Test_fixtures(t *testing.T) {
+	assert.Nil(t, fixtures(config{idleXacts: true}))
+	assert.Equal(t, []string{"_noisia_deadlocks_workload", "_noisia_waitxacts_workload"}, fixtures(config{deadlocks: true, waitXacts: true}))
+	assert.Len(t, fixtures(config{scenario: "timeline.json"}), 9)
+	assert.Equal(t, []string{"deadlocks_test"}, fixtures(config{deadlocks: true, deadlocksTable: "deadlocks_test"}))
+}
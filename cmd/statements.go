@@ -0,0 +1,33 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+// resolveStatements returns statements of custom SQL workload: statements specified with flags
+// followed by statements read from the file. The file contains one statement per line, empty
+// lines and comments starting with '--' are ignored.
+func resolveStatements(statements []string, file string) ([]string, error) {
+	if file == "" {
+		return statements, nil
+	}
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("read statements file failed: %w", err)
+	}
+
+	result := append([]string{}, statements...)
+	for _, line := range strings.Split(string(data), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "--") {
+			continue
+		}
+
+		result = append(result, line)
+	}
+
+	return result, nil
+}
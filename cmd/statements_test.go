@@ -0,0 +1,24 @@
+package main
+
+import (
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func Test_resolveStatements(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "statements.sql")
+	assert.NoError(t, os.WriteFile(file, []byte("-- harmless statements\nSELECT 1\n\n  SELECT pg_sleep(0.1)  \n"), 0600))
+
+	got, err := resolveStatements([]string{"SELECT now()"}, file)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SELECT now()", "SELECT 1", "SELECT pg_sleep(0.1)"}, got)
+
+	got, err = resolveStatements([]string{"SELECT now()"}, "")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"SELECT now()"}, got)
+
+	_, err = resolveStatements(nil, filepath.Join(t.TempDir(), "missing.sql"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/sink"
+	"io"
+	"sort"
+	"time"
+)
+
+// statsExporter records workloads statistics into sink, periodically and at the end of the run.
+// Periodic samples are also streamed into writer as JSON lines, if specified.
+type statsExporter struct {
+	s         sink.Sink
+	stream    io.Writer
+	workloads []noisia.Workload
+	cancel    context.CancelFunc
+	done      chan struct{}
+}
+
+// startStatsExport starts recording statistics of passed workloads into sink and streaming them
+// into writer each interval, zero interval disables periodic samples. Nil is returned if neither
+// sink nor stream is specified.
+func startStatsExport(ctx context.Context, s sink.Sink, stream io.Writer, interval time.Duration, workloads []noisia.Workload, log log.Logger) (*statsExporter, error) {
+	if s == nil && stream == nil {
+		return nil, nil
+	}
+
+	e := &statsExporter{s: s, stream: stream, workloads: workloads, done: make(chan struct{})}
+
+	ctx, e.cancel = context.WithCancel(ctx)
+	go func() {
+		defer close(e.done)
+		if interval <= 0 {
+			return
+		}
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case t := <-ticker.C:
+				err := e.sample(t)
+				if err != nil {
+					log.Warnf("write stats sample failed: %s", err)
+				}
+				err = e.streamSample(t)
+				if err != nil {
+					log.Warnf("stream stats sample failed: %s", err)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return e, nil
+}
+
+// stop stops periodic samples and records final statistics.
+func (e *statsExporter) stop() error {
+	if e == nil {
+		return nil
+	}
+
+	e.cancel()
+	<-e.done
+
+	return e.sample(time.Now())
+}
+
+// sample records current statistics of all workloads, one counter per metric.
+func (e *statsExporter) sample(t time.Time) error {
+	if e.s == nil {
+		return nil
+	}
+
+	for _, wl := range e.workloads {
+		stats := wl.Stats()
+
+		// Sort metrics for stable output.
+		metrics := make([]string, 0, len(stats))
+		for m := range stats {
+			metrics = append(metrics, m)
+		}
+		sort.Strings(metrics)
+
+		for _, m := range metrics {
+			err := e.s.RecordCounter(t, workloadLabel(wl), m, stats[m])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// statsLine defines single line of streamed statistics.
+type statsLine struct {
+	Time      time.Time         `json:"time"`
+	Workloads []workloadSummary `json:"workloads"`
+}
+
+// streamSample writes current statistics of all workloads into stream as a single JSON line.
+func (e *statsExporter) streamSample(t time.Time) error {
+	if e.stream == nil {
+		return nil
+	}
+
+	line := statsLine{Time: t, Workloads: make([]workloadSummary, 0, len(e.workloads))}
+	for _, wl := range e.workloads {
+		line.Workloads = append(line.Workloads, workloadSummary{Name: wl.Name(), Cluster: workloadCluster(wl), Stats: wl.Stats()})
+	}
+
+	data, err := json.Marshal(line)
+	if err != nil {
+		return err
+	}
+
+	// Write the whole line at once, so lines are not interleaved with other output.
+	_, err = e.stream.Write(append(data, '\n'))
+	return err
+}
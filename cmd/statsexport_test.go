@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func Test_startStatsExport(t *testing.T) {
+	workloads := []noisia.Workload{
+		fakeWorkload{name: "rollbacks", stats: noisia.Stats{"rollbacks": 10, "commits": 0}},
+		fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 2}},
+	}
+
+	buf := &bytes.Buffer{}
+	s, err := sink.NewCSVSink(buf)
+	assert.NoError(t, err)
+
+	e, err := startStatsExport(context.Background(), s, nil, 20*time.Millisecond, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	time.Sleep(50 * time.Millisecond)
+	assert.NoError(t, e.stop())
+
+	records, err := csv.NewReader(buf).ReadAll()
+	assert.NoError(t, err)
+
+	// Header, at least one periodic sample and final sample, 3 rows per sample.
+	assert.Equal(t, sink.CSVHeader, records[0])
+	assert.GreaterOrEqual(t, len(records), 1+3*2)
+	assert.Equal(t, 0, (len(records)-1)%3)
+
+	last := records[len(records)-3:]
+	assert.Equal(t, []string{"rollbacks", "commits", "0"}, last[0][1:])
+	assert.Equal(t, []string{"rollbacks", "rollbacks", "10"}, last[1][1:])
+	assert.Equal(t, []string{"terminate", "signalled", "2"}, last[2][1:])
+
+	for _, r := range records[1:] {
+		_, err := time.Parse(time.RFC3339, r[0])
+		assert.NoError(t, err)
+	}
+}
+
+func Test_startStatsExport_final(t *testing.T) {
+	workloads := []noisia.Workload{fakeWorkload{name: "hotrow", stats: noisia.Stats{"updates": 5}}}
+
+	// Without interval only final statistics are recorded.
+	r := &sink.Recorder{}
+	e, err := startStatsExport(context.Background(), r, nil, 0, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.NoError(t, e.stop())
+
+	records := r.Records("")
+	assert.Len(t, records, 1)
+	assert.Equal(t, sink.KindCounter, records[0].Kind)
+	assert.Equal(t, "hotrow", records[0].Workload)
+	assert.Equal(t, "updates", records[0].Name)
+	assert.Equal(t, int64(5), records[0].Value)
+
+	// Nothing is done if sink is not specified.
+	e, err = startStatsExport(context.Background(), nil, nil, time.Second, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Nil(t, e)
+	assert.NoError(t, e.stop())
+}
+
+func Test_startStatsExport_events(t *testing.T) {
+	// Events and statistics of workloads are written into the same composite sink.
+	r1, r2 := &sink.Recorder{}, &sink.Recorder{}
+	results := sink.Multi(r1, r2)
+	events.SetSink(sink.EventsWriter(results))
+	defer events.SetSink(nil)
+
+	workloads := []noisia.Workload{fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 1}}}
+	e, err := startStatsExport(context.Background(), results, nil, 0, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	events.Emit(context.Background(), "terminate", "terminated backend %d", 123)
+	assert.NoError(t, e.stop())
+
+	for _, r := range []*sink.Recorder{r1, r2} {
+		records := r.Records("")
+		assert.Len(t, records, 2)
+		assert.Equal(t, sink.KindEvent, records[0].Kind)
+		assert.Equal(t, "terminated backend 123", records[0].Action)
+		assert.Equal(t, sink.KindCounter, records[1].Kind)
+		assert.Equal(t, "signalled", records[1].Name)
+	}
+}
+
+// failSink implements sink.Sink interface which always fails.
+type failSink struct {
+	sink.Recorder
+}
+
+func (*failSink) RecordCounter(time.Time, string, string, int64) error {
+	return errors.New("disk full")
+}
+
+func Test_startStatsExport_error(t *testing.T) {
+	workloads := []noisia.Workload{fakeWorkload{name: "hotrow", stats: noisia.Stats{"updates": 5}}}
+
+	e, err := startStatsExport(context.Background(), &failSink{}, nil, 0, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.EqualError(t, e.stop(), "disk full")
+}
+
+// countingWorkload implements noisia.Workload interface which counter grows on every Stats call.
+type countingWorkload struct {
+	n int64
+}
+
+func (w *countingWorkload) Run(context.Context) error { return nil }
+func (w *countingWorkload) Name() string              { return "rollbacks" }
+func (w *countingWorkload) Stats() noisia.Stats {
+	return noisia.Stats{"rollbacks": atomic.AddInt64(&w.n, 1)}
+}
+
+func Test_startStatsExport_stream(t *testing.T) {
+	workloads := []noisia.Workload{&countingWorkload{}, fakeWorkload{name: "terminate", stats: noisia.Stats{"signalled": 2}}}
+
+	buf := &bytes.Buffer{}
+	e, err := startStatsExport(context.Background(), nil, buf, 10*time.Millisecond, workloads, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	time.Sleep(55 * time.Millisecond)
+	assert.NoError(t, e.stop())
+
+	// Each line is a single JSON object with statistics of all workloads, counters grow over time.
+	var lines []statsLine
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		var line statsLine
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		assert.False(t, line.Time.IsZero())
+		assert.Len(t, line.Workloads, 2)
+		assert.Equal(t, "terminate", line.Workloads[1].Name)
+		assert.Equal(t, noisia.Stats{"signalled": 2}, line.Workloads[1].Stats)
+		lines = append(lines, line)
+	}
+	assert.NoError(t, scanner.Err())
+	assert.GreaterOrEqual(t, len(lines), 2)
+
+	for i := 1; i < len(lines); i++ {
+		assert.Greater(t, lines[i].Workloads[0].Stats["rollbacks"], lines[i-1].Workloads[0].Stats["rollbacks"])
+	}
+}
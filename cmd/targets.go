@@ -0,0 +1,43 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/targeting"
+	"io"
+)
+
+// runListTargets connects to Postgres and prints tables which would be chosen by workloads.
+// Only read-only queries to statistics views are executed.
+func runListTargets(ctx context.Context, w io.Writer, conninfo string, n int) error {
+	pool, err := db.NewPostgresDB(ctx, conninfo)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	return printTargets(ctx, w, pool, n)
+}
+
+// printTargets prints top N tables selected by targeting functions with their statistics.
+func printTargets(ctx context.Context, w io.Writer, pool db.DB, n int) error {
+	stats, err := targeting.TopWriteTablesStats(ctx, pool, n)
+	if err != nil {
+		return fmt.Errorf("select top write tables failed: %s", err)
+	}
+
+	_, err = fmt.Fprintf(w, "top %d tables by writes (n_tup_upd + n_tup_del):\n", n)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats {
+		_, err = fmt.Fprintf(w, "  %s\tupdates: %d, deletes: %d, size: %d bytes\n", s.Table, s.Updates, s.Deletes, s.Size)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
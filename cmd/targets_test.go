@@ -0,0 +1,38 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_printTargets(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_targets (a int)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "INSERT INTO noisia_test_targets SELECT generate_series(1, 100000)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "UPDATE noisia_test_targets SET a = a + 1")
+	assert.NoError(t, err)
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_targets")
+		assert.NoError(t, err)
+	}()
+
+	// Wait until statistics is flushed into stats collector.
+	time.Sleep(1 * time.Second)
+
+	buf := &bytes.Buffer{}
+	assert.NoError(t, printTargets(context.Background(), buf, pool, 1))
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.True(t, strings.HasPrefix(strings.TrimSpace(lines[1]), `"public"."noisia_test_targets"`+"\tupdates: 100000, deletes: 0, size: "))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"github.com/lesovsky/noisia/log"
+	"os"
+	"strings"
+	"time"
+)
+
+// watchdogLimit returns max time allowed for the whole run with passed duration. The limit is
+// the duration multiplied by passed multiple, but not less than the duration plus two cleanup
+// timeouts, so workloads and the application have enough time for finishing their cleanups.
+// Zero multiple disables the watchdog, in this case zero is returned.
+func watchdogLimit(duration, cleanupTimeout time.Duration, multiple float64) time.Duration {
+	if multiple <= 0 || duration <= 0 {
+		return 0
+	}
+
+	limit := time.Duration(float64(duration) * multiple)
+	if floor := duration + 2*cleanupTimeout; limit < floor {
+		limit = floor
+	}
+
+	return limit
+}
+
+// startWatchdog starts timer which calls exit when the run is not finished within passed limit.
+// It catches workloads stuck in operations which ignore context (e.g. blocking queries), which
+// otherwise would run forever. Returned function stops the watchdog, it should be called when
+// the run is finished. Zero limit disables the watchdog.
+func startWatchdog(limit time.Duration, log log.Logger, exit func()) func() {
+	if limit <= 0 {
+		return func() {}
+	}
+
+	t := time.AfterFunc(limit, func() {
+		log.Errorf("watchdog: run is not finished within %s, force exit", limit)
+		exit()
+	})
+
+	return func() { t.Stop() }
+}
+
+// exitProcess terminates the process with passed exit code, it is replaced in tests.
+var exitProcess = os.Exit
+
+// watchdogExit returns function which is called when the watchdog fires. The function lists
+// fixtures which might be left behind and exits the process.
+func watchdogExit(c config, log log.Logger) func() {
+	return func() {
+		if tables := fixtures(c); len(tables) > 0 {
+			log.Warnf("fixtures might be left behind, drop them manually: %s", strings.Join(tables, ", "))
+		}
+		exitProcess(exitFailure)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func Test_watchdogLimit(t *testing.T) {
+	testcases := []struct {
+		duration time.Duration
+		cleanup  time.Duration
+		multiple float64
+		want     time.Duration
+	}{
+		{duration: time.Minute, cleanup: 10 * time.Second, multiple: 2, want: 2 * time.Minute},
+		{duration: 10 * time.Second, cleanup: 10 * time.Second, multiple: 2, want: 30 * time.Second},
+		{duration: time.Minute, cleanup: 10 * time.Second, multiple: 0, want: 0},
+		{duration: 0, cleanup: 10 * time.Second, multiple: 2, want: 0},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, watchdogLimit(tc.duration, tc.cleanup, tc.multiple))
+	}
+}
+
+// stuckWorkload implements noisia.Workload which ignores context and returns only when release is closed.
+type stuckWorkload struct {
+	fakeWorkload
+	release chan struct{}
+}
+
+func (w stuckWorkload) Run(context.Context) error {
+	<-w.release
+	return nil
+}
+
+func Test_runApplication_watchdog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scenario.json")
+	assert.NoError(t, os.WriteFile(path, []byte(`[{"start": "0s", "duration": "100ms", "workload": "forkconns"}]`), 0600))
+
+	// Workload ignores context, it is released when the watchdog exits.
+	release := make(chan struct{})
+	constructor := constructors["forkconns"]
+	constructors["forkconns"] = func(config, log.Logger) (noisia.Workload, error) {
+		return stuckWorkload{fakeWorkload: fakeWorkload{name: "forkconns"}, release: release}, nil
+	}
+	defer func() { constructors["forkconns"] = constructor }()
+
+	var code int
+	defer func() { exitProcess = os.Exit }()
+	exitProcess = func(c int) {
+		code = c
+		close(release)
+	}
+
+	c := config{scenario: path, cleanupTimeout: 50 * time.Millisecond, watchdogMultiple: 2}
+
+	start := time.Now()
+	assert.NoError(t, runApplication(context.Background(), c, log.NewDefaultLogger("error")))
+	assert.Equal(t, exitFailure, code)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(200*time.Millisecond))
+}
+
+func Test_startWatchdog(t *testing.T) {
+	logger := log.NewDefaultLogger("error")
+	c := config{duration: 50 * time.Millisecond}
+
+	// Run finished in time, stopped watchdog doesn't fire.
+	stop := startWatchdog(100*time.Millisecond, logger, func() { t.Error("stopped watchdog fired") })
+	assert.NoError(t, runWorkloads(context.Background(), c, []noisia.Workload{fakeWorkload{name: "rollbacks"}}, logger))
+	stop()
+	time.Sleep(200 * time.Millisecond)
+
+	// Zero limit disables watchdog.
+	startWatchdog(0, logger, func() { t.Error("disabled watchdog fired") })()
+}
@@ -0,0 +1,179 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package customsql defines implementation of workload which executes SQL statements
+// provided by user. This allows reproducing arbitrary stress patterns without changes
+// of noisia code.
+//
+// The necessary number of workers is started (accordingly to Config.Jobs). Each worker
+// executes all statements specified in Config.Statements one by one, accordingly to rate
+// specified in Config.Rate. If Config.InTransaction is set, statements are executed
+// within single transaction which is committed when all statements succeed. Failed
+// executions are counted and logged, the workload continues.
+package customsql
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/workerpool"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// Config defines configuration settings for custom SQL workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for executing statements.
+	Jobs uint16
+	// Rate defines how many times statements are executed per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Statements defines SQL statements executed by the workload in specified order.
+	Statements []string
+	// InTransaction defines to execute statements within single transaction.
+	InTransaction bool
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if len(c.Statements) == 0 {
+		return noisia.NewConfigError("Statements", noisia.ErrInvalidValue, "at least one statement must be specified")
+	}
+
+	for i, s := range c.Statements {
+		if strings.TrimSpace(s) == "" {
+			return noisia.NewConfigError("Statements", noisia.ErrInvalidValue, "statement %d is empty", i+1)
+		}
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// executions defines number of successful executions of all statements.
+	executions int64
+	// errors defines number of failed executions.
+	errors int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "customsql"
+}
+
+// Stats returns counters of successful and failed executions of statements.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"executions": atomic.LoadInt64(&w.stats.executions),
+		"errors":     atomic.LoadInt64(&w.stats.errors),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		ratelimit.RunWorker(ctx, w.config.Rate, w.config.Scheduler, i, func(ctx context.Context) error {
+			err := execStatements(ctx, pool, w.config.Statements, w.config.InTransaction)
+			if err != nil {
+				if ctx.Err() == nil {
+					atomic.AddInt64(&w.stats.errors, 1)
+				}
+				return err
+			}
+
+			atomic.AddInt64(&w.stats.executions, 1)
+			return nil
+		}, w.logger)
+	})
+
+	w.logger.Infof("customsql finished: %d executions, %d errors", atomic.LoadInt64(&w.stats.executions), atomic.LoadInt64(&w.stats.errors))
+
+	return nil
+}
+
+// execStatements executes passed statements one by one, optionally within single transaction.
+func execStatements(ctx context.Context, pool db.DB, statements []string, inTransaction bool) error {
+	if !inTransaction {
+		return execAll(ctx, pool, statements)
+	}
+
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	err = execAll(ctx, tx, statements)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// execAll executes passed statements one by one, stops on the first failed statement.
+func execAll(ctx context.Context, e db.Execer, statements []string) error {
+	for i, s := range statements {
+		_, _, err := e.Exec(ctx, s)
+		if err != nil {
+			return fmt.Errorf("statement %d failed: %s", i+1, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,116 @@
+package customsql
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1, Statements: []string{"SELECT 1"}}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0, Statements: []string{"SELECT 1"}}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1", " "}}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}, Role: "app", SearchPath: "app, public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}, SearchPath: "app,"}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}, PoolAcquireTimeout: time.Second}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}, PoolAcquireTimeout: -time.Second}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{
+		Conninfo:      db.TestConninfo,
+		Jobs:          2,
+		Rate:          10,
+		Statements:    []string{"SELECT 1", "SELECT pg_sleep(0.01)"},
+		InTransaction: true,
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["executions"], int64(0))
+	assert.Equal(t, int64(0), w.Stats()["errors"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1, Statements: []string{"SELECT 1"}}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "customsql", w.Name())
+}
+
+func Test_execStatements(t *testing.T) {
+	statements := []string{"SELECT 1", "SELECT 2"}
+
+	// Without transaction statements are executed by pool.
+	pool := &recordDB{tx: &recordTx{}}
+	assert.NoError(t, execStatements(context.Background(), pool, statements, false))
+	assert.Equal(t, statements, pool.queries)
+	assert.Len(t, pool.tx.queries, 0)
+
+	// In transaction statements are executed within transaction which is committed.
+	pool = &recordDB{tx: &recordTx{}}
+	assert.NoError(t, execStatements(context.Background(), pool, statements, true))
+	assert.Len(t, pool.queries, 0)
+	assert.Equal(t, statements, pool.tx.queries)
+	assert.True(t, pool.tx.committed)
+
+	// Execution stops on the first failed statement, transaction is not committed.
+	pool = &recordDB{tx: &recordTx{err: errors.New("syntax error")}}
+	assert.Error(t, execStatements(context.Background(), pool, statements, true))
+	assert.Equal(t, []string{"SELECT 1"}, pool.tx.queries)
+	assert.False(t, pool.tx.committed)
+}
+
+// recordTx implements db.Tx interface, records executed queries and returns configured error.
+type recordTx struct {
+	queries   []string
+	err       error
+	committed bool
+}
+
+func (tx *recordTx) Commit(context.Context) error {
+	tx.committed = true
+	return nil
+}
+func (tx *recordTx) Rollback(context.Context) error { return nil }
+func (tx *recordTx) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	tx.queries = append(tx.queries, sql)
+	return 0, "", tx.err
+}
+func (tx *recordTx) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+
+// recordDB implements db.DB interface, records executed queries and returns recordTx on Begin.
+type recordDB struct {
+	queries []string
+	tx      *recordTx
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) { return d.tx, nil }
+func (d *recordDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	d.queries = append(d.queries, sql)
+	return 0, "", nil
+}
+func (d *recordDB) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+func (d *recordDB) Close()                                                         {}
@@ -2,7 +2,6 @@ package db
 
 import (
 	"context"
-	"github.com/jackc/pgx/v4"
 )
 
 /* Database connection wrapper */
@@ -10,7 +9,7 @@ import (
 type DB interface {
 	Begin(ctx context.Context) (Tx, error)
 	Exec(ctx context.Context, sql string, arguments ...interface{}) (int64, string, error)
-	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (Rows, error)
 	Close()
 }
 
@@ -18,12 +17,41 @@ type Tx interface {
 	Commit(ctx context.Context) error
 	Rollback(ctx context.Context) error
 	Exec(ctx context.Context, sql string, arguments ...interface{}) (int64, string, error)
-	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (Rows, error)
 }
 
 type Conn interface {
 	Begin(ctx context.Context) (Tx, error)
 	Exec(ctx context.Context, sql string, arguments ...interface{}) (int64, string, error)
-	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	Query(ctx context.Context, sql string, args ...interface{}) (Rows, error)
 	Close() error
 }
+
+// Beginner defines object which is able to start transactions, it is implemented by DB and Conn.
+type Beginner interface {
+	Begin(ctx context.Context) (Tx, error)
+}
+
+// Sizer defines pool with limited number of connections, it is implemented by PostgresDB.
+type Sizer interface {
+	MaxConns() int32
+}
+
+// Querier defines object which is able to execute queries, it is implemented by DB, Tx and Conn.
+type Querier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (Rows, error)
+}
+
+// Execer defines object which is able to execute statements, it is implemented by DB, Tx and Conn.
+type Execer interface {
+	Exec(ctx context.Context, sql string, arguments ...interface{}) (int64, string, error)
+}
+
+// Rows defines result set returned by queries. It contains a minimal set of methods
+// required by workloads, so consumers are not tied to a specific database driver.
+type Rows interface {
+	Next() bool
+	Scan(dest ...interface{}) error
+	Err() error
+	Close()
+}
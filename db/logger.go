@@ -0,0 +1,99 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/lesovsky/noisia/log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/* Driver logging */
+
+// DriverLogLevelOff defines driver log level which disables driver logging.
+const DriverLogLevelOff = "off"
+
+var (
+	driverMu       sync.RWMutex
+	driverLogger   pgx.Logger
+	driverLogLevel pgx.LogLevel
+)
+
+// SetDriverLogger configures global logging of pgx driver. Messages of the driver with passed level
+// and above are routed into passed logger. Level could be one of: trace, debug, info, warn, error, off.
+// Logging is off by default. Configured logging is applied to connections established afterwards.
+func SetDriverLogger(logger log.Logger, level string) error {
+	if level == DriverLogLevelOff {
+		driverMu.Lock()
+		driverLogger, driverLogLevel = nil, pgx.LogLevelNone
+		driverMu.Unlock()
+		return nil
+	}
+
+	lvl, err := pgx.LogLevelFromString(level)
+	if err != nil {
+		return fmt.Errorf("unknown driver log level: %s", level)
+	}
+
+	driverMu.Lock()
+	driverLogger, driverLogLevel = &driverLogAdapter{logger: logger}, lvl
+	driverMu.Unlock()
+
+	return nil
+}
+
+// applyDriverLogger applies global driver logging settings to connection config.
+func applyDriverLogger(config *pgx.ConnConfig) {
+	driverMu.RLock()
+	defer driverMu.RUnlock()
+
+	if driverLogger == nil {
+		return
+	}
+
+	config.Logger = driverLogger
+	config.LogLevel = driverLogLevel
+}
+
+// driverLogAdapter implements pgx.Logger interface and routes driver messages into noisia logger.
+type driverLogAdapter struct {
+	logger log.Logger
+}
+
+// Log writes driver message into logger. Verbosity is already chosen using driver log level, so
+// messages below warn level are written as informational, otherwise they would be filtered out
+// by the logger level.
+func (a *driverLogAdapter) Log(_ context.Context, level pgx.LogLevel, msg string, data map[string]interface{}) {
+	line := "pgx: " + msg + formatLogData(data)
+
+	switch level {
+	case pgx.LogLevelError:
+		a.logger.Error(line)
+	case pgx.LogLevelWarn:
+		a.logger.Warn(line)
+	default:
+		a.logger.Info(line)
+	}
+}
+
+// formatLogData returns data of driver message as sorted key=value pairs.
+func formatLogData(data map[string]interface{}) string {
+	if len(data) == 0 {
+		return ""
+	}
+
+	keys := make([]string, 0, len(data))
+	for k := range data {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, k := range keys {
+		fmt.Fprintf(&b, " %s=%v", k, data[k])
+	}
+
+	return b.String()
+}
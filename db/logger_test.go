@@ -0,0 +1,107 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgx/v4"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// captureLogger implements log.Logger and captures all written messages.
+type captureLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *captureLogger) write(level string, msg string) {
+	l.mu.Lock()
+	l.msgs = append(l.msgs, level+" "+msg)
+	l.mu.Unlock()
+}
+
+func (l *captureLogger) contains(s string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, m := range l.msgs {
+		if strings.Contains(m, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *captureLogger) Debug(msg string) { l.write("debug", msg) }
+func (l *captureLogger) Debugf(format string, v ...interface{}) {
+	l.write("debug", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Info(msg string) { l.write("info", msg) }
+func (l *captureLogger) Infof(format string, v ...interface{}) {
+	l.write("info", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Warn(msg string) { l.write("warn", msg) }
+func (l *captureLogger) Warnf(format string, v ...interface{}) {
+	l.write("warn", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Error(msg string) { l.write("error", msg) }
+func (l *captureLogger) Errorf(format string, v ...interface{}) {
+	l.write("error", fmt.Sprintf(format, v...))
+}
+
+func TestSetDriverLogger(t *testing.T) {
+	defer func() { _ = SetDriverLogger(nil, DriverLogLevelOff) }()
+
+	logger := &captureLogger{}
+	assert.Error(t, SetDriverLogger(logger, "invalid"))
+
+	// Logging is off, config is not changed.
+	config, err := pgx.ParseConfig("host=127.0.0.1")
+	assert.NoError(t, err)
+	applyOptions(config, ConnOptions{})
+	assert.Nil(t, config.Logger)
+
+	assert.NoError(t, SetDriverLogger(logger, "trace"))
+	applyOptions(config, ConnOptions{})
+	assert.NotNil(t, config.Logger)
+	assert.Equal(t, pgx.LogLevel(pgx.LogLevelTrace), config.LogLevel)
+
+	assert.NoError(t, SetDriverLogger(logger, DriverLogLevelOff))
+	config, err = pgx.ParseConfig("host=127.0.0.1")
+	assert.NoError(t, err)
+	applyOptions(config, ConnOptions{})
+	assert.Nil(t, config.Logger)
+}
+
+func Test_driverLogAdapter(t *testing.T) {
+	logger := &captureLogger{}
+	a := &driverLogAdapter{logger: logger}
+
+	a.Log(context.Background(), pgx.LogLevelTrace, "Exec", map[string]interface{}{"sql": "SELECT 1", "args": []interface{}{}})
+	a.Log(context.Background(), pgx.LogLevelWarn, "slow", nil)
+	a.Log(context.Background(), pgx.LogLevelError, "connect failed", map[string]interface{}{"err": "refused"})
+
+	assert.Equal(t, []string{
+		"info pgx: Exec args=[] sql=SELECT 1",
+		"warn pgx: slow",
+		"error pgx: connect failed err=refused",
+	}, logger.msgs)
+}
+
+func TestConnect_driverLogger(t *testing.T) {
+	defer func() { _ = SetDriverLogger(nil, DriverLogLevelOff) }()
+
+	logger := &captureLogger{}
+	assert.NoError(t, SetDriverLogger(logger, "trace"))
+
+	conn, err := Connect(context.Background(), TestConninfo)
+	assert.NoError(t, err)
+
+	_, _, err = conn.Exec(context.Background(), "SELECT 1")
+	assert.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	assert.True(t, logger.contains("pgx: Exec"))
+	assert.True(t, logger.contains("sql=SELECT 1"))
+}
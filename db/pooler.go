@@ -0,0 +1,102 @@
+package db
+
+import (
+	"context"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"strconv"
+)
+
+/* Connection pooler admin console */
+
+// PoolStats defines clients statistics of a single pool reported by connection pooler.
+type PoolStats struct {
+	// Database defines name of the pool's database.
+	Database string
+	// User defines name of the pool's user.
+	User string
+	// Active defines number of clients linked to server connections.
+	Active int64
+	// Waiting defines number of clients queued for a server connection.
+	Waiting int64
+}
+
+// ShowPools connects to admin console of connection pooler and returns pools statistics using
+// SHOW POOLS command. Admin console is accessed through passed database, e.g. 'pgbouncer' for
+// PgBouncer or 'console' for Odyssey.
+func ShowPools(ctx context.Context, connString string, database string) ([]PoolStats, error) {
+	config, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return nil, redactError(err, connString)
+	}
+
+	config.Database = database
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, &connectError{err: err}
+	}
+	defer func() {
+		cctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+		defer cancel()
+		_ = conn.Close(cctx)
+	}()
+
+	// Admin console accepts simple protocol only, it is used by Exec.
+	results, err := conn.Exec(ctx, "SHOW POOLS").ReadAll()
+	if err != nil {
+		return nil, err
+	}
+
+	if len(results) != 1 {
+		return nil, fmt.Errorf("unexpected result of SHOW POOLS")
+	}
+
+	columns := make([]string, len(results[0].FieldDescriptions))
+	for i, f := range results[0].FieldDescriptions {
+		columns[i] = string(f.Name)
+	}
+
+	return parsePools(columns, results[0].Rows)
+}
+
+// parsePools parses result of SHOW POOLS command. Columns are looked up by names, because their
+// set and order differ between poolers and their versions.
+func parsePools(columns []string, rows [][][]byte) ([]PoolStats, error) {
+	idx := map[string]int{}
+	for i, name := range columns {
+		idx[name] = i
+	}
+
+	for _, name := range []string{"database", "user", "cl_active", "cl_waiting"} {
+		if _, ok := idx[name]; !ok {
+			return nil, fmt.Errorf("column '%s' not found in result of SHOW POOLS", name)
+		}
+	}
+
+	pools := make([]PoolStats, 0, len(rows))
+	for _, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("unexpected number of values in row of SHOW POOLS: %d", len(row))
+		}
+
+		active, err := strconv.ParseInt(string(row[idx["cl_active"]]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse cl_active failed: %s", err)
+		}
+
+		waiting, err := strconv.ParseInt(string(row[idx["cl_waiting"]]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("parse cl_waiting failed: %s", err)
+		}
+
+		pools = append(pools, PoolStats{
+			Database: string(row[idx["database"]]),
+			User:     string(row[idx["user"]]),
+			Active:   active,
+			Waiting:  waiting,
+		})
+	}
+
+	return pools, nil
+}
@@ -0,0 +1,34 @@
+package db
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func Test_parsePools(t *testing.T) {
+	// Columns of PgBouncer 1.18+ have cl_active_cancel_req between cl_waiting and sv_active.
+	columns := []string{"database", "user", "cl_active", "cl_waiting", "cl_active_cancel_req", "sv_active", "pool_mode"}
+	rows := [][][]byte{
+		{[]byte("noisia"), []byte("noisia"), []byte("20"), []byte("80"), []byte("0"), []byte("20"), []byte("transaction")},
+		{[]byte("pgbouncer"), []byte("pgbouncer"), []byte("1"), []byte("0"), []byte("0"), []byte("0"), []byte("statement")},
+	}
+
+	got, err := parsePools(columns, rows)
+	assert.NoError(t, err)
+	assert.Equal(t, []PoolStats{
+		{Database: "noisia", User: "noisia", Active: 20, Waiting: 80},
+		{Database: "pgbouncer", User: "pgbouncer", Active: 1, Waiting: 0},
+	}, got)
+
+	// Required column is missing.
+	_, err = parsePools([]string{"database", "user", "cl_active"}, nil)
+	assert.Error(t, err)
+
+	// Invalid value.
+	_, err = parsePools(columns[:4], [][][]byte{{[]byte("noisia"), []byte("noisia"), []byte("20"), []byte("invalid")}})
+	assert.Error(t, err)
+
+	// Short row.
+	_, err = parsePools(columns[:4], [][][]byte{{[]byte("noisia")}})
+	assert.Error(t, err)
+}
@@ -2,50 +2,508 @@ package db
 
 import (
 	"context"
+	"errors"
+	"fmt"
+	"github.com/jackc/pgconn"
 	"github.com/jackc/pgx/v4"
 	"github.com/jackc/pgx/v4/pgxpool"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
 )
 
+// closeTimeout defines max time allowed for gracefully closing connection, after that the
+// connection is closed forcibly, so shutdown is not delayed by unresponsive server.
+const closeTimeout = 5 * time.Second
+
+// ErrConnect is matched by errors returned when connection to Postgres could not be established, use errors.Is for checking.
+var ErrConnect = errors.New("connect failed")
+
+// ErrAcquireTimeout is matched by errors returned when free connection has not been acquired from
+// the pool within the acquire timeout, use errors.Is for checking.
+var ErrAcquireTimeout = errors.New("acquire connection timed out")
+
+// connectError wraps error of establishing connection, message of the original error is preserved.
+type connectError struct {
+	err error
+}
+
+// Error returns message of the original error.
+func (e *connectError) Error() string {
+	return e.err.Error()
+}
+
+// Unwrap returns the original error.
+func (e *connectError) Unwrap() error {
+	return e.err
+}
+
+// Is reports whether target is ErrConnect.
+func (e *connectError) Is(target error) bool {
+	return target == ErrConnect
+}
+
+/* Connection options */
+
+const (
+	// PoolerModeSession defines session pooling mode, session-level features are allowed.
+	PoolerModeSession = "session"
+	// PoolerModeTransaction defines transaction pooling mode, session-level features are not allowed.
+	PoolerModeTransaction = "transaction"
+)
+
+/* Transaction isolation levels */
+
+const (
+	// IsolationReadCommitted defines READ COMMITTED isolation level.
+	IsolationReadCommitted = "read-committed"
+	// IsolationRepeatableRead defines REPEATABLE READ isolation level.
+	IsolationRepeatableRead = "repeatable-read"
+	// IsolationSerializable defines SERIALIZABLE isolation level.
+	IsolationSerializable = "serializable"
+)
+
+// isolationLevels maps supported isolation levels to their SQL names.
+var isolationLevels = map[string]string{
+	IsolationReadCommitted:  "READ COMMITTED",
+	IsolationRepeatableRead: "REPEATABLE READ",
+	IsolationSerializable:   "SERIALIZABLE",
+}
+
+// ValidateIsolationLevel checks isolation level is supported. Empty value is allowed and means
+// the default isolation level of the database is used.
+func ValidateIsolationLevel(level string) error {
+	if _, ok := isolationLevels[level]; ok || level == "" {
+		return nil
+	}
+
+	return fmt.Errorf("unknown isolation level: %s", level)
+}
+
+// SetIsolationLevel sets isolation level of the current transaction, it must be called before
+// any other statement of the transaction. Nothing is done if level is empty.
+func SetIsolationLevel(ctx context.Context, tx Execer, level string) error {
+	if level == "" {
+		return nil
+	}
+
+	name, ok := isolationLevels[level]
+	if !ok {
+		return fmt.Errorf("unknown isolation level: %s", level)
+	}
+
+	_, _, err := tx.Exec(ctx, "SET TRANSACTION ISOLATION LEVEL "+name)
+	return err
+}
+
+// ConnOptions defines additional settings applied to database connections.
+type ConnOptions struct {
+	// PoolerMode defines pooling mode of connection pooler (e.g. PgBouncer) used between noisia and Postgres.
+	PoolerMode string
+	// Workload defines name of the workload which uses connections, it is used in application_name.
+	Workload string
+	// Database defines name of the database to connect, it overrides database specified in connection string.
+	Database string
+	// MinConns defines number of connections established in pool before it is returned (warmup), zero means
+	// connections are established on demand. It is used only by connections pools.
+	MinConns int32
+	// Role defines role which is set using SET ROLE after connecting, connecting user must be a member of the role.
+	Role string
+	// SearchPath defines comma-separated list of schemas which is set as search_path after connecting.
+	SearchPath string
+	// AcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting
+	// until context is done. It is used only by connections pools.
+	AcquireTimeout time.Duration
+}
+
+// WorkerDatabase returns database mapped to the worker with passed index. Empty string is returned
+// if worker is not mapped, in this case the database from connection string should be used.
+func WorkerDatabase(databases []string, i int) string {
+	if i < 0 || i >= len(databases) {
+		return ""
+	}
+
+	return databases[i]
+}
+
+// ValidateWorkerDatabases checks passed mapping of workers to databases fits into passed number of
+// jobs and mapped names are valid databases names.
+func ValidateWorkerDatabases(databases []string, jobs uint16) error {
+	if len(databases) > int(jobs) {
+		return fmt.Errorf("databases are mapped to %d workers, but only %d jobs specified", len(databases), jobs)
+	}
+
+	for i, name := range databases {
+		if name == "" {
+			continue
+		}
+
+		err := ValidateIdentifier(name)
+		if err != nil {
+			return fmt.Errorf("invalid database of worker %d: %s", i, err)
+		}
+	}
+
+	return nil
+}
+
+// ApplicationName returns application_name used by connections of passed workload, operators could
+// see in pg_stat_activity which workload each backend belongs to.
+func ApplicationName(workload string) string {
+	return "noisia-" + workload
+}
+
+// ValidatePoolerMode checks pooler mode is supported. Empty value is allowed and means no pooler is used.
+func ValidatePoolerMode(mode string) error {
+	switch mode {
+	case "", PoolerModeSession, PoolerModeTransaction:
+		return nil
+	default:
+		return fmt.Errorf("unknown pooler mode: %s", mode)
+	}
+}
+
+// ValidateRole checks role could be set with passed pooler mode. Empty value is allowed and means
+// role of connecting user is used.
+func ValidateRole(poolerMode string, role string) error {
+	if role != "" && poolerMode == PoolerModeTransaction {
+		return fmt.Errorf("role is a session setting, it is not supported in transaction pooling mode")
+	}
+
+	return nil
+}
+
+// ValidateSearchPath checks search_path is a list of schemas and could be set with passed pooler
+// mode. Empty value is allowed and means default search_path is used.
+func ValidateSearchPath(poolerMode string, path string) error {
+	if path == "" {
+		return nil
+	}
+
+	if poolerMode == PoolerModeTransaction {
+		return fmt.Errorf("search_path is a session setting, it is not supported in transaction pooling mode")
+	}
+
+	for _, s := range strings.Split(path, ",") {
+		if strings.TrimSpace(s) == "" {
+			return fmt.Errorf("invalid search_path: %s, empty schema name", path)
+		}
+	}
+
+	return nil
+}
+
+// sessionStatements returns statements which apply role and search_path of passed options to new connections.
+func sessionStatements(opts ConnOptions) []string {
+	var statements []string
+
+	if opts.Role != "" {
+		statements = append(statements, fmt.Sprintf("SET ROLE %s", QuoteIdentifier(opts.Role)))
+	}
+
+	if opts.SearchPath != "" {
+		var schemas []string
+		for _, s := range strings.Split(opts.SearchPath, ",") {
+			schemas = append(schemas, QuoteIdentifier(strings.TrimSpace(s)))
+		}
+		statements = append(statements, fmt.Sprintf("SET search_path TO %s", strings.Join(schemas, ", ")))
+	}
+
+	return statements
+}
+
+// applySession executes passed session statements on the new connection. Permission errors are
+// reported explicitly, because they mean connecting user is not a member of the role.
+func applySession(ctx context.Context, conn *pgconn.PgConn, statements []string) error {
+	for _, s := range statements {
+		_, err := conn.Exec(ctx, s).ReadAll()
+		if err != nil {
+			if ErrorCode(err) == "42501" {
+				return fmt.Errorf("%s failed, connecting user is not allowed to use the role: %w", s, err)
+			}
+			return fmt.Errorf("%s failed: %w", s, err)
+		}
+	}
+
+	return nil
+}
+
+// applyOptions applies connection options to connection config.
+func applyOptions(config *pgx.ConnConfig, opts ConnOptions) {
+	// Prepared statements are not supported in transaction pooling mode.
+	if opts.PoolerMode == PoolerModeTransaction {
+		config.PreferSimpleProtocol = true
+		config.BuildStatementCache = nil
+	}
+
+	// Application name is sent in startup packet, so it is set even in transaction pooling mode.
+	if opts.Workload != "" {
+		config.RuntimeParams["application_name"] = ApplicationName(opts.Workload)
+	}
+
+	if opts.Database != "" {
+		config.Database = opts.Database
+	}
+
+	// Role and search_path are applied to each new connection, including reconnects of pools.
+	statements := sessionStatements(opts)
+	if len(statements) > 0 {
+		config.AfterConnect = func(ctx context.Context, conn *pgconn.PgConn) error {
+			return applySession(ctx, conn, statements)
+		}
+	}
+
+	applyDriverLogger(config)
+}
+
+// maxIdentifierLength defines max length of identifiers in bytes, longer identifiers are truncated by Postgres.
+const maxIdentifierLength = 63
+
+// ValidateIdentifier checks passed name could be used as identifier, e.g. name of table. Identifier
+// is quoted when used in queries, so any characters except NUL are allowed.
+func ValidateIdentifier(name string) error {
+	if name == "" {
+		return fmt.Errorf("identifier must not be empty")
+	}
+
+	if len(name) > maxIdentifierLength {
+		return fmt.Errorf("identifier '%s' is longer than %d bytes", name, maxIdentifierLength)
+	}
+
+	if strings.ContainsRune(name, 0) {
+		return fmt.Errorf("identifier must not contain NUL characters")
+	}
+
+	return nil
+}
+
+// QuoteIdentifier quotes passed parts of identifier (e.g. schema and table names) and joins them with dot.
+func QuoteIdentifier(parts ...string) string {
+	return pgx.Identifier(parts).Sanitize()
+}
+
+// redactedPassword defines placeholder used instead of passwords in redacted connection strings.
+const redactedPassword = "xxxxx"
+
+// conninfoPasswordRe defines regexp matching password in keyword/value connection strings.
+var conninfoPasswordRe = regexp.MustCompile(`(password\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// urlPasswordRe defines regexp matching password in userinfo or query parameters of URL connection
+// strings. It is used when URL can't be parsed, e.g. when unix socket directory is specified as
+// percent-encoded host.
+var urlPasswordRe = regexp.MustCompile(`(^postgres(?:ql)?://[^:@/?]*:|[?&]password=)([^@&]*)`)
+
+// RedactConninfo returns connection string with password replaced by placeholder, the result is safe for logging.
+func RedactConninfo(conninfo string) string {
+	if strings.HasPrefix(conninfo, "postgres://") || strings.HasPrefix(conninfo, "postgresql://") {
+		u, err := url.Parse(conninfo)
+		if err != nil {
+			return urlPasswordRe.ReplaceAllString(conninfo, "${1}"+redactedPassword)
+		}
+
+		if q := u.Query(); q.Get("password") != "" {
+			q.Set("password", redactedPassword)
+			u.RawQuery = q.Encode()
+		}
+
+		return u.Redacted()
+	}
+
+	return conninfoPasswordRe.ReplaceAllString(conninfo, "${1}"+redactedPassword)
+}
+
+// redactError returns error with connection string redacted. Connection string is included
+// into errors returned by driver when parsing of connection string failed.
+func redactError(err error, conninfo string) error {
+	if conninfo == "" || !strings.Contains(err.Error(), conninfo) {
+		return err
+	}
+
+	return errors.New(strings.ReplaceAll(err.Error(), conninfo, RedactConninfo(conninfo)))
+}
+
+// ErrorCode returns SQLSTATE code of the error returned by Postgres. Empty string is returned
+// if the error has not been returned by Postgres.
+func ErrorCode(err error) string {
+	var e interface{ SQLState() string }
+	if errors.As(err, &e) {
+		return e.SQLState()
+	}
+
+	return ""
+}
+
+// IsInRecovery returns true if Postgres is in recovery, e.g. it is a hot standby.
+func IsInRecovery(ctx context.Context, q Querier) (bool, error) {
+	rows, err := q.Query(ctx, "SELECT pg_is_in_recovery()")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var recovery bool
+	for rows.Next() {
+		err = rows.Scan(&recovery)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return recovery, rows.Err()
+}
+
+// TableExists returns true if table with passed name exists.
+func TableExists(ctx context.Context, q Querier, name string) (bool, error) {
+	rows, err := q.Query(ctx, "SELECT to_regclass($1) IS NOT NULL", QuoteIdentifier(name))
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var exists bool
+	for rows.Next() {
+		err = rows.Scan(&exists)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return exists, rows.Err()
+}
+
 /* Database connections pool implementation */
 
 // PostgresDB implements pgxpool.Pool as DB interface.
 type PostgresDB struct {
-	pool *pgxpool.Pool
+	pool           *pgxpool.Pool
+	acquireTimeout time.Duration
 }
 
 // NewPostgresDB creates new database connections pool.
 func NewPostgresDB(ctx context.Context, conninfo string) (DB, error) {
+	return NewPostgresDBWithOptions(ctx, conninfo, ConnOptions{})
+}
+
+// NewPostgresDBWithOptions creates new database connections pool using passed options.
+func NewPostgresDBWithOptions(ctx context.Context, conninfo string, opts ConnOptions) (DB, error) {
 	config, err := pgxpool.ParseConfig(conninfo)
 	if err != nil {
-		return nil, err
+		return nil, redactError(err, conninfo)
 	}
 
 	config.ConnConfig.RuntimeParams["application_name"] = "noisia"
+	applyOptions(config.ConnConfig, opts)
+
+	// Keep warmed up connections in the pool, pool must be able to hold all of them.
+	if opts.MinConns > 0 {
+		config.MinConns = opts.MinConns
+		if config.MaxConns < opts.MinConns {
+			config.MaxConns = opts.MinConns
+		}
+	}
 
 	pool, err := pgxpool.ConnectConfig(ctx, config)
 	if err != nil {
-		return nil, err
+		return nil, &connectError{err: err}
+	}
+
+	err = warmup(ctx, pool, opts.MinConns)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("warmup failed: %w", err)
 	}
 
 	return &PostgresDB{
-		pool: pool,
+		pool:           pool,
+		acquireTimeout: opts.AcquireTimeout,
 	}, nil
 }
 
+// warmup establishes passed number of connections in the pool. Connections are acquired all
+// together, so the pool has to open new connection for each of them, and then released.
+func warmup(ctx context.Context, pool *pgxpool.Pool, n int32) error {
+	conns := make([]*pgxpool.Conn, 0, n)
+	defer func() {
+		for _, c := range conns {
+			c.Release()
+		}
+	}()
+
+	for i := int32(0); i < n; i++ {
+		c, err := pool.Acquire(ctx)
+		if err != nil {
+			return err
+		}
+		conns = append(conns, c)
+	}
+
+	return nil
+}
+
+// acquire acquires connection from the pool waiting for a free connection no longer than acquire
+// timeout. Passed context is used only for waiting, the connection is not bound to it.
+func (db *PostgresDB) acquire(ctx context.Context) (*pgxpool.Conn, error) {
+	actx, cancel := context.WithTimeout(ctx, db.acquireTimeout)
+	defer cancel()
+
+	conn, err := db.pool.Acquire(actx)
+	if err != nil {
+		// Distinguish the acquire timeout from the done parent context.
+		if ctx.Err() == nil && errors.Is(actx.Err(), context.DeadlineExceeded) {
+			return nil, fmt.Errorf("%w after %s", ErrAcquireTimeout, db.acquireTimeout)
+		}
+		return nil, err
+	}
+
+	return conn, nil
+}
+
 // Begin opens transaction in database and returns transaction object.
 func (db *PostgresDB) Begin(ctx context.Context) (Tx, error) {
-	tx, err := db.pool.Begin(ctx)
+	if db.acquireTimeout <= 0 {
+		tx, err := db.pool.Begin(ctx)
+		if err != nil {
+			return nil, err
+		}
+		return &PostgresTx{
+			tx: tx,
+		}, nil
+	}
+
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := conn.Begin(ctx)
 	if err != nil {
+		conn.Release()
 		return nil, err
 	}
+
 	return &PostgresTx{
-		tx: tx,
+		tx:   tx,
+		conn: conn,
 	}, nil
 }
 
 // Exec executes query expression and returns resulting tag.
 func (db *PostgresDB) Exec(ctx context.Context, sql string, args ...interface{}) (int64, string, error) {
-	tag, err := db.pool.Exec(ctx, sql, args...)
+	var tag pgconn.CommandTag
+	var err error
+
+	if db.acquireTimeout <= 0 {
+		tag, err = db.pool.Exec(ctx, sql, args...)
+	} else {
+		var conn *pgxpool.Conn
+		conn, err = db.acquire(ctx)
+		if err != nil {
+			return 0, "", err
+		}
+		tag, err = conn.Exec(ctx, sql, args...)
+		conn.Release()
+	}
 	if err != nil {
 		return 0, "", err
 	}
@@ -54,8 +512,28 @@ func (db *PostgresDB) Exec(ctx context.Context, sql string, args ...interface{})
 }
 
 // Query executes query expression and returns resulting Rows.
-func (db *PostgresDB) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
-	return db.pool.Query(ctx, sql, args...)
+func (db *PostgresDB) Query(ctx context.Context, sql string, args ...interface{}) (Rows, error) {
+	if db.acquireTimeout <= 0 {
+		return db.pool.Query(ctx, sql, args...)
+	}
+
+	conn, err := db.acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := conn.Query(ctx, sql, args...)
+	if err != nil {
+		conn.Release()
+		return nil, err
+	}
+
+	return &poolRows{Rows: rows, conn: conn}, nil
+}
+
+// MaxConns returns max number of connections in the pool.
+func (db *PostgresDB) MaxConns() int32 {
+	return db.pool.Stat().MaxConns()
 }
 
 // Close closes database connections pool.
@@ -68,16 +546,31 @@ func (db *PostgresDB) Close() {
 // PostgresTx implements PostgreSQL transaction object.
 type PostgresTx struct {
 	tx pgx.Tx
+	// conn defines connection acquired explicitly for the transaction, it is released when
+	// transaction is finished.
+	conn *pgxpool.Conn
 }
 
 // Commit does transaction commit.
 func (tx *PostgresTx) Commit(ctx context.Context) error {
-	return tx.tx.Commit(ctx)
+	err := tx.tx.Commit(ctx)
+	tx.release()
+	return err
 }
 
 // Rollback does transaction rollback.
 func (tx *PostgresTx) Rollback(ctx context.Context) error {
-	return tx.tx.Rollback(ctx)
+	err := tx.tx.Rollback(ctx)
+	tx.release()
+	return err
+}
+
+// release returns explicitly acquired connection back to the pool.
+func (tx *PostgresTx) release() {
+	if tx.conn != nil {
+		tx.conn.Release()
+		tx.conn = nil
+	}
 }
 
 // Exec executes query expression inside the transaction and returns resulting tag.
@@ -91,10 +584,42 @@ func (tx *PostgresTx) Exec(ctx context.Context, sql string, args ...interface{})
 }
 
 // Query executes query expression inside the transaction and returns resulting Rows.
-func (tx *PostgresTx) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+func (tx *PostgresTx) Query(ctx context.Context, sql string, args ...interface{}) (Rows, error) {
 	return tx.tx.Query(ctx, sql, args...)
 }
 
+/* Rows implementation */
+
+// poolRows wraps rows of explicitly acquired connection, the connection is released when rows
+// are read or closed.
+type poolRows struct {
+	pgx.Rows
+	conn *pgxpool.Conn
+}
+
+// Next prepares the next row for reading, connection is released after the last row.
+func (r *poolRows) Next() bool {
+	if r.Rows.Next() {
+		return true
+	}
+	r.release()
+	return false
+}
+
+// Close closes rows and releases connection.
+func (r *poolRows) Close() {
+	r.Rows.Close()
+	r.release()
+}
+
+// release returns connection back to the pool.
+func (r *poolRows) release() {
+	if r.conn != nil {
+		r.conn.Release()
+		r.conn = nil
+	}
+}
+
 /* Connection implementation */
 
 // PostgresConn wraps *pgx.Conn.
@@ -104,9 +629,21 @@ type PostgresConn struct {
 
 // Connect accepts connection string and create new connection.
 func Connect(ctx context.Context, connString string) (Conn, error) {
-	conn, err := pgx.Connect(ctx, connString)
+	return ConnectWithOptions(ctx, connString, ConnOptions{})
+}
+
+// ConnectWithOptions accepts connection string and create new connection using passed options.
+func ConnectWithOptions(ctx context.Context, connString string, opts ConnOptions) (Conn, error) {
+	config, err := pgx.ParseConfig(connString)
 	if err != nil {
-		return nil, err
+		return nil, redactError(err, connString)
+	}
+
+	applyOptions(config, opts)
+
+	conn, err := pgx.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, &connectError{err: err}
 	}
 
 	return &PostgresConn{
@@ -136,10 +673,14 @@ func (c *PostgresConn) Exec(ctx context.Context, sql string, args ...interface{}
 }
 
 // Query executes query expression and returns resulting Rows.
-func (c *PostgresConn) Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error) {
+func (c *PostgresConn) Query(ctx context.Context, sql string, args ...interface{}) (Rows, error) {
 	return c.conn.Query(ctx, sql, args...)
 }
 
+// Close closes connection, waiting for server no longer than close timeout.
 func (c *PostgresConn) Close() error {
-	return c.conn.Close(context.Background())
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	return c.conn.Close(ctx)
 }
@@ -0,0 +1,180 @@
+package db
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"github.com/jackc/pgconn"
+	"github.com/jackc/pgproto3/v2"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/* Physical replication connection implementation */
+
+// epoch defines start of Postgres time, timestamps in replication messages are microseconds since epoch.
+var epoch = time.Date(2000, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// ReplicationConn wraps *pgconn.PgConn connected using physical replication protocol.
+type ReplicationConn struct {
+	conn *pgconn.PgConn
+}
+
+// ConnectReplication accepts connection string and creates new physical replication connection
+// using passed options. Connecting role must have REPLICATION attribute.
+func ConnectReplication(ctx context.Context, connString string, opts ConnOptions) (*ReplicationConn, error) {
+	config, err := pgconn.ParseConfig(connString)
+	if err != nil {
+		return nil, redactError(err, connString)
+	}
+
+	config.RuntimeParams["replication"] = "true"
+	if opts.Workload != "" {
+		config.RuntimeParams["application_name"] = ApplicationName(opts.Workload)
+	}
+
+	conn, err := pgconn.ConnectConfig(ctx, config)
+	if err != nil {
+		return nil, &connectError{err: err}
+	}
+
+	return &ReplicationConn{conn: conn}, nil
+}
+
+// IdentifySystem returns current WAL flush location of the server.
+func (c *ReplicationConn) IdentifySystem(ctx context.Context) (uint64, error) {
+	results, err := c.conn.Exec(ctx, "IDENTIFY_SYSTEM").ReadAll()
+	if err != nil {
+		return 0, err
+	}
+
+	if len(results) != 1 || len(results[0].Rows) != 1 || len(results[0].Rows[0]) < 3 {
+		return 0, fmt.Errorf("unexpected result of IDENTIFY_SYSTEM")
+	}
+
+	return ParseLSN(string(results[0].Rows[0][2]))
+}
+
+// CreateTemporarySlot creates physical replication slot which reserves WAL immediately. Slot is
+// temporary and it is dropped automatically when the connection is closed.
+func (c *ReplicationConn) CreateTemporarySlot(ctx context.Context, name string) error {
+	_, err := c.conn.Exec(ctx, fmt.Sprintf("CREATE_REPLICATION_SLOT %s TEMPORARY PHYSICAL RESERVE_WAL", QuoteIdentifier(name))).ReadAll()
+	return err
+}
+
+// StartReplication starts streaming WAL from passed location using passed slot. After streaming
+// is started, only Receive and SendStatus methods could be used.
+func (c *ReplicationConn) StartReplication(ctx context.Context, slot string, lsn uint64) error {
+	q := fmt.Sprintf("START_REPLICATION SLOT %s PHYSICAL %s", QuoteIdentifier(slot), FormatLSN(lsn))
+
+	err := c.conn.SendBytes(ctx, (&pgproto3.Query{String: q}).Encode(nil))
+	if err != nil {
+		return err
+	}
+
+	for {
+		msg, err := c.conn.ReceiveMessage(ctx)
+		if err != nil {
+			return err
+		}
+
+		switch msg := msg.(type) {
+		case *pgproto3.CopyBothResponse:
+			return nil
+		case *pgproto3.ErrorResponse:
+			return pgconn.ErrorResponseToPgError(msg)
+		}
+	}
+}
+
+// Receive receives single message of replication stream and returns end of WAL on the server
+// reported by the message. Zero is returned for messages which don't report WAL location.
+func (c *ReplicationConn) Receive(ctx context.Context) (uint64, error) {
+	msg, err := c.conn.ReceiveMessage(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	switch msg := msg.(type) {
+	case *pgproto3.CopyData:
+		return parseStreamMessage(msg.Data)
+	case *pgproto3.CopyDone:
+		return 0, fmt.Errorf("replication stream finished by server")
+	case *pgproto3.ErrorResponse:
+		return 0, pgconn.ErrorResponseToPgError(msg)
+	}
+
+	return 0, nil
+}
+
+// SendStatus sends standby status update which reports passed location as written, flushed and applied.
+func (c *ReplicationConn) SendStatus(ctx context.Context, lsn uint64) error {
+	data := make([]byte, 34)
+	data[0] = 'r'
+	binary.BigEndian.PutUint64(data[1:], lsn)
+	binary.BigEndian.PutUint64(data[9:], lsn)
+	binary.BigEndian.PutUint64(data[17:], lsn)
+	binary.BigEndian.PutUint64(data[25:], uint64(time.Since(epoch).Microseconds()))
+
+	return c.conn.SendBytes(ctx, (&pgproto3.CopyData{Data: data}).Encode(nil))
+}
+
+// Close closes replication connection, temporary slots are dropped by the server. Server
+// is waited no longer than close timeout.
+func (c *ReplicationConn) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	return c.conn.Close(ctx)
+}
+
+// parseStreamMessage parses payload of CopyData message of replication stream and returns end
+// of WAL on the server. Both WAL data and keepalive messages report WAL end.
+func parseStreamMessage(data []byte) (uint64, error) {
+	if len(data) == 0 {
+		return 0, fmt.Errorf("empty replication message")
+	}
+
+	switch data[0] {
+	case 'w':
+		// XLogData: WAL start, WAL end, send time, WAL data.
+		if len(data) < 25 {
+			return 0, fmt.Errorf("short WAL data message: %d bytes", len(data))
+		}
+		return binary.BigEndian.Uint64(data[9:]), nil
+	case 'k':
+		// Primary keepalive: WAL end, send time, reply requested.
+		if len(data) < 18 {
+			return 0, fmt.Errorf("short keepalive message: %d bytes", len(data))
+		}
+		return binary.BigEndian.Uint64(data[1:]), nil
+	default:
+		return 0, fmt.Errorf("unknown replication message type: %q", data[0])
+	}
+}
+
+// ParseLSN parses textual representation of WAL location, e.g. '16/B374D848'.
+func ParseLSN(s string) (uint64, error) {
+	parts := strings.Split(s, "/")
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+
+	hi, err := strconv.ParseUint(parts[0], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+
+	lo, err := strconv.ParseUint(parts[1], 16, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid LSN: %s", s)
+	}
+
+	return hi<<32 | lo, nil
+}
+
+// FormatLSN returns textual representation of WAL location.
+func FormatLSN(lsn uint64) string {
+	return fmt.Sprintf("%X/%X", lsn>>32, uint32(lsn))
+}
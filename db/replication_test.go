@@ -0,0 +1,68 @@
+package db
+
+import (
+	"encoding/binary"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestParseLSN(t *testing.T) {
+	testcases := []struct {
+		valid bool
+		lsn   string
+		want  uint64
+	}{
+		{valid: true, lsn: "0/0", want: 0},
+		{valid: true, lsn: "0/16B3748", want: 0x16B3748},
+		{valid: true, lsn: "16/B374D848", want: 0x16B374D848},
+		{valid: false, lsn: ""},
+		{valid: false, lsn: "16B374D848"},
+		{valid: false, lsn: "0/XYZ"},
+		{valid: false, lsn: "100000000/0"},
+	}
+
+	for _, tc := range testcases {
+		got, err := ParseLSN(tc.lsn)
+		if tc.valid {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+			assert.Equal(t, tc.lsn, FormatLSN(got))
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
+
+func Test_parseStreamMessage(t *testing.T) {
+	xlog := make([]byte, 30)
+	xlog[0] = 'w'
+	binary.BigEndian.PutUint64(xlog[1:], 100)
+	binary.BigEndian.PutUint64(xlog[9:], 200)
+
+	keepalive := make([]byte, 18)
+	keepalive[0] = 'k'
+	binary.BigEndian.PutUint64(keepalive[1:], 300)
+
+	testcases := []struct {
+		valid bool
+		data  []byte
+		want  uint64
+	}{
+		{valid: true, data: xlog, want: 200},
+		{valid: true, data: keepalive, want: 300},
+		{valid: false, data: nil},
+		{valid: false, data: xlog[:20]},
+		{valid: false, data: keepalive[:10]},
+		{valid: false, data: []byte{'x', 0, 0}},
+	}
+
+	for _, tc := range testcases {
+		got, err := parseStreamMessage(tc.data)
+		if tc.valid {
+			assert.NoError(t, err)
+			assert.Equal(t, tc.want, got)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
@@ -2,12 +2,107 @@ package db
 
 import (
 	"context"
+	"errors"
+	"os"
+	"sync/atomic"
+	"time"
 )
 
-// TestConninfo defines connection string to test database.
-const TestConninfo = "host=postgres user=noisia database=noisia_fixtures"
+// TestConninfo defines connection string to test database. Default connection string could be
+// overridden with NOISIA_TEST_CONNINFO environment variable, e.g. for connecting through unix
+// socket with peer authentication: "host=/var/run/postgresql dbname=noisia_fixtures".
+var TestConninfo = testConninfo()
+
+// testConninfo returns connection string to test database.
+func testConninfo() string {
+	if v := os.Getenv("NOISIA_TEST_CONNINFO"); v != "" {
+		return v
+	}
+
+	return "host=postgres user=noisia database=noisia_fixtures"
+}
 
 // NewTestDB creates connection for test database.
 func NewTestDB() (DB, error) {
 	return NewPostgresDB(context.Background(), TestConninfo)
 }
+
+// SlowDB implements DB and Tx interfaces and simulates slow database in tests. Each operation
+// takes Delay, zero delay simulates unresponsive database and operations are blocked until
+// context is done. Number of operations executed at the moment is tracked.
+type SlowDB struct {
+	// Delay defines how long each operation takes, zero means until context is done.
+	Delay time.Duration
+	// inflight defines number of operations executed at the moment, max defines max observed number.
+	inflight int64
+	max      int64
+}
+
+// Begin waits for delay and returns the database as transaction.
+func (d *SlowDB) Begin(ctx context.Context) (Tx, error) {
+	err := d.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return d, nil
+}
+
+// Commit does nothing.
+func (d *SlowDB) Commit(context.Context) error { return nil }
+
+// Rollback does nothing.
+func (d *SlowDB) Rollback(context.Context) error { return nil }
+
+// Exec waits for delay.
+func (d *SlowDB) Exec(ctx context.Context, _ string, _ ...interface{}) (int64, string, error) {
+	return 0, "", d.wait(ctx)
+}
+
+// Query waits for delay, rows are not supported and error is returned anyway.
+func (d *SlowDB) Query(ctx context.Context, _ string, _ ...interface{}) (Rows, error) {
+	err := d.wait(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	return nil, errors.New("rows are not supported by slow database")
+}
+
+// Close does nothing.
+func (d *SlowDB) Close() {}
+
+// Inflight returns number of operations executed at the moment.
+func (d *SlowDB) Inflight() int64 {
+	return atomic.LoadInt64(&d.inflight)
+}
+
+// MaxInflight returns max observed number of operations executed at once.
+func (d *SlowDB) MaxInflight() int64 {
+	return atomic.LoadInt64(&d.max)
+}
+
+// wait blocks until delay is expired or context is done.
+func (d *SlowDB) wait(ctx context.Context) error {
+	n := atomic.AddInt64(&d.inflight, 1)
+	defer atomic.AddInt64(&d.inflight, -1)
+
+	for {
+		max := atomic.LoadInt64(&d.max)
+		if n <= max || atomic.CompareAndSwapInt64(&d.max, max, n) {
+			break
+		}
+	}
+
+	if d.Delay == 0 {
+		<-ctx.Done()
+		return ctx.Err()
+	}
+
+	select {
+	case <-time.After(d.Delay):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -17,6 +17,20 @@
 // forces Postgres to resolve it. Postgres resolves the deadlock by terminating a
 // single participant of the deadlock. As a result the second survived transaction
 // can continue its work and return.
+//
+// Name of the working table could be specified with Config.TableName, such table must not
+// exist before the start, because it is dropped at the end. Rows are written with
+// random text payload of Config.PayloadSize bytes, larger payloads make rows wider, so more
+// data is written into WAL by each update (large payloads are stored in TOAST).
+//
+// Transactions wait Config.LockDelay between updates to allow concurrent transaction
+// to capture its lock. On fast systems this window might be missed, so the delay is tuned
+// automatically accordingly to the rate of missed deadlocks: when many deadlocks are missed,
+// the delay is increased, when none are missed, the delay is decreased back towards
+// Config.LockDelay. Serialization failures returned instead of deadlocks (when transactions
+// are serializable) are not counted as missed deadlocks. Each detected deadlock is confirmed
+// using deadlocks counter of pg_stat_database, number of confirmed deadlocks is reported at
+// the end.
 package deadlocks
 
 import (
@@ -24,24 +38,132 @@ import (
 	"fmt"
 	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/lesovsky/noisia/workerpool"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// fixtureTable defines default name of the working table created by the workload.
+	fixtureTable = "_noisia_deadlocks_workload"
+	// defaultPayloadSize defines default size of rows payload in bytes, it is a length of md5 hash.
+	defaultPayloadSize = 32
+	// maxPayloadSize defines upper limit of rows payload size in bytes.
+	maxPayloadSize = 1 << 20
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures.
+	defaultCleanupTimeout = 10 * time.Second
+	// defaultLockDelay defines default delay between updates in deadlock transactions.
+	defaultLockDelay = 10 * time.Millisecond
+	// maxLockDelay defines upper limit for automatically increased lock delay.
+	maxLockDelay = 1 * time.Second
+	// tuneWindow defines number of attempts to reproduce deadlock, after which lock delay is tuned.
+	tuneWindow = 10
+	// maxMissRate defines rate of missed deadlocks within tuning window, above which lock delay is increased.
+	maxMissRate = 0.5
+	// serializationFailure defines SQLSTATE code of serialization failure, it could be returned
+	// instead of deadlock when transactions are serializable.
+	serializationFailure = "40001"
+	// confirmTimeout defines max time of waiting until detected deadlock appears in pg_stat_database.
+	confirmTimeout = 2 * time.Second
+	// confirmInterval defines interval between polling pg_stat_database when deadlock is confirmed.
+	confirmInterval = 100 * time.Millisecond
+)
+
+// outcome defines result of attempt to reproduce deadlock.
+type outcome int
+
+const (
+	// outcomeMissed means transactions haven't collided and deadlock has been missed.
+	outcomeMissed outcome = iota
+	// outcomeDeadlock means deadlock has been detected by Postgres.
+	outcomeDeadlock
+	// outcomeSerialization means transactions failed with serialization failure instead of deadlock.
+	outcomeSerialization
+)
+
 // Config defines configuration settings for deadlocks workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
 	Conninfo string
 	// Jobs defines how many workers should be created for producing deadlocks.
 	Jobs uint16
+	// CleanupTimeout defines max time allowed for cleanup fixtures, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// LockDelay defines initial and minimal delay between updates in deadlock transactions, if zero the default delay is used.
+	LockDelay time.Duration
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// Isolation defines isolation level of transactions: read-committed, repeatable-read, serializable. Default isolation level is used if empty.
+	// Serializable transactions could fail with serialization failure instead of deadlock.
+	Isolation string
+	// Seed defines seed of random IDs of rows used in deadlocks, current time is used if zero.
+	Seed int64
+	// TableName defines name of the working table created by the workload, if empty the default name is used.
+	// Table with custom name must not exist, the workload refuses to use existing table.
+	TableName string
+	// PayloadSize defines size of random text payload of rows in bytes, if zero the default size is used.
+	PayloadSize int
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than zero")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	if c.LockDelay < 0 || c.LockDelay > maxLockDelay {
+		return noisia.NewConfigError("LockDelay", noisia.ErrInvalidRange, "lock delay must be between 0 and %s", maxLockDelay)
+	}
+
+	err := db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	err = db.ValidateIsolationLevel(c.Isolation)
+	if err != nil {
+		return noisia.NewConfigError("Isolation", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.TableName != "" {
+		err = db.ValidateIdentifier(c.TableName)
+		if err != nil {
+			return noisia.NewConfigError("TableName", noisia.ErrInvalidValue, "%s", err)
+		}
+	}
+
+	if c.PayloadSize < 0 || c.PayloadSize > maxPayloadSize {
+		return noisia.NewConfigError("PayloadSize", noisia.ErrInvalidRange, "payload size must be between 0 and %d", maxPayloadSize)
 	}
 
 	return nil
@@ -52,6 +174,22 @@ type workload struct {
 	config Config
 	logger log.Logger
 	pool   db.DB
+	// lockDelay defines current delay between updates in nanoseconds, it is tuned during the workload.
+	lockDelay int64
+	// tuneMu protects counters of the current tuning window.
+	tuneMu sync.Mutex
+	// attempts and misses define number of attempts to reproduce deadlock and number of missed
+	// deadlocks within the current tuning window.
+	attempts int
+	misses   int
+	// detected defines number of deadlocks detected by workers.
+	detected int64
+	// confirmMu protects confirmation of deadlocks by concurrent workers.
+	confirmMu sync.Mutex
+	// baseline defines deadlocks counter of pg_stat_database at the start of the workload.
+	baseline int64
+	// confirmed defines number of detected deadlocks confirmed by pg_stat_database.
+	confirmed int64
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -61,12 +199,41 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger, nil}, nil
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	if config.LockDelay == 0 {
+		config.LockDelay = defaultLockDelay
+	}
+
+	if config.TableName == "" {
+		config.TableName = fixtureTable
+	}
+
+	if config.PayloadSize == 0 {
+		config.PayloadSize = defaultPayloadSize
+	}
+
+	return &workload{config: config, logger: logger, lockDelay: int64(config.LockDelay)}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "deadlocks"
+}
+
+// Stats returns counters of detected and confirmed deadlocks.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"detected":  atomic.LoadInt64(&w.detected),
+		"confirmed": atomic.LoadInt64(&w.confirmed),
+	}
 }
 
 // Run method connects to Postgres and starts the workload.
 func (w *workload) Run(ctx context.Context) error {
-	pool, err := db.NewPostgresDB(ctx, w.config.Conninfo)
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
 	if err != nil {
 		return err
 	}
@@ -83,79 +250,298 @@ func (w *workload) Run(ctx context.Context) error {
 	defer func() {
 		err = w.cleanup()
 		if err != nil {
-			w.logger.Warnf("deadlocks cleanup failed: %s")
+			w.logger.Warnf("deadlocks cleanup failed: %s", err)
 		}
 	}()
 
-	// Keep specified number of workers using channel - run new workers until there is any free slot.
-	guard := make(chan struct{}, w.config.Jobs)
+	w.baseline, err = countDeadlocks(ctx, w.pool)
+	if err != nil {
+		return err
+	}
+
+	// Keep specified number of workers, each worker reproduces deadlocks one by one until context
+	// is done. Pool returns when all workers are finished, so none of them outlives the pool.
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		rnd := random.New(w.config.Seed, i)
+		for ctx.Err() == nil {
+			w.reproduceDeadlock(ctx, rnd)
+		}
+	})
+
+	// Main context is done, use private context for collecting stats.
+	statCtx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	after, err := countDeadlocks(statCtx, w.pool)
+	if err != nil {
+		return err
+	}
+
+	w.logger.Infof("deadlocks finished: %d detected, %d confirmed by pg_stat_database, %d counted by pg_stat_database (might include deadlocks produced by concurrent workload)", atomic.LoadInt64(&w.detected), atomic.LoadInt64(&w.confirmed), after-w.baseline)
+
+	return nil
+}
+
+// reproduceDeadlock executes single deadlock and records its outcome. IDs of rows used in deadlock
+// are taken from passed random source.
+func (w *workload) reproduceDeadlock(ctx context.Context, rnd *rand.Rand) {
+	delay := time.Duration(atomic.LoadInt64(&w.lockDelay))
+	start := time.Now()
+	result, err := executeDeadlock(ctx, w.logger, w.config.Conninfo, db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}, w.workingTable(), delay, w.config.Isolation, rnd)
+	elapsed := time.Since(start)
+	if err != nil && ctx.Err() == nil {
+		w.logger.Warnf("reproduce deadlock failed: %s", err)
+	}
+
+	// Interrupted attempt is not a missed deadlock.
+	if result == outcomeMissed && (err != nil || ctx.Err() != nil) {
+		return
+	}
+
+	w.recordOutcome(ctx, result, elapsed)
+}
+
+// recordOutcome counts detected deadlock and confirms it by pg_stat_database, time taken by detected
+// deadlock is recorded into global sink. The outcome is used for tuning lock delay, serialization
+// failures are neither detected nor missed deadlocks and they don't affect the delay.
+func (w *workload) recordOutcome(ctx context.Context, result outcome, elapsed time.Duration) {
+	switch result {
+	case outcomeDeadlock:
+		atomic.AddInt64(&w.detected, 1)
+		sink.Latency(ctx, "deadlocks", "deadlock", elapsed)
+		w.tuneLockDelay(true)
+
+		if !w.confirmDeadlock() {
+			w.logger.Warnf("deadlock has not been confirmed by pg_stat_database within %s", confirmTimeout)
+		}
+	case outcomeSerialization:
+		// Transactions collided, but Postgres resolved the conflict with serialization failure.
+	default:
+		w.tuneLockDelay(false)
+	}
+}
+
+// confirmDeadlock waits until deadlock detected by worker is counted in pg_stat_database and
+// returns true if it has been counted. Statistics are updated asynchronously, so the counter is
+// polled until its delta since the start of the workload exceeds number of already confirmed
+// deadlocks, or until confirm timeout is expired. Each confirmation consumes a single increment
+// of the counter, so concurrent workers can't confirm their deadlocks using the same increment.
+// Confirmation uses private context, so the last deadlock is confirmed when the workload is stopping.
+func (w *workload) confirmDeadlock() bool {
+	ctx, cancel := context.WithTimeout(context.Background(), confirmTimeout)
+	defer cancel()
+
 	for {
-		select {
-		// run workers only when it's possible to write into channel (channel is limited by number of jobs).
-		case guard <- struct{}{}:
-			go func() {
-				err := executeDeadlock(ctx, w.logger, w.config.Conninfo)
-				if err != nil {
-					w.logger.Warnf("reproduce deadlock failed: %s", err)
-				}
-
-				// when worker finished, read from the channel to allow starting another workers
-				<-guard
-			}()
-		case <-ctx.Done():
-			return nil
+		n, err := countDeadlocks(ctx, w.pool)
+		if err == nil {
+			w.confirmMu.Lock()
+			confirmed := n-w.baseline > atomic.LoadInt64(&w.confirmed)
+			if confirmed {
+				atomic.AddInt64(&w.confirmed, 1)
+			}
+			w.confirmMu.Unlock()
+
+			if confirmed {
+				return true
+			}
+		}
+
+		if sleepCtx(ctx, confirmInterval) != nil {
+			return false
 		}
 	}
 }
 
+// tuneLockDelay records outcome of attempt to reproduce deadlock and tunes lock delay when tuning
+// window is complete. If rate of missed deadlocks within the window exceeds max miss rate, the delay
+// is doubled (but no more than max lock delay). If no deadlocks have been missed, the delay is halved
+// (but no less than configured lock delay).
+func (w *workload) tuneLockDelay(detected bool) {
+	w.tuneMu.Lock()
+	defer w.tuneMu.Unlock()
+
+	w.attempts++
+	if !detected {
+		w.misses++
+	}
+
+	if w.attempts < tuneWindow {
+		return
+	}
+
+	missRate := float64(w.misses) / float64(w.attempts)
+	w.attempts, w.misses = 0, 0
+
+	current := time.Duration(atomic.LoadInt64(&w.lockDelay))
+	next := current
+	switch {
+	case missRate > maxMissRate:
+		next = current * 2
+		if next > maxLockDelay {
+			next = maxLockDelay
+		}
+	case missRate == 0:
+		next = current / 2
+		if next < w.config.LockDelay {
+			next = w.config.LockDelay
+		}
+	}
+
+	if next != current {
+		atomic.StoreInt64(&w.lockDelay, int64(next))
+		w.logger.Infof("%.0f%% of deadlocks have not been detected, change lock delay to %s", missRate*100, next)
+	}
+}
+
+// workingTable returns working table used in deadlocks.
+func (w *workload) workingTable() workingTable {
+	return workingTable{name: db.QuoteIdentifier(w.config.TableName), payloadSize: w.config.PayloadSize}
+}
+
 // prepare method creates working table required for deadlocks workload.
 func (w *workload) prepare(ctx context.Context) error {
-	_, _, err := w.pool.Exec(ctx, "CREATE TABLE IF NOT EXISTS _noisia_deadlocks_workload (id bigint, payload text)")
+	// Default table could be left behind by previous run and is reused. Table with custom name
+	// might belong to user and must not be written and then dropped by cleanup, refuse to use it.
+	query := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s (id bigint, payload text)", db.QuoteIdentifier(w.config.TableName))
+	if w.config.TableName != fixtureTable {
+		exists, err := db.TableExists(ctx, w.pool, w.config.TableName)
+		if err != nil {
+			return fmt.Errorf("check working table failed: %s", err)
+		}
+		if exists {
+			return fmt.Errorf("table %s already exists, refuse to use it as working table", w.config.TableName)
+		}
+		query = fmt.Sprintf("CREATE TABLE %s (id bigint, payload text)", db.QuoteIdentifier(w.config.TableName))
+	}
+
+	_, _, err := w.pool.Exec(ctx, query)
 	if err != nil {
 		return err
 	}
+
+	// Make sure the table is really there, otherwise all deadlocks would fail.
+	exists, err := db.TableExists(ctx, w.pool, w.config.TableName)
+	if err != nil {
+		return fmt.Errorf("check working table failed: %s", err)
+	}
+	if !exists {
+		return fmt.Errorf("working table %s does not exist after prepare", w.config.TableName)
+	}
+
 	return nil
 }
 
 // cleanup method drops working table after workload has been done.
 func (w *workload) cleanup() error {
-	_, _, err := w.pool.Exec(context.Background(), "DROP TABLE IF EXISTS _noisia_deadlocks_workload")
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", db.QuoteIdentifier(w.config.TableName)))
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s: %s", w.config.CleanupTimeout, err)
+		}
 		return err
 	}
+
+	// Make sure the table has been dropped and not left behind.
+	exists, err := db.TableExists(ctx, w.pool, w.config.TableName)
+	if err != nil {
+		return fmt.Errorf("check working table failed: %s", err)
+	}
+	if exists {
+		return fmt.Errorf("working table %s still exists after cleanup", w.config.TableName)
+	}
+
 	return nil
 }
 
+// workingTable defines table where deadlocks are reproduced and size of payload written into its rows.
+type workingTable struct {
+	// name defines quoted name of the table.
+	name string
+	// payloadSize defines size of random text payload of rows in bytes.
+	payloadSize int
+}
+
+// insertQuery returns query which inserts two rows with passed IDs.
+func (t workingTable) insertQuery() string {
+	p := payloadExpr(t.payloadSize)
+	return fmt.Sprintf("INSERT INTO %s (id, payload) VALUES ($1, %s), ($2, %s)", t.name, p, p)
+}
+
+// updateQuery returns query which updates payload of row with passed ID.
+func (t workingTable) updateQuery() string {
+	return fmt.Sprintf("UPDATE %s SET payload = %s WHERE id = $1", t.name, payloadExpr(t.payloadSize))
+}
+
+// payloadExpr returns SQL expression which produces random text of passed size in bytes. Text
+// is made of md5 hashes of random values, so it is not compressed when stored in TOAST.
+func payloadExpr(size int) string {
+	if size == defaultPayloadSize {
+		return "md5(random()::text)"
+	}
+
+	n := (size + defaultPayloadSize - 1) / defaultPayloadSize
+	return fmt.Sprintf("left((SELECT string_agg(md5(random()::text), '') FROM generate_series(1, %d)), %d)", n, size)
+}
+
+// participantOptions returns connection options of two deadlock participants. Participants have
+// distinct application_name (e.g. noisia-deadlocks-a and noisia-deadlocks-b), so they and the
+// victim chosen by Postgres could be observed in pg_stat_activity and server logs.
+func participantOptions(opts db.ConnOptions) (db.ConnOptions, db.ConnOptions) {
+	a, b := opts, opts
+	a.Workload = opts.Workload + "-a"
+	b.Workload = opts.Workload + "-b"
+	return a, b
+}
+
 // executeDeadlock make two database connections, inserts necessary rows to the working table
-// and executes transactions which update the rows and collides in a deadlock.
-func executeDeadlock(ctx context.Context, log log.Logger, conninfo string) error {
-	conn1, err := db.Connect(ctx, conninfo)
+// and executes transactions which update the rows and collides in a deadlock. Returns outcome
+// of the collision: detected deadlock, serialization failure or missed deadlock. Transactions
+// are started with passed isolation level.
+func executeDeadlock(ctx context.Context, log log.Logger, conninfo string, opts db.ConnOptions, table workingTable, delay time.Duration, isolation string, rnd *rand.Rand) (outcome, error) {
+	opts1, opts2 := participantOptions(opts)
+
+	conn1, err := db.ConnectWithOptions(ctx, conninfo, opts1)
 	if err != nil {
-		return err
+		return outcomeMissed, err
 	}
+	defer func() { _ = conn1.Close() }()
 
-	conn2, err := db.Connect(ctx, conninfo)
+	conn2, err := db.ConnectWithOptions(ctx, conninfo, opts2)
 	if err != nil {
-		return err
+		return outcomeMissed, err
 	}
+	defer func() { _ = conn2.Close() }()
 
 	// insert two rows
-	rand.Seed(time.Now().UnixNano())
-	id1, id2 := rand.Int(), rand.Int()
-	_, _, err = conn1.Exec(ctx, "INSERT INTO _noisia_deadlocks_workload (id, payload) VALUES ($1, md5(random()::text)), ($2, md5(random()::text))", id1, id2)
+	id1, id2 := rnd.Int(), rnd.Int()
+	_, _, err = conn1.Exec(ctx, table.insertQuery(), id1, id2)
 	if err != nil {
-		return err
+		return outcomeMissed, err
 	}
+	events.Emit(ctx, "deadlocks", "started deadlock on rows %d and %d", id1, id2)
 
-	var wg sync.WaitGroup
+	var (
+		wg            sync.WaitGroup
+		detected      int32
+		serialization int32
+	)
 
 	wg.Add(1)
 	go func() {
-		err := runUpdateXact(context.Background(), conn1, id1, id2)
+		err := runUpdateXact(ctx, conn1, table, id1, id2, delay, isolation)
 		if err != nil {
 			if err.Error() == "ERROR: deadlock detected (SQLSTATE 40P01)" {
-				log.Info("deadlock detected")
-			} else {
+				log.Infof("deadlock detected, victim %s", db.ApplicationName(opts1.Workload))
+				events.Emit(ctx, "deadlocks", "deadlock detected, victim %s", db.ApplicationName(opts1.Workload))
+				atomic.StoreInt32(&detected, 1)
+			} else if db.ErrorCode(err) == serializationFailure {
+				log.Info("serialization failure detected")
+				events.Emit(ctx, "deadlocks", "serialization failure detected")
+				atomic.StoreInt32(&serialization, 1)
+			} else if ctx.Err() == nil {
 				log.Warnf("update failed: %s", err)
 			}
 		}
@@ -164,11 +550,17 @@ func executeDeadlock(ctx context.Context, log log.Logger, conninfo string) error
 
 	wg.Add(1)
 	go func() {
-		err := runUpdateXact(context.Background(), conn2, id2, id1)
+		err := runUpdateXact(ctx, conn2, table, id2, id1, delay, isolation)
 		if err != nil {
 			if err.Error() == "ERROR: deadlock detected (SQLSTATE 40P01)" {
-				log.Info("deadlock detected")
-			} else {
+				log.Infof("deadlock detected, victim %s", db.ApplicationName(opts2.Workload))
+				events.Emit(ctx, "deadlocks", "deadlock detected, victim %s", db.ApplicationName(opts2.Workload))
+				atomic.StoreInt32(&detected, 1)
+			} else if db.ErrorCode(err) == serializationFailure {
+				log.Info("serialization failure detected")
+				events.Emit(ctx, "deadlocks", "serialization failure detected")
+				atomic.StoreInt32(&serialization, 1)
+			} else if ctx.Err() == nil {
 				log.Warnf("update failed: %s", err)
 			}
 		}
@@ -176,31 +568,80 @@ func executeDeadlock(ctx context.Context, log log.Logger, conninfo string) error
 	}()
 
 	wg.Wait()
-	return nil
+
+	switch {
+	case atomic.LoadInt32(&detected) == 1:
+		return outcomeDeadlock, nil
+	case atomic.LoadInt32(&serialization) == 1:
+		return outcomeSerialization, nil
+	default:
+		return outcomeMissed, nil
+	}
 }
 
-// runUpdateXact receives rows IDs and tries to update these rows inside the transaction.
-func runUpdateXact(ctx context.Context, conn db.Conn, id1 int, id2 int) error {
+// runUpdateXact receives rows IDs and tries to update these rows of passed table inside the
+// transaction started with passed isolation level.
+func runUpdateXact(ctx context.Context, conn db.Conn, table workingTable, id1 int, id2 int, delay time.Duration, isolation string) error {
 	tx, err := conn.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
+	err = db.SetIsolationLevel(ctx, tx, isolation)
+	if err != nil {
+		return err
+	}
+
 	// Update row #1
-	_, _, err = tx.Exec(ctx, "UPDATE _noisia_deadlocks_workload SET payload = md5(random()::text) WHERE id = $1", id1)
+	_, _, err = tx.Exec(ctx, table.updateQuery(), id1)
 	if err != nil {
 		return err
 	}
 
-	// This time is sufficient to allow capturing locks in concurrent transaction.
-	time.Sleep(10 * time.Millisecond)
+	// Wait to allow capturing locks in concurrent transaction.
+	err = sleepCtx(ctx, delay)
+	if err != nil {
+		return err
+	}
 
 	// Update row #2
-	_, _, err = tx.Exec(ctx, "UPDATE _noisia_deadlocks_workload SET payload = md5(random()::text) WHERE id = $1", id2)
+	_, _, err = tx.Exec(ctx, table.updateQuery(), id2)
 	if err != nil {
 		return err
 	}
 
 	return tx.Commit(ctx)
 }
+
+// countDeadlocks returns number of deadlocks detected in current database.
+func countDeadlocks(ctx context.Context, pool db.DB) (int64, error) {
+	rows, err := pool.Query(ctx, "SELECT deadlocks FROM pg_stat_database WHERE datname = current_database()")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, rows.Err()
+}
+
+// sleepCtx pauses execution for specified duration or until context is done.
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -2,9 +2,14 @@ package deadlocks
 
 import (
 	"context"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/sink"
 	"github.com/stretchr/testify/assert"
+	"runtime"
+	"strings"
 	"testing"
 	"time"
 )
@@ -16,6 +21,16 @@ func TestConfig_validate(t *testing.T) {
 	}{
 		{valid: true, config: Config{Jobs: 1}},
 		{valid: false, config: Config{Jobs: 0}},
+		{valid: false, config: Config{Jobs: 1, CleanupTimeout: -1}},
+		{valid: true, config: Config{Jobs: 1, LockDelay: 100 * time.Millisecond}},
+		{valid: false, config: Config{Jobs: 1, LockDelay: -1}},
+		{valid: false, config: Config{Jobs: 1, LockDelay: 2 * time.Second}},
+		{valid: true, config: Config{Jobs: 1, Isolation: db.IsolationSerializable}},
+		{valid: false, config: Config{Jobs: 1, Isolation: "invalid"}},
+		{valid: true, config: Config{Jobs: 1, TableName: "Deadlocks Test", PayloadSize: 4096}},
+		{valid: false, config: Config{Jobs: 1, TableName: strings.Repeat("x", 64)}},
+		{valid: false, config: Config{Jobs: 1, PayloadSize: -1}},
+		{valid: false, config: Config{Jobs: 1, PayloadSize: maxPayloadSize + 1}},
 	}
 
 	for _, tc := range testcases {
@@ -36,8 +51,347 @@ func TestWorkload_Run(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
+	r := &sink.Recorder{}
+	sink.Set(r)
+	defer sink.Set(nil)
+
 	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
 	assert.NoError(t, err)
 	err = w.Run(ctx)
 	assert.NoError(t, err)
+
+	// Each detected deadlock is confirmed by pg_stat_database.
+	assert.Greater(t, w.(*workload).detected, int64(0))
+	assert.Greater(t, w.(*workload).confirmed, int64(0))
+	assert.LessOrEqual(t, w.(*workload).confirmed, w.(*workload).detected)
+
+	// Latencies of detected deadlocks are recorded into sink.
+	records := r.Records(sink.KindLatency)
+	assert.Equal(t, w.(*workload).detected, int64(len(records)))
+	for _, rec := range records {
+		assert.Equal(t, "deadlocks", rec.Workload)
+		assert.Equal(t, "deadlock", rec.Name)
+	}
+}
+
+func TestWorkload_Run_goroutines(t *testing.T) {
+	before := runtime.NumGoroutine()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(Config{Conninfo: db.TestConninfo, Jobs: 4}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	// None of goroutines started by the workload outlives Run. Background goroutines of the closed
+	// pool exit asynchronously, give them a moment.
+	assert.Eventually(t, func() bool { return runtime.NumGoroutine() <= before }, time.Second, 10*time.Millisecond)
+}
+
+func TestWorkload_tuneLockDelay(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	record := func(detected, missed int) {
+		for i := 0; i < detected; i++ {
+			wl.tuneLockDelay(true)
+		}
+		for i := 0; i < missed; i++ {
+			wl.tuneLockDelay(false)
+		}
+	}
+
+	// Single miss doesn't change the delay.
+	record(9, 1)
+	assert.Equal(t, int64(defaultLockDelay), wl.lockDelay)
+
+	// Delay is increased when most of deadlocks within the window have been missed.
+	record(4, 6)
+	assert.Equal(t, int64(2*defaultLockDelay), wl.lockDelay)
+
+	// Delay is not changed until the window is complete.
+	record(0, 9)
+	assert.Equal(t, int64(2*defaultLockDelay), wl.lockDelay)
+	record(0, 1)
+	assert.Equal(t, int64(4*defaultLockDelay), wl.lockDelay)
+
+	// Delay is decreased when no deadlocks have been missed, but not below configured delay.
+	record(10, 0)
+	assert.Equal(t, int64(2*defaultLockDelay), wl.lockDelay)
+	record(20, 0)
+	assert.Equal(t, int64(defaultLockDelay), wl.lockDelay)
+
+	// Delay is limited.
+	wl.lockDelay = int64(maxLockDelay)
+	record(0, 10)
+	assert.Equal(t, int64(maxLockDelay), wl.lockDelay)
+}
+
+func TestWorkload_recordOutcome(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	// Serialization failures are not missed deadlocks, they don't increase the delay.
+	for i := 0; i < 2*tuneWindow; i++ {
+		wl.recordOutcome(context.Background(), outcomeSerialization, time.Millisecond)
+	}
+	assert.Equal(t, int64(defaultLockDelay), wl.lockDelay)
+	assert.Equal(t, 0, wl.attempts)
+	assert.Equal(t, int64(0), wl.detected)
+
+	for i := 0; i < tuneWindow; i++ {
+		wl.recordOutcome(context.Background(), outcomeMissed, time.Millisecond)
+	}
+	assert.Equal(t, int64(2*defaultLockDelay), wl.lockDelay)
+
+	// Detected deadlock is counted and confirmed.
+	wl.pool = &countDB{counts: []int64{5, 6}}
+	wl.baseline = 5
+	wl.recordOutcome(context.Background(), outcomeDeadlock, time.Millisecond)
+	assert.Equal(t, int64(1), wl.detected)
+	assert.Equal(t, int64(1), wl.confirmed)
+}
+
+func TestWorkload_confirmDeadlock(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+	wl.baseline = 10
+
+	// Counter is updated with a delay.
+	pool := &countDB{counts: []int64{10, 10, 12}}
+	wl.pool = pool
+	assert.True(t, wl.confirmDeadlock())
+	assert.True(t, wl.confirmDeadlock())
+	assert.Equal(t, int64(2), wl.confirmed)
+
+	// Each increment of the counter confirms a single deadlock only.
+	start := time.Now()
+	assert.False(t, wl.confirmDeadlock())
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(confirmTimeout))
+	assert.Equal(t, int64(2), wl.confirmed)
+}
+
+func Test_sleepCtx(t *testing.T) {
+	assert.NoError(t, sleepCtx(context.Background(), 10*time.Millisecond))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	start := time.Now()
+	assert.Error(t, sleepCtx(ctx, 10*time.Second))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "deadlocks", w.Name())
+}
+
+func TestWorkload_cleanup(t *testing.T) {
+	w := &workload{config: Config{CleanupTimeout: 100 * time.Millisecond, TableName: fixtureTable}, logger: log.NewDefaultLogger("error"), pool: &db.SlowDB{}}
+
+	start := time.Now()
+	assert.Error(t, w.cleanup())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWorkload_prepare_postcondition(t *testing.T) {
+	// Table is not created, e.g. it has been dropped concurrently.
+	w := &workload{config: Config{CleanupTimeout: time.Second, TableName: fixtureTable}, logger: log.NewDefaultLogger("error"), pool: &tableDB{exists: false}}
+	assert.EqualError(t, w.prepare(context.Background()), "working table _noisia_deadlocks_workload does not exist after prepare")
+
+	w.pool = &tableDB{exists: true}
+	assert.NoError(t, w.prepare(context.Background()))
+}
+
+func TestWorkload_prepare_existingTable(t *testing.T) {
+	// Existing table with custom name must not be used and dropped.
+	w := &workload{config: Config{CleanupTimeout: time.Second, TableName: "orders"}, logger: log.NewDefaultLogger("error"), pool: &tableDB{exists: true}}
+	assert.EqualError(t, w.prepare(context.Background()), "table orders already exists, refuse to use it as working table")
+}
+
+func TestWorkload_cleanup_postcondition(t *testing.T) {
+	// Table is not dropped, e.g. DROP has been silently ignored.
+	w := &workload{config: Config{CleanupTimeout: time.Second, TableName: fixtureTable}, logger: log.NewDefaultLogger("error"), pool: &tableDB{exists: true}}
+	assert.EqualError(t, w.cleanup(), "working table _noisia_deadlocks_workload still exists after cleanup")
+
+	w.pool = &tableDB{exists: false}
+	assert.NoError(t, w.cleanup())
+
+	w.pool = &tableDB{err: fmt.Errorf("connection reset")}
+	assert.Error(t, w.cleanup())
+}
+
+// tableDB implements db.DB interface, all statements succeed but don't affect the working
+// table, existence of the table is reported accordingly to exists.
+type tableDB struct {
+	exists bool
+	err    error
+}
+
+func (d *tableDB) Begin(context.Context) (db.Tx, error) {
+	return tableTx{}, nil
+}
+
+func (d *tableDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (d *tableDB) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &boolRows{v: d.exists}, nil
+}
+
+func (d *tableDB) Close() {}
+
+// tableTx implements db.Tx interface, all statements succeed.
+type tableTx struct{}
+
+func (tableTx) Commit(context.Context) error   { return nil }
+func (tableTx) Rollback(context.Context) error { return nil }
+func (tableTx) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (tableTx) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+
+// countDB implements db.DB interface and returns passed deadlocks counters one by one, the last
+// counter is returned when all counters are returned.
+type countDB struct {
+	tableDB
+	counts []int64
+}
+
+func (d *countDB) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	n := d.counts[0]
+	if len(d.counts) > 1 {
+		d.counts = d.counts[1:]
+	}
+	return &countRows{n: n}, nil
+}
+
+// countRows implements db.Rows interface and returns single counter.
+type countRows struct {
+	boolRows
+	n int64
+}
+
+func (r *countRows) Scan(dest ...interface{}) error {
+	*dest[0].(*int64) = r.n
+	return nil
+}
+
+// boolRows implements db.Rows interface and returns single boolean value.
+type boolRows struct {
+	v    bool
+	done bool
+}
+
+func (r *boolRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *boolRows) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = r.v
+	return nil
+}
+
+func (r *boolRows) Err() error { return nil }
+func (r *boolRows) Close()     {}
+
+func Test_workingTable(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	// Default table and payload.
+	table := w.(*workload).workingTable()
+	assert.Equal(t, `INSERT INTO "_noisia_deadlocks_workload" (id, payload) VALUES ($1, md5(random()::text)), ($2, md5(random()::text))`, table.insertQuery())
+	assert.Equal(t, `UPDATE "_noisia_deadlocks_workload" SET payload = md5(random()::text) WHERE id = $1`, table.updateQuery())
+
+	// Configured table name is quoted.
+	w, err = NewWorkload(Config{Jobs: 1, TableName: `dead"locks`, PayloadSize: 100}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	table = w.(*workload).workingTable()
+	payload := "left((SELECT string_agg(md5(random()::text), '') FROM generate_series(1, 4)), 100)"
+	assert.Equal(t, `UPDATE "dead""locks" SET payload = `+payload+` WHERE id = $1`, table.updateQuery())
+}
+
+func Test_executeDeadlock_payloadSize(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 1, TableName: "_noisia_deadlocks_payload_test", PayloadSize: 3000}
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	wl.pool, err = db.NewTestDB()
+	assert.NoError(t, err)
+	defer wl.pool.Close()
+
+	assert.NoError(t, wl.prepare(context.Background()))
+	defer func() { assert.NoError(t, wl.cleanup()) }()
+
+	_, err = executeDeadlock(context.Background(), wl.logger, db.TestConninfo, db.ConnOptions{Workload: w.Name()}, wl.workingTable(), defaultLockDelay, "", random.New(1, 0))
+	assert.NoError(t, err)
+
+	// Inserted and updated rows have payload of configured size.
+	rows, err := wl.pool.Query(context.Background(), "SELECT length(payload) FROM _noisia_deadlocks_payload_test")
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var sizes []int
+	for rows.Next() {
+		var n int
+		assert.NoError(t, rows.Scan(&n))
+		sizes = append(sizes, n)
+	}
+	assert.NoError(t, rows.Err())
+	assert.Equal(t, []int{3000, 3000}, sizes)
+}
+
+func Test_participantOptions(t *testing.T) {
+	opts := db.ConnOptions{PoolerMode: db.PoolerModeSession, Workload: "deadlocks", Role: "app"}
+
+	a, b := participantOptions(opts)
+	assert.Equal(t, "noisia-deadlocks-a", db.ApplicationName(a.Workload))
+	assert.Equal(t, "noisia-deadlocks-b", db.ApplicationName(b.Workload))
+
+	// Other options are preserved.
+	assert.Equal(t, db.PoolerModeSession, b.PoolerMode)
+	assert.Equal(t, "app", b.Role)
+	assert.Equal(t, "deadlocks", opts.Workload)
+}
+
+func Test_participantOptions_applicationName(t *testing.T) {
+	a, b := participantOptions(db.ConnOptions{Workload: "deadlocks"})
+
+	var names []string
+	for _, opts := range []db.ConnOptions{a, b} {
+		conn, err := db.ConnectWithOptions(context.Background(), db.TestConninfo, opts)
+		assert.NoError(t, err)
+		defer func() { _ = conn.Close() }()
+
+		rows, err := conn.Query(context.Background(), "SELECT application_name FROM pg_stat_activity WHERE pid = pg_backend_pid()")
+		assert.NoError(t, err)
+
+		var name string
+		for rows.Next() {
+			assert.NoError(t, rows.Scan(&name))
+		}
+		rows.Close()
+		assert.NoError(t, rows.Err())
+		names = append(names, name)
+	}
+
+	assert.Equal(t, []string{"noisia-deadlocks-a", "noisia-deadlocks-b"}, names)
 }
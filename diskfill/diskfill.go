@@ -0,0 +1,303 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package diskfill defines implementation of workload which consumes disk space of the
+// database up to specified budget. This allows exercising disk usage alerting without
+// actually running out of space.
+//
+// Before starting the workload, a special unlogged working table should be created, so
+// written data doesn't produce WAL. Its payload column uses EXTERNAL storage, so values
+// are not compressed and occupy as much space as requested. When the workload is finished
+// this table is dropped and disk space is reclaimed. For more info see prepare and cleanup
+// methods.
+//
+// When working table is created, rows are inserted accordingly to rate specified in
+// Config.Rate. Before each insert, growth of the database is checked using
+// pg_database_size(). When growth reaches Config.TargetBytes, inserts are stopped and
+// data is held until the workload is finished.
+//
+// To avoid filling the volume by mistake, Config.TargetBytes could not exceed safety cap
+// (see maxTargetBytes). The cap is lifted only when Config.AllowFull is set explicitly,
+// in this case zero TargetBytes means writing until Postgres reports disk is full.
+package diskfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures at the end.
+	defaultCleanupTimeout = 10 * time.Second
+	// maxTargetBytes defines safety cap of target bytes, it could be exceeded only if filling is allowed.
+	maxTargetBytes = 10 * 1024 * 1024 * 1024
+	// maxInsertBytes defines max size of value inserted at once.
+	maxInsertBytes = 1024 * 1024
+	// chunkSize defines size of chunk (md5 hash in text form) used for building values.
+	chunkSize = 32
+	// errDiskFull defines SQLSTATE of "could not extend file: No space left on device" error.
+	errDiskFull = "53100"
+)
+
+// Config defines configuration settings for diskfill workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// TargetBytes defines how much the database should grow, in bytes.
+	TargetBytes int64
+	// Rate defines inserts rate produced per second, each insert writes up to 1MB.
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// AllowFull defines explicit permission to exceed safety cap and fill the volume.
+	AllowFull bool
+	// CleanupTimeout defines max time allowed for cleanup fixtures at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.TargetBytes < 0 {
+		return noisia.NewConfigError("TargetBytes", noisia.ErrInvalidValue, "target bytes must not be negative")
+	}
+
+	if !c.AllowFull && (c.TargetBytes == 0 || c.TargetBytes > maxTargetBytes) {
+		return noisia.NewConfigError("TargetBytes", noisia.ErrInvalidRange, "target bytes must be between 1 and %d, exceeding the cap must be allowed explicitly", int64(maxTargetBytes))
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// inserts defines number of inserted rows.
+	inserts int64
+	// written defines number of bytes of inserted values.
+	written int64
+	// growth defines last observed growth of the database, in bytes.
+	growth int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "diskfill"
+}
+
+// Stats returns counters of inserted rows, written bytes and observed growth of the database.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"inserts":      atomic.LoadInt64(&w.stats.inserts),
+		"bytes":        atomic.LoadInt64(&w.stats.written),
+		"growth_bytes": atomic.LoadInt64(&w.stats.growth),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	// Prepare working table for workload.
+	err = w.prepare(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cleanup in the end.
+	defer func() {
+		err = w.cleanup()
+		if err != nil {
+			w.logger.Warnf("diskfill cleanup failed: %s", err)
+		}
+	}()
+
+	size := func(ctx context.Context) (int64, error) {
+		return databaseSize(ctx, w.pool)
+	}
+
+	err = fillLoop(ctx, w.logger, w.pool, size, w.config, &w.stats)
+	if err != nil {
+		if db.ErrorCode(err) != errDiskFull || !w.config.AllowFull {
+			return err
+		}
+
+		events.Emit(ctx, "diskfill", "disk is full")
+		w.logger.Warnf("diskfill: disk is full, hold written data")
+	}
+
+	// Hold written data until the end, so alerting could fire.
+	<-ctx.Done()
+
+	w.logger.Infof("diskfill finished: %d bytes written, database grew by %d bytes", atomic.LoadInt64(&w.stats.written), atomic.LoadInt64(&w.stats.growth))
+
+	return nil
+}
+
+// prepare method creates unlogged working table with uncompressed payload column.
+func (w *workload) prepare(ctx context.Context) error {
+	tx, err := w.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, _, err = tx.Exec(ctx, "CREATE UNLOGGED TABLE IF NOT EXISTS _noisia_diskfill_workload (id bigserial PRIMARY KEY, payload text)")
+	if err != nil {
+		return err
+	}
+
+	// Disable compression, values occupy as much space as requested.
+	_, _, err = tx.Exec(ctx, "ALTER TABLE _noisia_diskfill_workload ALTER COLUMN payload SET STORAGE EXTERNAL")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// cleanup method drops working table after workload has been done, disk space is reclaimed.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_diskfill_workload")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// fillLoop inserts values with required rate until growth of the database reaches target or
+// context is done. Rate is throttled by adaptive limiter, if specified, inserts are paced by
+// scheduler. Growth is measured using passed size function, zero target means no limit.
+func fillLoop(ctx context.Context, log log.Logger, e db.Execer, size func(context.Context) (int64, error), config Config, st *stats) error {
+	initial, err := size(ctx)
+	if err != nil {
+		return fmt.Errorf("get database size failed: %s", err)
+	}
+
+	target := config.TargetBytes
+	var loopErr error
+	ratelimit.RunWorkerRate(ctx, ratelimit.NewRate(config.Rate), config.Adaptive, config.Scheduler, 0, func(ctx context.Context) error {
+		current, err := size(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = fmt.Errorf("get database size failed: %s", err)
+			}
+			return ratelimit.ErrStop
+		}
+
+		growth := current - initial
+		atomic.StoreInt64(&st.growth, growth)
+
+		if target > 0 && growth >= target {
+			events.Emit(ctx, "diskfill", "target reached, database grew by %d bytes", growth)
+			return ratelimit.ErrStop
+		}
+
+		n := int64(maxInsertBytes)
+		if target > 0 && target-growth < n {
+			n = target - growth
+		}
+
+		// Value is built on the server side to avoid sending it over network.
+		chunks := n / chunkSize
+		if chunks < 1 {
+			chunks = 1
+		}
+
+		_, _, err = e.Exec(ctx, "INSERT INTO _noisia_diskfill_workload (payload) SELECT repeat(md5(random()::text), $1)", chunks)
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = err
+			}
+			return ratelimit.ErrStop
+		}
+
+		atomic.AddInt64(&st.inserts, 1)
+		atomic.AddInt64(&st.written, chunks*chunkSize)
+		return nil
+	}, log)
+
+	return loopErr
+}
+
+// databaseSize returns size of the current database, in bytes.
+func databaseSize(ctx context.Context, q db.Querier) (int64, error) {
+	rows, err := q.Query(ctx, "SELECT pg_database_size(current_database())")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var size int64
+	for rows.Next() {
+		err = rows.Scan(&size)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return size, rows.Err()
+}
@@ -0,0 +1,119 @@
+package diskfill
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Rate: 1, TargetBytes: 1024}},
+		{valid: true, config: Config{Rate: 1, TargetBytes: maxTargetBytes}},
+		{valid: true, config: Config{Rate: 1, TargetBytes: maxTargetBytes + 1, AllowFull: true}},
+		{valid: true, config: Config{Rate: 1, TargetBytes: 0, AllowFull: true}},
+		{valid: false, config: Config{Rate: 0, TargetBytes: 1024}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: 0}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: -1, AllowFull: true}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: maxTargetBytes + 1}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: 1024, CleanupTimeout: -1}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: 1024, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Rate: 1, TargetBytes: 1024, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, TargetBytes: 256 * 1024, Rate: 20}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	// Data must be written and then the working table must be dropped.
+	assert.Greater(t, w.Stats()["bytes"], int64(0))
+
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	var exists bool
+	rows, err := pool.Query(context.Background(), "SELECT to_regclass('_noisia_diskfill_workload') IS NOT NULL")
+	assert.NoError(t, err)
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&exists))
+	}
+	rows.Close()
+	assert.False(t, exists)
+}
+
+// growingExecer implements db.Execer, size of the database grows by size of inserted values.
+type growingExecer struct {
+	size int64
+	err  error
+}
+
+func (e *growingExecer) Exec(_ context.Context, _ string, args ...interface{}) (int64, string, error) {
+	if e.err != nil {
+		return 0, "", e.err
+	}
+	atomic.AddInt64(&e.size, args[0].(int64)*chunkSize)
+	return 1, "INSERT 0 1", nil
+}
+
+func (e *growingExecer) dbSize(context.Context) (int64, error) {
+	return atomic.LoadInt64(&e.size), nil
+}
+
+func Test_fillLoop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// Database has 8MB already, it must grow by 2.5MB only.
+	e := &growingExecer{size: 8 * 1024 * 1024}
+	st := &stats{}
+	assert.NoError(t, fillLoop(ctx, log.NewDefaultLogger("error"), e, e.dbSize, Config{TargetBytes: 2560 * 1024, Rate: 100}, st))
+	assert.NoError(t, ctx.Err()) // loop must stop when target reached, not when context is done
+
+	assert.Equal(t, int64(3), st.inserts)
+	assert.Equal(t, int64(2560*1024), st.written)
+	assert.Equal(t, int64(2560*1024), st.growth)
+	assert.Equal(t, int64(8*1024*1024+2560*1024), e.size)
+}
+
+func Test_fillLoop_unlimited(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	e := &growingExecer{}
+	st := &stats{}
+	assert.NoError(t, fillLoop(ctx, log.NewDefaultLogger("error"), e, e.dbSize, Config{TargetBytes: 0, Rate: 50}, st))
+	assert.Greater(t, st.inserts, int64(1))
+	assert.Equal(t, st.inserts*maxInsertBytes, st.written)
+}
+
+func Test_fillLoop_error(t *testing.T) {
+	e := &growingExecer{err: fmt.Errorf("no space left on device")}
+	assert.Error(t, fillLoop(context.Background(), log.NewDefaultLogger("error"), e, e.dbSize, Config{TargetBytes: 1024, Rate: 50}, &stats{}))
+
+	failed := func(context.Context) (int64, error) { return 0, fmt.Errorf("permission denied") }
+	assert.Error(t, fillLoop(context.Background(), log.NewDefaultLogger("error"), e, failed, Config{TargetBytes: 1024, Rate: 50}, &stats{}))
+}
@@ -0,0 +1,82 @@
+package noisia
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Categories of configuration errors, use errors.Is for checking category of the error returned by workload constructors.
+var (
+	// ErrInvalidJobs defines error related to invalid number of workers.
+	ErrInvalidJobs = errors.New("invalid jobs")
+	// ErrInvalidRate defines error related to invalid rate.
+	ErrInvalidRate = errors.New("invalid rate")
+	// ErrInvalidDuration defines error related to invalid duration, interval or timeout.
+	ErrInvalidDuration = errors.New("invalid duration")
+	// ErrInvalidRange defines error related to invalid range, e.g. min naptime greater than max naptime.
+	ErrInvalidRange = errors.New("invalid range")
+	// ErrInvalidValue defines error related to other invalid values.
+	ErrInvalidValue = errors.New("invalid value")
+)
+
+// ConfigError describes invalid setting in workload's configuration. Use errors.As for
+// extracting the error and getting name of the invalid field.
+type ConfigError struct {
+	// Field defines name of the invalid field in workload's Config.
+	Field string
+	// Err defines category of the error, e.g. ErrInvalidJobs.
+	Err error
+	// Msg defines human-readable description of the error.
+	Msg string
+}
+
+// NewConfigError creates a new configuration error for specified field and category.
+func NewConfigError(field string, category error, format string, a ...interface{}) error {
+	return &ConfigError{Field: field, Err: category, Msg: fmt.Sprintf(format, a...)}
+}
+
+// Error returns human-readable description of the error.
+func (e *ConfigError) Error() string {
+	return e.Msg
+}
+
+// Unwrap returns category of the error.
+func (e *ConfigError) Unwrap() error {
+	return e.Err
+}
+
+// RunError describes failures of workloads which have been run together. Use errors.As for
+// extracting the error, errors.Is reports whether error of any failed workload matches target.
+type RunError struct {
+	// Errs defines errors returned by failed workloads, by workloads names.
+	Errs map[string]error
+}
+
+// Error returns human-readable description of the error, workloads are sorted by names.
+func (e *RunError) Error() string {
+	names := make([]string, 0, len(e.Errs))
+	for name := range e.Errs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	msgs := make([]string, 0, len(names))
+	for _, name := range names {
+		msgs = append(msgs, fmt.Sprintf("%s: %s", name, e.Errs[name]))
+	}
+
+	return "workloads failed: " + strings.Join(msgs, "; ")
+}
+
+// Is reports whether error of any failed workload matches target.
+func (e *RunError) Is(target error) bool {
+	for _, err := range e.Errs {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,34 @@
+package noisia
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestConfigError(t *testing.T) {
+	err := NewConfigError("Jobs", ErrInvalidJobs, "jobs must be greater than %s", "zero")
+	assert.EqualError(t, err, "jobs must be greater than zero")
+	assert.True(t, errors.Is(err, ErrInvalidJobs))
+	assert.False(t, errors.Is(err, ErrInvalidRate))
+
+	// Field is available for wrapped errors too.
+	var cerr *ConfigError
+	assert.True(t, errors.As(fmt.Errorf("create workload: %w", err), &cerr))
+	assert.Equal(t, "Jobs", cerr.Field)
+}
+
+func TestRunError(t *testing.T) {
+	err := &RunError{Errs: map[string]error{
+		"rollbacks": errors.New("connection refused"),
+		"deadlocks": NewConfigError("Jobs", ErrInvalidJobs, "jobs must be greater than zero"),
+	}}
+	assert.EqualError(t, err, "workloads failed: deadlocks: jobs must be greater than zero; rollbacks: connection refused")
+	assert.True(t, errors.Is(err, ErrInvalidJobs))
+	assert.False(t, errors.Is(err, ErrInvalidRate))
+
+	var rerr *RunError
+	assert.True(t, errors.As(fmt.Errorf("run: %w", err), &rerr))
+	assert.Len(t, rerr.Errs, 2)
+}
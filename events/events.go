@@ -0,0 +1,113 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package events defines machine-readable log of actions performed by workloads.
+// Unlike human-readable logger, events are intended for post-incident analysis
+// and replaying what was done.
+//
+// Sink is configured globally using SetSink. Workloads call Emit at decision points,
+// when no sink is configured, events are discarded. Events are marked with run ID
+// configured using SetRunID, so events of different runs could be told apart. Workloads
+// run with context tagged by WithCluster emit events tagged by the cluster, so events of
+// the same workloads run against different clusters could be told apart too.
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// Event defines single action performed by workload.
+type Event struct {
+	// Time defines when action has been performed.
+	Time time.Time `json:"time"`
+	// Workload defines name of the workload which performed action.
+	Workload string `json:"workload"`
+	// Action defines description of performed action.
+	Action string `json:"action"`
+	// RunID defines identifier of the run which performed action.
+	RunID string `json:"run_id,omitempty"`
+}
+
+// Sink defines destination where events are written to.
+type Sink interface {
+	Write(e Event) error
+}
+
+var (
+	mu    sync.RWMutex
+	sink  Sink
+	runID string
+)
+
+// SetSink configures global sink used for writing events. Nil sink disables events.
+func SetSink(s Sink) {
+	mu.Lock()
+	sink = s
+	mu.Unlock()
+}
+
+// SetRunID configures identifier of the run which is added to all events. Empty ID is not added.
+func SetRunID(id string) {
+	mu.Lock()
+	runID = id
+	mu.Unlock()
+}
+
+// clusterKey defines key of cluster label stored in context.
+type clusterKey struct{}
+
+// WithCluster returns copy of passed context tagged by label of the cluster, which workloads run
+// with the context are run against.
+func WithCluster(ctx context.Context, cluster string) context.Context {
+	return context.WithValue(ctx, clusterKey{}, cluster)
+}
+
+// WorkloadLabel returns name of the workload tagged by cluster of passed context, e.g. 'rollbacks@b'.
+// Name is returned as is if context is not tagged.
+func WorkloadLabel(ctx context.Context, workload string) string {
+	if cluster, ok := ctx.Value(clusterKey{}).(string); ok && cluster != "" {
+		return workload + "@" + cluster
+	}
+
+	return workload
+}
+
+// Emit writes event about action performed by workload into global sink. Workload is tagged by
+// cluster of passed context.
+func Emit(ctx context.Context, workload string, format string, v ...interface{}) {
+	mu.RLock()
+	s, id := sink, runID
+	mu.RUnlock()
+
+	if s == nil {
+		return
+	}
+
+	// Events are auxiliary, ignore errors to don't affect workload.
+	_ = s.Write(Event{Time: time.Now(), Workload: WorkloadLabel(ctx, workload), Action: fmt.Sprintf(format, v...), RunID: id})
+}
+
+// jsonSink implements Sink interface which writes events as JSON lines.
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONSink creates sink which writes events as JSON lines into passed writer.
+func NewJSONSink(w io.Writer) Sink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+// Write encodes event as JSON line and writes it.
+func (s *jsonSink) Write(e Event) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(e)
+}
@@ -0,0 +1,47 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEmit(t *testing.T) {
+	buf := &bytes.Buffer{}
+	SetSink(NewJSONSink(buf))
+	defer SetSink(nil)
+
+	Emit(context.Background(), "example", "action %d", 1)
+	Emit(context.Background(), "example", "action %d", 2)
+
+	dec := json.NewDecoder(buf)
+	for _, want := range []string{"action 1", "action 2"} {
+		var e Event
+		assert.NoError(t, dec.Decode(&e))
+		assert.Equal(t, "example", e.Workload)
+		assert.Equal(t, want, e.Action)
+		assert.False(t, e.Time.IsZero())
+	}
+
+	// Run ID is added to events when configured.
+	SetRunID("abc123")
+	defer SetRunID("")
+	Emit(context.Background(), "example", "action %d", 3)
+
+	var e Event
+	assert.NoError(t, dec.Decode(&e))
+	assert.Equal(t, "abc123", e.RunID)
+
+	// Workload is tagged by cluster of the context.
+	Emit(WithCluster(context.Background(), "b"), "example", "action %d", 4)
+	assert.NoError(t, dec.Decode(&e))
+	assert.Equal(t, "example@b", e.Workload)
+
+	// No sink configured, events are discarded.
+	SetSink(nil)
+	buf.Reset()
+	Emit(context.Background(), "example", "discarded")
+	assert.Equal(t, 0, buf.Len())
+}
@@ -8,28 +8,120 @@
 // and no one client can connect to Postgres.
 //
 // Implementation of the workload is quite simple - create new connections in a
-// loop until Postgres starts respond with error. By default, an array with 1000
-// slots is used, so it possible to set max_connections to higher value and
-// pass the workload with no errors.
+// loop until Postgres starts respond with error. Held connections are kept in a list
+// which initial capacity is taken from Config.Capacity, or derived from max_connections
+// of the server if not specified, so the list is not regrown on clusters with many
+// connections and not overallocated on small ones.
+//
+// Opened connections are held until the workload is done. Optionally, to model a
+// client pool which keeps churning near the limit, each Config.HoldTime a part of
+// held connections (accordingly to Config.ReleaseRatio) is closed and then reopened.
+//
+// When Postgres refuses connection with "too many clients" error, number of connections held
+// at that moment is recorded and reported at the end as the discovered connections limit.
+//
+// Connections are made each Config.Interval. When connection attempt fails the
+// interval is increased in Config.GrowFactor times, when attempt succeeds the interval
+// is reduced in Config.ShrinkFactor times, but no less than Config.MinInterval.
 package failconns
 
 import (
 	"context"
 	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/sink"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// defaultCleanupTimeout defines default max time allowed for closing held connections at the end.
+	defaultCleanupTimeout = 10 * time.Second
+	// cleanupConcurrency defines max number of connections closed concurrently during cleanup.
+	cleanupConcurrency = 16
+	// defaultInterval defines default interval between making new connections to Postgres.
+	defaultInterval = 50 * time.Millisecond
+	// defaultGrowFactor defines default factor used for increasing interval after failed connection attempt.
+	defaultGrowFactor = 2
+	// defaultShrinkFactor defines default factor used for reducing interval after successful connection attempt.
+	defaultShrinkFactor = 2
+	// defaultCapacity defines initial capacity of held connections list used when max_connections could not be queried.
+	defaultCapacity = 1000
+	// errTooManyConnections defines SQLSTATE of "sorry, too many clients already" error.
+	errTooManyConnections = "53300"
+)
+
 // Config defines configuration settings for failconns workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
 	Conninfo string
+	// HoldTime defines interval after which a part of held connections is released, zero means hold until the end.
+	HoldTime time.Duration
+	// ReleaseRatio defines a fraction of held connections released every HoldTime.
+	ReleaseRatio float64
+	// Interval defines base interval between making new connections, if zero the default interval is used.
+	Interval time.Duration
+	// MinInterval defines lower limit for interval reduced after successful attempts, if zero the base interval is used.
+	MinInterval time.Duration
+	// GrowFactor defines factor of increasing interval after failed attempt, if zero the default factor is used.
+	GrowFactor float64
+	// ShrinkFactor defines factor of reducing interval after successful attempt, if zero the default factor is used.
+	ShrinkFactor float64
+	// Capacity defines initial capacity of held connections list, if zero it is derived from max_connections.
+	Capacity int
+	// CleanupTimeout defines max time allowed for closing held connections at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
-	// nothing to validate
+	if c.HoldTime < 0 {
+		return noisia.NewConfigError("HoldTime", noisia.ErrInvalidDuration, "hold time must not be negative")
+	}
+
+	if c.ReleaseRatio < 0 || c.ReleaseRatio > 1 {
+		return noisia.NewConfigError("ReleaseRatio", noisia.ErrInvalidRange, "release ratio must be between 0 and 1")
+	}
+
+	if c.HoldTime > 0 && c.ReleaseRatio == 0 {
+		return noisia.NewConfigError("ReleaseRatio", noisia.ErrInvalidValue, "release ratio must be greater than zero when hold time is specified")
+	}
+
+	if c.Interval < 0 || c.MinInterval < 0 {
+		return noisia.NewConfigError("Interval", noisia.ErrInvalidDuration, "intervals must not be negative")
+	}
+
+	if c.Interval > 0 && c.MinInterval > c.Interval {
+		return noisia.NewConfigError("MinInterval", noisia.ErrInvalidRange, "min interval must be less or equal to interval")
+	}
+
+	if c.GrowFactor != 0 && c.GrowFactor <= 1 {
+		return noisia.NewConfigError("GrowFactor", noisia.ErrInvalidValue, "grow factor must be greater than 1")
+	}
+
+	if c.ShrinkFactor != 0 && c.ShrinkFactor <= 1 {
+		return noisia.NewConfigError("ShrinkFactor", noisia.ErrInvalidValue, "shrink factor must be greater than 1")
+	}
+
+	if c.Capacity < 0 {
+		return noisia.NewConfigError("Capacity", noisia.ErrInvalidValue, "capacity must not be negative")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
 
 	return nil
 }
@@ -38,6 +130,18 @@ func (c Config) validate() error {
 type workload struct {
 	config Config
 	logger log.Logger
+	// connect defines function used for making new connections.
+	connect func(ctx context.Context, conninfo string) (db.Conn, error)
+	// maxConnections defines function used for querying max_connections of the server.
+	maxConnections func(ctx context.Context, conninfo string) (int, error)
+	// opened defines number of opened connections.
+	opened int64
+	// released defines number of connections released before the end of the workload.
+	released int64
+	// failed defines number of failed connection attempts.
+	failed int64
+	// limit defines number of connections held when Postgres refused connection due to too many clients.
+	limit int64
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -47,49 +151,241 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger}, nil
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	if config.Interval == 0 {
+		config.Interval = defaultInterval
+	}
+
+	if config.MinInterval == 0 || config.MinInterval > config.Interval {
+		config.MinInterval = config.Interval
+	}
+
+	if config.GrowFactor == 0 {
+		config.GrowFactor = defaultGrowFactor
+	}
+
+	if config.ShrinkFactor == 0 {
+		config.ShrinkFactor = defaultShrinkFactor
+	}
+
+	w := &workload{config: config, logger: logger}
+	w.connect = func(ctx context.Context, conninfo string) (db.Conn, error) {
+		return db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath})
+	}
+	w.maxConnections = func(ctx context.Context, conninfo string) (int, error) {
+		conn, err := db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath})
+		if err != nil {
+			return 0, err
+		}
+		defer func() { _ = conn.Close() }()
+
+		return queryMaxConnections(ctx, conn)
+	}
+
+	return w, nil
 }
 
-// Run method connects to Postgres and starts the workload.
-func (w *workload) Run(ctx context.Context) error {
-	// defaultConnInterval defines default interval between making new connection to Postgres
-	defaultConnInterval := 50 * time.Millisecond
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "failconns"
+}
 
-	conns := make([]db.Conn, 0, 1000)
-	interval := defaultConnInterval
+// Stats returns counters of opened, released and failed connections, and discovered connections
+// limit (zero if the limit has not been reached).
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"opened":   atomic.LoadInt64(&w.opened),
+		"released": atomic.LoadInt64(&w.released),
+		"failed":   atomic.LoadInt64(&w.failed),
+		"limit":    atomic.LoadInt64(&w.limit),
+	}
+}
+
+// Run method connects to Postgres and starts the workload. Latencies of successful connects are
+// recorded into global sink.
+func (w *workload) Run(ctx context.Context) error {
+	conns := w.newConnsList(ctx)
+	interval := w.config.Interval
 	timer := time.NewTimer(interval)
 
+	// Release connections periodically only if hold time is specified.
+	var releaseC <-chan time.Time
+	if w.config.HoldTime > 0 {
+		ticker := time.NewTicker(w.config.HoldTime)
+		defer ticker.Stop()
+		releaseC = ticker.C
+	}
+
 	for {
 		// Wait until timer has been expired or context has been done.
 		select {
 		case <-timer.C:
-			c, err := db.Connect(ctx, w.config.Conninfo)
+			start := time.Now()
+			c, err := w.connect(ctx, w.config.Conninfo)
 			if err != nil {
 				w.logger.Info(err.Error())
+				events.Emit(ctx, "failconns", "connection failed: %s", err)
+				atomic.AddInt64(&w.failed, 1)
+
+				if db.ErrorCode(err) == errTooManyConnections && atomic.LoadInt64(&w.limit) != int64(len(conns)) {
+					atomic.StoreInt64(&w.limit, int64(len(conns)))
+					events.Emit(ctx, "failconns", "connections limit reached, %d connections held", len(conns))
+				}
 
 				// if connect has failed, increase interval between connects
-				interval = interval * 2
+				interval = time.Duration(float64(interval) * w.config.GrowFactor)
 			} else {
 				// append connection into slice
 				conns = append(conns, c)
+				atomic.AddInt64(&w.opened, 1)
+				sink.Latency(ctx, "failconns", "connect", time.Since(start))
+				events.Emit(ctx, "failconns", "opened connection, total %d", len(conns))
 
-				// if attempt was successful reduce interval, but no less than default
-				if interval > defaultConnInterval {
-					interval = interval / 2
+				// if attempt was successful reduce interval, but no less than min interval
+				if interval > w.config.MinInterval {
+					interval = time.Duration(float64(interval) / w.config.ShrinkFactor)
+					if interval < w.config.MinInterval {
+						interval = w.config.MinInterval
+					}
 				}
 			}
 
 			timer.Reset(interval)
+		case <-releaseC:
+			n := len(conns)
+			conns = releaseConns(conns, w.config.ReleaseRatio)
+			atomic.AddInt64(&w.released, int64(n-len(conns)))
+			events.Emit(ctx, "failconns", "released %d connections, total %d", n-len(conns), len(conns))
 		case <-ctx.Done():
 			w.cleanup(conns)
+			w.logger.Infof("failconns finished: %d connections opened, %d released", atomic.LoadInt64(&w.opened), atomic.LoadInt64(&w.released))
+			if limit := atomic.LoadInt64(&w.limit); limit > 0 {
+				w.logger.Infof("failconns: connections limit reached with %d connections held", limit)
+			} else {
+				w.logger.Info("failconns: connections limit has not been reached")
+			}
 			return nil
 		}
 	}
 }
 
-// cleanup gracefully closes all database connections
-func (w *workload) cleanup(conns []db.Conn) {
-	for i := range conns {
+// newConnsList creates empty list for held connections. If capacity is not configured, it is
+// derived from max_connections, because no more connections could be held.
+func (w *workload) newConnsList(ctx context.Context) []db.Conn {
+	if w.config.Capacity > 0 {
+		return make([]db.Conn, 0, w.config.Capacity)
+	}
+
+	n, err := w.maxConnections(ctx, w.config.Conninfo)
+	if err != nil {
+		w.logger.Warnf("failconns: query max_connections failed, use default capacity %d: %s", defaultCapacity, err)
+		return make([]db.Conn, 0, defaultCapacity)
+	}
+
+	if n <= 0 {
+		n = defaultCapacity
+	}
+
+	return make([]db.Conn, 0, n)
+}
+
+// queryMaxConnections returns value of max_connections setting.
+func queryMaxConnections(ctx context.Context, q db.Querier) (int, error) {
+	rows, err := q.Query(ctx, "SELECT current_setting('max_connections')::int")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, rows.Err()
+}
+
+// releaseConns closes the oldest connections accordingly to ratio and returns remaining connections.
+// Remaining connections are moved to the beginning of the list, so closed connections are not
+// referenced and the list capacity is reused.
+func releaseConns(conns []db.Conn, ratio float64) []db.Conn {
+	n := int(float64(len(conns)) * ratio)
+
+	for i := 0; i < n; i++ {
 		_ = conns[i].Close()
 	}
+
+	remaining := copy(conns, conns[n:])
+	for i := remaining; i < len(conns); i++ {
+		conns[i] = nil
+	}
+
+	return conns[:remaining]
+}
+
+// cleanup gracefully closes all database connections. Run's context is already done at
+// this moment, hence private context is used to limit cleanup duration.
+func (w *workload) cleanup(conns []db.Conn) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	err := closeConns(ctx, w.logger, conns, cleanupConcurrency)
+	if err != nil {
+		w.logger.Warnf("failconns cleanup interrupted: %s", err)
+	}
+}
+
+// closeConns closes connections using limited number of concurrent workers. It returns when
+// all connections are closed or context is done, remaining connections are left as is.
+func closeConns(ctx context.Context, logger log.Logger, conns []db.Conn, concurrency int) error {
+	if concurrency > len(conns) {
+		concurrency = len(conns)
+	}
+
+	connCh := make(chan db.Conn)
+	doneCh := make(chan struct{})
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for c := range connCh {
+				err := c.Close()
+				if err != nil {
+					logger.Debugf("close connection failed: %s", err)
+				}
+			}
+		}()
+	}
+
+	// Feed connections to workers until all of them are passed or context is done.
+	go func() {
+		defer close(connCh)
+		for _, c := range conns {
+			select {
+			case connCh <- c:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	go func() {
+		wg.Wait()
+		close(doneCh)
+	}()
+
+	select {
+	case <-doneCh:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
@@ -2,9 +2,12 @@ package failconns
 
 import (
 	"context"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/sink"
 	"github.com/stretchr/testify/assert"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -15,6 +18,23 @@ func TestConfig_validate(t *testing.T) {
 		config Config
 	}{
 		{valid: true, config: Config{}},
+		{valid: true, config: Config{HoldTime: time.Second, ReleaseRatio: 0.5}},
+		{valid: false, config: Config{HoldTime: -1}},
+		{valid: false, config: Config{HoldTime: time.Second}},
+		{valid: false, config: Config{HoldTime: time.Second, ReleaseRatio: -0.1}},
+		{valid: false, config: Config{HoldTime: time.Second, ReleaseRatio: 1.1}},
+		{valid: true, config: Config{Interval: time.Second, MinInterval: 100 * time.Millisecond, GrowFactor: 1.5, ShrinkFactor: 3}},
+		{valid: false, config: Config{Interval: -1}},
+		{valid: false, config: Config{MinInterval: -1}},
+		{valid: false, config: Config{Interval: 100 * time.Millisecond, MinInterval: time.Second}},
+		{valid: false, config: Config{GrowFactor: 1}},
+		{valid: false, config: Config{GrowFactor: 0.5}},
+		{valid: false, config: Config{ShrinkFactor: 1}},
+		{valid: false, config: Config{ShrinkFactor: -2}},
+		{valid: true, config: Config{Capacity: 100}},
+		{valid: false, config: Config{Capacity: -1}},
+		{valid: false, config: Config{CleanupTimeout: -1}},
+		{valid: false, config: Config{SearchPath: "app,,public"}},
 	}
 
 	for _, tc := range testcases {
@@ -39,3 +59,246 @@ func TestWorkload_Run(t *testing.T) {
 	err = w.Run(ctx)
 	assert.Nil(t, err)
 }
+
+func TestWorkload_Run_release(t *testing.T) {
+	config := Config{
+		HoldTime:     200 * time.Millisecond,
+		ReleaseRatio: 0.5,
+		Interval:     10 * time.Millisecond,
+		MinInterval:  10 * time.Millisecond,
+		Capacity:     100,
+	}
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	// Connections are released between connects, held and released connections are
+	// recorded at the next connect.
+	type release struct{ held, released int64 }
+	var opened, closed, lastClosed int64
+	var releases []release
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) {
+		if c := atomic.LoadInt64(&closed); c != lastClosed {
+			releases = append(releases, release{held: opened - lastClosed, released: c - lastClosed})
+			lastClosed = c
+		}
+		opened++
+		return &fakeConn{closes: &closed}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 550*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, w.Run(ctx))
+
+	// Expecting releases at 200ms and 400ms, each closes half of held connections.
+	assert.Greater(t, opened, int64(0))
+	assert.Len(t, releases, 2)
+	var released int64
+	for _, r := range releases {
+		assert.Greater(t, r.held, int64(0))
+		assert.Equal(t, int64(float64(r.held)*config.ReleaseRatio), r.released)
+		released += r.released
+	}
+	assert.Equal(t, released, w.Stats()["released"])
+
+	// All connections are closed at the end.
+	assert.Equal(t, opened, atomic.LoadInt64(&closed))
+}
+
+func TestNewWorkload(t *testing.T) {
+	w, err := NewWorkload(Config{}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, Config{Interval: defaultInterval, MinInterval: defaultInterval, GrowFactor: 2, ShrinkFactor: 2, CleanupTimeout: defaultCleanupTimeout}, w.(*workload).config)
+
+	w, err = NewWorkload(Config{Interval: time.Second, MinInterval: 10 * time.Millisecond}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, time.Second, w.(*workload).config.Interval)
+	assert.Equal(t, 10*time.Millisecond, w.(*workload).config.MinInterval)
+}
+
+func TestWorkload_Run_interval(t *testing.T) {
+	w, err := NewWorkload(Config{Interval: 40 * time.Millisecond}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	var times []time.Time
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) {
+		times = append(times, time.Now())
+		return &fakeConn{}, nil
+	}
+
+	r := &sink.Recorder{}
+	sink.Set(r)
+	defer sink.Set(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 420*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, w.Run(ctx))
+
+	// Latencies of successful connects are recorded into sink.
+	records := r.Records(sink.KindLatency)
+	assert.Len(t, records, len(times))
+	for _, rec := range records {
+		assert.Equal(t, "failconns", rec.Workload)
+		assert.Equal(t, "connect", rec.Name)
+	}
+
+	// Expecting about 10 connections made each 40ms.
+	assert.GreaterOrEqual(t, len(times), 8)
+	assert.LessOrEqual(t, len(times), 10)
+	for i := 1; i < len(times); i++ {
+		assert.GreaterOrEqual(t, int64(times[i].Sub(times[i-1])), int64(40*time.Millisecond))
+	}
+}
+
+func Test_releaseConns(t *testing.T) {
+	conns := make([]db.Conn, 10)
+	for i := range conns {
+		conns[i] = &fakeConn{}
+	}
+
+	all := append([]db.Conn(nil), conns...)
+	remaining := releaseConns(conns, 0.3)
+	assert.Len(t, remaining, 7)
+
+	for i, c := range all {
+		assert.Equal(t, i < 3, c.(*fakeConn).closed)
+	}
+
+	// Remaining connections are the newest ones, closed connections are not referenced.
+	assert.Equal(t, all[3:], remaining)
+	for _, c := range conns[7:] {
+		assert.Nil(t, c)
+	}
+
+	assert.Len(t, releaseConns(remaining, 0), 7)
+	assert.Len(t, releaseConns(remaining, 1), 0)
+}
+
+func Test_closeConns(t *testing.T) {
+	// Sequential closing would take 5 seconds.
+	conns := make([]db.Conn, 1000)
+	for i := range conns {
+		conns[i] = &fakeConn{delay: 5 * time.Millisecond}
+	}
+	conns[0].(*fakeConn).err = fmt.Errorf("example error")
+
+	start := time.Now()
+	assert.NoError(t, closeConns(context.Background(), log.NewDefaultLogger("error"), conns, cleanupConcurrency))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	for _, c := range conns {
+		assert.True(t, c.(*fakeConn).closed)
+	}
+
+	// Cleanup is interrupted when context is done.
+	conns = []db.Conn{&fakeConn{delay: 10 * time.Second}}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	start = time.Now()
+	assert.Error(t, closeConns(ctx, log.NewDefaultLogger("error"), conns, cleanupConcurrency))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Nothing to close.
+	assert.NoError(t, closeConns(context.Background(), log.NewDefaultLogger("error"), nil, cleanupConcurrency))
+}
+
+// sqlstateErr implements error with SQLSTATE code, as returned by Postgres.
+type sqlstateErr struct{ code string }
+
+func (e sqlstateErr) Error() string {
+	return "FATAL: sorry, too many clients already (SQLSTATE " + e.code + ")"
+}
+func (e sqlstateErr) SQLState() string { return e.code }
+
+func TestWorkload_Run_limit(t *testing.T) {
+	testcases := []struct {
+		err   error
+		limit int64
+	}{
+		{err: sqlstateErr{code: "53300"}, limit: 3},
+		{err: sqlstateErr{code: "28P01"}, limit: 0}, // authentication failure is not a limit
+		{err: fmt.Errorf("connection refused"), limit: 0},
+	}
+
+	for _, tc := range testcases {
+		w, err := NewWorkload(Config{Interval: 10 * time.Millisecond, GrowFactor: 1.1}, log.NewDefaultLogger("error"))
+		assert.NoError(t, err)
+
+		// Server accepts only 3 connections.
+		var n int
+		w.(*workload).connect = func(context.Context, string) (db.Conn, error) {
+			n++
+			if n > 3 {
+				return nil, tc.err
+			}
+			return &fakeConn{}, nil
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 150*time.Millisecond)
+		assert.NoError(t, w.Run(ctx))
+		cancel()
+
+		stats := w.Stats()
+		assert.Greater(t, stats["failed"], int64(0))
+		assert.Equal(t, tc.limit, stats["limit"])
+	}
+}
+
+func TestWorkload_newConnsList(t *testing.T) {
+	w, err := NewWorkload(Config{}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	// Capacity is derived from max_connections of the server.
+	wl.maxConnections = func(context.Context, string) (int, error) { return 5000, nil }
+	conns := wl.newConnsList(context.Background())
+	assert.Len(t, conns, 0)
+	assert.Equal(t, 5000, cap(conns))
+
+	// Default capacity is used if max_connections could not be queried.
+	wl.maxConnections = func(context.Context, string) (int, error) { return 0, fmt.Errorf("connection refused") }
+	assert.Equal(t, defaultCapacity, cap(wl.newConnsList(context.Background())))
+
+	// Configured capacity takes precedence.
+	wl.config.Capacity = 20
+	assert.Equal(t, 20, cap(wl.newConnsList(context.Background())))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "failconns", w.Name())
+}
+
+// fakeConn implements db.Conn interface and tracks whether connection is closed.
+type fakeConn struct {
+	closed bool
+	// delay defines how long closing of connection takes.
+	delay time.Duration
+	// err defines error returned when connection is closed.
+	err error
+	// closes defines optional counter of closed connections.
+	closes *int64
+}
+
+func (c *fakeConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *fakeConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (c *fakeConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func (c *fakeConn) Close() error {
+	time.Sleep(c.delay)
+	c.closed = true
+	if c.closes != nil {
+		atomic.AddInt64(c.closes, 1)
+	}
+	return c.err
+}
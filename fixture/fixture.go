@@ -0,0 +1,98 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package fixture implements management of temporary tables created by workloads.
+// Names of the tables are guaranteed to be unique within the process, so tables
+// created concurrently or within the same second never collide. Created tables are
+// tracked, so they could be dropped when workload is finished.
+package fixture
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// namePrefix defines prefix used in names of temporary tables.
+const namePrefix = "noisia_tmp"
+
+// seq is incremented on every generated name.
+var seq uint64
+
+// Name returns unique name of temporary table. Name contains process ID and sequence number.
+func Name() string {
+	return fmt.Sprintf("%s_%d_%d", namePrefix, os.Getpid(), atomic.AddUint64(&seq, 1))
+}
+
+// TempTables creates temporary tables using passed connection and tracks them for cleanup.
+type TempTables struct {
+	mu     sync.Mutex
+	conn   db.Execer
+	tables []string
+}
+
+// NewTempTables creates a new TempTables which uses passed connection (or transaction).
+func NewTempTables(conn db.Execer) *TempTables {
+	return &TempTables{conn: conn}
+}
+
+// Create creates temporary table with unique name and returns the name. Definition is
+// appended to CREATE TEMP TABLE statement, e.g. list of columns or AS SELECT clause.
+func (t *TempTables) Create(ctx context.Context, definition string) (string, error) {
+	name := Name()
+
+	_, _, err := t.conn.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE %s %s", name, definition))
+	if err != nil {
+		return "", err
+	}
+
+	t.mu.Lock()
+	t.tables = append(t.tables, name)
+	t.mu.Unlock()
+
+	return name, nil
+}
+
+// Drop drops passed table and stops tracking it.
+func (t *TempTables) Drop(ctx context.Context, name string) error {
+	_, _, err := t.conn.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", name))
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for i, v := range t.tables {
+		if v == name {
+			t.tables = append(t.tables[:i], t.tables[i+1:]...)
+			break
+		}
+	}
+
+	return nil
+}
+
+// DropAll drops all tracked tables. It continues on errors and returns the first one.
+func (t *TempTables) DropAll(ctx context.Context) error {
+	var firstErr error
+	for _, name := range t.Tables() {
+		err := t.Drop(ctx, name)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	return firstErr
+}
+
+// Tables returns names of tracked tables.
+func (t *TempTables) Tables() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	return append([]string{}, t.tables...)
+}
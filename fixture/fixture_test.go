@@ -0,0 +1,86 @@
+package fixture
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// recordExecer implements db.Execer and records executed statements.
+type recordExecer struct {
+	mu      sync.Mutex
+	queries []string
+}
+
+func (e *recordExecer) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.queries = append(e.queries, sql)
+	return 0, "", nil
+}
+
+func TestTempTables_Create_concurrent(t *testing.T) {
+	e := &recordExecer{}
+	tt := NewTempTables(e)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := tt.Create(context.Background(), "(id int)")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+
+	seen := map[string]bool{}
+	for _, name := range tt.Tables() {
+		assert.False(t, seen[name])
+		seen[name] = true
+	}
+	assert.Equal(t, 100, len(seen))
+	assert.Equal(t, 100, len(e.queries))
+}
+
+func TestTempTables_Drop_fake(t *testing.T) {
+	e := &recordExecer{}
+	tt := NewTempTables(e)
+
+	t1, err := tt.Create(context.Background(), "(id int)")
+	assert.NoError(t, err)
+	t2, err := tt.Create(context.Background(), "(id int)")
+	assert.NoError(t, err)
+
+	assert.NoError(t, tt.Drop(context.Background(), t1))
+	assert.Equal(t, []string{t2}, tt.Tables())
+	assert.True(t, strings.HasPrefix(e.queries[2], "DROP TABLE IF EXISTS "+t1))
+
+	assert.NoError(t, tt.DropAll(context.Background()))
+	assert.Equal(t, []string{}, tt.Tables())
+}
+
+func TestTempTables_Drop(t *testing.T) {
+	conn, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { assert.NoError(t, conn.Close()) }()
+
+	tt := NewTempTables(conn)
+	name, err := tt.Create(context.Background(), "(id int)")
+	assert.NoError(t, err)
+
+	assert.NoError(t, tt.Drop(context.Background(), name))
+
+	rows, err := conn.Query(context.Background(), "SELECT to_regclass($1) IS NULL", "pg_temp."+name)
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var absent bool
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&absent))
+	}
+	assert.True(t, absent)
+}
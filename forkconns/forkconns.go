@@ -13,36 +13,82 @@
 // to pg_class relation and then close the connection. The number of workers
 // depends on Config.Jobs. Interval between creating connections is based on
 // Config.Rate and calculated on per-second manner.
+//
+// Time spent for establishing each connection is recorded into histogram, at the
+// end of the workload latency percentiles are reported. This shows how connection
+// time degrades under load.
 package forkconns
 
 import (
 	"context"
 	"fmt"
 	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
-	"sync"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/lesovsky/noisia/workerpool"
+	"math"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// minLatency defines upper bound of the first latency histogram bucket.
+	minLatency = 100 * time.Microsecond
+	// latencyBuckets defines number of latency histogram buckets, each next bucket is twice wider.
+	latencyBuckets = 24
+	// maxRate defines sanity limit of connections rate (per worker), higher rates are allowed only when forced.
+	maxRate = 100
+)
+
 // Config defines configuration settings for 'forkconns' workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
 	Conninfo string
 	// Rate defines a rate of how many connections should be established per interval.
 	Rate uint16
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
 	// Jobs defines how many workers should be created for producing connections.
 	Jobs uint16
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// Force defines to allow rates higher than sanity limit.
+	Force bool
+	// Databases defines databases which workers connect to accordingly to workers indexes, empty
+	// name means the database from connection string.
+	Databases []string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Rate < 1 {
-		return fmt.Errorf("terminate rate must be greater than zero")
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "terminate rate must be greater than zero")
+	}
+
+	if c.Rate > maxRate && !c.Force {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate %d exceeds sanity limit of %d connections per second, force is required for higher rates", c.Rate, maxRate)
 	}
 
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than zero")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	err := db.ValidateWorkerDatabases(c.Databases, c.Jobs)
+	if err != nil {
+		return noisia.NewConfigError("Databases", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
 	}
 
 	return nil
@@ -51,6 +97,19 @@ func (c Config) validate() error {
 type workload struct {
 	config Config
 	logger log.Logger
+	stats  stats
+	// rate defines current rate of workers, it could be changed while the workload is running.
+	rate *ratelimit.Rate
+	// workers defines pool of workers, its size could be changed while the workload is running.
+	workers *workerpool.Pool
+}
+
+// stats defines counters of established connections, counters are updated atomically.
+type stats struct {
+	// connections defines number of established connections.
+	connections int64
+	// latency defines histogram of connection establishment time.
+	latency histogram
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -60,59 +119,148 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger}, nil
+	return &workload{
+		config:  config,
+		logger:  logger,
+		rate:    ratelimit.NewRate(float64(config.Rate)),
+		workers: workerpool.New(int(config.Jobs)),
+	}, nil
 }
 
-// Run method creates worker goroutines which produces the workload.
-func (w *workload) Run(ctx context.Context) error {
-	var wg sync.WaitGroup
-
-	wg.Add(int(w.config.Jobs))
-
-	for i := uint16(0); i < w.config.Jobs; i++ {
-		go func() {
-			err := makeConnectionLoop(ctx, w.config.Conninfo, w.config.Rate)
-			if err != nil {
-				w.logger.Warnf("worker failed: %s, continue", err)
-			}
-			wg.Done()
-		}()
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "forkconns"
+}
+
+// SetRate changes rate of running workers, new rate takes effect since the next connection.
+func (w *workload) SetRate(r float64) error {
+	if r <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be greater than zero")
+	}
+
+	if r > maxRate && !w.config.Force {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate %g exceeds sanity limit of %d connections per second, force is required for higher rates", r, maxRate)
 	}
 
-	w.logger.Infof("all workers started, waiting for finish")
-	wg.Wait()
+	w.rate.Store(r)
+	return nil
+}
+
+// SetJobs changes number of running workers, extra workers are stopped and missing workers are started.
+func (w *workload) SetJobs(jobs uint16) error {
+	if jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
 
+	w.workers.Resize(int(jobs))
 	return nil
 }
 
-// makeConnectionLoop establishes database connections in a loop, executes query and closes connection.
-func makeConnectionLoop(ctx context.Context, conninfo string, rate uint16) error {
-	// calculate naptime interval between establishing connections
-	naptime := time.Second / time.Duration(rate)
-	timer := time.NewTimer(naptime)
+// Stats returns counter of established connections and percentiles of connect latency, in microseconds.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"connections":    atomic.LoadInt64(&w.stats.connections),
+		"connect_p50_us": w.stats.latency.percentile(50).Microseconds(),
+		"connect_p95_us": w.stats.latency.percentile(95).Microseconds(),
+		"connect_p99_us": w.stats.latency.percentile(99).Microseconds(),
+	}
+}
+
+// Run method creates worker goroutines which produces the workload.
+func (w *workload) Run(ctx context.Context) error {
+	w.logger.Infof("start workers, waiting for finish")
+
+	w.workers.Run(ctx, func(ctx context.Context, i int) {
+		opts := db.ConnOptions{Workload: w.Name(), Database: db.WorkerDatabase(w.config.Databases, i), Role: w.config.Role, SearchPath: w.config.SearchPath}
+		makeConnectionLoop(ctx, w.logger, w.config.Conninfo, opts, w.rate, ratelimit.NewScheduler(w.config.Scheduler, i), w.config.Adaptive, &w.stats)
+	})
 
-	for {
-		conn, err := db.Connect(ctx, conninfo)
+	w.logger.Infof(
+		"established %d connections, connect latency p50: %s, p95: %s, p99: %s",
+		atomic.LoadInt64(&w.stats.connections),
+		w.stats.latency.percentile(50), w.stats.latency.percentile(95), w.stats.latency.percentile(99),
+	)
+
+	return nil
+}
+
+// makeConnectionLoop establishes database connections using passed options in a loop, executes query and closes connection.
+// Rate is throttled by adaptive limiter, if specified, connections are paced by passed scheduler. Number of established connections and
+// connect latency are recorded into passed stats, latencies are also recorded into global sink. Failed attempts are logged and the loop continues.
+func makeConnectionLoop(ctx context.Context, log log.Logger, conninfo string, opts db.ConnOptions, r *ratelimit.Rate, s ratelimit.Scheduler, al *adaptive.Limiter, st *stats) {
+	ratelimit.RunScheduler(ctx, r, al, s, func(ctx context.Context) error {
+		start := time.Now()
+		conn, err := db.ConnectWithOptions(ctx, conninfo, opts)
 		if err != nil {
-			return err
+			return fmt.Errorf("connect failed: %s", err)
 		}
+		latency := time.Since(start)
+		st.latency.observe(latency)
+		sink.Latency(ctx, "forkconns", "connect", latency)
 
 		_, _, err = conn.Exec(ctx, "SELECT count(*) FROM pg_class LIMIT 1")
 		if err != nil {
-			return err
+			_ = conn.Close()
+			return fmt.Errorf("execute query failed: %s", err)
 		}
 
 		err = conn.Close()
 		if err != nil {
-			return err
+			return fmt.Errorf("close connection failed: %s", err)
 		}
+		atomic.AddInt64(&st.connections, 1)
+		events.Emit(ctx, "forkconns", "established and closed connection")
+
+		return nil
+	}, log)
+}
 
-		select {
-		case <-timer.C:
-			timer.Reset(naptime)
-			continue
-		case <-ctx.Done():
-			return nil
+// histogram implements lightweight concurrency-safe histogram of latencies with exponential buckets.
+// Upper bound of bucket i is minLatency * 2^i, the last bucket also accounts all bigger values.
+type histogram struct {
+	counts [latencyBuckets]int64
+}
+
+// observe records latency sample into histogram.
+func (h *histogram) observe(d time.Duration) {
+	i := 0
+	for bound := minLatency; d > bound && i < latencyBuckets-1; bound *= 2 {
+		i++
+	}
+
+	atomic.AddInt64(&h.counts[i], 1)
+}
+
+// count returns total number of recorded samples.
+func (h *histogram) count() int64 {
+	var total int64
+	for i := range h.counts {
+		total += atomic.LoadInt64(&h.counts[i])
+	}
+
+	return total
+}
+
+// percentile returns upper bound of bucket which contains requested percentile (between 0 and 100).
+// Zero is returned if no samples recorded.
+func (h *histogram) percentile(p float64) time.Duration {
+	total := h.count()
+	if total == 0 {
+		return 0
+	}
+
+	rank := int64(math.Ceil(float64(total) * p / 100))
+	if rank < 1 {
+		rank = 1
+	}
+
+	var cumulative int64
+	for i := range h.counts {
+		cumulative += atomic.LoadInt64(&h.counts[i])
+		if cumulative >= rank {
+			return minLatency << i
 		}
 	}
+
+	return minLatency << (latencyBuckets - 1)
 }
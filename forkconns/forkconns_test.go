@@ -4,6 +4,8 @@ import (
 	"context"
 	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/sink"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -18,6 +20,10 @@ func TestConfig_validate(t *testing.T) {
 		{valid: false, config: Config{Rate: 0, Jobs: 1}},
 		{valid: false, config: Config{Rate: 1, Jobs: 0}},
 		{valid: false, config: Config{}},
+		{valid: true, config: Config{Rate: 100, Jobs: 1}},
+		{valid: false, config: Config{Rate: 60000, Jobs: 1}},
+		{valid: true, config: Config{Rate: 60000, Jobs: 1, Force: true}},
+		{valid: false, config: Config{Rate: 1, Jobs: 1, SearchPath: "app,,public"}},
 	}
 
 	for _, tc := range testcases {
@@ -49,6 +55,82 @@ func Test_makeConnectionLoop(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	err := makeConnectionLoop(ctx, db.TestConninfo, 2)
+	r := &sink.Recorder{}
+	sink.Set(r)
+	defer sink.Set(nil)
+
+	st := &stats{}
+	makeConnectionLoop(ctx, log.NewDefaultLogger("error"), db.TestConninfo, db.ConnOptions{}, ratelimit.NewRate(2), ratelimit.NewConstantScheduler(), nil, st)
+	assert.Greater(t, st.connections, int64(0))
+	assert.Equal(t, st.connections, st.latency.count())
+	assert.Greater(t, int64(st.latency.percentile(50)), int64(0))
+
+	// Connect latencies are recorded into sink.
+	records := r.Records(sink.KindLatency)
+	assert.Equal(t, st.latency.count(), int64(len(records)))
+	for _, rec := range records {
+		assert.Equal(t, "forkconns", rec.Workload)
+		assert.Equal(t, "connect", rec.Name)
+	}
+}
+
+func Test_histogram(t *testing.T) {
+	h := &histogram{}
+	assert.Equal(t, time.Duration(0), h.percentile(50))
+
+	// 90 fast samples, 9 slower samples and single very slow sample.
+	for i := 0; i < 90; i++ {
+		h.observe(150 * time.Microsecond)
+	}
+	for i := 0; i < 9; i++ {
+		h.observe(3 * time.Millisecond)
+	}
+	h.observe(time.Hour)
+
+	assert.Equal(t, int64(100), h.count())
+	assert.Equal(t, 200*time.Microsecond, h.percentile(50))
+	assert.Equal(t, 3200*time.Microsecond, h.percentile(95))
+	assert.Equal(t, 3200*time.Microsecond, h.percentile(99))
+	assert.Equal(t, minLatency<<(latencyBuckets-1), h.percentile(100))
+
+	// Samples less than min latency are accounted in the first bucket.
+	h = &histogram{}
+	h.observe(time.Microsecond)
+	assert.Equal(t, minLatency, h.percentile(99))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Rate: 1, Jobs: 1}, log.NewDefaultLogger("error"))
 	assert.NoError(t, err)
+	assert.Equal(t, "forkconns", w.Name())
+}
+
+func TestWorkload_SetRate(t *testing.T) {
+	w, err := NewWorkload(Config{Rate: 1, Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetRate(0))
+	assert.Error(t, wl.SetRate(maxRate+1))
+	assert.Equal(t, float64(1), wl.rate.Load())
+
+	assert.NoError(t, wl.SetRate(10))
+	assert.Equal(t, float64(10), wl.rate.Load())
+
+	// Rates above sanity limit are allowed when forced.
+	w, err = NewWorkload(Config{Rate: 1, Jobs: 1, Force: true}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.(*workload).SetRate(maxRate+1))
+}
+
+func TestWorkload_SetJobs(t *testing.T) {
+	w, err := NewWorkload(Config{Rate: 1, Jobs: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetJobs(0))
+	assert.Equal(t, 1, wl.workers.Size())
+
+	assert.NoError(t, wl.SetJobs(3))
+	assert.Equal(t, 3, wl.workers.Size())
 }
@@ -0,0 +1,256 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package hotrow defines implementation of workload which repeatedly updates the
+// same single row. This produces a lot of dead row versions and index bloat, and
+// could be used for testing autovacuum responsiveness.
+//
+// Before starting the workload, a special working table should be created and
+// filled with single row. When the workload is finished this table should be
+// dropped. For more info see prepare and cleanup methods.
+// When working table is created, the necessary number of workers is started
+// (accordingly to Config.Jobs). Each worker updates the row in a loop accordingly
+// to rate specified in Config.Rate. Number of dead tuples in working table is
+// collected before and after the workload and reported at the end.
+package hotrow
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// defaultCleanupTimeout defines default max time allowed for cleanup fixtures and collecting stats at the end.
+const defaultCleanupTimeout = 10 * time.Second
+
+// Config defines configuration settings for hot row workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for updating the row.
+	Jobs uint16
+	// Rate defines updates rate produced per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// CleanupTimeout defines max time allowed for cleanup fixtures and collecting stats at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	// updates defines number of executed updates.
+	updates int64
+	// deadTuples defines number of dead tuples produced by the workload.
+	deadTuples int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "hotrow"
+}
+
+// Stats returns counters of executed updates and produced dead tuples.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"updates":     atomic.LoadInt64(&w.updates),
+		"dead_tuples": atomic.LoadInt64(&w.deadTuples),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	// Prepare working table for workload.
+	err = w.prepare(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cleanup in the end.
+	defer func() {
+		err = w.cleanup()
+		if err != nil {
+			w.logger.Warnf("hotrow cleanup failed: %s", err)
+		}
+	}()
+
+	deadBefore, err := countDeadTuples(ctx, w.pool)
+	if err != nil {
+		return err
+	}
+
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func(i int) {
+			err := startLoop(ctx, w.logger, w.pool, w.config, i, &w.updates)
+			if err != nil {
+				w.logger.Warnf("hotrow worker failed: %s", err)
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Main context is done, use private context for collecting stats.
+	statCtx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	deadAfter, err := countDeadTuples(statCtx, w.pool)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.deadTuples, deadAfter-deadBefore)
+	w.logger.Infof("executed %d updates, generated %d dead tuples (might be already vacuumed or pruned)", atomic.LoadInt64(&w.updates), deadAfter-deadBefore)
+
+	return nil
+}
+
+// prepare method creates working table with single row.
+func (w *workload) prepare(ctx context.Context) error {
+	tx, err := w.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, _, err = tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS _noisia_hotrow_workload (id int PRIMARY KEY, payload bigint)")
+	if err != nil {
+		return err
+	}
+
+	// Index on updated column prevents HOT updates and leads to index bloat.
+	_, _, err = tx.Exec(ctx, "CREATE INDEX IF NOT EXISTS _noisia_hotrow_workload_payload_idx ON _noisia_hotrow_workload (payload)")
+	if err != nil {
+		return err
+	}
+
+	_, _, err = tx.Exec(ctx, "INSERT INTO _noisia_hotrow_workload (id, payload) VALUES (1, 0) ON CONFLICT (id) DO NOTHING")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// cleanup method drops working table after workload has been done.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_hotrow_workload")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// startLoop updates the row in a loop with required rate until context timeout exceeded. Rate is
+// throttled by adaptive limiter, if specified, updates are paced by scheduler of the worker with
+// passed index. Number of executed updates is added to passed counter.
+func startLoop(ctx context.Context, log log.Logger, pool db.DB, config Config, worker int, updates *int64) error {
+	var loopErr error
+	ratelimit.RunWorkerRate(ctx, ratelimit.NewRate(config.Rate), config.Adaptive, config.Scheduler, worker, func(ctx context.Context) error {
+		_, _, err := pool.Exec(ctx, "UPDATE _noisia_hotrow_workload SET payload = payload + 1 WHERE id = 1")
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = err
+			}
+			return ratelimit.ErrStop
+		}
+
+		atomic.AddInt64(updates, 1)
+		events.Emit(ctx, "hotrow", "updated hot row")
+		return nil
+	}, log)
+
+	return loopErr
+}
+
+// countDeadTuples returns number of dead tuples in working table.
+func countDeadTuples(ctx context.Context, pool db.DB) (int64, error) {
+	rows, err := pool.Query(ctx, "SELECT n_dead_tup FROM pg_stat_user_tables WHERE relid = '_noisia_hotrow_workload'::regclass")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return n, rows.Err()
+}
@@ -0,0 +1,77 @@
+package hotrow
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CleanupTimeout: -1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 10}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+}
+
+func Test_startLoop(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	w := &workload{config: Config{Jobs: 1, Rate: 20, CleanupTimeout: time.Second}, logger: log.NewDefaultLogger("error"), pool: pool}
+	assert.NoError(t, w.prepare(context.Background()))
+
+	before, err := countDeadTuples(context.Background(), pool)
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var n int64
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), pool, Config{Rate: 20}, 0, &n))
+	assert.Greater(t, n, int64(0))
+
+	// Wait until stats are flushed.
+	time.Sleep(1 * time.Second)
+
+	after, err := countDeadTuples(context.Background(), pool)
+	assert.NoError(t, err)
+	assert.Greater(t, after, before)
+
+	assert.NoError(t, w.cleanup())
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "hotrow", w.Name())
+}
@@ -0,0 +1,197 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package idleconns implements a workload which opens many database connections
+// and holds them idle (not in transaction) until the workload is done. Each idle
+// connection is served by dedicated Postgres backend which consumes memory, so
+// the workload reproduces "too many idle connections" scenarios.
+//
+// Implementation of the workload is simple - open Config.Count connections, run
+// trivial query in each of them and then hold them. To prevent connections from
+// being closed by network equipment or idle timeouts, each Config.KeepaliveInterval
+// the same trivial query is executed in each held connection. Connections which
+// failed keepalive query are closed and not reopened.
+package idleconns
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultKeepaliveInterval defines default interval between keepalive queries.
+	defaultKeepaliveInterval = 30 * time.Second
+	// keepaliveQuery defines trivial query executed in held connections.
+	keepaliveQuery = "SELECT 1"
+)
+
+// Config defines configuration settings for idle connections workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Count defines number of connections held idle.
+	Count uint16
+	// KeepaliveInterval defines interval between keepalive queries, if zero the default interval is used.
+	KeepaliveInterval time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Count < 1 {
+		return noisia.NewConfigError("Count", noisia.ErrInvalidValue, "count must be greater than zero")
+	}
+
+	if c.KeepaliveInterval < 0 {
+		return noisia.NewConfigError("KeepaliveInterval", noisia.ErrInvalidDuration, "keepalive interval must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// connect defines function used for making new connections.
+	connect func(ctx context.Context, conninfo string) (db.Conn, error)
+	// held defines number of currently held connections.
+	held int64
+	// failed defines number of failed connection attempts and keepalive queries.
+	failed int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.KeepaliveInterval == 0 {
+		config.KeepaliveInterval = defaultKeepaliveInterval
+	}
+
+	w := &workload{config: config, logger: logger}
+	w.connect = func(ctx context.Context, conninfo string) (db.Conn, error) {
+		return db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath})
+	}
+
+	return w, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "idleconns"
+}
+
+// Stats returns counters of held and failed connections.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"held":   atomic.LoadInt64(&w.held),
+		"failed": atomic.LoadInt64(&w.failed),
+	}
+}
+
+// Run method opens connections and holds them until context is done.
+func (w *workload) Run(ctx context.Context) error {
+	conns := w.openConns(ctx)
+	defer w.cleanup(conns)
+
+	w.logger.Infof("idleconns: holding %d connections", len(conns))
+
+	ticker := time.NewTicker(w.config.KeepaliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			conns = w.keepalive(ctx, conns)
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// openConns opens required number of connections and executes trivial query in each of them.
+func (w *workload) openConns(ctx context.Context) []db.Conn {
+	conns := make([]db.Conn, 0, w.config.Count)
+
+	for i := 0; i < int(w.config.Count); i++ {
+		if ctx.Err() != nil {
+			break
+		}
+
+		c, err := w.connect(ctx, w.config.Conninfo)
+		if err != nil {
+			w.logger.Warnf("idleconns: connect failed: %s", err)
+			atomic.AddInt64(&w.failed, 1)
+			continue
+		}
+
+		_, _, err = c.Exec(ctx, keepaliveQuery)
+		if err != nil {
+			w.logger.Warnf("idleconns: query failed: %s", err)
+			atomic.AddInt64(&w.failed, 1)
+			_ = c.Close()
+			continue
+		}
+
+		conns = append(conns, c)
+		atomic.AddInt64(&w.held, 1)
+	}
+
+	events.Emit(ctx, "idleconns", "opened %d idle connections", len(conns))
+
+	return conns
+}
+
+// keepalive executes trivial query in each held connection. Connections which failed
+// the query are closed. Returns remaining connections.
+func (w *workload) keepalive(ctx context.Context, conns []db.Conn) []db.Conn {
+	alive := conns[:0]
+	for _, c := range conns {
+		_, _, err := c.Exec(ctx, keepaliveQuery)
+		if err != nil {
+			if ctx.Err() != nil {
+				// Context is done, keep connection for closing in cleanup.
+				alive = append(alive, c)
+				continue
+			}
+
+			w.logger.Debugf("idleconns: keepalive query failed: %s", err)
+			atomic.AddInt64(&w.failed, 1)
+			atomic.AddInt64(&w.held, -1)
+			_ = c.Close()
+			continue
+		}
+
+		alive = append(alive, c)
+	}
+
+	return alive
+}
+
+// cleanup closes all held connections.
+func (w *workload) cleanup(conns []db.Conn) {
+	for _, c := range conns {
+		err := c.Close()
+		if err != nil {
+			w.logger.Debugf("idleconns: close connection failed: %s", err)
+		}
+	}
+}
@@ -0,0 +1,118 @@
+package idleconns
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Count: 10}},
+		{valid: true, config: Config{Count: 10, KeepaliveInterval: time.Second}},
+		{valid: false, config: Config{Count: 0}},
+		{valid: false, config: Config{Count: 10, KeepaliveInterval: -1}},
+		{valid: false, config: Config{Count: 10, SearchPath: "app,,public"}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Count: 10, KeepaliveInterval: 500 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Equal(t, int64(10), w.Stats()["held"])
+}
+
+func TestWorkload_Run_fakeConns(t *testing.T) {
+	w, err := NewWorkload(Config{Count: 20, KeepaliveInterval: 50 * time.Millisecond}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	var (
+		mu    sync.Mutex
+		conns []*fakeConn
+	)
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		c := &fakeConn{}
+		// One connection fails keepalive queries.
+		if len(conns) == 0 {
+			c.err = fmt.Errorf("example error")
+			c.failAfter = 1
+		}
+		conns = append(conns, c)
+		return c, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 180*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, w.Run(ctx))
+
+	assert.Len(t, conns, 20)
+	assert.Equal(t, int64(19), w.Stats()["held"])
+	assert.Equal(t, int64(1), w.Stats()["failed"])
+
+	for _, c := range conns[1:] {
+		// Initial query and at least two keepalive queries.
+		assert.GreaterOrEqual(t, c.queries, 3)
+		assert.True(t, c.closed)
+	}
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Count: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "idleconns", w.Name())
+}
+
+// fakeConn implements db.Conn interface and tracks executed queries.
+type fakeConn struct {
+	queries int
+	closed  bool
+	// err defines error returned by queries executed after failAfter queries.
+	err       error
+	failAfter int
+}
+
+func (c *fakeConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *fakeConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	c.queries++
+	if c.err != nil && c.queries > c.failAfter {
+		return 0, "", c.err
+	}
+	return 0, "", nil
+}
+
+func (c *fakeConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func (c *fakeConn) Close() error {
+	c.closed = true
+	return nil
+}
@@ -7,16 +7,29 @@
 // might be created.
 //
 // Before starting the workload, looking for tables with most UPDATE and DELETE
-// operations. Then create goroutines in a loop. Single goroutine selects a random
-// victim table from the list and creates a single idle transaction. The number of
-// goroutines depends on Config.Jobs. During the transaction, a temporary table has
-// been created with one row from victim table. This make the transaction writeable
-// and force Postgres to avoid vacuuming the row version used in the transaction.
-// This approach avoid direct write into victim table and at the same time lead to
-// bloat due to idle transaction. If no table is passed transaction do nothing.
-// Next, transaction is keeping idle for some random interval between
-// Config.NaptimeMin and Config.NaptimeMax. After time is out, transaction is rolled
-// back and temporary table is dropped.
+// operations. Then create goroutines in a loop. Single goroutine selects a random victim
+// table from the list and creates a single idle transaction. The number of goroutines
+// depends on Config.Jobs. During the transaction, a temporary table has been created with
+// one row from victim table. This make the transaction writeable and force Postgres to
+// avoid vacuuming the row version used in the transaction. This approach avoid direct
+// write into victim table and at the same time lead to bloat due to idle transaction. If
+// no table is passed transaction do nothing. Next, transaction is keeping idle for some
+// random interval between Config.NaptimeMin and Config.NaptimeMax. The interval is
+// distributed accordingly to Config.Distribution: uniformly (by default) or
+// exponentially, which produces many short and a few very long idle transactions. If
+// Config.HoldLock is enabled, the transaction also locks a row of victim table
+// (SELECT ... FOR UPDATE) before going idle, so concurrent writers of the row are blocked
+// until the transaction is finished. If Config.WakeInterval is set, transaction wakes every
+// interval during the naptime and executes a short statement, so the backend flips
+// between active and idle in transaction states. In read committed isolation each
+// statement takes a new snapshot and xmin of the backend advances slowly, which
+// reproduces a different vacuum-blocking pattern. After time is out, transaction is
+// rolled back, temporary table is dropped and the lock (if any) is released.
+//
+// If Config.CommitTempTables is enabled, each worker uses its own session instead of the
+// pool. Temporary tables are created without ON COMMIT DROP and transactions are
+// committed, so tables persist in the session and usage of temporary schema grows with
+// each transaction. Temporary tables are dropped when the worker is finished.
 package idlexacts
 
 import (
@@ -24,12 +37,31 @@ import (
 	"fmt"
 	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/fixture"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
 	"github.com/lesovsky/noisia/targeting"
+	"github.com/lesovsky/noisia/workerpool"
 	"math/rand"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// DistributionUniform defines uniform distribution of naptime.
+	DistributionUniform = "uniform"
+	// DistributionExponential defines exponential distribution of naptime clamped to max naptime.
+	DistributionExponential = "exponential"
+)
+
+// wakeQuery defines statement executed when transaction wakes, it keeps the backend active for
+// a short time, so the state is visible in pg_stat_activity.
+const wakeQuery = "SELECT pg_sleep(0.05)"
+
+// defaultCleanupTimeout defines default max time allowed for dropping temporary tables persisted in session.
+const defaultCleanupTimeout = 10 * time.Second
+
 // Config defines configuration settings for idle transactions workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
@@ -40,20 +72,88 @@ type Config struct {
 	NaptimeMin time.Duration
 	// NaptimeMax defines upper threshold when transactions being idle.
 	NaptimeMax time.Duration
+	// Distribution defines distribution of naptime between min and max: uniform (default) or exponential.
+	Distribution string
+	// WakeInterval defines interval of executing short statement during the naptime, zero means transaction is idle all the time.
+	WakeInterval time.Duration
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// HoldLock defines whether idle transactions should lock a row of victim table.
+	HoldLock bool
+	// Isolation defines isolation level of transactions: read-committed, repeatable-read, serializable. Default isolation level is used if empty.
+	Isolation string
+	// CommitTempTables defines whether transactions should be committed keeping temporary tables in worker's session.
+	CommitTempTables bool
+	// Seed defines seed of random choices of tables and naptimes, current time is used if zero.
+	Seed int64
+	// CleanupTimeout defines max time allowed for dropping temporary tables persisted in session, if zero the default timeout is used.
+	CleanupTimeout time.Duration
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than zero")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
 	}
 
 	if c.NaptimeMin == 0 || c.NaptimeMax == 0 {
-		return fmt.Errorf("min and max idle time must be greater than zero")
+		return noisia.NewConfigError("NaptimeMin", noisia.ErrInvalidRange, "min and max idle time must be greater than zero")
 	}
 
 	if c.NaptimeMin > c.NaptimeMax {
-		return fmt.Errorf("min naptime must be less or equal to naptime max")
+		return noisia.NewConfigError("NaptimeMin", noisia.ErrInvalidRange, "min naptime must be less or equal to naptime max")
+	}
+
+	switch c.Distribution {
+	case "", DistributionUniform, DistributionExponential:
+	default:
+		return noisia.NewConfigError("Distribution", noisia.ErrInvalidValue, "unknown naptime distribution: %s", c.Distribution)
+	}
+
+	if c.WakeInterval < 0 {
+		return noisia.NewConfigError("WakeInterval", noisia.ErrInvalidDuration, "wake interval must not be negative")
+	}
+
+	if c.WakeInterval > 0 && c.WakeInterval >= c.NaptimeMax {
+		return noisia.NewConfigError("WakeInterval", noisia.ErrInvalidRange, "wake interval must be less than naptime max")
+	}
+
+	err := db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	err = db.ValidateIsolationLevel(c.Isolation)
+	if err != nil {
+		return noisia.NewConfigError("Isolation", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.CommitTempTables && c.PoolerMode == db.PoolerModeTransaction {
+		return noisia.NewConfigError("CommitTempTables", noisia.ErrInvalidValue, "temporary tables are not supported in transaction pooling mode")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
 	}
 
 	return nil
@@ -63,6 +163,8 @@ func (c Config) validate() error {
 type workload struct {
 	config Config
 	logger log.Logger
+	// xacts defines number of started idle transactions.
+	xacts int64
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -71,7 +173,24 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 	if err != nil {
 		return nil, err
 	}
-	return &workload{config, logger}, nil
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "idlexacts"
+}
+
+// Stats returns counter of started idle transactions.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"xacts": atomic.LoadInt64(&w.xacts),
+	}
 }
 
 // Run connects to Postgres and starts the workload.
@@ -79,7 +198,9 @@ func (w *workload) Run(ctx context.Context) error {
 	// maxAffectedTables defines max number of tables which will be affected by idle transactions.
 	maxAffectedTables := 3
 
-	pool, err := db.NewPostgresDB(ctx, w.config.Conninfo)
+	opts := db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}
+
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, opts)
 	if err != nil {
 		return err
 	}
@@ -89,89 +210,219 @@ func (w *workload) Run(ctx context.Context) error {
 	// Each idle transaction will produce a write operation (which will rolled back
 	// at the end). As a result, write operation and idle transaction will lead to
 	// keep dead rows versions and affect overall performance.
-	tables, err := targeting.TopWriteTables(pool, maxAffectedTables)
+	tables, err := targeting.TopWriteTables(ctx, pool, maxAffectedTables)
 	if err != nil {
 		return err
 	}
 
-	return startLoop(ctx, w.logger, pool, tables, w.config.Jobs, w.config.NaptimeMin, w.config.NaptimeMax)
+	if w.config.CommitTempTables {
+		connect := func(ctx context.Context) (db.Conn, error) {
+			return db.ConnectWithOptions(ctx, w.config.Conninfo, opts)
+		}
+		return startSessionLoop(ctx, w.logger, connect, targeting.QuotedNames(tables), w.config, &w.xacts)
+	}
+
+	return startLoop(ctx, w.logger, pool, targeting.QuotedNames(tables), w.config, &w.xacts)
 }
 
-// startLoop starts workload using passed settings and database connection.
-func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string, jobs uint16, minTime, maxTime time.Duration) error {
-	rand.Seed(time.Now().UnixNano())
+// startLoop starts workload using passed settings and database connection. Number of
+// started idle transactions is added to passed counter.
+func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string, config Config, xacts *int64) error {
+	// While running, keep required number of workers, each worker starts idle transactions one
+	// by one. Pool returns when all workers are finished, so none of them outlives the pool.
+	workerpool.New(int(config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		runIdleXacts(ctx, log, pool, nil, random.New(config.Seed, i), tables, config, xacts)
+	})
 
-	// Increment maxTime up to 1 due to rand.Int63n() never return max value.
-	maxTime++
+	return nil
+}
 
-	// While running, keep required number of workers using channel.
-	// Run new workers only until there is any free slot.
-	guard := make(chan struct{}, jobs)
-	for {
-		select {
-		// Run workers only when it's possible to write into channel (channel is limited by number of jobs).
-		case guard <- struct{}{}:
-			go func() {
-				table := selectRandomTable(tables)
-				naptime := time.Duration(rand.Int63n(maxTime.Nanoseconds()-minTime.Nanoseconds()) + minTime.Nanoseconds())
-
-				err := startSingleIdleXact(ctx, pool, table, naptime)
-				if err != nil {
-					log.Warnf("start idle transaction failed: %s", err)
-				}
+// startSessionLoop starts workload where each worker uses its own session made with passed connect
+// function. Transactions are committed and temporary tables persist in the session until the worker
+// is finished. Number of started idle transactions is added to passed counter.
+func startSessionLoop(ctx context.Context, log log.Logger, connect func(ctx context.Context) (db.Conn, error), tables []string, config Config, xacts *int64) error {
+	workerpool.New(int(config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		conn, err := connect(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("connect failed: %s", err)
+			}
+			return
+		}
+		defer func() { _ = conn.Close() }()
 
-				// When worker finishes, read from the channel to allow starting another worker.
-				<-guard
-			}()
-		case <-ctx.Done():
+		session := fixture.NewTempTables(conn)
+		defer func() {
+			// Context is done at this point, use a separate bounded context for dropping tables.
+			dctx, cancel := context.WithTimeout(context.Background(), config.CleanupTimeout)
+			defer cancel()
+			if err := session.DropAll(dctx); err != nil {
+				log.Warnf("drop temporary tables failed: %s", err)
+			}
+		}()
 
-			return nil
+		runIdleXacts(ctx, log, conn, session, random.New(config.Seed, i), tables, config, xacts)
+	})
+
+	return nil
+}
+
+// runIdleXacts starts idle transactions one by one until context is done. If session is not nil,
+// temporary tables are kept in the session. Number of started idle transactions is added to
+// passed counter.
+func runIdleXacts(ctx context.Context, log log.Logger, b db.Beginner, session *fixture.TempTables, rnd *rand.Rand, tables []string, config Config, xacts *int64) {
+	for ctx.Err() == nil {
+		table := selectRandomTable(rnd, tables)
+		naptime := randomNaptime(rnd, config.Distribution, config.NaptimeMin, config.NaptimeMax)
+
+		err := startSingleIdleXact(ctx, b, table, naptime, config.WakeInterval, config.HoldLock, config.Isolation, session)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("start idle transaction failed: %s", err)
+			}
+		} else {
+			atomic.AddInt64(xacts, 1)
 		}
 	}
 }
 
-// startSingleIdleXact starts transaction and goes sleeping for specified amount of time.
-func startSingleIdleXact(ctx context.Context, pool db.DB, table string, naptime time.Duration) error {
-	tx, err := pool.Begin(ctx)
+// startSingleIdleXact starts transaction and goes sleeping for specified amount of time, waking
+// each wake interval if it is positive. If holdLock is true, a row of passed table is locked until
+// the transaction is finished. Transaction is started with passed isolation level, or with default
+// one if level is empty. If session is not nil, temporary table is created using session and the
+// transaction is committed, so the table persists in the session; otherwise the transaction is
+// rolled back.
+func startSingleIdleXact(ctx context.Context, b db.Beginner, table string, naptime time.Duration, wake time.Duration, holdLock bool, isolation string, session *fixture.TempTables) error {
+	tx, err := b.Begin(ctx)
 	if err != nil {
 		return err
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
+	err = db.SetIsolationLevel(ctx, tx, isolation)
+	if err != nil {
+		return err
+	}
+
 	// When table is specified, create a temp table using single row from target table. Later,
 	// transaction will be rolled back and temp table will be dropped. Also, any errors could
 	// be ignored, because in this case transaction (aborted) also stay idle.
 	if table != "" {
-		err = createTempTable(tx, table)
+		if session != nil {
+			err = createSessionTempTable(ctx, session, table)
+		} else {
+			err = createTempTable(ctx, fixture.NewTempTables(tx), table)
+		}
 		if err != nil {
 			return err
 		}
+
+		if holdLock {
+			err = lockRow(ctx, tx, table)
+			if err != nil {
+				return err
+			}
+		}
 	}
 
-	// Stop execution only if context has been done or naptime interval is timed out.
+	events.Emit(ctx, "idlexacts", "started idle transaction on table '%s' for %s", table, naptime)
+
+	err = nap(ctx, tx, naptime, wake)
+	if err != nil || session == nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+// nap keeps transaction open until context has been done or naptime interval is timed out. If wake
+// interval is positive, short statement is executed each interval, so the backend flips between
+// active and idle in transaction states.
+func nap(ctx context.Context, tx db.Tx, naptime time.Duration, wake time.Duration) error {
 	timer := time.NewTimer(naptime)
-	select {
-	case <-ctx.Done():
-		return nil
-	case <-timer.C:
-		return nil
+	defer timer.Stop()
+
+	var tick <-chan time.Time
+	if wake > 0 {
+		ticker := time.NewTicker(wake)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-timer.C:
+			return nil
+		case <-tick:
+			_, _, err := tx.Exec(ctx, wakeQuery)
+			if err != nil {
+				if ctx.Err() != nil {
+					return nil
+				}
+				return err
+			}
+		}
+	}
+}
+
+// randomNaptime returns random naptime between min and max accordingly to distribution.
+func randomNaptime(rnd *rand.Rand, distribution string, minTime, maxTime time.Duration) time.Duration {
+	switch distribution {
+	case DistributionExponential:
+		// Mean of the distribution is a quarter of the range, values above max are clamped.
+		mean := float64(maxTime-minTime) / 4
+		naptime := minTime + time.Duration(rnd.ExpFloat64()*mean)
+		if naptime > maxTime {
+			naptime = maxTime
+		}
+		return naptime
+	default:
+		// Increment range up to 1 due to rand.Int63n() never return max value.
+		return time.Duration(rnd.Int63n(maxTime.Nanoseconds()-minTime.Nanoseconds()+1) + minTime.Nanoseconds())
 	}
 }
 
 // selectRandomTable returns random table from passed list. Empty value returned if empty list.
-func selectRandomTable(tables []string) string {
+func selectRandomTable(rnd *rand.Rand, tables []string) string {
 	if len(tables) == 0 {
 		return ""
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	return tables[rand.Intn(len(tables))]
+	return tables[rnd.Intn(len(tables))]
 }
 
 // createTempTable creates a temporary table within a transaction using single row from passed table.
-func createTempTable(tx db.Tx, table string) error {
-	q := fmt.Sprintf("CREATE TEMP TABLE noisia_%d ON COMMIT DROP AS SELECT * FROM %s LIMIT 1", time.Now().Unix(), table)
-	_, _, err := tx.Exec(context.Background(), q)
+// The table is dropped when the transaction is finished.
+func createTempTable(ctx context.Context, tables *fixture.TempTables, table string) error {
+	_, err := tables.Create(ctx, fmt.Sprintf("ON COMMIT DROP AS SELECT * FROM %s LIMIT 1", table))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// createSessionTempTable creates a temporary table using single row from passed table. The table
+// persists in the session after the transaction is committed, until it is dropped using session.
+func createSessionTempTable(ctx context.Context, session *fixture.TempTables, table string) error {
+	_, err := session.Create(ctx, fmt.Sprintf("AS SELECT * FROM %s LIMIT 1", table))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// lockRow locks single row of passed table within a transaction. The lock is held until the transaction is finished.
+func lockRow(ctx context.Context, tx db.Tx, table string) error {
+	_, _, err := tx.Exec(ctx, fmt.Sprintf("SELECT 1 FROM %s LIMIT 1 FOR UPDATE", table))
 	if err != nil {
 		return err
 	}
@@ -2,9 +2,17 @@ package idlexacts
 
 import (
 	"context"
+	"errors"
+	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/fixture"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
 	"github.com/stretchr/testify/assert"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -21,6 +29,15 @@ func TestConfig_validate(t *testing.T) {
 		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 0}},
 		{valid: false, config: Config{Jobs: 1, NaptimeMin: 0, NaptimeMax: 5 * time.Second}},
 		{valid: false, config: Config{Jobs: 1, NaptimeMin: 0, NaptimeMax: 0}},
+		{valid: true, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, Distribution: DistributionExponential}},
+		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, Distribution: "invalid"}},
+		{valid: true, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, Isolation: db.IsolationSerializable}},
+		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, Isolation: "invalid"}},
+		{valid: true, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, WakeInterval: time.Second}},
+		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, WakeInterval: -time.Second}},
+		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, WakeInterval: 10 * time.Second}},
+		{valid: true, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, CommitTempTables: true}},
+		{valid: false, config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, CommitTempTables: true, PoolerMode: db.PoolerModeTransaction}},
 	}
 
 	for _, tc := range testcases {
@@ -32,6 +49,33 @@ func TestConfig_validate(t *testing.T) {
 	}
 }
 
+func TestConfig_validate_errors(t *testing.T) {
+	testcases := []struct {
+		config   Config
+		field    string
+		category error
+	}{
+		{config: Config{Jobs: 0}, field: "Jobs", category: noisia.ErrInvalidJobs},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 4 * time.Second}, field: "NaptimeMin", category: noisia.ErrInvalidRange},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, Distribution: "invalid"}, field: "Distribution", category: noisia.ErrInvalidValue},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, PoolerMode: "invalid"}, field: "PoolerMode", category: noisia.ErrInvalidValue},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, PoolerMode: db.PoolerModeTransaction, Role: "example"}, field: "Role", category: noisia.ErrInvalidValue},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, SearchPath: "app,,public"}, field: "SearchPath", category: noisia.ErrInvalidValue},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, WakeInterval: -time.Second}, field: "WakeInterval", category: noisia.ErrInvalidDuration},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, WakeInterval: 10 * time.Second}, field: "WakeInterval", category: noisia.ErrInvalidRange},
+		{config: Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second, PoolAcquireTimeout: -time.Second}, field: "PoolAcquireTimeout", category: noisia.ErrInvalidDuration},
+	}
+
+	for _, tc := range testcases {
+		err := tc.config.validate()
+		assert.True(t, errors.Is(err, tc.category))
+
+		var cerr *noisia.ConfigError
+		assert.True(t, errors.As(err, &cerr))
+		assert.Equal(t, tc.field, cerr.Field)
+	}
+}
+
 func TestWorkload_Run(t *testing.T) {
 	config := Config{
 		Conninfo:   db.TestConninfo,
@@ -60,7 +104,93 @@ func Test_startLoop(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
-	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("info"), pool, []string{""}, 2, 1, 2))
+	var n int64
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("info"), pool, []string{""}, Config{Jobs: 2, NaptimeMin: 1, NaptimeMax: 2}, &n))
+}
+
+func Test_startLoop_wait(t *testing.T) {
+	pool := &countingDB{}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Loop returns only when all started transactions are finished.
+	var n int64
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), pool, []string{""}, Config{Jobs: 4, NaptimeMin: 10 * time.Millisecond, NaptimeMax: 20 * time.Millisecond}, &n))
+	assert.Greater(t, atomic.LoadInt64(&pool.started), int64(0))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&pool.open))
+}
+
+func Test_startLoop_seed(t *testing.T) {
+	run := func(seed int64) []string {
+		pool := &countingDB{}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		var n int64
+		config := Config{Jobs: 1, NaptimeMin: time.Millisecond, NaptimeMax: 2 * time.Millisecond, Seed: seed}
+		assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), pool, []string{"t1", "t2", "t3", "t4"}, config, &n))
+
+		// Names of temporary tables are unique, keep only names of chosen tables.
+		pool.mu.Lock()
+		defer pool.mu.Unlock()
+		assert.Greater(t, len(pool.queries), 10)
+		tables := make([]string, 10)
+		for i, q := range pool.queries[:10] {
+			tables[i] = q[strings.Index(q, "FROM "):]
+		}
+		return tables
+	}
+
+	// Runs with the same seed choose the same tables.
+	assert.Equal(t, run(42), run(42))
+	assert.NotEqual(t, run(42), run(43))
+}
+
+// countingDB implements db.DB interface and counts started and not finished transactions.
+// Queries executed within transactions are recorded.
+type countingDB struct {
+	started int64
+	open    int64
+	mu      sync.Mutex
+	queries []string
+}
+
+func (d *countingDB) Begin(context.Context) (db.Tx, error) {
+	atomic.AddInt64(&d.started, 1)
+	atomic.AddInt64(&d.open, 1)
+	return &countingTx{db: d}, nil
+}
+func (d *countingDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (d *countingDB) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+func (d *countingDB) Close()                                                         {}
+
+// countingTx implements db.Tx interface and decrements number of open transactions when finished.
+type countingTx struct {
+	db   *countingDB
+	once sync.Once
+}
+
+func (tx *countingTx) finish() { tx.once.Do(func() { atomic.AddInt64(&tx.db.open, -1) }) }
+func (tx *countingTx) Commit(context.Context) error {
+	tx.finish()
+	return nil
+}
+func (tx *countingTx) Rollback(context.Context) error {
+	tx.finish()
+	return nil
+}
+func (tx *countingTx) Exec(_ context.Context, q string, _ ...interface{}) (int64, string, error) {
+	tx.db.mu.Lock()
+	tx.db.queries = append(tx.db.queries, q)
+	tx.db.mu.Unlock()
+	return 0, "", nil
+}
+func (tx *countingTx) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
 }
 
 func Test_startSingleIdleXact(t *testing.T) {
@@ -69,8 +199,69 @@ func Test_startSingleIdleXact(t *testing.T) {
 
 	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
 	defer cancel()
-	assert.NoError(t, startSingleIdleXact(ctx, pool, "pg_class", 10*time.Millisecond))
-	assert.NoError(t, startSingleIdleXact(ctx, pool, "", 10*time.Millisecond))
+	assert.NoError(t, startSingleIdleXact(ctx, pool, "pg_class", 10*time.Millisecond, 0, false, db.IsolationRepeatableRead, nil))
+	assert.NoError(t, startSingleIdleXact(ctx, pool, "", 10*time.Millisecond, 0, false, "", nil))
+}
+
+func Test_startSingleIdleXact_holdLock(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE IF NOT EXISTS _noisia_idlexacts_test (id int)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "INSERT INTO _noisia_idlexacts_test VALUES (1)")
+	assert.NoError(t, err)
+	defer func() { _, _, _ = pool.Exec(context.Background(), "DROP TABLE _noisia_idlexacts_test") }()
+
+	done := make(chan error)
+	go func() {
+		done <- startSingleIdleXact(context.Background(), pool, "_noisia_idlexacts_test", time.Second, 0, true, "", nil)
+	}()
+
+	// tryLock tries to lock the same row without waiting.
+	tryLock := func() error {
+		tx, err := pool.Begin(context.Background())
+		assert.NoError(t, err)
+		defer func() { _ = tx.Rollback(context.Background()) }()
+		_, _, err = tx.Exec(context.Background(), "SELECT 1 FROM _noisia_idlexacts_test LIMIT 1 FOR UPDATE NOWAIT")
+		return err
+	}
+
+	// Row is locked during naptime.
+	time.Sleep(300 * time.Millisecond)
+	err = tryLock()
+	assert.Error(t, err)
+	assert.Equal(t, "55P03", db.ErrorCode(err)) // lock_not_available
+
+	// Row is unlocked after transaction is rolled back.
+	assert.NoError(t, <-done)
+	assert.NoError(t, tryLock())
+}
+
+func Test_randomNaptime(t *testing.T) {
+	minTime, maxTime := 1*time.Second, 5*time.Second
+	rnd := random.New(0, 0)
+
+	const n = 100000
+	var sum time.Duration
+	for i := 0; i < n; i++ {
+		d := randomNaptime(rnd, DistributionExponential, minTime, maxTime)
+		assert.GreaterOrEqual(t, int64(d), int64(minTime))
+		assert.LessOrEqual(t, int64(d), int64(maxTime))
+		sum += d
+	}
+
+	// Mean of exponential distribution clamped to range L with mean L/4 is L/4*(1-e^-4).
+	rng := float64(maxTime - minTime)
+	want := float64(minTime) + rng/4*(1-math.Exp(-4))
+	assert.InEpsilon(t, want, float64(sum/n), 0.02)
+
+	for i := 0; i < 1000; i++ {
+		d := randomNaptime(rnd, DistributionUniform, minTime, maxTime)
+		assert.GreaterOrEqual(t, int64(d), int64(minTime))
+		assert.LessOrEqual(t, int64(d), int64(maxTime))
+	}
 }
 
 func Test_selectRandomTable(t *testing.T) {
@@ -83,7 +274,7 @@ func Test_selectRandomTable(t *testing.T) {
 	}
 
 	for _, tc := range testcases {
-		assert.Equal(t, tc.want, len(selectRandomTable(tc.tables)))
+		assert.Equal(t, tc.want, len(selectRandomTable(random.New(0, 0), tc.tables)))
 	}
 }
 
@@ -94,7 +285,213 @@ func Test_createTempTable(t *testing.T) {
 	tx, err := pool.Begin(context.Background())
 	assert.NoError(t, err)
 
-	assert.NoError(t, createTempTable(tx, "pg_class"))
+	assert.NoError(t, createTempTable(context.Background(), fixture.NewTempTables(tx), "pg_class"))
 
 	assert.NoError(t, tx.Rollback(context.Background()))
 }
+
+// recordTx implements db.Tx interface and records executed queries.
+type recordTx struct {
+	queries []string
+}
+
+func (tx *recordTx) Commit(context.Context) error   { return nil }
+func (tx *recordTx) Rollback(context.Context) error { return nil }
+func (tx *recordTx) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	tx.queries = append(tx.queries, sql)
+	return 0, "", nil
+}
+func (tx *recordTx) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+
+// recordDB implements db.DB interface and returns recordTx on Begin.
+type recordDB struct {
+	tx *recordTx
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) { return d.tx, nil }
+func (d *recordDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (d *recordDB) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+func (d *recordDB) Close()                                                         {}
+
+func Test_startSingleIdleXact_cancel(t *testing.T) {
+	pool := &recordDB{tx: &recordTx{}}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// Transaction should be finished right after cancel instead of waiting for naptime.
+	start := time.Now()
+	assert.NoError(t, startSingleIdleXact(ctx, pool, `"public"."example"`, time.Hour, 0, true, "", nil))
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Len(t, pool.tx.queries, 2)
+}
+
+func Test_startSingleIdleXact_isolation(t *testing.T) {
+	pool := &recordDB{tx: &recordTx{}}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, startSingleIdleXact(ctx, pool, "", time.Hour, 0, false, db.IsolationSerializable, nil))
+	assert.Equal(t, []string{"SET TRANSACTION ISOLATION LEVEL SERIALIZABLE"}, pool.tx.queries)
+}
+
+func Test_nap(t *testing.T) {
+	// Transaction without wake interval stays idle.
+	tx := &recordTx{}
+	assert.NoError(t, nap(context.Background(), tx, 50*time.Millisecond, 0))
+	assert.Len(t, tx.queries, 0)
+
+	// Transaction with wake interval executes short statement during the naptime.
+	tx = &recordTx{}
+	assert.NoError(t, nap(context.Background(), tx, 100*time.Millisecond, 20*time.Millisecond))
+	assert.GreaterOrEqual(t, len(tx.queries), 2)
+	for _, q := range tx.queries {
+		assert.Equal(t, wakeQuery, q)
+	}
+}
+
+func Test_startSingleIdleXact_wake(t *testing.T) {
+	pool, err := db.NewPostgresDBWithOptions(context.Background(), db.TestConninfo, db.ConnOptions{Workload: "idlexacts-wake-test"})
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	observer, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer observer.Close()
+
+	done := make(chan error)
+	go func() {
+		done <- startSingleIdleXact(context.Background(), pool, "", 1500*time.Millisecond, 200*time.Millisecond, false, "", nil)
+	}()
+
+	// Sample state of the backend during the naptime.
+	states := map[string]bool{}
+	for start := time.Now(); time.Since(start) < 1200*time.Millisecond; time.Sleep(10 * time.Millisecond) {
+		rows, err := observer.Query(context.Background(), "SELECT state FROM pg_stat_activity WHERE application_name = $1", db.ApplicationName("idlexacts-wake-test"))
+		assert.NoError(t, err)
+		for rows.Next() {
+			var state string
+			assert.NoError(t, rows.Scan(&state))
+			states[state] = true
+		}
+		rows.Close()
+	}
+
+	assert.NoError(t, <-done)
+	assert.True(t, states["active"])
+	assert.True(t, states["idle in transaction"])
+}
+
+func Test_startSingleIdleXact_commitTempTables(t *testing.T) {
+	conn, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	session := fixture.NewTempTables(conn)
+
+	// countTempTables returns number of tables in temporary schema of the session.
+	countTempTables := func() int {
+		rows, err := conn.Query(context.Background(), "SELECT count(*) FROM pg_class WHERE relnamespace = pg_my_temp_schema()")
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		var n int
+		for rows.Next() {
+			assert.NoError(t, rows.Scan(&n))
+		}
+		return n
+	}
+
+	// Temporary tables persist across transactions.
+	for i := 1; i <= 3; i++ {
+		assert.NoError(t, startSingleIdleXact(context.Background(), conn, "pg_class", 10*time.Millisecond, 0, false, "", session))
+		assert.Equal(t, i, countTempTables())
+	}
+
+	assert.NoError(t, session.DropAll(context.Background()))
+	assert.Equal(t, 0, countTempTables())
+}
+
+// sessionConn implements db.Conn interface which records queries executed in the session and
+// number of committed transactions.
+type sessionConn struct {
+	queries []string
+	commits int
+	closed  bool
+}
+
+func (c *sessionConn) Begin(context.Context) (db.Tx, error) { return &sessionTx{conn: c}, nil }
+func (c *sessionConn) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	c.queries = append(c.queries, sql)
+	return 0, "", nil
+}
+func (c *sessionConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+func (c *sessionConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// sessionTx implements db.Tx interface which counts commits in the session.
+type sessionTx struct {
+	conn *sessionConn
+}
+
+func (tx *sessionTx) Commit(context.Context) error {
+	tx.conn.commits++
+	return nil
+}
+func (tx *sessionTx) Rollback(context.Context) error { return nil }
+func (tx *sessionTx) Exec(ctx context.Context, sql string, args ...interface{}) (int64, string, error) {
+	return tx.conn.Exec(ctx, sql, args...)
+}
+func (tx *sessionTx) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func Test_startSessionLoop(t *testing.T) {
+	conn := &sessionConn{}
+	connect := func(context.Context) (db.Conn, error) { return conn, nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	var n int64
+	config := Config{Jobs: 1, NaptimeMin: 5 * time.Millisecond, NaptimeMax: 10 * time.Millisecond, CommitTempTables: true}
+	assert.NoError(t, startSessionLoop(ctx, log.NewDefaultLogger("error"), connect, []string{`"public"."example"`}, config, &n))
+
+	var created, dropped []string
+	for _, q := range conn.queries {
+		switch {
+		case strings.HasPrefix(q, "CREATE TEMP TABLE "):
+			assert.NotContains(t, q, "ON COMMIT DROP")
+			created = append(created, strings.Fields(q)[3])
+		case strings.HasPrefix(q, "DROP TABLE IF EXISTS "):
+			dropped = append(dropped, strings.Fields(q)[4])
+		}
+	}
+
+	// Transactions are committed, so temporary tables are accumulated in the session and they
+	// are dropped when the worker is finished.
+	assert.Greater(t, len(created), 1)
+	assert.GreaterOrEqual(t, conn.commits, len(created)-1)
+	assert.Equal(t, created, dropped)
+	assert.Equal(t, int64(conn.commits), n)
+	assert.True(t, conn.closed)
+}
+
+func Test_lockRow(t *testing.T) {
+	tx := &recordTx{}
+	assert.NoError(t, lockRow(context.Background(), tx, `"public"."example"`))
+	assert.Equal(t, []string{`SELECT 1 FROM "public"."example" LIMIT 1 FOR UPDATE`}, tx.queries)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, NaptimeMin: 5 * time.Second, NaptimeMax: 10 * time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "idlexacts", w.Name())
+}
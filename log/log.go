@@ -2,6 +2,8 @@ package log
 
 // Logger defines logging methods.
 type Logger interface {
+	Debug(msg string)
+	Debugf(format string, v ...interface{})
 	Info(msg string)
 	Infof(format string, v ...interface{})
 	Warn(msg string)
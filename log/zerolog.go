@@ -2,11 +2,13 @@ package log
 
 import (
 	"github.com/rs/zerolog"
+	"io"
 	"os"
 	"time"
 )
 
 const (
+	levelDebug = "debug"
 	levelInfo  = "info"
 	levelWarn  = "warn"
 	levelError = "error"
@@ -19,8 +21,21 @@ type defaultLogger struct {
 
 // NewDefaultLogger creates new default logger.
 func NewDefaultLogger(level string) Logger {
+	return newLogger(os.Stdout, level, "")
+}
+
+// NewRunLogger creates new default logger which adds passed run ID to all messages, so messages
+// of different runs written to the same output could be told apart.
+func NewRunLogger(level string, runID string) Logger {
+	return newLogger(os.Stdout, level, runID)
+}
+
+// newLogger creates logger which writes messages into passed writer. Run ID is added to messages if not empty.
+func newLogger(w io.Writer, level string, runID string) Logger {
 	var zerologLevel zerolog.Level
 	switch level {
+	case levelDebug:
+		zerologLevel = zerolog.DebugLevel
 	case levelInfo:
 		zerologLevel = zerolog.InfoLevel
 	case levelWarn:
@@ -29,9 +44,20 @@ func NewDefaultLogger(level string) Logger {
 		zerologLevel = zerolog.ErrorLevel
 	}
 
-	l := zerolog.New(zerolog.ConsoleWriter{Out: os.Stdout, TimeFormat: time.RFC3339}).Level(zerologLevel).With().Timestamp().Logger()
+	c := zerolog.New(zerolog.ConsoleWriter{Out: w, TimeFormat: time.RFC3339}).Level(zerologLevel).With().Timestamp()
+	if runID != "" {
+		c = c.Str("run_id", runID)
+	}
+
+	return &defaultLogger{logger: c.Logger()}
+}
+
+func (l *defaultLogger) Debug(msg string) {
+	l.logger.Debug().Msg(msg)
+}
 
-	return &defaultLogger{logger: l}
+func (l *defaultLogger) Debugf(format string, v ...interface{}) {
+	l.logger.Debug().Msgf(format, v...)
 }
 
 func (l *defaultLogger) Info(msg string) {
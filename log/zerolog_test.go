@@ -0,0 +1,31 @@
+package log
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// colorRe defines terminal color codes written by console writer.
+var colorRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+
+func Test_newLogger_runID(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := newLogger(buf, "info", "abc123")
+	l.Info("first message")
+	l.Warnf("second %s", "message")
+	l.Debug("filtered message")
+
+	lines := strings.Split(strings.TrimSpace(colorRe.ReplaceAllString(buf.String(), "")), "\n")
+	assert.Len(t, lines, 2)
+	for _, line := range lines {
+		assert.Contains(t, line, "run_id=abc123")
+	}
+
+	// Run ID is not added if not specified.
+	buf.Reset()
+	newLogger(buf, "info", "").Info("message")
+	assert.NotContains(t, buf.String(), "run_id")
+}
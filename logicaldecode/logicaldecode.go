@@ -0,0 +1,296 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package logicaldecode defines implementation of workload which generates changes and
+// decodes them using logical replication slots. This stresses CPU and memory used by
+// logical decoding, like logical replication subscribers or CDC tools do.
+//
+// Before starting the workload, it is checked that wal_level is 'logical', otherwise the
+// workload is skipped gracefully. Then a special working table is created, and logical
+// replication slot using test_decoding plugin is created for each worker. Slots are named
+// using Config.SlotName and index of the worker, e.g. 'noisia_logicaldecode_0'.
+//
+// The necessary number of workers is started (accordingly to Config.Jobs). Each worker,
+// accordingly to rate specified in Config.Rate, inserts a batch of rows into working table
+// and then consumes all pending changes of its slot using pg_logical_slot_get_changes().
+//
+// When the workload is finished, slots and working table are dropped. Note, slots retain
+// WAL until they are dropped, if the workload has been killed the slots should be dropped
+// manually using pg_drop_replication_slot().
+package logicaldecode
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/workerpool"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures at the end.
+	defaultCleanupTimeout = 10 * time.Second
+	// batchSize defines number of rows inserted at once, each row produces a change for decoding.
+	batchSize = 100
+)
+
+// slotNameRe defines characters allowed in replication slots names, the rest of 63 characters is
+// reserved for suffix with worker index.
+var slotNameRe = regexp.MustCompile(`^[a-z0-9_]{1,57}$`)
+
+// Config defines configuration settings for logical decoding workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// SlotName defines prefix of names of logical replication slots created by workers.
+	SlotName string
+	// Jobs defines how many workers should be created, each worker uses its own slot.
+	Jobs uint16
+	// Rate defines how many times changes are generated and decoded per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// CleanupTimeout defines max time allowed for cleanup fixtures at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if !slotNameRe.MatchString(c.SlotName) {
+		return noisia.NewConfigError("SlotName", noisia.ErrInvalidValue, "slot name must contain only lower case letters, numbers and underscores, up to 57 characters")
+	}
+
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// changes defines number of inserted rows.
+	changes int64
+	// decoded defines number of decoded changes returned by slots, including BEGIN and COMMIT records.
+	decoded int64
+	// errors defines number of failed iterations.
+	errors int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "logicaldecode"
+}
+
+// Stats returns counters of generated and decoded changes.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"changes": atomic.LoadInt64(&w.stats.changes),
+		"decoded": atomic.LoadInt64(&w.stats.decoded),
+		"errors":  atomic.LoadInt64(&w.stats.errors),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	level, err := walLevel(ctx, w.pool)
+	if err != nil {
+		return err
+	}
+	if level != "logical" {
+		w.logger.Warnf("logicaldecode: wal_level is '%s', logical decoding requires 'logical', skip", level)
+		return nil
+	}
+
+	slots := slotNames(w.config.SlotName, int(w.config.Jobs))
+
+	// Prepare working table and slots, cleanup in the end.
+	defer func() {
+		err := w.cleanup(slots)
+		if err != nil {
+			w.logger.Warnf("logicaldecode cleanup failed: %s", err)
+		}
+	}()
+
+	err = w.prepare(ctx, slots)
+	if err != nil {
+		if db.ErrorCode(err) == "42501" {
+			w.logger.Warnf("logicaldecode: creating replication slots is not allowed: %s, skip", err)
+			return nil
+		}
+		return err
+	}
+
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		ratelimit.RunWorker(ctx, w.config.Rate, w.config.Scheduler, i, func(ctx context.Context) error {
+			err := decodeChanges(ctx, w.pool, slots[i], &w.stats)
+			if err != nil && ctx.Err() == nil {
+				atomic.AddInt64(&w.stats.errors, 1)
+			}
+			return err
+		}, w.logger)
+	})
+
+	w.logger.Infof("logicaldecode finished: %d changes generated, %d decoded", atomic.LoadInt64(&w.stats.changes), atomic.LoadInt64(&w.stats.decoded))
+
+	return nil
+}
+
+// prepare method creates working table and logical replication slots.
+func (w *workload) prepare(ctx context.Context, slots []string) error {
+	_, _, err := w.pool.Exec(ctx, "CREATE TABLE IF NOT EXISTS _noisia_logicaldecode_workload (id bigserial PRIMARY KEY, payload text)")
+	if err != nil {
+		return err
+	}
+
+	for _, slot := range slots {
+		_, _, err = w.pool.Exec(ctx, "SELECT pg_create_logical_replication_slot($1, 'test_decoding')", slot)
+		if err != nil {
+			return fmt.Errorf("create slot %s failed: %w", slot, err)
+		}
+		events.Emit(ctx, "logicaldecode", "created logical replication slot %s", slot)
+	}
+
+	return nil
+}
+
+// cleanup method drops slots and working table after workload has been done. All slots are
+// attempted, error of the last failed attempt is returned.
+func (w *workload) cleanup(slots []string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	var lastErr error
+	for _, slot := range slots {
+		_, _, err := w.pool.Exec(ctx, "SELECT pg_drop_replication_slot(slot_name) FROM pg_replication_slots WHERE slot_name = $1", slot)
+		if err != nil {
+			lastErr = fmt.Errorf("drop slot %s failed: %s", slot, err)
+		}
+	}
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_logicaldecode_workload")
+	if err != nil {
+		lastErr = err
+	}
+
+	return lastErr
+}
+
+// decodeChanges inserts a batch of rows into working table and consumes pending changes of passed slot.
+func decodeChanges(ctx context.Context, pool db.DB, slot string, st *stats) error {
+	n, _, err := pool.Exec(ctx, "INSERT INTO _noisia_logicaldecode_workload (payload) SELECT md5(random()::text) FROM generate_series(1, $1)", batchSize)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&st.changes, n)
+
+	rows, err := pool.Query(ctx, "SELECT count(*) FROM pg_logical_slot_get_changes($1, NULL, NULL)", slot)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var decoded int64
+	for rows.Next() {
+		err = rows.Scan(&decoded)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&st.decoded, decoded)
+	return nil
+}
+
+// slotNames returns names of slots used by passed number of workers.
+func slotNames(prefix string, n int) []string {
+	names := make([]string, n)
+	for i := range names {
+		names[i] = fmt.Sprintf("%s_%d", prefix, i)
+	}
+
+	return names
+}
+
+// walLevel returns value of wal_level setting.
+func walLevel(ctx context.Context, q db.Querier) (string, error) {
+	rows, err := q.Query(ctx, "SELECT current_setting('wal_level')")
+	if err != nil {
+		return "", err
+	}
+	defer rows.Close()
+
+	var level string
+	for rows.Next() {
+		err = rows.Scan(&level)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return level, rows.Err()
+}
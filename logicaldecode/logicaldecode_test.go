@@ -0,0 +1,138 @@
+package logicaldecode
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{SlotName: "noisia_logicaldecode", Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{SlotName: "", Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{SlotName: "Noisia-slot", Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{SlotName: "noisia_logicaldecode_with_very_long_name_exceeding_the_limit", Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{SlotName: "noisia_logicaldecode", Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{SlotName: "noisia_logicaldecode", Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{SlotName: "noisia_logicaldecode", Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{SlotName: "noisia_logicaldecode", Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// Logical decoding requires wal_level = logical, skip if not configured.
+	level, err := walLevel(context.Background(), pool)
+	assert.NoError(t, err)
+	if level != "logical" {
+		t.Skipf("wal_level is '%s', logical decoding is not available", level)
+	}
+
+	config := Config{Conninfo: db.TestConninfo, SlotName: "noisia_logicaldecode_test", Jobs: 2, Rate: 5}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["decoded"], w.Stats()["changes"]) // including BEGIN and COMMIT records
+
+	// Slots must be dropped after the workload.
+	rows, err := pool.Query(context.Background(), "SELECT count(*) FROM pg_replication_slots WHERE slot_name LIKE 'noisia_logicaldecode_test%'")
+	assert.NoError(t, err)
+	var n int64
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&n))
+	}
+	rows.Close()
+	assert.Equal(t, int64(0), n)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{SlotName: "noisia_logicaldecode", Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "logicaldecode", w.Name())
+}
+
+func Test_slotNames(t *testing.T) {
+	assert.Equal(t, []string{"noisia_0", "noisia_1", "noisia_2"}, slotNames("noisia", 3))
+}
+
+func Test_decodeChanges(t *testing.T) {
+	pool := &decodeDB{}
+	st := &stats{}
+
+	assert.NoError(t, decodeChanges(context.Background(), pool, "noisia_0", st))
+	assert.NoError(t, decodeChanges(context.Background(), pool, "noisia_0", st))
+	assert.Equal(t, int64(2*batchSize), st.changes)
+	assert.Equal(t, int64(2*(batchSize+2)), st.decoded)
+	assert.Equal(t, []interface{}{"noisia_0"}, pool.args)
+
+	pool.err = fmt.Errorf("replication slot \"noisia_0\" is active")
+	assert.Error(t, decodeChanges(context.Background(), pool, "noisia_0", st))
+	assert.Equal(t, int64(2*(batchSize+2)), st.decoded)
+}
+
+// decodeDB implements db.DB interface. Inserts always add a batch of rows, decoding returns
+// inserted rows together with BEGIN and COMMIT records, or fails with err.
+type decodeDB struct {
+	err  error
+	args []interface{}
+}
+
+func (d *decodeDB) Begin(context.Context) (db.Tx, error) { return nil, nil }
+
+func (d *decodeDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return batchSize, "INSERT 0 100", nil
+}
+
+func (d *decodeDB) Query(_ context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	if d.err != nil {
+		return nil, d.err
+	}
+	d.args = args
+	return &countRows{v: batchSize + 2}, nil
+}
+
+func (d *decodeDB) Close() {}
+
+// countRows implements db.Rows interface and returns single counter.
+type countRows struct {
+	v    int64
+	done bool
+}
+
+func (r *countRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *countRows) Scan(dest ...interface{}) error {
+	*dest[0].(*int64) = r.v
+	return nil
+}
+
+func (r *countRows) Err() error { return nil }
+func (r *countRows) Close()     {}
@@ -4,6 +4,15 @@ import (
 	"context"
 )
 
+// Workload defines common methods of all workloads.
 type Workload interface {
+	// Run starts the workload and blocks until it is done or context is cancelled.
 	Run(context.Context) error
+	// Name returns stable name of the workload, used in logs and metrics labels.
+	Name() string
+	// Stats returns counters of work performed by the workload. It is safe to call during the run.
+	Stats() Stats
 }
+
+// Stats defines counters of work performed by workload, e.g. number of executed queries.
+type Stats map[string]int64
@@ -0,0 +1,23 @@
+package noisia
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestWorkloads(t *testing.T) {
+	want := []string{"advisorylocks", "analyzeload", "checksumload", "clientcancel", "customsql", "deadlocks", "diskfill", "failconns", "forkconns", "hotrow", "idleconns", "idlexacts", "logicaldecode", "notifyload", "orphanload", "plancacheload", "poolerload", "rollbacks", "serialfailures", "statsload", "tempfiles", "terminate", "toastload", "waitxacts", "walsenderload"}
+
+	got := Workloads()
+
+	names := make([]string, 0, len(got))
+	for _, d := range got {
+		names = append(names, d.Name)
+		assert.NotEmpty(t, d.Description)
+		assert.NotEmpty(t, d.Fields)
+	}
+
+	for _, name := range want {
+		assert.Contains(t, names, name)
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package notifyload defines implementation of workload which sends many notifications
+// using NOTIFY and stresses asynchronous notifications queue. This reproduces incidents
+// when notifications queue is full and NOTIFY fails.
+//
+// Notifications are removed from the queue when they are read by all listening sessions.
+// Before starting the workload, a listener session is started. It executes LISTEN on
+// Config.Channel and then stays idle in transaction. Notifications are not delivered to
+// a session in transaction, so the queue can't be truncated and its usage grows.
+// When listener is started, the necessary number of workers is started (accordingly to
+// Config.Jobs). Each worker sends notifications with payload of Config.PayloadSize bytes
+// in a loop accordingly to rate specified in Config.Rate. Notifications queue usage
+// (pg_notification_queue_usage) is reported at the end, before listener is stopped.
+package notifyload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"math"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCleanupTimeout defines default max time allowed for collecting stats at the end.
+	defaultCleanupTimeout = 10 * time.Second
+	// maxPayloadSize defines max size of notification payload accepted by Postgres.
+	maxPayloadSize = 7999
+)
+
+// Config defines configuration settings for notifications workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for sending notifications.
+	Jobs uint16
+	// Rate defines notifications rate produced per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// PayloadSize defines size of notification payload, in bytes.
+	PayloadSize uint16
+	// Channel defines name of the channel notifications are sent to.
+	Channel string
+	// CleanupTimeout defines max time allowed for collecting stats at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.PayloadSize > maxPayloadSize {
+		return noisia.NewConfigError("PayloadSize", noisia.ErrInvalidValue, "payload size must not be greater than %d bytes", maxPayloadSize)
+	}
+
+	if c.Channel == "" {
+		return noisia.NewConfigError("Channel", noisia.ErrInvalidValue, "channel must be specified")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// notifications defines number of sent notifications.
+	notifications int64
+	// queueUsage defines notifications queue usage at the end of the workload, in parts per million.
+	queueUsage int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "notifyload"
+}
+
+// Stats returns counter of sent notifications and notifications queue usage (in parts per million).
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"notifications":   atomic.LoadInt64(&w.notifications),
+		"queue_usage_ppm": atomic.LoadInt64(&w.queueUsage),
+	}
+}
+
+// Run method connects to Postgres, starts listener and workers.
+func (w *workload) Run(ctx context.Context) error {
+	opts := db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}
+
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Listener holds notifications in the queue until it is closed.
+	conn, err := db.ConnectWithOptions(ctx, w.config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	err = startListener(ctx, conn, w.config.Channel)
+	if err != nil {
+		return err
+	}
+
+	payload := strings.Repeat("x", int(w.config.PayloadSize))
+
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func(i int) {
+			ratelimit.RunWorker(ctx, w.config.Rate, w.config.Scheduler, i, func(ctx context.Context) error {
+				err := notify(ctx, pool, w.config.Channel, payload)
+				if err != nil {
+					return fmt.Errorf("notify failed: %s", err)
+				}
+
+				atomic.AddInt64(&w.notifications, 1)
+				events.Emit(ctx, "notifyload", "sent notification to channel %s", w.config.Channel)
+				return nil
+			}, w.logger)
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Main context is done, use private context for collecting stats.
+	statCtx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	usage, err := queueUsage(statCtx, pool)
+	if err != nil {
+		return err
+	}
+	atomic.StoreInt64(&w.queueUsage, int64(math.Round(usage*1e6)))
+	w.logger.Infof("sent %d notifications, notifications queue usage %.6f%%", atomic.LoadInt64(&w.notifications), usage*100)
+
+	return nil
+}
+
+// startListener starts listening the channel and opens transaction which is left idle. The session
+// doesn't receive notifications until the transaction is finished, so notifications stay in the queue.
+func startListener(ctx context.Context, conn db.Conn, channel string) error {
+	_, _, err := conn.Exec(ctx, fmt.Sprintf("LISTEN %s", db.QuoteIdentifier(channel)))
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Begin(ctx)
+	return err
+}
+
+// notify sends notification with passed payload to the channel.
+func notify(ctx context.Context, pool db.DB, channel string, payload string) error {
+	_, _, err := pool.Exec(ctx, "SELECT pg_notify($1, $2)", channel, payload)
+	return err
+}
+
+// queueUsage returns fraction of notifications queue currently occupied by pending notifications.
+func queueUsage(ctx context.Context, pool db.DB) (float64, error) {
+	rows, err := pool.Query(ctx, "SELECT pg_notification_queue_usage()")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var usage float64
+	for rows.Next() {
+		err = rows.Scan(&usage)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return usage, rows.Err()
+}
@@ -0,0 +1,123 @@
+package notifyload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1, PayloadSize: 100, Channel: "noisia"}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, PayloadSize: 0, Channel: "noisia"}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1, PayloadSize: 100, Channel: "noisia"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0, PayloadSize: 100, Channel: "noisia"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PayloadSize: 8000, Channel: "noisia"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PayloadSize: 100, Channel: ""}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PayloadSize: 100, Channel: "noisia", SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PayloadSize: 100, Channel: "noisia", PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 50, PayloadSize: 1000, Channel: "noisia_test"}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	stats := w.Stats()
+	assert.Greater(t, stats["notifications"], int64(0))
+	// Notifications are held in the queue by listener.
+	assert.Greater(t, stats["queue_usage_ppm"], int64(0))
+}
+
+func Test_queueUsage(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	assert.NoError(t, notify(context.Background(), pool, "noisia_test", "example"))
+
+	usage, err := queueUsage(context.Background(), pool)
+	assert.NoError(t, err)
+	assert.GreaterOrEqual(t, usage, float64(0))
+}
+
+func Test_notify(t *testing.T) {
+	pool := &recordDB{}
+	assert.NoError(t, notify(context.Background(), pool, "noisia", "payload"))
+	assert.Equal(t, []interface{}{"noisia", "payload"}, pool.args)
+}
+
+func Test_startListener(t *testing.T) {
+	conn := &recordConn{}
+	assert.NoError(t, startListener(context.Background(), conn, "Noisia"))
+	assert.Equal(t, []string{`LISTEN "Noisia"`, "BEGIN"}, conn.queries)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1, Channel: "noisia"}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "notifyload", w.Name())
+}
+
+// recordDB implements db.DB interface and records arguments of executed query.
+type recordDB struct {
+	args []interface{}
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (d *recordDB) Exec(_ context.Context, _ string, args ...interface{}) (int64, string, error) {
+	d.args = args
+	return 0, "", nil
+}
+
+func (d *recordDB) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func (d *recordDB) Close() {}
+
+// recordConn implements db.Conn interface and records executed queries.
+type recordConn struct {
+	queries []string
+}
+
+func (c *recordConn) Begin(context.Context) (db.Tx, error) {
+	c.queries = append(c.queries, "BEGIN")
+	return nil, nil
+}
+
+func (c *recordConn) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	c.queries = append(c.queries, sql)
+	return 0, "", nil
+}
+
+func (c *recordConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func (c *recordConn) Close() error {
+	return nil
+}
@@ -0,0 +1,342 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package orphanload defines implementation of workload which reproduces temporary schemas
+// left behind abruptly terminated sessions.
+//
+// For creating the workload, start required number of workers (number of goroutines depends
+// on Config.Jobs). Accordingly to rate specified in Config.Rate, each worker opens a new session,
+// creates a temporary table filled with data and then terminates the session from the control
+// connection using pg_terminate_backend(), so the session doesn't drop its temporary objects
+// itself. Temporary schemas (pg_temp_N) of terminated sessions stay in the catalog, and their
+// objects are left behind if the backend fails to remove them on exit (e.g. after crash).
+// When context expires, number of temporary schemas and orphaned temporary tables left in the
+// database is reported. Next, the workload reconnects Config.Jobs sessions which create temporary
+// objects: a new session which takes temporary schema of the previous backend removes objects left
+// in the schema. Note, the workload relies on temporary tables and doesn't work through connection
+// pooler in transaction pooling mode.
+package orphanload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// workingTable defines name of the temporary table created in each session.
+	workingTable = "_noisia_orphanload_workload"
+	// tableRows defines number of rows written into temporary table.
+	tableRows = 10000
+	// defaultCleanupTimeout defines default max time allowed for reporting and removing orphaned temporary objects.
+	defaultCleanupTimeout = 10 * time.Second
+)
+
+// Config defines configuration settings for orphanload workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created.
+	Jobs uint16
+	// Rate defines rate of terminated sessions per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// CleanupTimeout defines max time allowed for reporting and removing orphaned temporary objects, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// connect defines function used for making new sessions.
+	connect func(ctx context.Context, conninfo string) (db.Conn, error)
+	stats   stats
+}
+
+// stats defines counters of created and terminated sessions, and orphaned objects left after the
+// run. Counters are updated atomically.
+type stats struct {
+	sessions    int64
+	terminated  int64
+	tempSchemas int64
+	orphaned    int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	w := &workload{config: config, logger: logger}
+	w.connect = func(ctx context.Context, conninfo string) (db.Conn, error) {
+		return db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	}
+
+	return w, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "orphanload"
+}
+
+// Stats returns counters of created and terminated sessions, temporary schemas and orphaned
+// temporary tables left after the run.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"sessions":        atomic.LoadInt64(&w.stats.sessions),
+		"terminated":      atomic.LoadInt64(&w.stats.terminated),
+		"temp_schemas":    atomic.LoadInt64(&w.stats.tempSchemas),
+		"orphaned_tables": atomic.LoadInt64(&w.stats.orphaned),
+	}
+}
+
+// Run method connects to Postgres, starts necessary number of workers and waits until they
+// finish. In the end, orphaned objects are reported and removed.
+func (w *workload) Run(ctx context.Context) error {
+	control, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	defer control.Close()
+
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func(i int) {
+			err := w.startLoop(ctx, control, i)
+			if err != nil {
+				w.logger.Warnf("orphanload worker failed: %s", err)
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	// Context is done, use separate context for reporting and cleanup.
+	cctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	schemas, orphaned, err := countOrphans(cctx, control)
+	if err != nil {
+		return fmt.Errorf("count orphaned objects failed: %s", err)
+	}
+	atomic.StoreInt64(&w.stats.tempSchemas, schemas)
+	atomic.StoreInt64(&w.stats.orphaned, orphaned)
+
+	w.logger.Infof("orphanload: terminated %d sessions, %d temporary schemas and %d orphaned temporary tables left",
+		atomic.LoadInt64(&w.stats.terminated), schemas, orphaned)
+
+	err = Cleanup(cctx, w.config.Conninfo, int(w.config.Jobs))
+	if err != nil {
+		return fmt.Errorf("cleanup failed: %s", err)
+	}
+
+	return nil
+}
+
+// startLoop creates and terminates sessions in a loop with required rate until context is done.
+// Rate is throttled by adaptive limiter, if specified, sessions are paced by scheduler of the worker
+// with passed index.
+func (w *workload) startLoop(ctx context.Context, control db.DB, worker int) error {
+	var loopErr error
+	ratelimit.RunWorkerRate(ctx, ratelimit.NewRate(w.config.Rate), w.config.Adaptive, w.config.Scheduler, worker, func(ctx context.Context) error {
+		err := w.orphanSession(ctx, control)
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = err
+			}
+			return ratelimit.ErrStop
+		}
+
+		return nil
+	}, w.logger)
+
+	return loopErr
+}
+
+// orphanSession opens a new session, creates temporary objects in it and terminates the session
+// using control connection.
+func (w *workload) orphanSession(ctx context.Context, control db.DB) error {
+	conn, err := w.connect(ctx, w.config.Conninfo)
+	if err != nil {
+		return err
+	}
+	// Session is terminated, error of closing is expected.
+	defer func() { _ = conn.Close() }()
+
+	pid, err := createTempObjects(ctx, conn)
+	if err != nil {
+		return err
+	}
+	atomic.AddInt64(&w.stats.sessions, 1)
+
+	ok, err := terminateBackend(ctx, control, pid)
+	if err != nil {
+		return err
+	}
+
+	if ok {
+		atomic.AddInt64(&w.stats.terminated, 1)
+		events.Emit(ctx, "orphanload", "terminated backend %d with temporary objects", pid)
+	}
+
+	return nil
+}
+
+// createTempObjects creates temporary table filled with data and returns PID of the session's backend.
+func createTempObjects(ctx context.Context, conn db.Conn) (int, error) {
+	q := fmt.Sprintf("CREATE TEMP TABLE %s (id INT, payload TEXT)", workingTable)
+	_, _, err := conn.Exec(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	q = fmt.Sprintf("INSERT INTO %s SELECT g, md5(g::text) FROM generate_series(1, %d) g", workingTable, tableRows)
+	_, _, err = conn.Exec(ctx, q)
+	if err != nil {
+		return 0, err
+	}
+
+	rows, err := conn.Query(ctx, "SELECT pg_backend_pid()")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var pid int
+	for rows.Next() {
+		err = rows.Scan(&pid)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return pid, rows.Err()
+}
+
+// terminateBackend terminates backend with passed PID. Returns true if backend has been signalled.
+func terminateBackend(ctx context.Context, q db.Querier, pid int) (bool, error) {
+	rows, err := q.Query(ctx, "SELECT pg_terminate_backend($1)", pid)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var ok bool
+	for rows.Next() {
+		err = rows.Scan(&ok)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return ok, rows.Err()
+}
+
+// countOrphans returns number of temporary schemas in the database and number of temporary tables
+// created by the workload which are left in these schemas.
+func countOrphans(ctx context.Context, q db.Querier) (int64, int64, error) {
+	query := fmt.Sprintf(
+		"SELECT count(DISTINCT n.oid), count(c.oid) FROM pg_namespace n "+
+			"LEFT JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = '%s' "+
+			"WHERE n.nspname ~ '^pg_temp_[0-9]+$'", workingTable,
+	)
+
+	rows, err := q.Query(ctx, query)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer rows.Close()
+
+	var schemas, tables int64
+	for rows.Next() {
+		err = rows.Scan(&schemas, &tables)
+		if err != nil {
+			return 0, 0, err
+		}
+	}
+
+	return schemas, tables, rows.Err()
+}
+
+// Cleanup opens passed number of sessions simultaneously, each of them creates temporary object.
+// Backends of new sessions take temporary schemas left by previous backends and remove objects
+// left in these schemas. Sessions are closed gracefully, so their own objects are dropped.
+func Cleanup(ctx context.Context, conninfo string, sessions int) error {
+	conns := make([]db.Conn, 0, sessions)
+	defer func() {
+		for _, c := range conns {
+			_ = c.Close()
+		}
+	}()
+
+	// Hold all sessions together, so each of them gets its own temporary schema.
+	for i := 0; i < sessions; i++ {
+		conn, err := db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: "orphanload"})
+		if err != nil {
+			return err
+		}
+		conns = append(conns, conn)
+
+		_, _, err = conn.Exec(ctx, fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s (id INT)", workingTable))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
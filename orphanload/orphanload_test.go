@@ -0,0 +1,180 @@
+package orphanload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 5}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["sessions"], int64(0))
+	assert.Greater(t, w.Stats()["terminated"], int64(0))
+	assert.Greater(t, w.Stats()["temp_schemas"], int64(0))
+}
+
+func Test_createTempObjects(t *testing.T) {
+	control, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer control.Close()
+
+	conn, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	// Temporary table is created in temporary schema of the session.
+	pid, err := createTempObjects(context.Background(), conn)
+	assert.NoError(t, err)
+	assert.Greater(t, pid, 0)
+
+	schemas, tables, err := countOrphans(context.Background(), control)
+	assert.NoError(t, err)
+	assert.Greater(t, schemas, int64(0))
+	assert.Greater(t, tables, int64(0))
+
+	// After termination the session is gone, but its temporary schema is left.
+	ok, err := terminateBackend(context.Background(), control, pid)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+
+	assert.Eventually(t, func() bool {
+		rows, err := control.Query(context.Background(), "SELECT count(*) FROM pg_stat_activity WHERE pid = $1", pid)
+		assert.NoError(t, err)
+		defer rows.Close()
+
+		var n int
+		for rows.Next() {
+			assert.NoError(t, rows.Scan(&n))
+		}
+		return n == 0
+	}, 5*time.Second, 50*time.Millisecond)
+
+	schemas, _, err = countOrphans(context.Background(), control)
+	assert.NoError(t, err)
+	assert.Greater(t, schemas, int64(0))
+
+	assert.NoError(t, Cleanup(context.Background(), db.TestConninfo, 2))
+}
+
+// recordConn implements db.Conn which records executed queries and returns predefined PID.
+type recordConn struct {
+	pid     int
+	queries []string
+	closed  bool
+}
+
+func (c *recordConn) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (c *recordConn) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	c.queries = append(c.queries, sql)
+	return 0, "", nil
+}
+func (c *recordConn) Query(_ context.Context, sql string, _ ...interface{}) (db.Rows, error) {
+	c.queries = append(c.queries, sql)
+	return &valueRows{value: c.pid}, nil
+}
+func (c *recordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+// terminateDB implements db.DB which records PIDs passed to pg_terminate_backend().
+type terminateDB struct {
+	pids []int
+}
+
+func (d *terminateDB) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (d *terminateDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (d *terminateDB) Query(_ context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	d.pids = append(d.pids, args[0].(int))
+	return &valueRows{value: true}, nil
+}
+func (d *terminateDB) Close() {}
+
+// valueRows implements db.Rows with single row of single value.
+type valueRows struct {
+	value interface{}
+	done  bool
+}
+
+func (r *valueRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *valueRows) Scan(dest ...interface{}) error {
+	switch v := r.value.(type) {
+	case int:
+		*dest[0].(*int) = v
+	case bool:
+		*dest[0].(*bool) = v
+	}
+	return nil
+}
+
+func (r *valueRows) Err() error { return nil }
+func (r *valueRows) Close()     {}
+
+func TestWorkload_orphanSession(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	conn := &recordConn{pid: 123}
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) { return conn, nil }
+	control := &terminateDB{}
+
+	// Temporary objects are created in the session, then the session's backend is terminated.
+	assert.NoError(t, w.(*workload).orphanSession(context.Background(), control))
+	assert.Len(t, conn.queries, 3)
+	assert.True(t, strings.HasPrefix(conn.queries[0], "CREATE TEMP TABLE "+workingTable))
+	assert.True(t, strings.HasPrefix(conn.queries[1], "INSERT INTO "+workingTable))
+	assert.Equal(t, "SELECT pg_backend_pid()", conn.queries[2])
+	assert.Equal(t, []int{123}, control.pids)
+	assert.True(t, conn.closed)
+
+	st := w.Stats()
+	assert.Equal(t, int64(1), st["sessions"])
+	assert.Equal(t, int64(1), st["terminated"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "orphanload", w.Name())
+}
@@ -0,0 +1,289 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package plancacheload defines implementation of workload which stresses the
+// prepared statements cache. Each session prepares many uniquely-named prepared
+// statements and executes them, so backends spend memory on cached plans and CPU
+// on planning.
+//
+// For creating the workload, start required number of workers (number of goroutines
+// depends on Config.Jobs). Each worker connects to the database, creates a temporary
+// table and prepares Config.StatementsPerSession statements which query the table.
+// Next, the worker executes random prepared statements in a loop accordingly to rate
+// specified in Config.Rate. If Config.Replan is enabled, after each round of executions
+// the worker runs DDL against the table, which invalidates cached plans and forces
+// replanning of all statements.
+// When context expires, the loop is stopped, prepared statements are deallocated and
+// the connection is closed. Note, the workload relies on session-level features and
+// doesn't work through connection pooler in transaction pooling mode.
+package plancacheload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// workingTable defines name of the temporary table queried by prepared statements.
+	workingTable = "_noisia_plancacheload_workload"
+	// statementPrefix defines prefix of prepared statements names.
+	statementPrefix = "noisia_plancache_"
+	// tableRows defines number of rows in working table.
+	tableRows = 1000
+	// defaultCleanupTimeout defines default max time allowed for deallocating prepared statements.
+	defaultCleanupTimeout = 10 * time.Second
+)
+
+// Config defines configuration settings for plancacheload workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers (sessions) should be created.
+	Jobs uint16
+	// StatementsPerSession defines how many prepared statements should be created in each session.
+	StatementsPerSession uint16
+	// Rate defines executions rate of prepared statements per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// Replan defines whether DDL should be executed after each round of executions for forcing replanning.
+	Replan bool
+	// Seed defines seed of random choices of statements and their arguments, current time is used if zero.
+	Seed int64
+	// CleanupTimeout defines max time allowed for deallocating prepared statements, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.StatementsPerSession < 1 {
+		return noisia.NewConfigError("StatementsPerSession", noisia.ErrInvalidValue, "statements per session must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// connect defines function used for making new connections.
+	connect func(ctx context.Context, conninfo string) (db.Conn, error)
+	stats   stats
+}
+
+// stats defines counters of prepared and executed statements, counters are updated atomically.
+type stats struct {
+	prepared   int64
+	executions int64
+	replans    int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	w := &workload{config: config, logger: logger}
+	w.connect = func(ctx context.Context, conninfo string) (db.Conn, error) {
+		return db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath})
+	}
+
+	return w, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "plancacheload"
+}
+
+// Stats returns counters of prepared and executed statements, and forced replans.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"prepared":   atomic.LoadInt64(&w.stats.prepared),
+		"executions": atomic.LoadInt64(&w.stats.executions),
+		"replans":    atomic.LoadInt64(&w.stats.replans),
+	}
+}
+
+// Run method starts necessary number of workers and waiting until they finish.
+func (w *workload) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func(i int) {
+			err := w.runWorker(ctx, i)
+			if err != nil {
+				w.logger.Warnf("plancacheload worker failed: %s", err)
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	w.logger.Infof("plancacheload: prepared %d statements, %d executions, %d replans",
+		atomic.LoadInt64(&w.stats.prepared), atomic.LoadInt64(&w.stats.executions), atomic.LoadInt64(&w.stats.replans))
+
+	return nil
+}
+
+// runWorker connects to the database, prepares statements and executes them until context is done.
+// Passed index of the worker defines its pacing and choices of statements.
+func (w *workload) runWorker(ctx context.Context, worker int) error {
+	conn, err := w.connect(ctx, w.config.Conninfo)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	err = createTable(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	// Deallocate statements in the end, even if not all of them have been prepared.
+	defer func() {
+		err := deallocate(conn, w.config.CleanupTimeout)
+		if err != nil {
+			w.logger.Warnf("plancacheload cleanup failed: %s", err)
+		}
+	}()
+
+	n, err := prepareStatements(ctx, conn, int(w.config.StatementsPerSession))
+	atomic.AddInt64(&w.stats.prepared, int64(n))
+	if err != nil {
+		return err
+	}
+
+	return startLoop(ctx, w.logger, conn, w.config, worker, &w.stats)
+}
+
+// createTable creates temporary table used in prepared statements.
+func createTable(ctx context.Context, conn db.Conn) error {
+	q := fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s (id INT PRIMARY KEY, val INT)", workingTable)
+	_, _, err := conn.Exec(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	q = fmt.Sprintf("INSERT INTO %s SELECT g, g FROM generate_series(1, %d) g", workingTable, tableRows)
+	_, _, err = conn.Exec(ctx, q)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// prepareStatements creates required number of uniquely-named prepared statements. Returns
+// number of successfully prepared statements.
+func prepareStatements(ctx context.Context, conn db.Conn, n int) (int, error) {
+	for i := 0; i < n; i++ {
+		// Statements have different texts, so each of them has its own cached plan.
+		q := fmt.Sprintf("PREPARE %s%d (INT) AS SELECT val FROM %s WHERE id = $1 AND val > %d", statementPrefix, i, workingTable, i)
+		_, _, err := conn.Exec(ctx, q)
+		if err != nil {
+			return i, err
+		}
+	}
+
+	return n, nil
+}
+
+// deallocate removes all prepared statements of the session, it takes no longer than passed timeout.
+func deallocate(conn db.Conn, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	_, _, err := conn.Exec(ctx, "DEALLOCATE ALL")
+	return err
+}
+
+// startLoop executes random prepared statements in a loop with required rate until context
+// timeout exceeded. Rate is throttled by adaptive limiter, if specified, executions are paced by
+// scheduler of the worker with passed index. Statements and their arguments are chosen randomly
+// accordingly to the seed and the worker index. If replanning is enabled, DDL is executed after
+// each round of executions.
+func startLoop(ctx context.Context, log log.Logger, conn db.Conn, config Config, worker int, st *stats) error {
+	n := int(config.StatementsPerSession)
+	rnd := random.New(config.Seed, worker)
+
+	var (
+		executions int
+		loopErr    error
+	)
+	ratelimit.RunWorkerRate(ctx, ratelimit.NewRate(config.Rate), config.Adaptive, config.Scheduler, worker, func(ctx context.Context) error {
+		q := fmt.Sprintf("EXECUTE %s%d(%d)", statementPrefix, rnd.Intn(n), rnd.Intn(tableRows)+1)
+		_, _, err := conn.Exec(ctx, q)
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = err
+			}
+			return ratelimit.ErrStop
+		}
+
+		atomic.AddInt64(&st.executions, 1)
+		executions++
+
+		if config.Replan && executions%n == 0 {
+			// Any ALTER TABLE invalidates cached plans of statements which use the table.
+			q = fmt.Sprintf("ALTER TABLE %s ALTER COLUMN val SET STATISTICS %d", workingTable, 100+executions/n%2)
+			_, _, err = conn.Exec(ctx, q)
+			if err != nil {
+				if ctx.Err() == nil {
+					loopErr = err
+				}
+				return ratelimit.ErrStop
+			}
+
+			atomic.AddInt64(&st.replans, 1)
+			events.Emit(ctx, "plancacheload", "forced replanning of %d prepared statements", n)
+		}
+
+		return nil
+	}, log)
+
+	return loopErr
+}
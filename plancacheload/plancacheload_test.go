@@ -0,0 +1,150 @@
+package plancacheload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, StatementsPerSession: 10, Rate: 1}},
+		{valid: true, config: Config{Jobs: 1, StatementsPerSession: 10, Rate: 1, Replan: true}},
+		{valid: false, config: Config{Jobs: 0, StatementsPerSession: 10, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, StatementsPerSession: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, StatementsPerSession: 10, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, StatementsPerSession: 10, Rate: 1, SearchPath: "app,,public"}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, StatementsPerSession: 50, Rate: 20, Replan: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Equal(t, int64(100), w.Stats()["prepared"])
+	assert.Greater(t, w.Stats()["executions"], int64(0))
+}
+
+func Test_prepareStatements(t *testing.T) {
+	conn, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { _ = conn.Close() }()
+
+	assert.NoError(t, createTable(context.Background(), conn))
+
+	n, err := prepareStatements(context.Background(), conn, 20)
+	assert.NoError(t, err)
+	assert.Equal(t, 20, n)
+	assert.Equal(t, 20, countStatements(t, conn))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	st := &stats{}
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), conn, Config{StatementsPerSession: 20, Rate: 40, Replan: true}, 0, st))
+	assert.Greater(t, st.executions, int64(0))
+	assert.Greater(t, st.replans, int64(0))
+
+	// No statements must be left after cleanup.
+	assert.NoError(t, deallocate(conn, defaultCleanupTimeout))
+	assert.Equal(t, 0, countStatements(t, conn))
+}
+
+// countStatements returns number of prepared statements created by the workload in the session.
+func countStatements(t *testing.T, conn db.Conn) int {
+	rows, err := conn.Query(context.Background(), "SELECT count(*) FROM pg_prepared_statements WHERE name LIKE $1", statementPrefix+"%")
+	assert.NoError(t, err)
+	defer rows.Close()
+
+	var n int
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&n))
+	}
+	assert.NoError(t, rows.Err())
+
+	return n
+}
+
+// recordConn implements db.Conn which records executed queries.
+type recordConn struct {
+	mu      sync.Mutex
+	queries []string
+	closed  bool
+}
+
+func (c *recordConn) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (c *recordConn) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.queries = append(c.queries, sql)
+	return 0, "", nil
+}
+func (c *recordConn) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+func (c *recordConn) Close() error {
+	c.closed = true
+	return nil
+}
+
+func TestWorkload_runWorker_fakeConn(t *testing.T) {
+	config := Config{Jobs: 1, StatementsPerSession: 5, Rate: 100, Replan: true}
+	w, err := NewWorkload(config, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	conn := &recordConn{}
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) { return conn, nil }
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, w.(*workload).runWorker(ctx, 0))
+	assert.True(t, conn.closed)
+
+	var prepares, executes, replans int
+	for _, q := range conn.queries {
+		switch {
+		case strings.HasPrefix(q, "PREPARE"):
+			prepares++
+		case strings.HasPrefix(q, "EXECUTE"):
+			executes++
+		case strings.HasPrefix(q, "ALTER TABLE"):
+			replans++
+		}
+	}
+
+	assert.Equal(t, 5, prepares)
+	assert.Greater(t, executes, 0)
+	assert.Equal(t, executes/5, replans)
+	assert.Equal(t, "DEALLOCATE ALL", conn.queries[len(conn.queries)-1])
+
+	st := w.Stats()
+	assert.Equal(t, int64(5), st["prepared"])
+	assert.Equal(t, int64(executes), st["executions"])
+	assert.Equal(t, int64(replans), st["replans"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, StatementsPerSession: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "plancacheload", w.Name())
+}
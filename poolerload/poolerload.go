@@ -0,0 +1,217 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package poolerload implements a workload which stresses client queue of connection pooler
+// (e.g. PgBouncer, Odyssey) placed in front of Postgres.
+//
+// The workload opens Config.Clients client connections to the pooler, this number should be
+// greater than the pooler's pool size. Each client executes pg_sleep() queries lasting
+// Config.HoldTime one after another, so each query holds a server connection of the pool.
+// When all server connections are busy, the rest of clients are queued by the pooler and wait
+// for a free server connection. Unlike failconns workload, Postgres max_connections is not
+// reached - the pooler's queue grows instead.
+//
+// Each second clients statistics are requested from admin console of the pooler using SHOW POOLS
+// command, and number of queued (waiting) clients across all pools is reported. If the pooler
+// doesn't expose SHOW POOLS (or admin console is not accessible), queued clients are not reported
+// but the workload continues.
+package poolerload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultAdminDatabase defines database of PgBouncer admin console.
+	defaultAdminDatabase = "pgbouncer"
+	// sampleInterval defines interval between requests of pools statistics.
+	sampleInterval = time.Second
+)
+
+// Config defines configuration settings for pooler workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to connection pooler.
+	Conninfo string
+	// Clients defines number of client connections opened to the pooler.
+	Clients uint16
+	// HoldTime defines duration of each query which holds server connection of the pool.
+	HoldTime time.Duration
+	// AdminDatabase defines database of the pooler's admin console used for SHOW POOLS,
+	// e.g. 'console' for Odyssey. If empty, 'pgbouncer' is used.
+	AdminDatabase string
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Clients < 1 {
+		return noisia.NewConfigError("Clients", noisia.ErrInvalidValue, "clients must be greater than zero")
+	}
+
+	if c.HoldTime <= 0 {
+		return noisia.NewConfigError("HoldTime", noisia.ErrInvalidDuration, "hold time must be positive")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	// connect defines function used for making client connections.
+	connect func(ctx context.Context, conninfo string) (db.Conn, error)
+	// showPools defines function used for requesting pools statistics from the pooler.
+	showPools func(ctx context.Context, conninfo string, database string) ([]db.PoolStats, error)
+	stats     stats
+}
+
+// stats defines counters of connected clients, executed queries and queued clients.
+// Counters are updated atomically.
+type stats struct {
+	clients   int64
+	queries   int64
+	failed    int64
+	queued    int64
+	maxQueued int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.AdminDatabase == "" {
+		config.AdminDatabase = defaultAdminDatabase
+	}
+
+	w := &workload{config: config, logger: logger, showPools: db.ShowPools}
+	w.connect = func(ctx context.Context, conninfo string) (db.Conn, error) {
+		// Pooler might work in transaction pooling mode, use transaction-safe queries.
+		return db.ConnectWithOptions(ctx, conninfo, db.ConnOptions{Workload: w.Name(), PoolerMode: db.PoolerModeTransaction})
+	}
+
+	return w, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "poolerload"
+}
+
+// Stats returns counters of connected clients, executed and failed queries, and current and max
+// number of clients queued by the pooler.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"clients":    atomic.LoadInt64(&w.stats.clients),
+		"queries":    atomic.LoadInt64(&w.stats.queries),
+		"failed":     atomic.LoadInt64(&w.stats.failed),
+		"queued":     atomic.LoadInt64(&w.stats.queued),
+		"max_queued": atomic.LoadInt64(&w.stats.maxQueued),
+	}
+}
+
+// Run method starts clients and samples pools statistics until context is done.
+func (w *workload) Run(ctx context.Context) error {
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Clients))
+	for i := 0; i < int(w.config.Clients); i++ {
+		go func() {
+			w.startClient(ctx)
+			wg.Done()
+		}()
+	}
+
+	w.samplePools(ctx)
+	wg.Wait()
+
+	w.logger.Infof("poolerload: %d clients connected, max %d clients queued",
+		atomic.LoadInt64(&w.stats.clients), atomic.LoadInt64(&w.stats.maxQueued))
+
+	return nil
+}
+
+// startClient connects to the pooler and executes queries holding server connection one after
+// another until context is done.
+func (w *workload) startClient(ctx context.Context) {
+	conn, err := w.connect(ctx, w.config.Conninfo)
+	if err != nil {
+		if ctx.Err() == nil {
+			w.logger.Warnf("poolerload: connect failed: %s", err)
+			atomic.AddInt64(&w.stats.failed, 1)
+		}
+		return
+	}
+	defer func() { _ = conn.Close() }()
+
+	atomic.AddInt64(&w.stats.clients, 1)
+
+	q := fmt.Sprintf("SELECT pg_sleep(%f)", w.config.HoldTime.Seconds())
+	for ctx.Err() == nil {
+		_, _, err := conn.Exec(ctx, q)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+
+			w.logger.Warnf("poolerload: query failed: %s", err)
+			atomic.AddInt64(&w.stats.failed, 1)
+			return
+		}
+
+		atomic.AddInt64(&w.stats.queries, 1)
+	}
+}
+
+// samplePools periodically requests pools statistics and updates number of queued clients until
+// context is done. If statistics are not available, sampling is stopped.
+func (w *workload) samplePools(ctx context.Context) {
+	ticker := time.NewTicker(sampleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			pools, err := w.showPools(ctx, w.config.Conninfo, w.config.AdminDatabase)
+			if err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+
+				w.logger.Warnf("poolerload: pools statistics are not available, queued clients are not reported: %s", err)
+				<-ctx.Done()
+				return
+			}
+
+			w.updateQueued(ctx, pools)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// updateQueued updates current and max number of queued clients across all pools.
+func (w *workload) updateQueued(ctx context.Context, pools []db.PoolStats) {
+	var queued int64
+	for _, p := range pools {
+		queued += p.Waiting
+	}
+
+	atomic.StoreInt64(&w.stats.queued, queued)
+
+	if queued > atomic.LoadInt64(&w.stats.maxQueued) {
+		atomic.StoreInt64(&w.stats.maxQueued, queued)
+		events.Emit(ctx, "poolerload", "%d clients queued by the pooler", queued)
+	}
+}
@@ -0,0 +1,171 @@
+package poolerload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"os"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Clients: 10, HoldTime: time.Second}},
+		{valid: true, config: Config{Clients: 10, HoldTime: time.Second, AdminDatabase: "console"}},
+		{valid: false, config: Config{Clients: 0, HoldTime: time.Second}},
+		{valid: false, config: Config{Clients: 10, HoldTime: 0}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+// TestWorkload_Run requires connection pooler in front of test database, connection string
+// to the pooler is specified with NOISIA_TEST_POOLER_CONNINFO environment variable.
+func TestWorkload_Run(t *testing.T) {
+	conninfo := os.Getenv("NOISIA_TEST_POOLER_CONNINFO")
+	if conninfo == "" {
+		t.Skip("NOISIA_TEST_POOLER_CONNINFO is not set, connection pooler is not available")
+	}
+
+	config := Config{Conninfo: conninfo, Clients: 50, HoldTime: 500 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Equal(t, int64(50), w.Stats()["clients"])
+	assert.Greater(t, w.Stats()["queries"], int64(0))
+}
+
+func TestWorkload_Run_fake(t *testing.T) {
+	w, err := NewWorkload(Config{Clients: 5, HoldTime: 10 * time.Millisecond}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "pgbouncer", w.(*workload).config.AdminDatabase)
+
+	var (
+		mu    sync.Mutex
+		conns []*sleepConn
+	)
+	w.(*workload).connect = func(context.Context, string) (db.Conn, error) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		c := &sleepConn{}
+		conns = append(conns, c)
+		return c, nil
+	}
+
+	var requests int
+	w.(*workload).showPools = func(_ context.Context, _ string, database string) ([]db.PoolStats, error) {
+		assert.Equal(t, "pgbouncer", database)
+		requests++
+		return []db.PoolStats{
+			{Database: "noisia", User: "noisia", Active: 2, Waiting: int64(4 - requests)},
+			{Database: "pgbouncer", User: "pgbouncer", Active: 1, Waiting: 0},
+		}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	assert.NoError(t, w.Run(ctx))
+
+	assert.Len(t, conns, 5)
+	for _, c := range conns {
+		assert.Greater(t, c.queries(), 0)
+		assert.True(t, c.isClosed())
+	}
+
+	st := w.Stats()
+	assert.Equal(t, 2, requests)
+	assert.Equal(t, int64(5), st["clients"])
+	assert.Equal(t, int64(2), st["queued"])
+	assert.Equal(t, int64(3), st["max_queued"])
+	assert.Equal(t, int64(0), st["failed"])
+}
+
+func TestWorkload_samplePools_unavailable(t *testing.T) {
+	w, err := NewWorkload(Config{Clients: 1, HoldTime: time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	var requests int
+	w.(*workload).showPools = func(context.Context, string, string) ([]db.PoolStats, error) {
+		requests++
+		return nil, fmt.Errorf("example error")
+	}
+
+	// Sampling is stopped after the first failed request.
+	ctx, cancel := context.WithTimeout(context.Background(), 2500*time.Millisecond)
+	defer cancel()
+	w.(*workload).samplePools(ctx)
+
+	assert.Equal(t, 1, requests)
+	assert.Equal(t, int64(0), w.Stats()["max_queued"])
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Clients: 1, HoldTime: time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "poolerload", w.Name())
+}
+
+// sleepConn implements db.Conn interface which sleeps in queries and tracks executed queries.
+type sleepConn struct {
+	mu     sync.Mutex
+	count  int
+	closed bool
+}
+
+func (c *sleepConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *sleepConn) Exec(ctx context.Context, _ string, _ ...interface{}) (int64, string, error) {
+	select {
+	case <-time.After(10 * time.Millisecond):
+	case <-ctx.Done():
+		return 0, "", ctx.Err()
+	}
+
+	c.mu.Lock()
+	c.count++
+	c.mu.Unlock()
+	return 0, "", nil
+}
+
+func (c *sleepConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return nil, nil
+}
+
+func (c *sleepConn) Close() error {
+	c.mu.Lock()
+	c.closed = true
+	c.mu.Unlock()
+	return nil
+}
+
+func (c *sleepConn) queries() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.count
+}
+
+func (c *sleepConn) isClosed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.closed
+}
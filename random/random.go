@@ -0,0 +1,40 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package random provides sources of pseudo-random numbers used by workloads for their
+// decisions, e.g. choosing tables, queries and naptimes. Sources created with the same
+// seed produce the same sequences, so runs could be reproduced.
+//
+// Workers of a workload run concurrently, each worker gets its own source derived from
+// the seed and index of the worker (stream). Sources are not safe for concurrent use.
+package random
+
+import (
+	"math/rand"
+	"time"
+)
+
+// streamStep defines distance between seeds of adjacent streams.
+const streamStep = 1000003
+
+// New creates a new source of random numbers for passed stream, e.g. index of worker. Sources
+// created with the same seed and stream produce the same sequence. Zero seed means the source
+// is seeded using current time.
+func New(seed int64, stream int) *rand.Rand {
+	if seed == 0 {
+		seed = NewSeed()
+	}
+
+	return rand.New(rand.NewSource(seed + int64(stream)*streamStep))
+}
+
+// NewSeed returns a new non-zero seed based on current time.
+func NewSeed() int64 {
+	seed := time.Now().UnixNano()
+	if seed == 0 {
+		seed = 1
+	}
+
+	return seed
+}
@@ -0,0 +1,29 @@
+package random
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNew(t *testing.T) {
+	sequence := func(seed int64, stream int) []int {
+		r := New(seed, stream)
+		s := make([]int, 10)
+		for i := range s {
+			s[i] = r.Intn(1000)
+		}
+		return s
+	}
+
+	// The same seed and stream produce the same sequence.
+	assert.Equal(t, sequence(42, 0), sequence(42, 0))
+	assert.Equal(t, sequence(42, 3), sequence(42, 3))
+
+	// Different streams and seeds produce different sequences.
+	assert.NotEqual(t, sequence(42, 0), sequence(42, 1))
+	assert.NotEqual(t, sequence(42, 0), sequence(43, 0))
+}
+
+func TestNewSeed(t *testing.T) {
+	assert.NotZero(t, NewSeed())
+}
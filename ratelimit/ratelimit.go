@@ -0,0 +1,80 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package ratelimit implements a loop which calls passed function with required
+// rate until context is done. It is shared by rate-based workloads, so throttling,
+// error logging and cancellation are handled in the same way.
+//
+// Rate is throttled by adaptive limiter, if specified. Errors returned by the
+// function are logged and the loop continues. Errors which happened after context
+// has been done are not logged, because these are expected at the end of workload.
+// To stop the loop before context is done, the function should return ErrStop.
+//
+// Rate could be changed while the loop is running using Rate passed to RunRate.
+// New rate takes effect since the next call of the function.
+//
+// Calls are paced by Scheduler, constant rate is used by default. Other schedulers could be
+// passed to RunScheduler or created by factory passed to RunWorker, e.g. Poisson arrivals or
+// on/off bursts. Rate changes and adaptive limiter are applied under any scheduler.
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/log"
+	"math"
+	"sync/atomic"
+)
+
+// ErrStop is returned by loop function when the loop should be stopped.
+var ErrStop = errors.New("stop loop")
+
+// Rate defines rate of the loop which could be changed while the loop is running. It is safe for concurrent use.
+type Rate struct {
+	bits uint64
+}
+
+// NewRate creates a new rate with initial value.
+func NewRate(r float64) *Rate {
+	return &Rate{bits: math.Float64bits(r)}
+}
+
+// Load returns current value of the rate.
+func (r *Rate) Load() float64 {
+	return math.Float64frombits(atomic.LoadUint64(&r.bits))
+}
+
+// Store sets new value of the rate.
+func (r *Rate) Store(v float64) {
+	atomic.StoreUint64(&r.bits, math.Float64bits(v))
+}
+
+// Run calls fn in a loop with required rate until context is done or fn returns ErrStop.
+func Run(ctx context.Context, r float64, al *adaptive.Limiter, fn func(ctx context.Context) error, logger log.Logger) {
+	RunRate(ctx, NewRate(r), al, fn, logger)
+}
+
+// RunRate calls fn in a loop with rate defined by r until context is done or fn returns ErrStop.
+// Changes of the rate are applied before each call. Calls are paced by constant scheduler.
+func RunRate(ctx context.Context, r *Rate, al *adaptive.Limiter, fn func(ctx context.Context) error, logger log.Logger) {
+	RunScheduler(ctx, r, al, NewConstantScheduler(), fn, logger)
+}
+
+// handleError logs error returned by loop function and returns true if the loop should be stopped.
+func handleError(ctx context.Context, err error, logger log.Logger) bool {
+	if err == nil {
+		return false
+	}
+
+	if errors.Is(err, ErrStop) {
+		return true
+	}
+
+	if ctx.Err() == nil {
+		logger.Warnf("%s, continue", err)
+	}
+
+	return false
+}
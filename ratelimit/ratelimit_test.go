@@ -0,0 +1,84 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestRun(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var n int
+	Run(ctx, 40, nil, func(context.Context) error {
+		n++
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	// Expected 20 calls plus the first one allowed immediately.
+	assert.GreaterOrEqual(t, n, 15)
+	assert.LessOrEqual(t, n, 25)
+}
+
+func TestRun_cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	// The loop should be stopped right after cancel instead of waiting for the next call.
+	var n int
+	start := time.Now()
+	Run(ctx, 0.1, nil, func(context.Context) error {
+		n++
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+	assert.Equal(t, 1, n)
+}
+
+func TestRun_errors(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Errors don't stop the loop, ErrStop does.
+	var n int
+	Run(ctx, 100, nil, func(context.Context) error {
+		n++
+		if n == 5 {
+			return ErrStop
+		}
+		return fmt.Errorf("failed")
+	}, log.NewDefaultLogger("error"))
+
+	assert.Equal(t, 5, n)
+	assert.NoError(t, ctx.Err())
+}
+
+func TestRunRate_store(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Increase rate in the middle of the run.
+	r := NewRate(10)
+	time.AfterFunc(500*time.Millisecond, func() { r.Store(100) })
+
+	var before, after int
+	start := time.Now()
+	RunRate(ctx, r, nil, func(context.Context) error {
+		if time.Since(start) < 500*time.Millisecond {
+			before++
+		} else {
+			after++
+		}
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	// Expected about 5 calls before and about 50 calls after the change.
+	assert.LessOrEqual(t, before, 8)
+	assert.GreaterOrEqual(t, after, 30)
+	assert.Equal(t, float64(100), r.Load())
+}
@@ -0,0 +1,144 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/log"
+	"math/rand"
+	"time"
+)
+
+// Scheduler defines pacing of the loop, it returns delay between starts of the previous and the
+// next calls of the function. Passed rate is the current rate of the loop (per second), which
+// could be changed while the loop is running or throttled by adaptive limiter.
+type Scheduler interface {
+	Next(r float64) time.Duration
+}
+
+// SchedulerFactory creates scheduler used by worker with passed index. Each worker uses its own
+// scheduler, so schedulers don't need to be safe for concurrent use.
+type SchedulerFactory func(worker int) Scheduler
+
+// NewScheduler creates scheduler for the worker with passed index using passed factory, if factory
+// is nil constant scheduler is created.
+func NewScheduler(factory SchedulerFactory, worker int) Scheduler {
+	if factory == nil {
+		return NewConstantScheduler()
+	}
+
+	return factory(worker)
+}
+
+// RunWorker calls fn in a loop until context is done or fn returns ErrStop. Calls are made with
+// rate r and paced by scheduler created by passed factory for the worker.
+func RunWorker(ctx context.Context, r float64, factory SchedulerFactory, worker int, fn func(ctx context.Context) error, logger log.Logger) {
+	RunWorkerRate(ctx, NewRate(r), nil, factory, worker, fn, logger)
+}
+
+// RunWorkerRate calls fn in a loop until context is done or fn returns ErrStop. Calls are made
+// with rate defined by r, throttled by adaptive limiter, and paced by scheduler created by passed
+// factory for the worker.
+func RunWorkerRate(ctx context.Context, r *Rate, al *adaptive.Limiter, factory SchedulerFactory, worker int, fn func(ctx context.Context) error, logger log.Logger) {
+	RunScheduler(ctx, r, al, NewScheduler(factory, worker), fn, logger)
+}
+
+// RunScheduler calls fn in a loop with delays returned by scheduler until context is done or fn returns ErrStop.
+// Changes of the rate and the adaptive limiter factor are applied before each call.
+func RunScheduler(ctx context.Context, r *Rate, al *adaptive.Limiter, s Scheduler, fn func(ctx context.Context) error, logger log.Logger) {
+	timer := time.NewTimer(0)
+	defer timer.Stop()
+	<-timer.C
+
+	var last time.Time
+	for {
+		// Delay is counted since the start of the previous call, so long calls don't lower the rate.
+		delay := s.Next(al.Scale(r.Load()))
+		if !last.IsZero() {
+			delay -= time.Since(last)
+		}
+
+		timer.Reset(delay)
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		last = time.Now()
+		if handleError(ctx, fn(ctx), logger) {
+			return
+		}
+	}
+}
+
+// ConstantScheduler implements Scheduler with equal delays between calls. The first call is made
+// immediately.
+type ConstantScheduler struct {
+	started bool
+}
+
+// NewConstantScheduler creates scheduler which makes calls with constant rate.
+func NewConstantScheduler() *ConstantScheduler {
+	return &ConstantScheduler{}
+}
+
+// Next returns interval of the rate, or zero for the first call.
+func (s *ConstantScheduler) Next(r float64) time.Duration {
+	if !s.started {
+		s.started = true
+		return 0
+	}
+
+	return rateInterval(r)
+}
+
+// PoissonScheduler implements Scheduler with exponentially distributed delays, so calls arrive
+// like independent requests of many clients (Poisson process) with average rate of the loop.
+type PoissonScheduler struct {
+	rnd *rand.Rand
+}
+
+// NewPoissonScheduler creates scheduler which makes calls with average rate of the loop.
+// Delays are generated using passed source of random numbers.
+func NewPoissonScheduler(rnd *rand.Rand) *PoissonScheduler {
+	return &PoissonScheduler{rnd: rnd}
+}
+
+// Next returns random delay, delays are exponentially distributed.
+func (s *PoissonScheduler) Next(r float64) time.Duration {
+	return time.Duration(s.rnd.ExpFloat64() / r * float64(time.Second))
+}
+
+// BurstScheduler implements Scheduler with on/off pattern: during on period calls are made with
+// rate of the loop, during off period no calls are made.
+type BurstScheduler struct {
+	on  time.Duration
+	off time.Duration
+	// pos defines position of the last call within the current on period.
+	pos time.Duration
+}
+
+// NewBurstScheduler creates scheduler which makes calls with rate of the loop during on period
+// and then pauses for off period.
+func NewBurstScheduler(on, off time.Duration) *BurstScheduler {
+	return &BurstScheduler{on: on, off: off}
+}
+
+// Next returns interval of the rate, or time until the next on period if the current one is over.
+func (s *BurstScheduler) Next(r float64) time.Duration {
+	interval := rateInterval(r)
+	if s.pos+interval < s.on {
+		s.pos += interval
+		return interval
+	}
+
+	// Skip the rest of on period and the whole off period.
+	d := s.on - s.pos + s.off
+	s.pos = 0
+	return d
+}
+
+// rateInterval returns interval between calls made with passed rate per second.
+func rateInterval(r float64) time.Duration {
+	return time.Duration(float64(time.Second) / r)
+}
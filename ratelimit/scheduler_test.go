@@ -0,0 +1,174 @@
+package ratelimit
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"math"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestConstantScheduler(t *testing.T) {
+	s := NewConstantScheduler()
+	assert.Equal(t, time.Duration(0), s.Next(20))
+	for i := 0; i < 10; i++ {
+		assert.Equal(t, 50*time.Millisecond, s.Next(20))
+	}
+
+	// Changed rate is applied to the next delay.
+	assert.Equal(t, 10*time.Millisecond, s.Next(100))
+}
+
+func TestPoissonScheduler(t *testing.T) {
+	s := NewPoissonScheduler(rand.New(rand.NewSource(1)))
+
+	const n = 20000
+	var sum, sumSq float64
+	for i := 0; i < n; i++ {
+		d := s.Next(10)
+		assert.GreaterOrEqual(t, int64(d), int64(0))
+		sum += d.Seconds()
+		sumSq += d.Seconds() * d.Seconds()
+	}
+
+	// Exponential distribution has mean and standard deviation both equal to 1/rate.
+	mean := sum / n
+	stddev := math.Sqrt(sumSq/n - mean*mean)
+	assert.InDelta(t, 0.1, mean, 0.005)
+	assert.InDelta(t, 0.1, stddev, 0.01)
+}
+
+func TestBurstScheduler(t *testing.T) {
+	// 10 calls per second during 1s, then 2s pause.
+	s := NewBurstScheduler(time.Second, 2*time.Second)
+
+	for cycle := 0; cycle < 3; cycle++ {
+		var total time.Duration
+		var short int
+		for total < 3*time.Second {
+			d := s.Next(10)
+			total += d
+			if d == 100*time.Millisecond {
+				short++
+			}
+		}
+
+		// Each cycle lasts exactly on plus off period, calls within on period are made with the rate.
+		assert.Equal(t, 3*time.Second, total)
+		assert.Equal(t, 9, short)
+	}
+}
+
+func TestRunScheduler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	var n int
+	RunScheduler(ctx, NewRate(40), nil, NewBurstScheduler(time.Second, time.Second), func(context.Context) error {
+		n++
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	// Expected 20 calls, the first one is made after the first delay.
+	assert.GreaterOrEqual(t, n, 15)
+	assert.LessOrEqual(t, n, 21)
+}
+
+func TestRunScheduler_slowCalls(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// Delays are counted since the start of previous call, so calls slower than the interval don't lower the rate.
+	var n int
+	RunScheduler(ctx, NewRate(20), nil, NewPoissonScheduler(rand.New(rand.NewSource(1))), func(context.Context) error {
+		n++
+		time.Sleep(40 * time.Millisecond)
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	assert.GreaterOrEqual(t, n, 5)
+	assert.LessOrEqual(t, n, 13)
+}
+
+func TestRunScheduler_rate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Increase rate in the middle of the run, the change is applied by non-constant scheduler.
+	r := NewRate(10)
+	time.AfterFunc(500*time.Millisecond, func() { r.Store(100) })
+
+	var before, after int
+	start := time.Now()
+	RunScheduler(ctx, r, nil, NewBurstScheduler(time.Minute, 0), func(context.Context) error {
+		if time.Since(start) < 500*time.Millisecond {
+			before++
+		} else {
+			after++
+		}
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	assert.LessOrEqual(t, before, 6)
+	assert.GreaterOrEqual(t, after, 30)
+}
+
+func TestRunScheduler_adaptive(t *testing.T) {
+	// Load is always above threshold, so rate factor is quickly lowered to minimum.
+	al, err := adaptive.NewLimiter(adaptive.Config{Threshold: 1, PollInterval: 5 * time.Millisecond}, loadSource(100), log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	lctx, lcancel := context.WithCancel(context.Background())
+	defer lcancel()
+	go al.Run(lctx)
+	assert.Eventually(t, func() bool { return al.Factor() < 0.1 }, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	// Throttled rate is about 5 calls per second.
+	var n int
+	RunScheduler(ctx, NewRate(100), al, NewPoissonScheduler(rand.New(rand.NewSource(1))), func(context.Context) error {
+		n++
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	assert.LessOrEqual(t, n, 10)
+}
+
+// loadSource implements adaptive.Source interface and returns constant load.
+type loadSource float64
+
+func (s loadSource) Load(context.Context) (float64, error) { return float64(s), nil }
+
+func TestRunWorker(t *testing.T) {
+	// Scheduler is created for each worker.
+	var workers []int
+	factory := func(worker int) Scheduler {
+		workers = append(workers, worker)
+		return NewConstantScheduler()
+	}
+
+	var n int
+	RunWorker(context.Background(), 100, factory, 3, func(context.Context) error {
+		n++
+		if n == 5 {
+			return ErrStop
+		}
+		return nil
+	}, log.NewDefaultLogger("error"))
+
+	assert.Equal(t, []int{3}, workers)
+	assert.Equal(t, 5, n)
+
+	// Without factory, constant rate is used.
+	n = 0
+	RunWorker(context.Background(), 100, nil, 0, func(context.Context) error {
+		n++
+		return ErrStop
+	}, log.NewDefaultLogger("error"))
+	assert.Equal(t, 1, n)
+}
@@ -8,10 +8,13 @@
 //
 // For creating the workload, start required number of workers (number of goroutines
 // depends on Config.Jobs). Each worker creates a temporary table. The table is used
-// in queries to bypass parser errors related to querying non-existent table. Next,
+// in queries to bypass parser errors related to querying non-existent table (in
+// transaction pooling mode, a regular working table is used instead). Next,
 // rollbacks loop is started. In the loop, a random query is selected and issued.
 // The query obviously fails. Next query is executed accordingly to rate specified
 // in Config.Rate.
+// In strict mode, SQLSTATE code of each error is compared with the code expected from
+// the query. Mismatched errors and unexpectedly succeeded queries are counted separately.
 // Workload duration is controlled by context created outside and passed to Run method.
 // Context is passed to each worker and used in the worker's loop. When context expires
 // loop is stopped.
@@ -21,14 +24,33 @@ import (
 	"context"
 	"fmt"
 	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/fixture"
 	"github.com/lesovsky/noisia/log"
-	"golang.org/x/time/rate"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/workerpool"
 	"math/rand"
+	"sort"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// fixtureTable defines name of the working table used in transaction pooling mode.
+	fixtureTable = "_noisia_rollbacks_workload"
+	// tableColumns defines columns of the table used in error queries.
+	tableColumns = "(entity_id INT, name TEXT, size_b BIGINT, created_at TIMESTAMPTZ)"
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures.
+	defaultCleanupTimeout = 10 * time.Second
+	// otherErrors defines key of rollbacks caused by errors without SQLSTATE code, e.g. network errors.
+	otherErrors = "other"
+)
+
 // Config defines configuration settings for rollbacks workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
@@ -37,16 +59,74 @@ type Config struct {
 	Jobs uint16
 	// Rate defines rollbacks rate produced per second (per single worker).
 	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// SQLStates defines SQLSTATE codes or condition names (e.g. 42601 or syntax_error) of errors
+	// which should be produced. All available errors are produced if empty.
+	SQLStates []string
+	// Strict defines whether errors should be checked they have SQLSTATE codes expected from queries.
+	Strict bool
+	// Databases defines databases which workers connect to accordingly to workers indexes, empty
+	// name means the database from connection string.
+	Databases []string
+	// Seed defines seed of random choices of error queries, current time is used if zero.
+	Seed int64
+	// CleanupTimeout defines max time allowed for cleanup fixtures, if zero the default timeout is used.
+	CleanupTimeout time.Duration
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than zero")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	err := db.ValidateWorkerDatabases(c.Databases, c.Jobs)
+	if err != nil {
+		return noisia.NewConfigError("Databases", noisia.ErrInvalidValue, "%s", err)
 	}
 
 	if c.Rate <= 0 {
-		return fmt.Errorf("rate must be positive")
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	err = db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	for _, v := range c.SQLStates {
+		if len(selectErrQueries([]string{v})) == 0 {
+			return noisia.NewConfigError("SQLStates", noisia.ErrInvalidValue, "unsupported sqlstate: %s", v)
+		}
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
 	}
 
 	return nil
@@ -56,6 +136,52 @@ func (c Config) validate() error {
 type workload struct {
 	config Config
 	logger log.Logger
+	stats  stats
+	// rate defines current rate of workers, it could be changed while the workload is running.
+	rate *ratelimit.Rate
+	// workers defines pool of workers, its size could be changed while the workload is running.
+	workers *workerpool.Pool
+}
+
+// stats defines counters of executed queries, counters are updated atomically.
+type stats struct {
+	commits    int64
+	rollbacks  int64
+	unexpected int64
+	// mu protects sqlstates.
+	mu sync.Mutex
+	// sqlstates defines breakdown of rollbacks by SQLSTATE codes of errors.
+	sqlstates map[string]int64
+}
+
+// addRollback counts rollback caused by passed error. Errors without SQLSTATE code are counted as other errors.
+func (s *stats) addRollback(err error) {
+	code := db.ErrorCode(err)
+	if code == "" {
+		code = otherErrors
+	}
+
+	atomic.AddInt64(&s.rollbacks, 1)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sqlstates == nil {
+		s.sqlstates = map[string]int64{}
+	}
+	s.sqlstates[code]++
+}
+
+// breakdown returns copy of rollbacks counters by SQLSTATE codes.
+func (s *stats) breakdown() map[string]int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := make(map[string]int64, len(s.sqlstates))
+	for code, n := range s.sqlstates {
+		b[code] = n
+	}
+
+	return b
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -65,40 +191,161 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger}, nil
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{
+		config:  config,
+		logger:  logger,
+		rate:    ratelimit.NewRate(config.Rate),
+		workers: workerpool.New(int(config.Jobs)),
+	}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "rollbacks"
+}
+
+// SetRate changes rate of running workers, new rate takes effect since the next query.
+func (w *workload) SetRate(r float64) error {
+	if r <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be greater than zero")
+	}
+
+	w.rate.Store(r)
+	return nil
+}
+
+// SetJobs changes number of running workers, extra workers are stopped and missing workers are started.
+func (w *workload) SetJobs(jobs uint16) error {
+	if jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	w.workers.Resize(int(jobs))
+	return nil
+}
+
+// Stats returns counters of rolled back, committed and unexpectedly finished queries. Rollbacks are
+// also broken down by SQLSTATE codes of errors, e.g. 'sqlstate_42601'.
+func (w *workload) Stats() noisia.Stats {
+	stats := noisia.Stats{
+		"rollbacks":  atomic.LoadInt64(&w.stats.rollbacks),
+		"commits":    atomic.LoadInt64(&w.stats.commits),
+		"unexpected": atomic.LoadInt64(&w.stats.unexpected),
+	}
+
+	for code, n := range w.stats.breakdown() {
+		stats["sqlstate_"+code] = n
+	}
+
+	return stats
 }
 
 // Run method starts necessary number of workers and waiting until they finish.
 func (w *workload) Run(ctx context.Context) error {
-	workers := int(w.config.Jobs)
-
-	var wg sync.WaitGroup
+	// Temporary tables are not allowed in transaction pooling mode, use regular working table.
+	if w.config.PoolerMode == db.PoolerModeTransaction {
+		err := w.prepare(ctx)
+		if err != nil {
+			return err
+		}
 
-	wg.Add(workers)
-	for i := 0; i < workers; i++ {
-		go func() {
-			err := runWorker(ctx, w.logger, w.config)
+		// Cleanup in the end.
+		defer func() {
+			err := w.cleanup()
 			if err != nil {
-				w.logger.Warnf("start rollbacks worker failed: %s, continue", err)
+				w.logger.Warnf("rollbacks cleanup failed: %s", err)
 			}
-			wg.Done()
 		}()
 	}
 
-	wg.Wait()
+	w.workers.Run(ctx, func(ctx context.Context, i int) {
+		err := runWorker(ctx, w.logger, w.config, w.rate, ratelimit.NewScheduler(w.config.Scheduler, i), w.workerOptions(i), random.New(w.config.Seed, i), &w.stats)
+		if err != nil {
+			w.logger.Warnf("start rollbacks worker failed: %s, continue", err)
+		}
+	})
+
+	w.logger.Infof("rollbacks by sqlstate: %s", formatBreakdown(w.stats.breakdown()))
+
 	return nil
 }
 
-// runWorker connects to the database and start rollback loop.
-func runWorker(ctx context.Context, log log.Logger, config Config) error {
+// prepare method creates working table used in transaction pooling mode.
+func (w *workload) prepare(ctx context.Context) error {
+	conn, err := db.ConnectWithOptions(ctx, w.config.Conninfo, w.connOptions())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, _, err = conn.Exec(ctx, fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s %s", fixtureTable, tableColumns))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// cleanup method drops working table after workload has been done.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	conn, err := db.ConnectWithOptions(ctx, w.config.Conninfo, w.connOptions())
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn.Close() }()
+
+	_, _, err = conn.Exec(ctx, fmt.Sprintf("DROP TABLE IF EXISTS %s", fixtureTable))
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// connOptions returns options used for connecting to the database.
+func (w *workload) connOptions() db.ConnOptions {
+	return db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}
+}
+
+// workerOptions returns options used by worker with passed index for connecting to the database mapped to the worker.
+func (w *workload) workerOptions(i int) db.ConnOptions {
+	opts := w.connOptions()
+	opts.Database = db.WorkerDatabase(w.config.Databases, i)
+
+	return opts
+}
+
+// runWorker connects to the database using passed options and start rollback loop.
+func runWorker(ctx context.Context, log log.Logger, config Config, r *ratelimit.Rate, s ratelimit.Scheduler, opts db.ConnOptions, rnd *rand.Rand, st *stats) error {
 	log.Info("start rollback worker")
 
-	conn, err := db.Connect(ctx, config.Conninfo)
+	conn, err := db.ConnectWithOptions(ctx, config.Conninfo, opts)
 	if err != nil {
 		return err
 	}
 
-	commits, rollbacks, err := startLoop(ctx, conn, config.Rate)
+	tables := fixture.NewTempTables(conn)
+	table, err := workingTable(ctx, tables, config.PoolerMode)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Context is done at this point, use a separate bounded context for dropping tables.
+		dctx, cancel := context.WithTimeout(context.Background(), config.CleanupTimeout)
+		defer cancel()
+		if err := tables.DropAll(dctx); err != nil {
+			log.Warnf("drop temporary table failed: %s", err)
+		}
+	}()
+
+	commits, rollbacks, err := startLoop(ctx, log, conn, table, config, r, s, rnd, st)
 	if err != nil {
 		log.Warnf("rollbacks worker failed: %s", err)
 	}
@@ -108,128 +355,248 @@ func runWorker(ctx context.Context, log log.Logger, config Config) error {
 }
 
 // startLoop start rollbacks in a loop with required rate until context timeout exceeded.
-func startLoop(ctx context.Context, conn db.Conn, r float64) (int, int, error) {
-	table, err := createTempTable(ctx, conn)
-	if err != nil {
-		return 0, 0, err
-	}
-
+// Rate is throttled by adaptive limiter, if specified, queries are paced by passed scheduler. Queries are chosen using passed random source.
+// Returns number of worker's commits and rollbacks, also these are added to passed stats.
+func startLoop(ctx context.Context, log log.Logger, conn db.Conn, table string, config Config, r *ratelimit.Rate, s ratelimit.Scheduler, rnd *rand.Rand, st *stats) (int, int, error) {
 	var commits, rollbacks int
 
-	limiter := rate.NewLimiter(rate.Limit(r), 1)
-	for {
-		if limiter.Allow() {
-			// Select random query with arguments.
-			q, args := newErrQuery(table)
+	templates := selectErrQueries(config.SQLStates)
 
-			// Execute query. Suppress errors, it is designed all generated queries produce errors.
-			// Consider the error related to context expiration lead to rollback.
-			_, _, err = conn.Exec(ctx, q, args...)
-			if err != nil {
-				rollbacks++
-			} else {
-				commits++
-			}
+	ratelimit.RunScheduler(ctx, r, config.Adaptive, s, func(ctx context.Context) error {
+		// Select random query with arguments.
+		q, args, sqlstate := newErrQuery(rnd, table, templates)
+
+		// Execute query. Suppress errors, it is designed all generated queries produce errors.
+		// Consider the error related to context expiration lead to rollback.
+		_, _, err := conn.Exec(ctx, q, args...)
+		if err != nil {
+			rollbacks++
+			st.addRollback(err)
+		} else {
+			commits++
+			atomic.AddInt64(&st.commits, 1)
 		}
 
-		select {
-		case <-ctx.Done():
-			return commits, rollbacks, nil
-		default:
+		// Errors related to context expiration are not checked.
+		if config.Strict && ctx.Err() == nil {
+			if code := db.ErrorCode(err); code != sqlstate {
+				atomic.AddInt64(&st.unexpected, 1)
+				log.Warnf("unexpected result of error query, expected sqlstate %s, got '%s' (error: %v): %s", sqlstate, code, err, q)
+			}
 		}
-	}
+		events.Emit(ctx, "rollbacks", "executed error query: %s", q)
+
+		return nil
+	}, log)
+
+	return commits, rollbacks, nil
 }
 
-// createTempTable creates temporary table for session.
-func createTempTable(ctx context.Context, conn db.Conn) (string, error) {
-	t := fmt.Sprintf("noisia_%d", time.Now().Unix())
-	q := fmt.Sprintf("CREATE TEMP TABLE IF NOT EXISTS %s (entity_id INT, name TEXT, size_b BIGINT, created_at TIMESTAMPTZ)", t)
+// formatBreakdown returns rollbacks counters by SQLSTATE codes sorted by codes, e.g. '22012: 10, 42601: 25'.
+func formatBreakdown(b map[string]int64) string {
+	if len(b) == 0 {
+		return "none"
+	}
 
-	_, _, err := conn.Exec(ctx, q)
-	if err != nil {
-		return "", err
+	codes := make([]string, 0, len(b))
+	for code := range b {
+		codes = append(codes, code)
 	}
+	sort.Strings(codes)
 
-	return t, nil
+	parts := make([]string, 0, len(codes))
+	for _, code := range codes {
+		parts = append(parts, fmt.Sprintf("%s: %d", code, b[code]))
+	}
+
+	return strings.Join(parts, ", ")
 }
 
-// newErrQuery returns random invalid query with arguments.
-func newErrQuery(table string) (string, []interface{}) {
-	// Total number of available erroneous queries.
-	const total = 15
+// workingTable returns table used in error queries. In transaction pooling mode the regular
+// working table is used, otherwise temporary table is created for session.
+func workingTable(ctx context.Context, tables *fixture.TempTables, poolerMode string) (string, error) {
+	if poolerMode == db.PoolerModeTransaction {
+		return fixtureTable, nil
+	}
 
-	rand.Seed(time.Now().UnixNano())
-	idx := rand.Intn(total)
+	return tables.Create(ctx, tableColumns)
+}
 
-	var (
-		num1, num2 = rand.Intn(1000), rand.Intn(10000)
-		str1       = fmt.Sprintf("AUX-%d-%d-%d", rand.Intn(1000), rand.Intn(1000), rand.Intn(1000))
-		str2       = fmt.Sprintf("AUX-%d-%d-%d", rand.Intn(1000), rand.Intn(1000), rand.Intn(1000))
+// errQuery defines template of invalid query and the error expected from it.
+type errQuery struct {
+	// sqlstate defines SQLSTATE code of the expected error.
+	sqlstate string
+	// condition defines condition name of the expected error, as listed in PostgreSQL documentation.
+	condition string
+	// build returns query text and its arguments for passed table and random values.
+	build func(table string, v queryValues) (string, []interface{})
+}
 
-		q    string
-		args []interface{}
-	)
+// queryValues defines random values used as arguments of error queries.
+type queryValues struct {
+	num1, num2 int
+	str1, str2 string
+}
 
-	switch idx {
-	case 0:
+// errQueries defines all available error query templates.
+var errQueries = []errQuery{
+	{
 		// ERROR:  INSERT has more expressions than target columns
-		q = fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b) VALUES ($1, $2, $3, $4)", table)
-		args = []interface{}{num1, str1, num2, time.Now().String()}
-	case 1:
+		sqlstate: "42601", condition: "syntax_error",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b) VALUES ($1, $2, $3, $4)", table),
+				[]interface{}{v.num1, v.str1, v.num2, time.Now().String()}
+		},
+	},
+	{
 		// ERROR:  invalid input syntax for type integer: "???"
-		q = fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b) VALUES ($1, $2, $3)", table)
-		args = []interface{}{num1, str1, str2}
-	case 2:
+		sqlstate: "22P02", condition: "invalid_text_representation",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b) VALUES ($1, $2, $3)", table),
+				[]interface{}{v.num1, v.str1, v.str2}
+		},
+	},
+	{
 		// ERROR:  date/time field value out of range: "???" at character ???
-		q = fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b, created_at) VALUES ($1, $2, $3, $4)", table)
-		args = []interface{}{num1, str1, num2, "30/02/2021"}
-	case 3:
-		// ERROR:  could not open file "???" for writing: No such file or directory
-		q = fmt.Sprintf("COPY %s FROM '/mnt/vol9/raw/data/%d/noisia.in.csv'", table, num1)
-	case 4:
+		sqlstate: "22008", condition: "datetime_field_overflow",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("INSERT INTO %s (entity_id, name, size_b, created_at) VALUES ($1, $2, $3, $4)", table),
+				[]interface{}{v.num1, v.str1, v.num2, "30/02/2021"}
+		},
+	},
+	{
+		// ERROR:  could not open file "???" for reading: No such file or directory
+		sqlstate: "58P01", condition: "undefined_file",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("COPY %s FROM '/mnt/vol9/raw/data/%d/noisia.in.csv'", table, v.num1), nil
+		},
+	},
+	{
 		// ERROR:  syntax error at or near "???" at character ???
-		q = fmt.Sprintf("INSERT SELECT entity_id, name, size_b, created_at FROM %s WHERE entity_id = $1", table)
-		args = []interface{}{num1}
-	case 5:
+		sqlstate: "42601", condition: "syntax_error",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("INSERT SELECT entity_id, name, size_b, created_at FROM %s WHERE entity_id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+	{
 		// ERROR:  column "???" does not exist at character ???
-		q = fmt.Sprintf("SELECT id, name, size_b, created_at FROM %s WHERE id = $1", table)
-		args = []interface{}{num1}
-	case 6:
+		sqlstate: "42703", condition: "undefined_column",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT id, name, size_b, created_at FROM %s WHERE id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+	{
 		// ERROR:  relation "???" does not exist at character ???
-		q = fmt.Sprintf("SELECT entity_id, name, size_b, created_at FROM %s_1 WHERE entity_id = $1", table)
-		args = []interface{}{num1}
-	case 7:
+		sqlstate: "42P01", condition: "undefined_table",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT entity_id, name, size_b, created_at FROM %s_1 WHERE entity_id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+	{
 		// ERROR:  function string_agg(integer, unknown) does not exist at character ???
-		q = fmt.Sprintf("SELECT string_agg(name, 10) FROM %s WHERE entity_id >= $1 and entity_id < $2", table)
-		args = []interface{}{num1, num2}
-	case 8:
+		sqlstate: "42883", condition: "undefined_function",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT string_agg(name, 10) FROM %s WHERE entity_id >= $1 and entity_id < $2", table),
+				[]interface{}{v.num1, v.num2}
+		},
+	},
+	{
 		// ERROR:  column "???" must appear in the GROUP BY clause or be used in an aggregate function at character ???
-		q = fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY name ORDER BY 3 DESC", table)
-		args = []interface{}{num1 * 999999}
-	case 9:
+		sqlstate: "42803", condition: "grouping_error",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY name ORDER BY 3 DESC", table),
+				[]interface{}{v.num1 * 999999}
+		},
+	},
+	{
 		// ERROR:  aggregate functions are not allowed in GROUP BY at character ???
-		q = fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY 1,2,3 ORDER BY 3 DESC", table)
-		args = []interface{}{num1 * 999999}
-	case 10:
+		sqlstate: "42803", condition: "grouping_error",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY 1,2,3 ORDER BY 3 DESC", table),
+				[]interface{}{v.num1 * 999999}
+		},
+	},
+	{
 		// ERROR:  ORDER BY position 4 is not in select list
-		q = fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY 1,2,3 ORDER BY 4 DESC", table)
-		args = []interface{}{num1 * 999999}
-	case 11:
+		sqlstate: "42P10", condition: "invalid_column_reference",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT name, created_at::date, count(size_b) FROM %s WHERE created_at > to_timestamp($1) GROUP BY 1,2,3 ORDER BY 4 DESC", table),
+				[]interface{}{v.num1 * 999999}
+		},
+	},
+	{
 		// ERROR:  more than one row returned by a subquery used as an expression
-		q = "SELECT relname, reltuples FROM pg_class WHERE relname = (SELECT relname FROM pg_stat_sys_indexes WHERE relname = 'pg_constraint')"
-	case 12:
+		sqlstate: "21000", condition: "cardinality_violation",
+		build: func(string, queryValues) (string, []interface{}) {
+			return "SELECT relname, reltuples FROM pg_class WHERE relname = (SELECT relname FROM pg_stat_sys_indexes WHERE relname = 'pg_constraint')", nil
+		},
+	},
+	{
 		// ERROR:  missing FROM-clause entry for table "???" at character ???
-		q = fmt.Sprintf("SELECT st.entity_id, s.name, s.size_b, s.created_at FROM %s s WHERE entity_id = $1", table)
-		args = []interface{}{num1}
-	case 13:
+		sqlstate: "42P01", condition: "undefined_table",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT st.entity_id, s.name, s.size_b, s.created_at FROM %s s WHERE entity_id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+	{
 		// ERROR:  NUMERIC scale 2 must be between 0 and precision 1 at character ???
-		q = fmt.Sprintf("SELECT entity_id, name, (size_b / 8192)::numeric(1,2) AS size_t, created_at FROM %s WHERE entity_id = $1", table)
-		args = []interface{}{num1}
-	case 14:
+		sqlstate: "22023", condition: "invalid_parameter_value",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT entity_id, name, (size_b / 8192)::numeric(1,2) AS size_t, created_at FROM %s WHERE entity_id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+	{
 		// ERROR:  COALESCE types date and bigint cannot be matched at character ???
-		q = fmt.Sprintf("SELECT entity_id, name, size_b, coalesce(created_at, 0) FROM %s WHERE entity_id = $1", table)
-		args = []interface{}{num1}
+		sqlstate: "42804", condition: "datatype_mismatch",
+		build: func(table string, v queryValues) (string, []interface{}) {
+			return fmt.Sprintf("SELECT entity_id, name, size_b, coalesce(created_at, 0) FROM %s WHERE entity_id = $1", table),
+				[]interface{}{v.num1}
+		},
+	},
+}
+
+// matches returns true if passed value equals to SQLSTATE code or condition name of the query's error.
+func (q errQuery) matches(v string) bool {
+	return strings.EqualFold(v, q.sqlstate) || strings.EqualFold(v, q.condition)
+}
+
+// selectErrQueries returns query templates which produce errors with passed SQLSTATE codes
+// or condition names. All templates are returned if nothing is passed.
+func selectErrQueries(sqlstates []string) []errQuery {
+	if len(sqlstates) == 0 {
+		return errQueries
 	}
 
-	return q, args
+	var selected []errQuery
+	for _, q := range errQueries {
+		for _, v := range sqlstates {
+			if q.matches(v) {
+				selected = append(selected, q)
+				break
+			}
+		}
+	}
+
+	return selected
+}
+
+// newErrQuery returns random invalid query with arguments built from one of passed templates.
+// SQLSTATE code of the error expected from the query is returned too.
+func newErrQuery(rnd *rand.Rand, table string, templates []errQuery) (string, []interface{}, string) {
+	v := queryValues{
+		num1: rnd.Intn(1000),
+		num2: rnd.Intn(10000),
+		str1: fmt.Sprintf("AUX-%d-%d-%d", rnd.Intn(1000), rnd.Intn(1000), rnd.Intn(1000)),
+		str2: fmt.Sprintf("AUX-%d-%d-%d", rnd.Intn(1000), rnd.Intn(1000), rnd.Intn(1000)),
+	}
+
+	t := templates[rnd.Intn(len(templates))]
+	q, args := t.build(table, v)
+
+	return q, args, t.sqlstate
 }
@@ -2,8 +2,12 @@ package rollbacks
 
 import (
 	"context"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/fixture"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -15,8 +19,15 @@ func TestConfig_validate(t *testing.T) {
 		config Config
 	}{
 		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: true, config: Config{Jobs: 2, Rate: 1, Databases: []string{"db1", "db2"}}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Databases: []string{"db1", "db2"}}},
 		{valid: false, config: Config{Jobs: 0, Rate: 1}},
 		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, CleanupTimeout: -1}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, PoolerMode: db.PoolerModeTransaction}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolerMode: "invalid"}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, SQLStates: []string{"42601", "undefined_column"}}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SQLStates: []string{"XX000"}}},
 	}
 
 	for _, tc := range testcases {
@@ -60,11 +71,44 @@ func TestWorkload_Run(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func TestWorkload_workerOptions(t *testing.T) {
+	conn, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defaultDatabase := currentDatabase(t, conn)
+	assert.NoError(t, conn.Close())
+
+	w, err := NewWorkload(Config{Conninfo: db.TestConninfo, Jobs: 3, Rate: 1, Databases: []string{"", "postgres"}}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	// Unmapped workers connect to the database from connection string.
+	for i, want := range []string{defaultDatabase, "postgres", defaultDatabase} {
+		conn, err := db.ConnectWithOptions(context.Background(), db.TestConninfo, w.(*workload).workerOptions(i))
+		assert.NoError(t, err)
+		assert.Equal(t, want, currentDatabase(t, conn), "worker %d", i)
+		assert.NoError(t, conn.Close())
+	}
+}
+
+// currentDatabase returns name of the database passed connection is connected to.
+func currentDatabase(t *testing.T, conn db.Conn) string {
+	rows, err := conn.Query(context.Background(), "SELECT current_database()")
+	assert.NoError(t, err)
+
+	var name string
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&name))
+	}
+	rows.Close()
+	assert.NoError(t, rows.Err())
+
+	return name
+}
+
 func Test_runWorker(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 	defer cancel()
 
-	assert.NoError(t, runWorker(ctx, log.NewDefaultLogger("error"), Config{Rate: 2, Conninfo: db.TestConninfo}))
+	assert.NoError(t, runWorker(ctx, log.NewDefaultLogger("error"), Config{Rate: 2, Conninfo: db.TestConninfo, CleanupTimeout: time.Second}, ratelimit.NewRate(2), ratelimit.NewConstantScheduler(), db.ConnOptions{}, random.New(0, 0), &stats{}))
 }
 
 func Test_startLoop(t *testing.T) {
@@ -74,26 +118,211 @@ func Test_startLoop(t *testing.T) {
 	conn, err := db.Connect(context.Background(), db.TestConninfo)
 	assert.NoError(t, err)
 
-	c, r, err := startLoop(ctx, conn, 2)
+	table, err := fixture.NewTempTables(conn).Create(context.Background(), tableColumns)
+	assert.NoError(t, err)
+
+	st := &stats{}
+	c, r, err := startLoop(ctx, log.NewDefaultLogger("error"), conn, table, Config{Rate: 2}, ratelimit.NewRate(2), ratelimit.NewConstantScheduler(), random.New(0, 0), st)
 	assert.NoError(t, err)
 	assert.Equal(t, 0, c) // expecting no commits
 	assert.Equal(t, 2, r) // expecting 2 rollbacks (rate 2, duration 1 second)
+	assert.Equal(t, int64(0), st.commits)
+	assert.Equal(t, int64(2), st.rollbacks)
+}
+
+// sqlstateErr implements error with SQLSTATE code, as returned by Postgres.
+type sqlstateErr struct{ code string }
+
+func (e sqlstateErr) Error() string    { return "ERROR: fake error (SQLSTATE " + e.code + ")" }
+func (e sqlstateErr) SQLState() string { return e.code }
+
+// errConn implements db.Conn which fails all queries with specified error.
+type errConn struct{ err error }
+
+func (c errConn) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (c errConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", c.err
+}
+func (c errConn) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, c.err }
+func (c errConn) Close() error                                                   { return nil }
+
+// cyclingConn implements db.Conn which fails queries with specified errors one by one.
+type cyclingConn struct {
+	errConn
+	errs []error
+	n    int
+}
+
+func (c *cyclingConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	err := c.errs[c.n%len(c.errs)]
+	c.n++
+	return 0, "", err
+}
+
+func Test_startLoop_breakdown(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+
+	conn := &cyclingConn{errs: []error{sqlstateErr{code: "42703"}, sqlstateErr{code: "22012"}, fmt.Errorf("connection reset")}}
+	st := &stats{}
+	_, r, err := startLoop(ctx, log.NewDefaultLogger("error"), conn, "test", Config{}, ratelimit.NewRate(50), ratelimit.NewConstantScheduler(), random.New(0, 0), st)
+	assert.NoError(t, err)
+	assert.Greater(t, r, 0)
+
+	b := st.breakdown()
+	assert.Contains(t, b, "42703")
+	assert.Contains(t, b, otherErrors)
+
+	var sum int64
+	for _, n := range b {
+		sum += n
+	}
+	assert.Equal(t, st.rollbacks, sum)
+	assert.Equal(t, int64(r), sum)
+}
+
+func Test_formatBreakdown(t *testing.T) {
+	assert.Equal(t, "none", formatBreakdown(nil))
+	assert.Equal(t, "22012: 1, 42703: 5, other: 2", formatBreakdown(map[string]int64{"42703": 5, "other": 2, "22012": 1}))
+}
+
+func Test_startLoop_strict(t *testing.T) {
+	testcases := []struct {
+		err        error
+		strict     bool
+		unexpected bool
+	}{
+		{err: sqlstateErr{code: "42703"}, strict: true, unexpected: false}, // expected error
+		{err: sqlstateErr{code: "42P01"}, strict: true, unexpected: true},  // mismatched error
+		{err: nil, strict: true, unexpected: true},                         // query succeeded
+		{err: sqlstateErr{code: "42P01"}, strict: false, unexpected: false},
+	}
+
+	for _, tc := range testcases {
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+
+		config := Config{Rate: 50, SQLStates: []string{"undefined_column"}, Strict: tc.strict}
+		st := &stats{}
+		c, r, err := startLoop(ctx, log.NewDefaultLogger("error"), errConn{err: tc.err}, "test", config, ratelimit.NewRate(config.Rate), ratelimit.NewConstantScheduler(), random.New(0, 0), st)
+		cancel()
+		assert.NoError(t, err)
+		assert.Greater(t, c+r, 0)
+
+		if tc.unexpected {
+			assert.Equal(t, int64(c+r), st.unexpected)
+		} else {
+			assert.Equal(t, int64(0), st.unexpected)
+		}
+	}
 }
 
-func Test_createTempTable(t *testing.T) {
+func TestWorkload_SetRate(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetRate(0))
+	assert.Equal(t, float64(1), wl.rate.Load())
+
+	assert.NoError(t, wl.SetRate(50))
+	assert.Equal(t, float64(50), wl.rate.Load())
+}
+
+func TestWorkload_SetJobs(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 2, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetJobs(0))
+	assert.Equal(t, 2, wl.workers.Size())
+
+	assert.NoError(t, wl.SetJobs(4))
+	assert.Equal(t, 4, wl.workers.Size())
+}
+
+func Test_startLoop_setRate(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Increase rate of running loop, queries after the change are executed faster.
+	r := ratelimit.NewRate(5)
+	time.AfterFunc(500*time.Millisecond, func() { r.Store(50) })
+
+	st := &stats{}
+	c, n, err := startLoop(ctx, log.NewDefaultLogger("error"), errConn{err: sqlstateErr{code: "42703"}}, "test", Config{}, r, ratelimit.NewConstantScheduler(), random.New(0, 0), st)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, c)
+	assert.GreaterOrEqual(t, n, 20)
+}
+
+func Test_workingTable(t *testing.T) {
+	// No queries are expected in transaction pooling mode.
+	tbl, err := workingTable(context.Background(), nil, db.PoolerModeTransaction)
+	assert.NoError(t, err)
+	assert.Equal(t, fixtureTable, tbl)
+}
+
+func Test_workingTable_temp(t *testing.T) {
 	conn, err := db.Connect(context.Background(), db.TestConninfo)
 	assert.NoError(t, err)
 
-	tbl, err := createTempTable(context.Background(), conn)
+	tables := fixture.NewTempTables(conn)
+	tbl, err := workingTable(context.Background(), tables, db.PoolerModeSession)
 	assert.NoError(t, err)
-	assert.Greater(t, len(tbl), 0)
+	assert.Equal(t, []string{tbl}, tables.Tables())
 
+	assert.NoError(t, tables.DropAll(context.Background()))
 	assert.NoError(t, conn.Close())
 }
 
 func Test_newErrQuery(t *testing.T) {
+	rnd := random.New(0, 0)
 	for i := 0; i < 1000; i++ {
-		q, _ := newErrQuery("test")
+		q, _, sqlstate := newErrQuery(rnd, "test", errQueries)
 		assert.Greater(t, len(q), 0)
+		assert.Greater(t, len(sqlstate), 0)
+	}
+}
+
+func Test_newErrQuery_seed(t *testing.T) {
+	sequence := func(seed int64) []string {
+		rnd := random.New(seed, 0)
+		queries := make([]string, 20)
+		for i := range queries {
+			// Arguments are not compared, some of them contain current time.
+			queries[i], _, _ = newErrQuery(rnd, "test", errQueries)
+		}
+		return queries
 	}
+
+	// The same seed produces the same queries.
+	assert.Equal(t, sequence(42), sequence(42))
+	assert.NotEqual(t, sequence(42), sequence(43))
+}
+
+func Test_selectErrQueries(t *testing.T) {
+	assert.Len(t, selectErrQueries(nil), len(errQueries))
+	assert.Len(t, selectErrQueries([]string{"invalid"}), 0)
+
+	templates := selectErrQueries([]string{"42601", "DATATYPE_MISMATCH"})
+	assert.Len(t, templates, 3)
+	for _, q := range templates {
+		assert.Contains(t, []string{"42601", "42804"}, q.sqlstate)
+	}
+
+	// Only queries of selected templates are generated.
+	rnd := random.New(0, 0)
+	templates = selectErrQueries([]string{"undefined_column"})
+	for i := 0; i < 100; i++ {
+		q, args, sqlstate := newErrQuery(rnd, "test", templates)
+		assert.Equal(t, "SELECT id, name, size_b, created_at FROM test WHERE id = $1", q)
+		assert.Len(t, args, 1)
+		assert.Equal(t, "42703", sqlstate)
+	}
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "rollbacks", w.Name())
 }
@@ -0,0 +1,185 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package scenario implements scheduler which runs workloads accordingly to timeline.
+//
+// Timeline consists of steps, each step defines workload, offset since the start of
+// the scenario when the workload should be started, and duration of the workload run.
+// Steps are independent, so workloads could overlap, e.g. "run idlexacts for 30s,
+// after 20s add terminate for 10s". When step's duration is over, the workload is
+// stopped by cancelling its context.
+package scenario
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"io"
+	"sync"
+	"time"
+)
+
+// Entry defines a single record of the timeline, workload is referenced by its name.
+type Entry struct {
+	// Start defines offset since the start of the scenario when workload should be started.
+	Start time.Duration
+	// Duration defines how long workload should run.
+	Duration time.Duration
+	// Workload defines name of the workload.
+	Workload string
+}
+
+// entryJSON defines timeline record in JSON format, durations are in Go duration format, e.g. "30s".
+type entryJSON struct {
+	Start    string `json:"start"`
+	Duration string `json:"duration"`
+	Workload string `json:"workload"`
+}
+
+// ParseTimeline parses timeline in JSON format, which is a list of objects with
+// "start", "duration" and "workload" keys.
+func ParseTimeline(r io.Reader) ([]Entry, error) {
+	var records []entryJSON
+	err := json.NewDecoder(r).Decode(&records)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]Entry, 0, len(records))
+	for i, rec := range records {
+		var start time.Duration
+		if rec.Start != "" {
+			start, err = time.ParseDuration(rec.Start)
+			if err != nil {
+				return nil, fmt.Errorf("step %d: invalid start: %s", i, err)
+			}
+		}
+
+		duration, err := time.ParseDuration(rec.Duration)
+		if err != nil {
+			return nil, fmt.Errorf("step %d: invalid duration: %s", i, err)
+		}
+
+		if rec.Workload == "" {
+			return nil, fmt.Errorf("step %d: workload is not specified", i)
+		}
+
+		entries = append(entries, Entry{Start: start, Duration: duration, Workload: rec.Workload})
+	}
+
+	return entries, nil
+}
+
+// Step defines a single step of the timeline with workload ready to run.
+type Step struct {
+	// Start defines offset since the start of the scenario when workload should be started.
+	Start time.Duration
+	// Duration defines how long workload should run.
+	Duration time.Duration
+	// Workload defines workload to run.
+	Workload noisia.Workload
+}
+
+// Scheduler runs workloads accordingly to timeline.
+type Scheduler struct {
+	steps  []Step
+	logger log.Logger
+}
+
+// NewScheduler creates new scheduler for passed steps.
+func NewScheduler(steps []Step, logger log.Logger) (*Scheduler, error) {
+	if len(steps) == 0 {
+		return nil, fmt.Errorf("no steps specified")
+	}
+
+	for i, s := range steps {
+		if s.Start < 0 {
+			return nil, fmt.Errorf("step %d: start must not be negative", i)
+		}
+
+		if s.Duration <= 0 {
+			return nil, fmt.Errorf("step %d: duration must be positive", i)
+		}
+
+		if s.Workload == nil {
+			return nil, fmt.Errorf("step %d: workload is not specified", i)
+		}
+	}
+
+	return &Scheduler{steps: steps, logger: logger}, nil
+}
+
+// Duration returns total duration of the scenario.
+func (s *Scheduler) Duration() time.Duration {
+	var total time.Duration
+	for _, step := range s.steps {
+		if end := step.Start + step.Duration; end > total {
+			total = end
+		}
+	}
+
+	return total
+}
+
+// Run starts and stops workloads accordingly to timeline. It returns when all workloads
+// are finished or context is done. If some workloads failed, *noisia.RunError is returned.
+func (s *Scheduler) Run(ctx context.Context) error {
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs = map[string]error{}
+	)
+
+	wg.Add(len(s.steps))
+	for _, step := range s.steps {
+		go func(step Step) {
+			defer wg.Done()
+			err := s.runStep(ctx, step)
+			if err != nil {
+				mu.Lock()
+				errs[step.Workload.Name()] = err
+				mu.Unlock()
+			}
+		}(step)
+	}
+
+	wg.Wait()
+
+	if len(errs) > 0 {
+		return &noisia.RunError{Errs: errs}
+	}
+
+	return nil
+}
+
+// runStep waits until step's start and runs workload during step's duration. Returns error
+// returned by the workload.
+func (s *Scheduler) runStep(ctx context.Context, step Step) error {
+	timer := time.NewTimer(step.Start)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+		return nil
+	}
+
+	name := step.Workload.Name()
+	s.logger.Infof("scenario: start %s workload for %s", name, step.Duration)
+	events.Emit(ctx, "scenario", "started %s workload for %s", name, step.Duration)
+
+	stepCtx, cancel := context.WithTimeout(ctx, step.Duration)
+	defer cancel()
+
+	err := step.Workload.Run(stepCtx)
+	if err != nil {
+		s.logger.Errorf("scenario: %s workload failed: %s", name, err)
+	}
+
+	events.Emit(ctx, "scenario", "stopped %s workload", name)
+	return err
+}
@@ -0,0 +1,144 @@
+package scenario
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseTimeline(t *testing.T) {
+	in := `[
+		{"start": "0s", "duration": "30s", "workload": "idlexacts"},
+		{"start": "20s", "duration": "10s", "workload": "terminate"},
+		{"duration": "1m", "workload": "rollbacks"}
+	]`
+
+	got, err := ParseTimeline(strings.NewReader(in))
+	assert.NoError(t, err)
+	assert.Equal(t, []Entry{
+		{Start: 0, Duration: 30 * time.Second, Workload: "idlexacts"},
+		{Start: 20 * time.Second, Duration: 10 * time.Second, Workload: "terminate"},
+		{Start: 0, Duration: time.Minute, Workload: "rollbacks"},
+	}, got)
+
+	for _, in := range []string{
+		`[{"start": "invalid", "duration": "30s", "workload": "idlexacts"}]`,
+		`[{"start": "0s", "duration": "", "workload": "idlexacts"}]`,
+		`[{"start": "0s", "duration": "30s"}]`,
+		`{"invalid": "json"}`,
+	} {
+		_, err = ParseTimeline(strings.NewReader(in))
+		assert.Error(t, err)
+	}
+}
+
+func TestNewScheduler(t *testing.T) {
+	w := &fakeWorkload{name: "example"}
+
+	testcases := []struct {
+		valid bool
+		steps []Step
+	}{
+		{valid: true, steps: []Step{{Start: 0, Duration: time.Second, Workload: w}}},
+		{valid: false, steps: []Step{}},
+		{valid: false, steps: []Step{{Start: -1, Duration: time.Second, Workload: w}}},
+		{valid: false, steps: []Step{{Start: 0, Duration: 0, Workload: w}}},
+		{valid: false, steps: []Step{{Start: 0, Duration: time.Second}}},
+	}
+
+	for _, tc := range testcases {
+		_, err := NewScheduler(tc.steps, log.NewDefaultLogger("error"))
+		if tc.valid {
+			assert.NoError(t, err)
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestScheduler_Run(t *testing.T) {
+	w1 := &fakeWorkload{name: "first"}
+	w2 := &fakeWorkload{name: "second"}
+
+	s, err := NewScheduler([]Step{
+		{Start: 0, Duration: 200 * time.Millisecond, Workload: w1},
+		{Start: 100 * time.Millisecond, Duration: 200 * time.Millisecond, Workload: w2},
+	}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, 300*time.Millisecond, s.Duration())
+
+	start := time.Now()
+	assert.NoError(t, s.Run(context.Background()))
+
+	assertNear := func(want time.Duration, got time.Time) {
+		d := got.Sub(start)
+		assert.True(t, d >= want && d < want+50*time.Millisecond, "want %s, got %s", want, d)
+	}
+
+	assertNear(0, w1.started)
+	assertNear(200*time.Millisecond, w1.stopped)
+	assertNear(100*time.Millisecond, w2.started)
+	assertNear(300*time.Millisecond, w2.stopped)
+}
+
+func TestScheduler_Run_cancel(t *testing.T) {
+	w := &fakeWorkload{name: "example"}
+	s, err := NewScheduler([]Step{{Start: time.Hour, Duration: time.Second, Workload: w}}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	assert.NoError(t, s.Run(ctx))
+	assert.True(t, w.started.IsZero())
+}
+
+func TestScheduler_Run_failed(t *testing.T) {
+	w1 := &fakeWorkload{name: "first", err: errors.New("connection refused")}
+	w2 := &fakeWorkload{name: "second"}
+
+	s, err := NewScheduler([]Step{
+		{Start: 0, Duration: 50 * time.Millisecond, Workload: w1},
+		{Start: 0, Duration: 50 * time.Millisecond, Workload: w2},
+	}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	// Only failed workloads are reported.
+	err = s.Run(context.Background())
+	var rerr *noisia.RunError
+	assert.True(t, errors.As(err, &rerr))
+	assert.Len(t, rerr.Errs, 1)
+	assert.EqualError(t, rerr.Errs["first"], "connection refused")
+}
+
+// fakeWorkload implements noisia.Workload interface and records when it has been started and stopped.
+// Configured error is returned when the workload is stopped.
+type fakeWorkload struct {
+	name    string
+	err     error
+	mu      sync.Mutex
+	started time.Time
+	stopped time.Time
+}
+
+func (w *fakeWorkload) Run(ctx context.Context) error {
+	w.mu.Lock()
+	w.started = time.Now()
+	w.mu.Unlock()
+
+	<-ctx.Done()
+
+	w.mu.Lock()
+	w.stopped = time.Now()
+	w.mu.Unlock()
+	return w.err
+}
+
+func (w *fakeWorkload) Name() string        { return w.name }
+func (w *fakeWorkload) Stats() noisia.Stats { return noisia.Stats{} }
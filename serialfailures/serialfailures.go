@@ -0,0 +1,327 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package serialfailures defines implementation of workload which runs concurrent
+// serializable transactions with overlapping read/write sets. Such transactions
+// fail with 'could not serialize access' errors (SQLSTATE 40001), and the workload
+// could be used for testing retry logic of applications and monitoring of
+// serialization failures.
+//
+// Before starting the workload, a special working table should be created and
+// filled with two rows. When the workload is finished this table should be
+// dropped. For more info see prepare and cleanup methods.
+// When working table is created, the necessary number of workers is started
+// (accordingly to Config.Jobs). Each worker makes two dedicated connections and runs
+// pairs of transactions in a loop accordingly to rate specified in Config.Rate. Both transactions of a pair read
+// the whole table and then update different rows (write skew), so one of them
+// fails with serialization failure. Serialization failures are recognized by
+// SQLSTATE code and counted, other errors are logged.
+package serialfailures
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures.
+	defaultCleanupTimeout = 10 * time.Second
+	// serializationFailure defines SQLSTATE code of serialization failure.
+	serializationFailure = "40001"
+)
+
+// Config defines configuration settings for serialization failures workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for running transactions.
+	Jobs uint16
+	// Rate defines pairs of transactions executed per second (per single worker).
+	Rate float64
+	// CleanupTimeout defines max time allowed for cleanup fixtures, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// commits defines number of committed transactions.
+	commits int64
+	// failures defines number of transactions failed due to serialization failure.
+	failures int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "serialfailures"
+}
+
+// Stats returns counters of committed transactions and serialization failures.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"commits":                atomic.LoadInt64(&w.stats.commits),
+		"serialization_failures": atomic.LoadInt64(&w.stats.failures),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	// Prepare working table for workload.
+	err = w.prepare(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cleanup in the end.
+	defer func() {
+		err = w.cleanup()
+		if err != nil {
+			w.logger.Warnf("serialfailures cleanup failed: %s", err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func() {
+			err := runWorker(ctx, w.logger, w.config, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}, &w.stats)
+			if err != nil && ctx.Err() == nil {
+				w.logger.Warnf("serialfailures worker failed: %s", err)
+			}
+			wg.Done()
+		}()
+	}
+
+	wg.Wait()
+
+	w.logger.Infof("serialfailures finished: %d transactions committed, %d serialization failures", atomic.LoadInt64(&w.stats.commits), atomic.LoadInt64(&w.stats.failures))
+
+	return nil
+}
+
+// prepare method creates working table with two rows.
+func (w *workload) prepare(ctx context.Context) error {
+	tx, err := w.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, _, err = tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS _noisia_serialfailures_workload (id int PRIMARY KEY, value bigint)")
+	if err != nil {
+		return err
+	}
+
+	_, _, err = tx.Exec(ctx, "INSERT INTO _noisia_serialfailures_workload (id, value) VALUES (1, 0), (2, 0) ON CONFLICT (id) DO NOTHING")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// cleanup method drops working table after workload has been done.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_serialfailures_workload")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// runWorker makes two connections used by pairs of transactions and starts the loop. Dedicated
+// connections are used, because pool could be exhausted by workers holding first transactions.
+func runWorker(ctx context.Context, log log.Logger, config Config, opts db.ConnOptions, st *stats) error {
+	conn1, err := db.ConnectWithOptions(ctx, config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn1.Close() }()
+
+	conn2, err := db.ConnectWithOptions(ctx, config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = conn2.Close() }()
+
+	startLoop(ctx, log, conn1, conn2, config.Rate, st)
+	return nil
+}
+
+// startLoop runs pairs of conflicting transactions in a loop with required rate until context
+// is done. Results of transactions are added to passed stats.
+func startLoop(ctx context.Context, log log.Logger, conn1, conn2 db.Conn, rate float64, st *stats) {
+	ratelimit.Run(ctx, rate, nil, func(ctx context.Context) error {
+		return runPair(ctx, conn1, conn2, st)
+	}, log)
+}
+
+// runPair runs two serializable transactions which read both rows of working table and
+// update different rows. The transaction which commits last fails with serialization failure.
+// Serialization failures are counted, other errors are returned.
+func runPair(ctx context.Context, conn1, conn2 db.Conn, st *stats) error {
+	tx1, err := beginSerializable(ctx, conn1)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx1.Rollback(ctx) }()
+
+	tx2, err := beginSerializable(ctx, conn2)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx2.Rollback(ctx) }()
+
+	// Both transactions read the whole table before any of them writes.
+	sum1, err := readSum(ctx, tx1)
+	if err != nil {
+		return classify(ctx, err, st)
+	}
+
+	sum2, err := readSum(ctx, tx2)
+	if err != nil {
+		return classify(ctx, err, st)
+	}
+
+	err = classify(ctx, writeSum(ctx, tx1, 1, sum1), st)
+	if err != nil {
+		return err
+	}
+
+	return classify(ctx, writeSum(ctx, tx2, 2, sum2), st)
+}
+
+// beginSerializable starts a transaction with serializable isolation level.
+func beginSerializable(ctx context.Context, conn db.Conn) (db.Tx, error) {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.SetIsolationLevel(ctx, tx, db.IsolationSerializable)
+	if err != nil {
+		_ = tx.Rollback(ctx)
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// readSum returns sum of values of all rows of working table.
+func readSum(ctx context.Context, tx db.Tx) (int64, error) {
+	rows, err := tx.Query(ctx, "SELECT coalesce(sum(value), 0) FROM _noisia_serialfailures_workload")
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var sum int64
+	for rows.Next() {
+		err = rows.Scan(&sum)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	return sum, rows.Err()
+}
+
+// writeSum updates row with passed id using passed sum and commits the transaction.
+func writeSum(ctx context.Context, tx db.Tx, id int, sum int64) error {
+	_, _, err := tx.Exec(ctx, "UPDATE _noisia_serialfailures_workload SET value = $1 WHERE id = $2", sum+1, id)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// classify counts result of transaction in passed stats. Serialization failures are counted
+// and not returned, nil error is counted as commit.
+func classify(ctx context.Context, err error, st *stats) error {
+	if err == nil {
+		atomic.AddInt64(&st.commits, 1)
+		return nil
+	}
+
+	if db.ErrorCode(err) == serializationFailure {
+		atomic.AddInt64(&st.failures, 1)
+		events.Emit(ctx, "serialfailures", "serialization failure: %s", err)
+		return nil
+	}
+
+	return err
+}
@@ -0,0 +1,148 @@
+package serialfailures
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 10}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+
+	// Each pair of transactions produces a serialization failure.
+	assert.Greater(t, w.Stats()["serialization_failures"], int64(0))
+	assert.Greater(t, w.Stats()["commits"], int64(0))
+}
+
+func Test_runPair(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	w := &workload{config: Config{Jobs: 1, Rate: 1, CleanupTimeout: time.Second}, logger: log.NewDefaultLogger("error"), pool: pool}
+	assert.NoError(t, w.prepare(context.Background()))
+	defer func() { assert.NoError(t, w.cleanup()) }()
+
+	conn1, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { _ = conn1.Close() }()
+
+	conn2, err := db.Connect(context.Background(), db.TestConninfo)
+	assert.NoError(t, err)
+	defer func() { _ = conn2.Close() }()
+
+	st := &stats{}
+	assert.NoError(t, runPair(context.Background(), conn1, conn2, st))
+	assert.Equal(t, stats{commits: 1, failures: 1}, *st)
+}
+
+// sqlstateErr implements error with SQLSTATE code, as returned by Postgres.
+type sqlstateErr struct{ code string }
+
+func (e sqlstateErr) Error() string    { return "ERROR: fake error (SQLSTATE " + e.code + ")" }
+func (e sqlstateErr) SQLState() string { return e.code }
+
+// fakeRows implements db.Rows which returns single zero value.
+type fakeRows struct{ done bool }
+
+func (r *fakeRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+func (r *fakeRows) Scan(dest ...interface{}) error { *(dest[0].(*int64)) = 0; return nil }
+func (r *fakeRows) Err() error                     { return nil }
+func (r *fakeRows) Close()                         {}
+
+// fakeTx implements db.Tx which fails commit with specified error.
+type fakeTx struct{ commitErr error }
+
+func (tx fakeTx) Commit(context.Context) error   { return tx.commitErr }
+func (tx fakeTx) Rollback(context.Context) error { return nil }
+func (tx fakeTx) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (tx fakeTx) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return &fakeRows{}, nil
+}
+
+// fakeConn implements db.Conn which begins fake transactions.
+type fakeConn struct{ tx fakeTx }
+
+func (c fakeConn) Begin(context.Context) (db.Tx, error) { return c.tx, nil }
+func (c fakeConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (c fakeConn) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+func (c fakeConn) Close() error                                                   { return nil }
+
+func Test_runPair_fakeConn(t *testing.T) {
+	testcases := []struct {
+		commitErr error
+		wantErr   bool
+		want      stats
+	}{
+		{commitErr: sqlstateErr{code: serializationFailure}, want: stats{commits: 1, failures: 1}},
+		{commitErr: nil, want: stats{commits: 2}},
+		{commitErr: sqlstateErr{code: "57014"}, wantErr: true, want: stats{commits: 1}},
+	}
+
+	for _, tc := range testcases {
+		st := &stats{}
+		err := runPair(context.Background(), fakeConn{}, fakeConn{tx: fakeTx{commitErr: tc.commitErr}}, st)
+		if tc.wantErr {
+			assert.Error(t, err)
+		} else {
+			assert.NoError(t, err)
+		}
+		assert.Equal(t, tc.want, *st)
+	}
+}
+
+func Test_classify(t *testing.T) {
+	st := &stats{}
+	assert.NoError(t, classify(context.Background(), nil, st))
+	assert.NoError(t, classify(context.Background(), sqlstateErr{code: serializationFailure}, st))
+	assert.Error(t, classify(context.Background(), errors.New("example"), st))
+	assert.Equal(t, stats{commits: 1, failures: 1}, *st)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "serialfailures", w.Name())
+}
@@ -0,0 +1,133 @@
+package sink
+
+import (
+	"fmt"
+	"github.com/lesovsky/noisia/events"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// series defines labels of single metric series.
+type series struct {
+	workload string
+	name     string
+}
+
+// latencySummary defines accumulated latencies of single series.
+type latencySummary struct {
+	count int64
+	sum   time.Duration
+}
+
+// PrometheusSink implements Sink interface which keeps the last values of counters, number of
+// events and sums of latencies, and exposes them in Prometheus text format. PrometheusSink
+// implements http.Handler, so it could be scraped by Prometheus.
+type PrometheusSink struct {
+	mu        sync.Mutex
+	counters  map[series]int64
+	events    map[string]int64
+	latencies map[series]latencySummary
+}
+
+// NewPrometheusSink creates sink which exposes results in Prometheus text format.
+func NewPrometheusSink() *PrometheusSink {
+	return &PrometheusSink{
+		counters:  map[series]int64{},
+		events:    map[string]int64{},
+		latencies: map[series]latencySummary{},
+	}
+}
+
+// RecordCounter remembers the last value of counter.
+func (s *PrometheusSink) RecordCounter(_ time.Time, workload string, name string, value int64) error {
+	s.mu.Lock()
+	s.counters[series{workload: workload, name: name}] = value
+	s.mu.Unlock()
+	return nil
+}
+
+// RecordEvent counts event of the workload.
+func (s *PrometheusSink) RecordEvent(e events.Event) error {
+	s.mu.Lock()
+	s.events[e.Workload]++
+	s.mu.Unlock()
+	return nil
+}
+
+// RecordLatency adds latency to the sum and count of the series.
+func (s *PrometheusSink) RecordLatency(_ time.Time, workload string, name string, d time.Duration) error {
+	s.mu.Lock()
+	k := series{workload: workload, name: name}
+	l := s.latencies[k]
+	l.count++
+	l.sum += d
+	s.latencies[k] = l
+	s.mu.Unlock()
+	return nil
+}
+
+// WriteTo writes recorded results in Prometheus text format, series are sorted for stable output.
+func (s *PrometheusSink) WriteTo(w io.Writer) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b := &strings.Builder{}
+
+	b.WriteString("# HELP noisia_workload_stat Current value of workload's statistics counter.\n")
+	b.WriteString("# TYPE noisia_workload_stat gauge\n")
+	counters := make([]series, 0, len(s.counters))
+	for k := range s.counters {
+		counters = append(counters, k)
+	}
+	sortSeries(counters)
+	for _, k := range counters {
+		fmt.Fprintf(b, "noisia_workload_stat{workload=%q,metric=%q} %d\n", k.workload, k.name, s.counters[k])
+	}
+
+	b.WriteString("# HELP noisia_workload_events_total Number of events about actions performed by workload.\n")
+	b.WriteString("# TYPE noisia_workload_events_total counter\n")
+	workloads := make([]string, 0, len(s.events))
+	for name := range s.events {
+		workloads = append(workloads, name)
+	}
+	sort.Strings(workloads)
+	for _, name := range workloads {
+		fmt.Fprintf(b, "noisia_workload_events_total{workload=%q} %d\n", name, s.events[name])
+	}
+
+	b.WriteString("# HELP noisia_workload_latency_seconds Latency of workload's operations.\n")
+	b.WriteString("# TYPE noisia_workload_latency_seconds summary\n")
+	latencies := make([]series, 0, len(s.latencies))
+	for k := range s.latencies {
+		latencies = append(latencies, k)
+	}
+	sortSeries(latencies)
+	for _, k := range latencies {
+		l := s.latencies[k]
+		fmt.Fprintf(b, "noisia_workload_latency_seconds_sum{workload=%q,operation=%q} %g\n", k.workload, k.name, l.sum.Seconds())
+		fmt.Fprintf(b, "noisia_workload_latency_seconds_count{workload=%q,operation=%q} %d\n", k.workload, k.name, l.count)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+// ServeHTTP writes recorded results in Prometheus text format.
+func (s *PrometheusSink) ServeHTTP(w http.ResponseWriter, _ *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = s.WriteTo(w)
+}
+
+// sortSeries sorts passed series by workload and name.
+func sortSeries(keys []series) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].workload != keys[j].workload {
+			return keys[i].workload < keys[j].workload
+		}
+		return keys[i].name < keys[j].name
+	})
+}
@@ -0,0 +1,47 @@
+package sink
+
+import (
+	"bytes"
+	"github.com/lesovsky/noisia/events"
+	"github.com/stretchr/testify/assert"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestPrometheusSink(t *testing.T) {
+	s := NewPrometheusSink()
+
+	now := time.Now()
+	assert.NoError(t, s.RecordCounter(now, "terminate", "signalled", 2))
+	assert.NoError(t, s.RecordCounter(now, "rollbacks", "rollbacks", 5))
+	assert.NoError(t, s.RecordCounter(now, "rollbacks", "rollbacks", 10))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated backend"}))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated backend"}))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", 250*time.Millisecond))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", 750*time.Millisecond))
+
+	want := `# HELP noisia_workload_stat Current value of workload's statistics counter.
+# TYPE noisia_workload_stat gauge
+noisia_workload_stat{workload="rollbacks",metric="rollbacks"} 10
+noisia_workload_stat{workload="terminate",metric="signalled"} 2
+# HELP noisia_workload_events_total Number of events about actions performed by workload.
+# TYPE noisia_workload_events_total counter
+noisia_workload_events_total{workload="terminate"} 2
+# HELP noisia_workload_latency_seconds Latency of workload's operations.
+# TYPE noisia_workload_latency_seconds summary
+noisia_workload_latency_seconds_sum{workload="forkconns",operation="connect"} 1
+noisia_workload_latency_seconds_count{workload="forkconns",operation="connect"} 2
+`
+
+	buf := &bytes.Buffer{}
+	n, err := s.WriteTo(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(len(want)), n)
+	assert.Equal(t, want, buf.String())
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	assert.Equal(t, 200, rec.Code)
+	assert.Equal(t, want, rec.Body.String())
+}
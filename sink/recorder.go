@@ -0,0 +1,54 @@
+package sink
+
+import (
+	"github.com/lesovsky/noisia/events"
+	"sync"
+	"time"
+)
+
+// Recorder implements Sink interface which keeps all results in memory. It is intended for tests
+// of workloads and tools which check what results have been produced.
+type Recorder struct {
+	mu      sync.Mutex
+	records []Record
+}
+
+// RecordCounter keeps counter.
+func (r *Recorder) RecordCounter(t time.Time, workload string, name string, value int64) error {
+	r.add(Record{Time: t, Kind: KindCounter, Workload: workload, Name: name, Value: value})
+	return nil
+}
+
+// RecordEvent keeps event.
+func (r *Recorder) RecordEvent(e events.Event) error {
+	r.add(Record{Time: e.Time, Kind: KindEvent, Workload: e.Workload, Action: e.Action, RunID: e.RunID})
+	return nil
+}
+
+// RecordLatency keeps latency in microseconds.
+func (r *Recorder) RecordLatency(t time.Time, workload string, name string, d time.Duration) error {
+	r.add(Record{Time: t, Kind: KindLatency, Workload: workload, Name: name, Value: d.Microseconds()})
+	return nil
+}
+
+// Records returns kept results of passed kind, all results are returned if kind is empty.
+func (r *Recorder) Records(kind string) []Record {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var records []Record
+	for _, rec := range r.records {
+		if kind == "" || rec.Kind == kind {
+			records = append(records, rec)
+		}
+	}
+
+	return records
+}
+
+// add keeps passed record.
+func (r *Recorder) add(rec Record) {
+	r.mu.Lock()
+	r.records = append(r.records, rec)
+	r.mu.Unlock()
+}
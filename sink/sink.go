@@ -0,0 +1,297 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package sink defines destinations of results produced by workloads: counters of workloads
+// statistics, events about performed actions and latencies of operations.
+//
+// Sinks are combined using Multi into a composite sink, which is configured globally using
+// Set. Workloads call Latency for recording latencies, events emitted using events.Emit are
+// routed into the composite sink using EventsWriter, and counters are recorded by exporter
+// which samples statistics of workloads. When no sink is configured, results are discarded.
+package sink
+
+import (
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"io"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sink defines destination where results of workloads are written to.
+type Sink interface {
+	// RecordCounter records current value of workload's counter, taken at passed time.
+	RecordCounter(t time.Time, workload string, name string, value int64) error
+	// RecordEvent records event about action performed by workload.
+	RecordEvent(e events.Event) error
+	// RecordLatency records duration of single workload's operation, finished at passed time.
+	RecordLatency(t time.Time, workload string, name string, d time.Duration) error
+}
+
+var (
+	mu     sync.RWMutex
+	global Sink
+)
+
+// Set configures global sink used by workloads. Nil sink disables recording.
+func Set(s Sink) {
+	mu.Lock()
+	global = s
+	mu.Unlock()
+}
+
+// Latency records duration of workload's operation into global sink. Workload is tagged by cluster
+// of passed context.
+func Latency(ctx context.Context, workload string, name string, d time.Duration) {
+	mu.RLock()
+	s := global
+	mu.RUnlock()
+
+	if s == nil {
+		return
+	}
+
+	// Results are auxiliary, ignore errors to don't affect workload.
+	_ = s.RecordLatency(time.Now(), events.WorkloadLabel(ctx, workload), name, d)
+}
+
+/* Composite sink */
+
+// multiSink implements Sink interface which writes results into several sinks.
+type multiSink []Sink
+
+// Multi creates composite sink which writes results into all passed sinks, nil sinks are skipped.
+// Nil is returned if no sinks are passed.
+func Multi(sinks ...Sink) Sink {
+	var m multiSink
+	for _, s := range sinks {
+		if s != nil {
+			m = append(m, s)
+		}
+	}
+
+	if len(m) == 0 {
+		return nil
+	}
+
+	return m
+}
+
+// RecordCounter records counter into all sinks, the first error is returned.
+func (m multiSink) RecordCounter(t time.Time, workload string, name string, value int64) error {
+	var err error
+	for _, s := range m {
+		if e := s.RecordCounter(t, workload, name, value); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RecordEvent records event into all sinks, the first error is returned.
+func (m multiSink) RecordEvent(ev events.Event) error {
+	var err error
+	for _, s := range m {
+		if e := s.RecordEvent(ev); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// RecordLatency records latency into all sinks, the first error is returned.
+func (m multiSink) RecordLatency(t time.Time, workload string, name string, d time.Duration) error {
+	var err error
+	for _, s := range m {
+		if e := s.RecordLatency(t, workload, name, d); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+/* Events */
+
+// eventsWriter implements events.Sink interface which records events into sink.
+type eventsWriter struct {
+	s Sink
+}
+
+// EventsWriter returns events sink which records events emitted by workloads into passed sink.
+func EventsWriter(s Sink) events.Sink {
+	return eventsWriter{s: s}
+}
+
+// Write records event into sink.
+func (w eventsWriter) Write(e events.Event) error {
+	return w.s.RecordEvent(e)
+}
+
+// eventsSink implements Sink interface which writes only events into events sink.
+type eventsSink struct {
+	w events.Sink
+}
+
+// NewEventsSink creates sink which writes events into passed events sink (e.g. events.NewJSONSink),
+// counters and latencies are ignored.
+func NewEventsSink(w events.Sink) Sink {
+	return eventsSink{w: w}
+}
+
+// RecordCounter ignores counter.
+func (eventsSink) RecordCounter(time.Time, string, string, int64) error { return nil }
+
+// RecordEvent writes event into events sink.
+func (s eventsSink) RecordEvent(e events.Event) error { return s.w.Write(e) }
+
+// RecordLatency ignores latency.
+func (eventsSink) RecordLatency(time.Time, string, string, time.Duration) error { return nil }
+
+/* Log sink */
+
+// logSink implements Sink interface which writes results into log.
+type logSink struct {
+	logger log.Logger
+}
+
+// NewLogSink creates sink which writes counters and latencies into passed logger, events are
+// written with debug level.
+func NewLogSink(logger log.Logger) Sink {
+	return logSink{logger: logger}
+}
+
+// RecordCounter writes counter into log.
+func (s logSink) RecordCounter(_ time.Time, workload string, name string, value int64) error {
+	s.logger.Infof("%s: %s = %d", workload, name, value)
+	return nil
+}
+
+// RecordEvent writes event into log.
+func (s logSink) RecordEvent(e events.Event) error {
+	s.logger.Debugf("%s: %s", e.Workload, e.Action)
+	return nil
+}
+
+// RecordLatency writes latency into log.
+func (s logSink) RecordLatency(_ time.Time, workload string, name string, d time.Duration) error {
+	s.logger.Infof("%s: %s latency %s", workload, name, d)
+	return nil
+}
+
+/* JSON lines sink */
+
+// Record kinds written by JSON sink.
+const (
+	KindCounter = "counter"
+	KindEvent   = "event"
+	KindLatency = "latency"
+)
+
+// Record defines single result written by JSON sink.
+type Record struct {
+	// Time defines when result has been recorded.
+	Time time.Time `json:"time"`
+	// Kind defines kind of the result: counter, event or latency.
+	Kind string `json:"kind"`
+	// Workload defines name of the workload which produced result.
+	Workload string `json:"workload"`
+	// Name defines name of counter or latency.
+	Name string `json:"name,omitempty"`
+	// Value defines value of counter or latency in microseconds.
+	Value int64 `json:"value"`
+	// Action defines description of action performed by workload.
+	Action string `json:"action,omitempty"`
+	// RunID defines identifier of the run which produced event.
+	RunID string `json:"run_id,omitempty"`
+}
+
+// jsonSink implements Sink interface which writes results as JSON lines.
+type jsonSink struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewJSONSink creates sink which writes all results as JSON lines into passed writer.
+func NewJSONSink(w io.Writer) Sink {
+	return &jsonSink{enc: json.NewEncoder(w)}
+}
+
+// RecordCounter writes counter as JSON line.
+func (s *jsonSink) RecordCounter(t time.Time, workload string, name string, value int64) error {
+	return s.write(Record{Time: t, Kind: KindCounter, Workload: workload, Name: name, Value: value})
+}
+
+// RecordEvent writes event as JSON line.
+func (s *jsonSink) RecordEvent(e events.Event) error {
+	return s.write(Record{Time: e.Time, Kind: KindEvent, Workload: e.Workload, Action: e.Action, RunID: e.RunID})
+}
+
+// RecordLatency writes latency in microseconds as JSON line.
+func (s *jsonSink) RecordLatency(t time.Time, workload string, name string, d time.Duration) error {
+	return s.write(Record{Time: t, Kind: KindLatency, Workload: workload, Name: name, Value: d.Microseconds()})
+}
+
+// write encodes record as JSON line and writes it.
+func (s *jsonSink) write(r Record) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.enc.Encode(r)
+}
+
+/* CSV sink */
+
+// CSVHeader defines columns of results written in CSV format.
+var CSVHeader = []string{"timestamp", "workload", "metric", "value"}
+
+// csvSink implements Sink interface which writes counters and latencies in CSV format.
+type csvSink struct {
+	mu sync.Mutex
+	w  *csv.Writer
+}
+
+// NewCSVSink creates sink which writes counters and latencies in CSV format into passed writer,
+// the header is written immediately. Latencies are written in microseconds with '_us' suffix
+// of metric name. Events don't fit into columns and are ignored.
+func NewCSVSink(w io.Writer) (Sink, error) {
+	s := &csvSink{w: csv.NewWriter(w)}
+
+	err := s.write(CSVHeader)
+	if err != nil {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// RecordCounter writes counter as CSV row.
+func (s *csvSink) RecordCounter(t time.Time, workload string, name string, value int64) error {
+	return s.write([]string{t.UTC().Format(time.RFC3339), workload, name, strconv.FormatInt(value, 10)})
+}
+
+// RecordEvent ignores event.
+func (s *csvSink) RecordEvent(events.Event) error { return nil }
+
+// RecordLatency writes latency in microseconds as CSV row.
+func (s *csvSink) RecordLatency(t time.Time, workload string, name string, d time.Duration) error {
+	return s.write([]string{t.UTC().Format(time.RFC3339), workload, name + "_us", strconv.FormatInt(d.Microseconds(), 10)})
+}
+
+// write writes single record and flushes it.
+func (s *csvSink) write(record []string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	err := s.w.Write(record)
+	if err != nil {
+		return err
+	}
+
+	s.w.Flush()
+	return s.w.Error()
+}
@@ -0,0 +1,172 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLatency(t *testing.T) {
+	r := &Recorder{}
+	Set(r)
+	defer Set(nil)
+
+	Latency(context.Background(), "forkconns", "connect", 1500*time.Microsecond)
+
+	records := r.Records(KindLatency)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "forkconns", records[0].Workload)
+	assert.Equal(t, "connect", records[0].Name)
+	assert.Equal(t, int64(1500), records[0].Value)
+
+	// Workload is tagged by cluster of the context.
+	Latency(events.WithCluster(context.Background(), "b"), "forkconns", "connect", time.Millisecond)
+	records = r.Records(KindLatency)
+	assert.Len(t, records, 2)
+	assert.Equal(t, "forkconns@b", records[1].Workload)
+
+	// No sink configured, latencies are discarded.
+	Set(nil)
+	Latency(context.Background(), "forkconns", "connect", time.Millisecond)
+	assert.Len(t, r.Records(""), 2)
+}
+
+func TestMulti(t *testing.T) {
+	assert.Nil(t, Multi())
+	assert.Nil(t, Multi(nil, nil))
+
+	r1, r2 := &Recorder{}, &Recorder{}
+	m := Multi(r1, nil, r2)
+
+	now := time.Now()
+	assert.NoError(t, m.RecordCounter(now, "rollbacks", "rollbacks", 10))
+	assert.NoError(t, m.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated backend"}))
+	assert.NoError(t, m.RecordLatency(now, "forkconns", "connect", time.Millisecond))
+
+	for _, r := range []*Recorder{r1, r2} {
+		assert.Equal(t, []Record{
+			{Time: now, Kind: KindCounter, Workload: "rollbacks", Name: "rollbacks", Value: 10},
+			{Time: now, Kind: KindEvent, Workload: "terminate", Action: "terminated backend"},
+			{Time: now, Kind: KindLatency, Workload: "forkconns", Name: "connect", Value: 1000},
+		}, r.Records(""))
+	}
+
+	// Failed sink doesn't prevent writing into other sinks.
+	r3 := &Recorder{}
+	m = Multi(failSink{}, r3)
+	assert.EqualError(t, m.RecordCounter(now, "rollbacks", "rollbacks", 1), "sink failed")
+	assert.Len(t, r3.Records(KindCounter), 1)
+}
+
+func TestEventsWriter(t *testing.T) {
+	r := &Recorder{}
+	events.SetSink(EventsWriter(r))
+	defer events.SetSink(nil)
+
+	events.Emit(context.Background(), "terminate", "terminated backend %d", 123)
+
+	records := r.Records(KindEvent)
+	assert.Len(t, records, 1)
+	assert.Equal(t, "terminate", records[0].Workload)
+	assert.Equal(t, "terminated backend 123", records[0].Action)
+}
+
+func TestNewEventsSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewEventsSink(events.NewJSONSink(buf))
+
+	assert.NoError(t, s.RecordCounter(time.Now(), "rollbacks", "rollbacks", 1))
+	assert.NoError(t, s.RecordLatency(time.Now(), "forkconns", "connect", time.Millisecond))
+	assert.Equal(t, 0, buf.Len())
+
+	assert.NoError(t, s.RecordEvent(events.Event{Time: time.Now(), Workload: "terminate", Action: "terminated backend", RunID: "abc"}))
+
+	var e events.Event
+	assert.NoError(t, json.NewDecoder(buf).Decode(&e))
+	assert.Equal(t, "terminated backend", e.Action)
+	assert.Equal(t, "abc", e.RunID)
+}
+
+func TestNewLogSink(t *testing.T) {
+	s := NewLogSink(log.NewDefaultLogger("error"))
+	assert.NoError(t, s.RecordCounter(time.Now(), "rollbacks", "rollbacks", 1))
+	assert.NoError(t, s.RecordEvent(events.Event{Workload: "terminate", Action: "terminated backend"}))
+	assert.NoError(t, s.RecordLatency(time.Now(), "forkconns", "connect", time.Millisecond))
+}
+
+func TestNewJSONSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s := NewJSONSink(buf)
+
+	now := time.Now().UTC()
+	assert.NoError(t, s.RecordCounter(now, "rollbacks", "rollbacks", 10))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated backend", RunID: "abc"}))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", 2*time.Millisecond))
+
+	dec := json.NewDecoder(buf)
+	for _, want := range []Record{
+		{Time: now, Kind: KindCounter, Workload: "rollbacks", Name: "rollbacks", Value: 10},
+		{Time: now, Kind: KindEvent, Workload: "terminate", Action: "terminated backend", RunID: "abc"},
+		{Time: now, Kind: KindLatency, Workload: "forkconns", Name: "connect", Value: 2000},
+	} {
+		var got Record
+		assert.NoError(t, dec.Decode(&got))
+		assert.True(t, want.Time.Equal(got.Time))
+		got.Time = want.Time
+		assert.Equal(t, want, got)
+	}
+
+	// Zero values of counters and latencies are written too.
+	buf.Reset()
+	assert.NoError(t, s.RecordCounter(now, "rollbacks", "rollbacks", 0))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", 500*time.Nanosecond))
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		assert.Contains(t, line, `"value":0`)
+	}
+}
+
+func TestNewCSVSink(t *testing.T) {
+	buf := &bytes.Buffer{}
+	s, err := NewCSVSink(buf)
+	assert.NoError(t, err)
+
+	now := time.Date(2021, 6, 1, 10, 0, 0, 0, time.UTC)
+	assert.NoError(t, s.RecordCounter(now, "rollbacks", "rollbacks", 10))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated backend"}))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", 2*time.Millisecond))
+
+	records, err := csv.NewReader(buf).ReadAll()
+	assert.NoError(t, err)
+	assert.Equal(t, [][]string{
+		CSVHeader,
+		{"2021-06-01T10:00:00Z", "rollbacks", "rollbacks", "10"},
+		{"2021-06-01T10:00:00Z", "forkconns", "connect_us", "2000"},
+	}, records)
+
+	_, err = NewCSVSink(failWriter{})
+	assert.EqualError(t, err, "disk full")
+}
+
+// failSink implements Sink interface which always fails.
+type failSink struct{}
+
+func (failSink) RecordCounter(time.Time, string, string, int64) error {
+	return errors.New("sink failed")
+}
+func (failSink) RecordEvent(events.Event) error { return errors.New("sink failed") }
+func (failSink) RecordLatency(time.Time, string, string, time.Duration) error {
+	return errors.New("sink failed")
+}
+
+// failWriter implements io.Writer which always fails.
+type failWriter struct{}
+
+func (failWriter) Write([]byte) (int, error) { return 0, errors.New("disk full") }
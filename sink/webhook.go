@@ -0,0 +1,244 @@
+package sink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// DefaultWebhookFilter defines filter which matches notable events: detected deadlocks, terminated
+// backends and reached connections limit.
+const DefaultWebhookFilter = "deadlock detected|terminated pid|connections limit reached"
+
+const (
+	// defaultWebhookQueueSize defines default number of events waiting for delivery.
+	defaultWebhookQueueSize = 1000
+	// defaultWebhookBatchSize defines default max number of events posted in single request.
+	defaultWebhookBatchSize = 100
+	// defaultWebhookFlushInterval defines default interval between posting of collected events.
+	defaultWebhookFlushInterval = time.Second
+	// defaultWebhookTimeout defines default timeout of single request.
+	defaultWebhookTimeout = 5 * time.Second
+)
+
+// WebhookConfig defines configuration of webhook sink.
+type WebhookConfig struct {
+	// URL defines address which events are posted to.
+	URL string
+	// Filter defines regexp matched against "<workload>: <action>" of events, only matching events
+	// are posted. Empty filter matches all events.
+	Filter string
+	// QueueSize defines max number of events waiting for delivery, events are dropped when queue
+	// is full. If zero, default size is used.
+	QueueSize int
+	// BatchSize defines max number of events posted in single request. If zero, default size is used.
+	BatchSize int
+	// FlushInterval defines interval between posting of collected events. If zero, default interval is used.
+	FlushInterval time.Duration
+	// Timeout defines timeout of single request. If zero, default timeout is used.
+	Timeout time.Duration
+}
+
+// webhookPayload defines JSON body of requests posted to webhook.
+type webhookPayload struct {
+	Events []events.Event `json:"events"`
+}
+
+// WebhookSink implements Sink interface which posts events to webhook as JSON, counters and
+// latencies are ignored. Events are queued and posted in batches by background goroutine, so
+// slow webhook doesn't block workloads. When queue is full, events are dropped.
+type WebhookSink struct {
+	config WebhookConfig
+	filter *regexp.Regexp
+	client *http.Client
+	logger log.Logger
+	// mu protects queue from writing after it has been closed.
+	mu     sync.RWMutex
+	closed bool
+	queue  chan events.Event
+	done   chan struct{}
+	// dropped defines number of events dropped due to full queue or failed requests.
+	dropped int64
+}
+
+// NewWebhookSink creates sink which posts events to webhook and starts delivery of events. Close
+// should be called for delivering the rest of queued events.
+func NewWebhookSink(config WebhookConfig, logger log.Logger) (*WebhookSink, error) {
+	u, err := url.Parse(config.URL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook URL: %s", stripURL(err))
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid webhook URL: unsupported scheme '%s'", u.Scheme)
+	}
+
+	filter, err := regexp.Compile(config.Filter)
+	if err != nil {
+		return nil, fmt.Errorf("invalid webhook filter: %s", err)
+	}
+
+	if config.QueueSize <= 0 {
+		config.QueueSize = defaultWebhookQueueSize
+	}
+	if config.BatchSize <= 0 {
+		config.BatchSize = defaultWebhookBatchSize
+	}
+	if config.FlushInterval <= 0 {
+		config.FlushInterval = defaultWebhookFlushInterval
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = defaultWebhookTimeout
+	}
+
+	s := &WebhookSink{
+		config: config,
+		filter: filter,
+		client: &http.Client{Timeout: config.Timeout},
+		logger: logger,
+		queue:  make(chan events.Event, config.QueueSize),
+		done:   make(chan struct{}),
+	}
+
+	go s.deliver()
+
+	return s, nil
+}
+
+// RecordCounter ignores counter.
+func (s *WebhookSink) RecordCounter(time.Time, string, string, int64) error { return nil }
+
+// RecordEvent queues event matching the filter for delivery. Error is returned if event has been
+// dropped because queue is full.
+func (s *WebhookSink) RecordEvent(e events.Event) error {
+	if !s.filter.MatchString(e.Workload + ": " + e.Action) {
+		return nil
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.closed {
+		return fmt.Errorf("webhook sink is closed")
+	}
+
+	select {
+	case s.queue <- e:
+		return nil
+	default:
+		atomic.AddInt64(&s.dropped, 1)
+		return fmt.Errorf("webhook queue is full, event dropped")
+	}
+}
+
+// RecordLatency ignores latency.
+func (s *WebhookSink) RecordLatency(time.Time, string, string, time.Duration) error { return nil }
+
+// Dropped returns number of events which have not been delivered.
+func (s *WebhookSink) Dropped() int64 {
+	return atomic.LoadInt64(&s.dropped)
+}
+
+// Close stops accepting events and waits until queued events are posted.
+func (s *WebhookSink) Close() {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+
+	<-s.done
+}
+
+// deliver collects queued events into batches and posts them until queue is closed. Batch is
+// posted when it is full or when flush interval elapsed.
+func (s *WebhookSink) deliver() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.config.FlushInterval)
+	defer ticker.Stop()
+
+	batch := make([]events.Event, 0, s.config.BatchSize)
+	for {
+		select {
+		case e, ok := <-s.queue:
+			if !ok {
+				s.post(batch)
+				return
+			}
+
+			batch = append(batch, e)
+			if len(batch) >= s.config.BatchSize {
+				s.post(batch)
+				batch = batch[:0]
+			}
+		case <-ticker.C:
+			s.post(batch)
+			batch = batch[:0]
+		}
+	}
+}
+
+// post sends batch of events to webhook. Failed requests are not retried, events are dropped.
+func (s *WebhookSink) post(batch []events.Event) {
+	if len(batch) == 0 {
+		return
+	}
+
+	err := s.send(batch)
+	if err != nil {
+		atomic.AddInt64(&s.dropped, int64(len(batch)))
+		s.logger.Warnf("post %d events to webhook failed: %s", len(batch), err)
+	}
+}
+
+// send makes request with batch of events in JSON payload.
+func (s *WebhookSink) send(batch []events.Event) error {
+	body, err := json.Marshal(webhookPayload{Events: batch})
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), s.config.Timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.config.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return stripURL(err)
+	}
+	defer func() { _ = resp.Body.Close() }()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected response status: %s", resp.Status)
+	}
+
+	return nil
+}
+
+// stripURL returns error without URL, webhook URLs often contain secret tokens which should not
+// be logged.
+func stripURL(err error) error {
+	var e *url.Error
+	if errors.As(err, &e) {
+		return e.Err
+	}
+
+	return err
+}
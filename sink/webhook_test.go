@@ -0,0 +1,125 @@
+package sink
+
+import (
+	"encoding/json"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewWebhookSink(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config WebhookConfig
+	}{
+		{valid: true, config: WebhookConfig{URL: "http://127.0.0.1/hook"}},
+		{valid: true, config: WebhookConfig{URL: "https://example.org/hook", Filter: "deadlock detected|terminated pid"}},
+		{valid: false, config: WebhookConfig{URL: ""}},
+		{valid: false, config: WebhookConfig{URL: "ftp://example.org/hook"}},
+		{valid: false, config: WebhookConfig{URL: "http://127.0.0.1/hook", Filter: "("}},
+	}
+
+	for _, tc := range testcases {
+		s, err := NewWebhookSink(tc.config, log.NewDefaultLogger("error"))
+		if tc.valid {
+			assert.NoError(t, err)
+			s.Close()
+		} else {
+			assert.Error(t, err)
+		}
+	}
+}
+
+func TestWebhookSink(t *testing.T) {
+	var (
+		mu       sync.Mutex
+		requests int
+		received []events.Event
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, http.MethodPost, r.Method)
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+
+		var p webhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&p))
+
+		mu.Lock()
+		requests++
+		received = append(received, p.Events...)
+		mu.Unlock()
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(WebhookConfig{URL: srv.URL, Filter: "deadlock detected|terminated pid", BatchSize: 2}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	now := time.Now()
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "deadlocks", Action: "deadlock detected, victim noisia-deadlocks"}))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "deadlocks", Action: "started deadlock on rows 1 and 2"}))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated pid 123", RunID: "abc123"}))
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "terminate", Action: "terminated pid 456"}))
+
+	// Counters and latencies are ignored.
+	assert.NoError(t, s.RecordCounter(now, "terminate", "signalled", 2))
+	assert.NoError(t, s.RecordLatency(now, "forkconns", "connect", time.Second))
+
+	// Full batch is posted without waiting for flush interval.
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return requests == 1
+	}, 500*time.Millisecond, 10*time.Millisecond)
+
+	// The rest of events is posted at close.
+	assert.NoError(t, s.RecordEvent(events.Event{Time: now, Workload: "deadlocks", Action: "deadlock detected, victim noisia-deadlocks"}))
+	s.Close()
+	s.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, 2, requests)
+	assert.Len(t, received, 4)
+	assert.Equal(t, "deadlocks", received[0].Workload)
+	assert.Equal(t, "terminated pid 123", received[1].Action)
+	assert.Equal(t, "abc123", received[1].RunID)
+	assert.Equal(t, "terminated pid 456", received[2].Action)
+	assert.Equal(t, int64(0), s.Dropped())
+
+	// Events are not accepted after close.
+	assert.Error(t, s.RecordEvent(events.Event{Time: now, Workload: "deadlocks", Action: "deadlock detected"}))
+}
+
+func TestWebhookSink_slowWebhook(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer srv.Close()
+
+	s, err := NewWebhookSink(WebhookConfig{URL: srv.URL, QueueSize: 2, BatchSize: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	// The first event is taken by delivery and stuck in request, two events fill the queue and the
+	// rest are dropped without blocking.
+	e := events.Event{Time: time.Now(), Workload: "failconns", Action: "connections limit reached, 100 connections held"}
+	assert.NoError(t, s.RecordEvent(e))
+	assert.Eventually(t, func() bool { return len(s.queue) == 0 }, 500*time.Millisecond, 10*time.Millisecond)
+
+	start := time.Now()
+	assert.NoError(t, s.RecordEvent(e))
+	assert.NoError(t, s.RecordEvent(e))
+	assert.Error(t, s.RecordEvent(e))
+	assert.Error(t, s.RecordEvent(e))
+	assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+
+	// Failed requests drop their events.
+	close(release)
+	s.Close()
+	assert.Equal(t, int64(5), s.Dropped())
+}
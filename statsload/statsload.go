@@ -0,0 +1,229 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package statsload defines implementation of workload which reads cumulative statistics
+// views in a tight loop and optionally resets statistics. This stresses statistics
+// subsystem and reproduces incidents when monitoring queries themselves become a load.
+//
+// The necessary number of workers is started (accordingly to Config.Jobs). Each worker
+// executes queries accordingly to rate specified in Config.Rate. Each query reads one of
+// pg_stat_* views chosen randomly, or resets statistics of the current database using
+// pg_stat_reset() with probability specified in Config.ResetRatio.
+//
+// Resetting statistics affects the whole database: autovacuum and monitoring rely on these
+// counters. Resets are made only when Config.AllowReset is set explicitly, and before
+// starting the workload it is checked the role is allowed to execute pg_stat_reset().
+package statsload
+
+import (
+	"context"
+	"fmt"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/workerpool"
+	"math/rand"
+	"sync/atomic"
+	"time"
+)
+
+// statsViews defines statistics views which are read by the workload.
+var statsViews = []string{
+	"pg_stat_activity",
+	"pg_stat_database",
+	"pg_stat_user_tables",
+	"pg_stat_user_indexes",
+	"pg_statio_user_tables",
+	"pg_statio_user_indexes",
+	"pg_stat_user_functions",
+	"pg_stat_bgwriter",
+}
+
+// Config defines configuration settings for statistics workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for querying statistics.
+	Jobs uint16
+	// Rate defines queries rate produced per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// ResetRatio defines probability of resetting statistics instead of reading, from 0 to 1.
+	ResetRatio float64
+	// AllowReset defines explicit permission to reset statistics of the database.
+	AllowReset bool
+	// Seed defines seed of random choices of views and resets, current time is used if zero.
+	Seed int64
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.ResetRatio < 0 || c.ResetRatio > 1 {
+		return noisia.NewConfigError("ResetRatio", noisia.ErrInvalidRange, "reset ratio must be between 0 and 1")
+	}
+
+	if c.ResetRatio > 0 && !c.AllowReset {
+		return noisia.NewConfigError("ResetRatio", noisia.ErrInvalidValue, "resetting statistics affects the whole database, it must be allowed explicitly")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// reads defines number of executed reads of statistics views.
+	reads int64
+	// resets defines number of statistics resets.
+	resets int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "statsload"
+}
+
+// Stats returns counters of statistics reads and resets.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"reads":  atomic.LoadInt64(&w.stats.reads),
+		"resets": atomic.LoadInt64(&w.stats.resets),
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	// Refuse to start instead of failing each reset in the middle of the run.
+	if w.config.ResetRatio > 0 {
+		ok, err := canResetStats(ctx, pool)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return fmt.Errorf("statsload: role is not allowed to execute pg_stat_reset()")
+		}
+	}
+
+	workerpool.New(int(w.config.Jobs)).Run(ctx, func(ctx context.Context, i int) {
+		rnd := random.New(w.config.Seed, i)
+		ratelimit.RunWorker(ctx, w.config.Rate, w.config.Scheduler, i, func(ctx context.Context) error {
+			return runQuery(ctx, pool, w.config.ResetRatio, rnd, &w.stats)
+		}, w.logger)
+	})
+
+	w.logger.Infof("statsload finished: %d reads, %d resets", atomic.LoadInt64(&w.stats.reads), atomic.LoadInt64(&w.stats.resets))
+
+	return nil
+}
+
+// runQuery resets statistics with probability of reset ratio, otherwise reads random statistics
+// view. Random choices are made using passed source. Executed queries are counted in passed stats.
+func runQuery(ctx context.Context, pool db.DB, ratio float64, rnd *rand.Rand, st *stats) error {
+	if rnd.Float64() < ratio {
+		_, _, err := pool.Exec(ctx, "SELECT pg_stat_reset()")
+		if err != nil {
+			return fmt.Errorf("reset statistics failed: %s", err)
+		}
+
+		atomic.AddInt64(&st.resets, 1)
+		events.Emit(ctx, "statsload", "statistics of the database reset")
+		return nil
+	}
+
+	view := statsViews[rnd.Intn(len(statsViews))]
+	err := readView(ctx, pool, view)
+	if err != nil {
+		return fmt.Errorf("read %s failed: %s", view, err)
+	}
+
+	atomic.AddInt64(&st.reads, 1)
+	return nil
+}
+
+// readView reads all rows of passed statistics view.
+func readView(ctx context.Context, q db.Querier, view string) error {
+	rows, err := q.Query(ctx, fmt.Sprintf("SELECT count(*) FROM (SELECT * FROM %s) s", view))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var n int64
+	for rows.Next() {
+		err = rows.Scan(&n)
+		if err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// canResetStats returns true if current role is allowed to execute pg_stat_reset().
+func canResetStats(ctx context.Context, q db.Querier) (bool, error) {
+	rows, err := q.Query(ctx, "SELECT has_function_privilege('pg_stat_reset()', 'EXECUTE')")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var ok bool
+	for rows.Next() {
+		err = rows.Scan(&ok)
+		if err != nil {
+			return false, err
+		}
+	}
+
+	return ok, rows.Err()
+}
@@ -0,0 +1,136 @@
+package statsload
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
+	"github.com/stretchr/testify/assert"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, ResetRatio: 0.1, AllowReset: true}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ResetRatio: 1.5, AllowReset: true}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ResetRatio: -0.1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ResetRatio: 0.1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	// Resetting statistics requires privileges, skip if not allowed.
+	ok, err := canResetStats(context.Background(), pool)
+	assert.NoError(t, err)
+	if !ok {
+		t.Skip("role is not allowed to execute pg_stat_reset()")
+	}
+
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 50, ResetRatio: 0.1, AllowReset: true}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["reads"], int64(0))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "statsload", w.Name())
+}
+
+func Test_runQuery(t *testing.T) {
+	pool := &recordDB{}
+	st := &stats{}
+	rnd := random.New(0, 0)
+
+	// Ratio 1 always resets statistics, ratio 0 always reads a view.
+	assert.NoError(t, runQuery(context.Background(), pool, 1, rnd, st))
+	assert.NoError(t, runQuery(context.Background(), pool, 0, rnd, st))
+	assert.NoError(t, runQuery(context.Background(), pool, 0, rnd, st))
+	assert.Equal(t, stats{reads: 2, resets: 1}, *st)
+	assert.Equal(t, "SELECT pg_stat_reset()", pool.queries[0])
+	assert.True(t, strings.HasPrefix(pool.queries[1], "SELECT count(*) FROM (SELECT * FROM pg_stat"))
+
+	// Failed queries are not counted.
+	pool.err = errors.New("permission denied")
+	assert.Error(t, runQuery(context.Background(), pool, 1, rnd, st))
+	assert.Error(t, runQuery(context.Background(), pool, 0, rnd, st))
+	assert.Equal(t, stats{reads: 2, resets: 1}, *st)
+}
+
+func Test_runQuery_seed(t *testing.T) {
+	run := func(seed int64) []string {
+		pool := &recordDB{}
+		rnd := random.New(seed, 0)
+		for i := 0; i < 20; i++ {
+			assert.NoError(t, runQuery(context.Background(), pool, 0.3, rnd, &stats{}))
+		}
+		return pool.queries
+	}
+
+	// The same seed produces the same sequence of resets and reads.
+	assert.Equal(t, run(42), run(42))
+	assert.NotEqual(t, run(42), run(43))
+}
+
+// recordDB implements db.DB interface, records executed queries and returns configured error.
+type recordDB struct {
+	queries []string
+	err     error
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) { return nil, d.err }
+func (d *recordDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	d.queries = append(d.queries, sql)
+	return 0, "", d.err
+}
+func (d *recordDB) Query(_ context.Context, sql string, _ ...interface{}) (db.Rows, error) {
+	d.queries = append(d.queries, sql)
+	if d.err != nil {
+		return nil, d.err
+	}
+	return &countRows{}, nil
+}
+func (d *recordDB) Close() {}
+
+// countRows implements db.Rows which returns single zero value.
+type countRows struct{ done bool }
+
+func (r *countRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+func (r *countRows) Scan(...interface{}) error { return nil }
+func (r *countRows) Err() error                { return nil }
+func (r *countRows) Close()                    {}
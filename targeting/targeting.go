@@ -5,22 +5,130 @@ import (
 	"github.com/lesovsky/noisia/db"
 )
 
+// Table defines table name with its schema, both are stored unquoted.
+type Table struct {
+	// Schema defines name of the schema the table belongs to.
+	Schema string
+	// Name defines name of the table.
+	Name string
+}
+
+// String returns quoted, schema-qualified name of the table which is safe to use in queries.
+func (t Table) String() string {
+	if t.Schema == "" {
+		return db.QuoteIdentifier(t.Name)
+	}
+	return db.QuoteIdentifier(t.Schema, t.Name)
+}
+
+// QuotedNames returns quoted, schema-qualified names of passed tables.
+func QuotedNames(tables []Table) []string {
+	names := make([]string, 0, len(tables))
+	for _, t := range tables {
+		names = append(names, t.String())
+	}
+
+	return names
+}
+
+// TableStat defines table's write statistics used for choosing target tables.
+type TableStat struct {
+	Table
+	// Updates defines number of tuples updated in the table.
+	Updates int64
+	// Deletes defines number of tuples deleted from the table.
+	Deletes int64
+	// Size defines total size of the table in bytes, including indexes and TOAST.
+	Size int64
+}
+
 // TopWriteTables returns tables with the most of tuples updated/deleted.
-func TopWriteTables(db db.DB, n int) ([]string, error) {
-	q := "SELECT schemaname ||'.'|| relname FROM pg_stat_user_tables " +
+func TopWriteTables(ctx context.Context, db db.DB, n int) ([]Table, error) {
+	stats, err := TopWriteTablesStats(ctx, db, n)
+	if err != nil {
+		return nil, err
+	}
+
+	tables := make([]Table, 0, len(stats))
+	for _, s := range stats {
+		tables = append(tables, s.Table)
+	}
+
+	return tables, nil
+}
+
+// TopWriteTablesStats returns statistics of tables with the most of tuples updated/deleted.
+func TopWriteTablesStats(ctx context.Context, db db.DB, n int) ([]TableStat, error) {
+	q := "SELECT schemaname, relname, n_tup_upd, n_tup_del, pg_total_relation_size(relid) FROM pg_stat_user_tables " +
 		"WHERE schemaname NOT IN ('pg_catalog', 'information_schema', 'pg_toast') " +
 		"ORDER BY (n_tup_upd + n_tup_del) DESC LIMIT $1"
-	rows, err := db.Query(context.Background(), q, n)
+	rows, err := db.Query(ctx, q, n)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	stats := make([]TableStat, 0, n)
+	for rows.Next() {
+		var s TableStat
+
+		err = rows.Scan(&s.Schema, &s.Name, &s.Updates, &s.Deletes, &s.Size)
+		if err != nil {
+			return nil, err
+		}
+
+		stats = append(stats, s)
+	}
+
+	return stats, rows.Err()
+}
+
+// ExpandPartitions replaces partitioned tables in passed list with their leaf partitions, so
+// workloads could lock or bloat particular partitions instead of parents which have no data.
+// Non-partitioned tables and partitions are returned as is, as well as partitioned tables which
+// have no partitions. Tables which occur more than once (e.g. both parent and its partition are
+// passed) are returned only once.
+func ExpandPartitions(ctx context.Context, db db.DB, tables []Table) ([]Table, error) {
+	q := "SELECT n.nspname, c.relname FROM pg_partition_tree($1::regclass) t " +
+		"JOIN pg_class c ON c.oid = t.relid JOIN pg_namespace n ON n.oid = c.relnamespace " +
+		"WHERE t.isleaf ORDER BY t.level, n.nspname, c.relname"
+
+	seen := map[Table]bool{}
+	expanded := make([]Table, 0, len(tables))
+	for _, t := range tables {
+		leaves, err := queryTables(ctx, db, q, t.String())
+		if err != nil {
+			return nil, err
+		}
+
+		if len(leaves) == 0 {
+			leaves = []Table{t}
+		}
+
+		for _, l := range leaves {
+			if !seen[l] {
+				seen[l] = true
+				expanded = append(expanded, l)
+			}
+		}
+	}
+
+	return expanded, nil
+}
+
+// queryTables executes query which returns schema and name of tables.
+func queryTables(ctx context.Context, db db.DB, q string, args ...interface{}) ([]Table, error) {
+	rows, err := db.Query(ctx, q, args...)
 	if err != nil {
 		return nil, err
 	}
 	defer rows.Close()
 
-	tables := make([]string, 0, n)
+	var tables []Table
 	for rows.Next() {
-		var t string
+		var t Table
 
-		err = rows.Scan(&t)
+		err = rows.Scan(&t.Schema, &t.Name)
 		if err != nil {
 			return nil, err
 		}
@@ -28,5 +136,5 @@ func TopWriteTables(db db.DB, n int) ([]string, error) {
 		tables = append(tables, t)
 	}
 
-	return tables, nil
+	return tables, rows.Err()
 }
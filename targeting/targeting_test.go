@@ -1,16 +1,271 @@
 package targeting
 
 import (
+	"context"
+	"errors"
 	"github.com/lesovsky/noisia/db"
 	"github.com/stretchr/testify/assert"
 	"testing"
+	"time"
 )
 
 func TestTopWriteTables(t *testing.T) {
 	pool, err := db.NewTestDB()
 	assert.NoError(t, err)
 
-	got, err := TopWriteTables(pool, 5)
+	got, err := TopWriteTables(context.Background(), pool, 5)
 	assert.NoError(t, err)
 	assert.NotNil(t, got)
 }
+
+func TestTopWriteTablesStats(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_stats (a int)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "INSERT INTO noisia_test_stats SELECT generate_series(1, 1000000)")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "UPDATE noisia_test_stats SET a = a + 1")
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), "DELETE FROM noisia_test_stats")
+	assert.NoError(t, err)
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_stats")
+		assert.NoError(t, err)
+	}()
+
+	// Wait until statistics is flushed into stats collector.
+	time.Sleep(1 * time.Second)
+
+	got, err := TopWriteTablesStats(context.Background(), pool, 1)
+	assert.NoError(t, err)
+	assert.Len(t, got, 1)
+	assert.Equal(t, Table{Schema: "public", Name: "noisia_test_stats"}, got[0].Table)
+	assert.Equal(t, "public", got[0].Schema)
+	assert.Equal(t, "noisia_test_stats", got[0].Name)
+	assert.Equal(t, int64(1000000), got[0].Updates)
+	assert.Equal(t, int64(1000000), got[0].Deletes)
+	assert.Greater(t, got[0].Size, int64(0))
+}
+
+func TestTopWriteTables_dots(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+
+	_, _, err = pool.Exec(context.Background(), `CREATE TABLE "noisia.test.dots" (a int)`)
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), `INSERT INTO "noisia.test.dots" SELECT generate_series(1, 1000000)`)
+	assert.NoError(t, err)
+	_, _, err = pool.Exec(context.Background(), `UPDATE "noisia.test.dots" SET a = a + 1`)
+	assert.NoError(t, err)
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), `DROP TABLE "noisia.test.dots"`)
+		assert.NoError(t, err)
+	}()
+
+	// Wait until statistics is flushed into stats collector.
+	time.Sleep(1 * time.Second)
+
+	got, err := TopWriteTables(context.Background(), pool, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{{Schema: "public", Name: "noisia.test.dots"}}, got)
+	assert.Equal(t, []string{`"public"."noisia.test.dots"`}, QuotedNames(got))
+
+	// Quoted name must be usable in queries.
+	_, _, err = pool.Exec(context.Background(), "SELECT * FROM "+got[0].String()+" LIMIT 1")
+	assert.NoError(t, err)
+}
+
+func TestTable_String(t *testing.T) {
+	testcases := []struct {
+		table Table
+		want  string
+	}{
+		{table: Table{Schema: "public", Name: "example"}, want: `"public"."example"`},
+		{table: Table{Schema: "public", Name: "my.table"}, want: `"public"."my.table"`},
+		{table: Table{Schema: "my.schema", Name: "table"}, want: `"my.schema"."table"`},
+		{table: Table{Schema: "public", Name: `quo"ted`}, want: `"public"."quo""ted"`},
+		{table: Table{Name: "example"}, want: `"example"`},
+	}
+
+	for _, tc := range testcases {
+		assert.Equal(t, tc.want, tc.table.String())
+	}
+}
+
+func TestTopWriteTablesStats_fakeDB(t *testing.T) {
+	pool := &statDB{stats: []TableStat{
+		{Table: Table{Schema: "public", Name: "my.table"}, Updates: 100, Deletes: 10, Size: 8192},
+		{Table: Table{Schema: "example", Name: "table"}, Updates: 50, Deletes: 0, Size: 16384},
+	}}
+
+	got, err := TopWriteTablesStats(context.Background(), pool, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, pool.stats, got)
+
+	tables, err := TopWriteTables(context.Background(), pool, 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`"public"."my.table"`, `"example"."table"`}, QuotedNames(tables))
+}
+
+func TestTopWriteTablesStats_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err := TopWriteTablesStats(ctx, &statDB{}, 2)
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+// statDB implements db.DB interface and returns predefined tables stats as query result.
+type statDB struct {
+	stats []TableStat
+}
+
+func (d *statDB) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (d *statDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (d *statDB) Query(ctx context.Context, _ string, _ ...interface{}) (db.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &statRows{stats: d.stats, idx: -1}, nil
+}
+
+func (d *statDB) Close() {}
+
+// statRows implements db.Rows interface over list of tables stats.
+type statRows struct {
+	stats []TableStat
+	idx   int
+}
+
+func (r *statRows) Next() bool {
+	r.idx++
+	return r.idx < len(r.stats)
+}
+
+func (r *statRows) Scan(dest ...interface{}) error {
+	s := r.stats[r.idx]
+	*dest[0].(*string) = s.Schema
+	*dest[1].(*string) = s.Name
+	*dest[2].(*int64) = s.Updates
+	*dest[3].(*int64) = s.Deletes
+	*dest[4].(*int64) = s.Size
+	return nil
+}
+
+func (r *statRows) Err() error {
+	return nil
+}
+
+func (r *statRows) Close() {}
+
+func TestExpandPartitions(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+
+	for _, q := range []string{
+		"CREATE TABLE noisia_test_parts (id int, a int) PARTITION BY RANGE (id)",
+		"CREATE TABLE noisia_test_parts_1 PARTITION OF noisia_test_parts FOR VALUES FROM (0) TO (100)",
+		"CREATE TABLE noisia_test_parts_2 PARTITION OF noisia_test_parts FOR VALUES FROM (100) TO (200) PARTITION BY RANGE (id)",
+		"CREATE TABLE noisia_test_parts_2_1 PARTITION OF noisia_test_parts_2 FOR VALUES FROM (100) TO (200)",
+		"CREATE TABLE noisia_test_plain (a int)",
+	} {
+		_, _, err = pool.Exec(context.Background(), q)
+		assert.NoError(t, err)
+	}
+	defer func() {
+		_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_parts, noisia_test_plain")
+		assert.NoError(t, err)
+	}()
+
+	// Parent is replaced with leaves of all levels, plain table and duplicated partition are passed through once.
+	got, err := ExpandPartitions(context.Background(), pool, []Table{
+		{Schema: "public", Name: "noisia_test_parts"},
+		{Schema: "public", Name: "noisia_test_plain"},
+		{Schema: "public", Name: "noisia_test_parts_1"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{
+		{Schema: "public", Name: "noisia_test_parts_1"},
+		{Schema: "public", Name: "noisia_test_parts_2_1"},
+		{Schema: "public", Name: "noisia_test_plain"},
+	}, got)
+}
+
+func TestExpandPartitions_fakeDB(t *testing.T) {
+	pool := &partitionDB{leaves: map[string][]Table{
+		`"public"."parent"`: {{Schema: "public", Name: "part_1"}, {Schema: "public", Name: "part_2"}},
+		`"public"."part_1"`: {{Schema: "public", Name: "part_1"}},
+	}}
+
+	got, err := ExpandPartitions(context.Background(), pool, []Table{
+		{Schema: "public", Name: "parent"},
+		{Schema: "public", Name: "part_1"},
+		{Schema: "public", Name: "empty"},
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []Table{
+		{Schema: "public", Name: "part_1"},
+		{Schema: "public", Name: "part_2"},
+		{Schema: "public", Name: "empty"},
+	}, got)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	_, err = ExpandPartitions(ctx, pool, []Table{{Schema: "public", Name: "parent"}})
+	assert.True(t, errors.Is(err, context.Canceled))
+}
+
+// partitionDB implements db.DB interface and returns predefined leaf partitions of the table
+// passed as query argument.
+type partitionDB struct {
+	leaves map[string][]Table
+}
+
+func (d *partitionDB) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (d *partitionDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (d *partitionDB) Query(ctx context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return &tableRows{tables: d.leaves[args[0].(string)], idx: -1}, nil
+}
+
+func (d *partitionDB) Close() {}
+
+// tableRows implements db.Rows interface over list of tables.
+type tableRows struct {
+	tables []Table
+	idx    int
+}
+
+func (r *tableRows) Next() bool {
+	r.idx++
+	return r.idx < len(r.tables)
+}
+
+func (r *tableRows) Scan(dest ...interface{}) error {
+	*dest[0].(*string) = r.tables[r.idx].Schema
+	*dest[1].(*string) = r.tables[r.idx].Name
+	return nil
+}
+
+func (r *tableRows) Err() error {
+	return nil
+}
+
+func (r *tableRows) Close() {}
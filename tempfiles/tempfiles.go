@@ -6,10 +6,23 @@
 // which create on-disk temporary files due to lack of work_mem.
 //
 // Before the starting workload, necessary number of workers is started. Each worker
-// connects to the database, creates connection pool and starts working loop. In the
-// loop, worker executes queries in a dedicated goroutine (to avoid awaiting when query
-// is finished). Before start query, reduce work_mem to guarantee creation of temp
-// file. Next query is executed accordingly to rate specified in Config.Rate.
+// connects to the database, creates connection pool and starts working loop. In the loop,
+// worker executes queries in a dedicated goroutine (to avoid awaiting when query is
+// finished). Before start query, reduce work_mem to guarantee creation of temp file (in
+// transaction pooling mode, work_mem is set within query's transaction). Next query is
+// executed accordingly to rate specified in Config.Rate.
+// Number of queries executed concurrently by each worker is limited by
+// Config.MaxInflight, when the limit is reached (e.g. queries are too slow for the rate)
+// queries are skipped and counted.
+// Also, number of concurrent queries is limited by size of the worker's pool: when all
+// connections are busy, the loop waits for a free connection instead of piling up
+// goroutines waiting for it.
+// During the workload, temp bytes statistics is sampled accordingly to
+// Config.SampleInterval and rate of written temp bytes per second is reported.
+// If Config.ExceedTempLimit is set, temp_file_limit is reduced within query's
+// transaction, so queries fail with "temporary file size exceeds temp_file_limit" errors,
+// these errors are counted. Setting temp_file_limit requires superuser or granted
+// privilege, if it can't be set the workload is skipped gracefully.
 // Workload duration is controlled by context created outside and passed to Run method.
 // Context is passed to each worker and used in the worker's loop. When context expires
 // loop is stopped.
@@ -19,12 +32,33 @@ import (
 	"context"
 	"fmt"
 	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
-	"golang.org/x/time/rate"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/sink"
+	"github.com/lesovsky/noisia/workerpool"
+	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
+const (
+	// defaultCleanupTimeout defines default max time allowed for collecting final statistics after the workload is done.
+	defaultCleanupTimeout = 10 * time.Second
+	// defaultSampleInterval defines default interval between samples of temp bytes statistics.
+	defaultSampleInterval = time.Second
+	// tempFileLimit defines temp_file_limit used for exceeding the limit, default query writes much more.
+	tempFileLimit = "1MB"
+	// errTempFileLimit defines SQLSTATE code of configuration_limit_exceeded error, returned when temp_file_limit is exceeded.
+	errTempFileLimit = "53400"
+)
+
+// defaultQuery defines query executed by default. Even on empty database this query might produce ~50MB temp file.
+const defaultQuery = "SELECT * FROM pg_class a, pg_class b ORDER BY random()"
+
 // Config defines configuration settings for temp files workload.
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
@@ -33,26 +67,134 @@ type Config struct {
 	Jobs uint16
 	// Rate defines rate interval for queries executing.
 	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// Query defines SELECT query which produces temp files, if empty the default query is used.
+	Query string
+	// SampleInterval defines interval between samples of temp bytes statistics, if zero the default interval is used.
+	SampleInterval time.Duration
+	// MinConns defines number of connections established in pool of each worker before queries are started, zero means no warmup.
+	MinConns uint16
+	// Databases defines databases which workers connect to accordingly to workers indexes, empty
+	// name means the database from connection string.
+	Databases []string
+	// ExceedTempLimit defines to set low temp_file_limit for queries, so they fail with temp_file_limit errors.
+	ExceedTempLimit bool
+	// MaxInflight defines max number of queries executed concurrently by each worker, queries are
+	// skipped when the limit is reached. Zero means no limit.
+	MaxInflight uint16
+	// CleanupTimeout defines max time allowed for collecting final statistics after the workload is done, if zero the default timeout is used.
+	CleanupTimeout time.Duration
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than zero")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	err := db.ValidateWorkerDatabases(c.Databases, c.Jobs)
+	if err != nil {
+		return noisia.NewConfigError("Databases", noisia.ErrInvalidValue, "%s", err)
 	}
 
 	if c.Rate <= 0 {
-		return fmt.Errorf("temp files queries rate must be positive")
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "temp files queries rate must be positive")
+	}
+
+	err = db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	if c.SampleInterval < 0 {
+		return noisia.NewConfigError("SampleInterval", noisia.ErrInvalidDuration, "sample interval must not be negative")
+	}
+
+	if c.Query != "" {
+		q := strings.TrimSuffix(strings.TrimSpace(c.Query), ";")
+		if !strings.HasPrefix(strings.ToUpper(q), "SELECT") || strings.Contains(q, ";") {
+			return noisia.NewConfigError("Query", noisia.ErrInvalidValue, "query must be a single SELECT statement")
+		}
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
 	}
 
 	return nil
 }
 
+// settings returns settings applied before each query for guaranteed creation of temp files.
+func (c Config) settings() []string {
+	settings := []string{"work_mem TO '64kB'"}
+	if c.ExceedTempLimit {
+		settings = append(settings, fmt.Sprintf("temp_file_limit TO '%s'", tempFileLimit))
+	}
+
+	return settings
+}
+
+// query returns query which should be executed by workers.
+func (c Config) query() string {
+	if c.Query == "" {
+		return defaultQuery
+	}
+
+	return c.Query
+}
+
 // workload implements noisia.Workload interface.
 type workload struct {
 	config Config
 	logger log.Logger
 	pool   db.DB
+	// stats defines counters of executed queries.
+	stats stats
+	// tempBytes defines number of temp bytes written during the workload.
+	tempBytes int64
+	// samples defines samples of temp bytes statistics taken during the workload.
+	samples sampler
+	// rate defines current rate of workers, it could be changed while the workload is running.
+	rate *ratelimit.Rate
+	// workers defines pool of workers, its size could be changed while the workload is running.
+	workers *workerpool.Pool
+}
+
+// stats defines counters of executed queries.
+type stats struct {
+	// queries defines number of successfully executed queries.
+	queries int64
+	// limitErrors defines number of queries failed due to exceeded temp_file_limit.
+	limitErrors int64
+	// skipped defines number of queries skipped because too many queries were in flight.
+	skipped int64
+	// poolWaits defines number of times the loop waited for a free connection of the pool.
+	poolWaits int64
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -62,7 +204,57 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger, nil}, nil
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{
+		config:  config,
+		logger:  logger,
+		rate:    ratelimit.NewRate(config.Rate),
+		workers: workerpool.New(int(config.Jobs)),
+	}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "tempfiles"
+}
+
+// SetRate changes rate of running workers, new rate takes effect since the next query.
+func (w *workload) SetRate(r float64) error {
+	if r <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be greater than zero")
+	}
+
+	w.rate.Store(r)
+	return nil
+}
+
+// SetJobs changes number of running workers, extra workers are stopped and missing workers are started.
+func (w *workload) SetJobs(jobs uint16) error {
+	if jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	w.workers.Resize(int(jobs))
+	return nil
+}
+
+// Stats returns counters of executed and skipped queries, waits for free pool connections,
+// temp_file_limit errors, written temp bytes and rate of written temp bytes.
+func (w *workload) Stats() noisia.Stats {
+	avg, max := w.samples.rate()
+
+	return noisia.Stats{
+		"queries":                atomic.LoadInt64(&w.stats.queries),
+		"temp_limit_errors":      atomic.LoadInt64(&w.stats.limitErrors),
+		"skipped_queries":        atomic.LoadInt64(&w.stats.skipped),
+		"pool_waits":             atomic.LoadInt64(&w.stats.poolWaits),
+		"temp_bytes":             atomic.LoadInt64(&w.tempBytes),
+		"temp_bytes_per_sec":     int64(avg),
+		"max_temp_bytes_per_sec": int64(max),
+	}
 }
 
 // Run creates necessary number of workers and waiting for until the are finish.
@@ -70,51 +262,100 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 // perfect, but there is no way to know how many temp bytes generated inside the
 // session or even transaction.
 func (w *workload) Run(ctx context.Context) error {
-	workers := int(w.config.Jobs)
+	opts := db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout}
 
-	var wg sync.WaitGroup
+	bytesBefore, err := countTempBytes(ctx, w.config.Conninfo, opts)
+	if err != nil {
+		return err
+	}
 
-	bytesBefore, err := countTempBytes(w.config.Conninfo)
+	// Sample temp bytes statistics in background using dedicated connection.
+	conn, err := db.ConnectWithOptions(ctx, w.config.Conninfo, opts)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = conn.Close() }()
 
-	wg.Add(workers)
-	for i := 0; i < workers; i++ {
-		go func() {
-			err := runWorker(ctx, w.logger, w.config)
-			if err != nil {
-				w.logger.Warnf("start tempfiles worker failed: %s, continue", err)
+	// Refuse to exceed the limit instead of failing each query with permission error.
+	if w.config.ExceedTempLimit {
+		err := checkTempLimit(ctx, conn)
+		if err != nil {
+			if db.ErrorCode(err) == "42501" {
+				w.logger.Warnf("tempfiles: temp_file_limit can't be set: %s, skip", err)
+				return nil
 			}
-			wg.Done()
-		}()
+			return err
+		}
 	}
 
-	wg.Wait()
+	interval := w.config.SampleInterval
+	if interval == 0 {
+		interval = defaultSampleInterval
+	}
 
-	bytesAfter, err := countTempBytes(w.config.Conninfo)
+	samplerDone := make(chan struct{})
+	go func() {
+		runSampler(ctx, w.logger, conn, interval, &w.samples)
+		close(samplerDone)
+	}()
+
+	w.workers.Run(ctx, func(ctx context.Context, i int) {
+		opts := opts
+		opts.Database = db.WorkerDatabase(w.config.Databases, i)
+
+		err := runWorker(ctx, w.logger, w.config, w.rate, ratelimit.NewScheduler(w.config.Scheduler, i), opts, &w.stats)
+		if err != nil {
+			w.logger.Warnf("start tempfiles worker failed: %s, continue", err)
+		}
+	})
+
+	<-samplerDone
+
+	// Run's context is already done at this point, use separate bounded context for collecting final stats.
+	statCtx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	bytesAfter, err := countTempBytes(statCtx, w.config.Conninfo, opts)
 	if err != nil {
 		return err
 	}
+	atomic.StoreInt64(&w.tempBytes, int64(bytesAfter-bytesBefore))
 	w.logger.Infof("generated %d temp bytes (might include temp bytes produced by concurrent workload)", bytesAfter-bytesBefore)
 
+	avg, max := w.samples.rate()
+	w.logger.Infof("temp bytes rate: avg %.0f bytes/s, max %.0f bytes/s", avg, max)
+
+	if w.config.ExceedTempLimit {
+		w.logger.Infof("temp_file_limit exceeded %d times", atomic.LoadInt64(&w.stats.limitErrors))
+	}
+
+	if skipped := atomic.LoadInt64(&w.stats.skipped); skipped > 0 {
+		w.logger.Warnf("skipped %d queries due to max in-flight queries limit", skipped)
+	}
+
+	if waits := atomic.LoadInt64(&w.stats.poolWaits); waits > 0 {
+		w.logger.Warnf("waited for free pool connection %d times, queries rate might be lower than required", waits)
+	}
+
 	return nil
 }
 
-// runWorker connects to the database and starts tempfiles loop.
-func runWorker(ctx context.Context, log log.Logger, config Config) error {
+// runWorker connects to the database using passed options and starts tempfiles loop.
+func runWorker(ctx context.Context, log log.Logger, config Config, r *ratelimit.Rate, s ratelimit.Scheduler, opts db.ConnOptions, st *stats) error {
 	log.Info("start tempfiles worker")
 
 	// Use pool because single connection is not enough here. Working loop executes
 	// queries asynchronously and several queries might be executed concurrently.
-	pool, err := db.NewPostgresDB(ctx, config.Conninfo)
+	// Warmed up pool allows to avoid connecting costs during the first queries.
+	opts.MinConns = int32(config.MinConns)
+	pool, err := db.NewPostgresDBWithOptions(ctx, config.Conninfo, opts)
 	if err != nil {
 		return err
 	}
 
 	defer pool.Close()
 
-	err = startLoop(ctx, pool, log, config.Rate)
+	err = startLoop(ctx, pool, log, config, r, s, st)
 	if err != nil {
 		return err
 	}
@@ -124,71 +365,183 @@ func runWorker(ctx context.Context, log log.Logger, config Config) error {
 }
 
 // startLoop start executing queries in a loop with required rate until context timeout exceeded.
-func startLoop(ctx context.Context, pool db.DB, log log.Logger, r float64) error {
+// Rate is throttled by adaptive limiter, if specified, queries are paced by passed scheduler. Executed queries and queries failed due to
+// exceeded temp_file_limit are counted in passed stats, latencies of executed queries are recorded
+// into global sink. If number of queries in flight reached
+// Config.MaxInflight, next queries are skipped until some of running queries are finished. If all
+// connections of the pool are busy, the loop waits until one of them is released.
+func startLoop(ctx context.Context, pool db.DB, log log.Logger, config Config, r *ratelimit.Rate, s ratelimit.Scheduler, st *stats) error {
 	var wg sync.WaitGroup
 
-	limiter := rate.NewLimiter(rate.Limit(r), 1)
-	for {
-		if limiter.Allow() {
-			wg.Add(1)
-
-			// Due to produced temp files, queries could be executed too long. At the same time
-			// we would like to preserve required rate of queries. Don't wait when query is
-			// finished and execute them asynchronously.
-			go func() {
-				// Ignore errors related to context expiration.
-				err := execQuery(ctx, pool)
-				if err != nil && ctx.Err() == nil {
-					log.Warnf("executing tempfiles query failed: %v, continue", err)
-				}
+	// Slots of in-flight queries, nil channel means no limit.
+	var inflight chan struct{}
+	if config.MaxInflight > 0 {
+		inflight = make(chan struct{}, config.MaxInflight)
+	}
+
+	// Slots of pool connections. Each query holds a connection until finished, queries started
+	// over the pool size would just wait for a connection in their goroutines.
+	var conns chan struct{}
+	if s, ok := pool.(db.Sizer); ok && s.MaxConns() > 0 {
+		conns = make(chan struct{}, s.MaxConns())
+	}
+	var waited bool
+
+	// In transaction pooling mode, SET and query must be executed within single transaction.
+	// Limit of temp files must be applied to the same connection which executes the query.
+	exec := execQuery
+	if config.PoolerMode == db.PoolerModeTransaction || config.ExceedTempLimit {
+		exec = execQueryXact
+	}
 
-				wg.Done()
-			}()
+	ratelimit.RunScheduler(ctx, r, config.Adaptive, s, func(ctx context.Context) error {
+		if inflight != nil {
+			select {
+			case inflight <- struct{}{}:
+			default:
+				// Don't delay the loop, delayed queries would be executed in bursts and exceed the rate.
+				atomic.AddInt64(&st.skipped, 1)
+				return nil
+			}
 		}
 
-		select {
-		case <-ctx.Done():
-			wg.Wait()
-			return nil
-		default:
+		if conns != nil {
+			select {
+			case conns <- struct{}{}:
+			default:
+				if !waited {
+					log.Warnf("tempfiles: all %d pool connections are busy, wait for free connection", cap(conns))
+					waited = true
+				}
+				atomic.AddInt64(&st.poolWaits, 1)
+
+				select {
+				case conns <- struct{}{}:
+				case <-ctx.Done():
+					if inflight != nil {
+						<-inflight
+					}
+					return nil
+				}
+			}
+		}
+
+		wg.Add(1)
+
+		// Due to produced temp files, queries could be executed too long. At the same time
+		// we would like to preserve required rate of queries. Don't wait when query is
+		// finished and execute them asynchronously.
+		go func() {
+			// Ignore errors related to context expiration.
+			start := time.Now()
+			err := exec(ctx, pool, config.settings(), config.query())
+			switch {
+			case err == nil:
+				atomic.AddInt64(&st.queries, 1)
+				sink.Latency(ctx, "tempfiles", "query", time.Since(start))
+			case config.ExceedTempLimit && db.ErrorCode(err) == errTempFileLimit:
+				atomic.AddInt64(&st.limitErrors, 1)
+				events.Emit(ctx, "tempfiles", "temp_file_limit exceeded")
+			case ctx.Err() == nil:
+				log.Warnf("executing tempfiles query failed: %v, continue", err)
+			}
+
+			if conns != nil {
+				<-conns
+			}
+			if inflight != nil {
+				<-inflight
+			}
+			wg.Done()
+		}()
+
+		return nil
+	}, log)
+
+	wg.Wait()
+	return nil
+}
+
+// execQuery executes query which should create a temp file. Before execute query, apply
+// passed settings, e.g. set work_mem value to minimum possible value to guarantee creation
+// of temp file.
+func execQuery(ctx context.Context, pool db.DB, settings []string, query string) error {
+	for _, s := range settings {
+		_, _, err := pool.Exec(ctx, "SET "+s)
+		if err != nil {
+			return err
 		}
 	}
+
+	_, _, err := pool.Exec(ctx, query)
+	if err != nil {
+		return err
+	}
+	events.Emit(ctx, "tempfiles", "executed temp files query")
+
+	return nil
 }
 
-// execQuery executes query which should create a temp file. Before execute query,
-// set work_mem value to minimum possible value to guarantee creation of temp file.
-func execQuery(ctx context.Context, pool db.DB) error {
-	_, _, err := pool.Exec(ctx, "SET work_mem TO '64kB'")
+// execQueryXact executes query which should create a temp file within a transaction.
+// Before execute query, apply passed settings local to transaction, e.g. set work_mem
+// value to minimum possible value to guarantee creation of temp file.
+func execQueryXact(ctx context.Context, pool db.DB, settings []string, query string) error {
+	tx, err := pool.Begin(ctx)
 	if err != nil {
 		return err
 	}
+	defer func() { _ = tx.Rollback(ctx) }()
 
-	// Even on empty database this query might produce ~50MB temp file.
-	_, _, err = pool.Exec(ctx, "SELECT * FROM pg_class a, pg_class b ORDER BY random()")
+	for _, s := range settings {
+		_, _, err = tx.Exec(ctx, "SET LOCAL "+s)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, _, err = tx.Exec(ctx, query)
 	if err != nil {
 		return err
 	}
+	events.Emit(ctx, "tempfiles", "executed temp files query")
 
-	return nil
+	return tx.Commit(ctx)
 }
 
-// countTempBytes queries current database statistics about temp bytes written.
-// Private context is used here, because this is auxiliary routine and is not related to
-// main workload.
-func countTempBytes(conninfo string) (int, error) {
-	bytes := -1 // zero could be returned from database and it is valid value
+// checkTempLimit checks temp_file_limit could be set using passed connection. The setting is
+// set within transaction which is rolled back, so the connection is not affected.
+func checkTempLimit(ctx context.Context, conn db.Conn) error {
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
 
-	conn, err := db.Connect(context.Background(), conninfo)
+	_, _, err = tx.Exec(ctx, fmt.Sprintf("SET LOCAL temp_file_limit TO '%s'", tempFileLimit))
+	return err
+}
+
+// countTempBytes queries current database statistics about temp bytes written.
+func countTempBytes(ctx context.Context, conninfo string, opts db.ConnOptions) (int, error) {
+	conn, err := db.ConnectWithOptions(ctx, conninfo, opts)
 	if err != nil {
-		return bytes, err
+		return -1, err
 	}
 
 	defer func() { _ = conn.Close() }()
 
-	rows, err := conn.Query(context.Background(), "SELECT pg_stat_get_db_temp_bytes(oid) from pg_database where datname = current_database()")
+	return queryTempBytes(ctx, conn)
+}
+
+// queryTempBytes queries number of temp bytes written in current database using passed connection.
+func queryTempBytes(ctx context.Context, conn db.Conn) (int, error) {
+	bytes := -1 // zero could be returned from database and it is valid value
+
+	rows, err := conn.Query(ctx, "SELECT pg_stat_get_db_temp_bytes(oid) from pg_database where datname = current_database()")
 	if err != nil {
 		return bytes, err
 	}
+	defer rows.Close()
 
 	for rows.Next() {
 		err = rows.Scan(&bytes)
@@ -197,5 +550,96 @@ func countTempBytes(conninfo string) (int, error) {
 		}
 	}
 
-	return bytes, nil
+	return bytes, rows.Err()
+}
+
+// sample defines reading of temp bytes statistics taken at specific time.
+type sample struct {
+	at    time.Time
+	bytes int
+}
+
+// sampler keeps timestamped readings of temp bytes statistics and computes rate of written temp bytes.
+type sampler struct {
+	mu      sync.Mutex
+	samples []sample
+}
+
+// add appends new reading of temp bytes statistics.
+func (s *sampler) add(at time.Time, bytes int) {
+	s.mu.Lock()
+	s.samples = append(s.samples, sample{at: at, bytes: bytes})
+	s.mu.Unlock()
+}
+
+// rates returns rates of written temp bytes per second between consecutive readings.
+func (s *sampler) rates() []float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.samples) < 2 {
+		return nil
+	}
+
+	rates := make([]float64, 0, len(s.samples)-1)
+	for i := 1; i < len(s.samples); i++ {
+		prev, cur := s.samples[i-1], s.samples[i]
+
+		elapsed := cur.at.Sub(prev.at).Seconds()
+		if elapsed <= 0 {
+			continue
+		}
+
+		// Statistics has been reset (e.g. using pg_stat_reset()) between readings, only bytes
+		// written after reset are known.
+		delta := cur.bytes - prev.bytes
+		if delta < 0 {
+			delta = cur.bytes
+		}
+
+		rates = append(rates, float64(delta)/elapsed)
+	}
+
+	return rates
+}
+
+// rate returns average and max rate of written temp bytes per second.
+func (s *sampler) rate() (float64, float64) {
+	rates := s.rates()
+	if len(rates) == 0 {
+		return 0, 0
+	}
+
+	var sum, max float64
+	for _, r := range rates {
+		sum += r
+		if r > max {
+			max = r
+		}
+	}
+
+	return sum / float64(len(rates)), max
+}
+
+// runSampler reads temp bytes statistics using passed connection with specified interval until context is done.
+func runSampler(ctx context.Context, log log.Logger, conn db.Conn, interval time.Duration, s *sampler) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		bytes, err := queryTempBytes(ctx, conn)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Warnf("sample temp bytes failed: %s, continue", err)
+			}
+		} else {
+			s.add(time.Now(), bytes)
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
 }
@@ -2,9 +2,15 @@ package tempfiles
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"github.com/lesovsky/noisia/sink"
 	"github.com/stretchr/testify/assert"
+	"strings"
+	"sync/atomic"
 	"testing"
 	"time"
 )
@@ -17,6 +23,11 @@ func TestConfig_validate(t *testing.T) {
 		{valid: true, config: Config{Jobs: 1, Rate: 1}},
 		{valid: false, config: Config{Jobs: 0, Rate: 1}},
 		{valid: false, config: Config{Jobs: 1, Rate: 0}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, PoolerMode: db.PoolerModeTransaction}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, PoolerMode: "invalid"}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, Query: " select * from generate_series(1, 1000000) order by random(); "}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Query: "DELETE FROM pg_class"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, Query: "SELECT 1; DROP TABLE example"}},
 	}
 
 	for _, tc := range testcases {
@@ -65,7 +76,7 @@ func Test_runWorker(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	err := runWorker(ctx, log.NewDefaultLogger("error"), Config{Rate: 1, Conninfo: db.TestConninfo})
+	err := runWorker(ctx, log.NewDefaultLogger("error"), Config{Rate: 1, Conninfo: db.TestConninfo}, ratelimit.NewRate(1), ratelimit.NewConstantScheduler(), db.ConnOptions{}, &stats{})
 	assert.NoError(t, err)
 }
 
@@ -76,20 +87,379 @@ func Test_startLoop(t *testing.T) {
 	pool, err := db.NewTestDB()
 	assert.NoError(t, err)
 
-	err = startLoop(ctx, pool, log.NewDefaultLogger("error"), 2)
+	st := &stats{}
+	err = startLoop(ctx, pool, log.NewDefaultLogger("error"), Config{Rate: 2}, ratelimit.NewRate(2), ratelimit.NewConstantScheduler(), st)
 	assert.NoError(t, err)
+	assert.Greater(t, st.queries, int64(0))
+}
+
+func Test_startLoop_exceedTempLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	pool := &limitDB{}
+	st := &stats{}
+	err := startLoop(ctx, pool, log.NewDefaultLogger("error"), Config{Rate: 2, ExceedTempLimit: true}, ratelimit.NewRate(2), ratelimit.NewConstantScheduler(), st)
+	assert.NoError(t, err)
+	assert.Greater(t, atomic.LoadInt64(&st.limitErrors), int64(0))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&st.queries))
+}
+
+func Test_startLoop_maxInflight(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Queries are much slower than the rate, without the limit dozens of them would be in flight.
+	// Each query takes two statements: setting work_mem and the query itself.
+	pool := &db.SlowDB{Delay: 250 * time.Millisecond}
+	st := &stats{}
+
+	r := &sink.Recorder{}
+	sink.Set(r)
+	defer sink.Set(nil)
+
+	err := startLoop(ctx, pool, log.NewDefaultLogger("error"), Config{Rate: 100, MaxInflight: 3}, ratelimit.NewRate(100), ratelimit.NewConstantScheduler(), st)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), pool.MaxInflight())
+	assert.Equal(t, int64(0), pool.Inflight())
+	assert.Greater(t, atomic.LoadInt64(&st.queries), int64(0))
+	assert.Greater(t, atomic.LoadInt64(&st.skipped), int64(0))
+
+	// Latencies of executed queries are recorded into sink.
+	records := r.Records(sink.KindLatency)
+	assert.Equal(t, atomic.LoadInt64(&st.queries), int64(len(records)))
+	for _, rec := range records {
+		assert.Equal(t, "tempfiles", rec.Workload)
+		assert.Equal(t, "query", rec.Name)
+		assert.GreaterOrEqual(t, rec.Value, (500 * time.Millisecond).Microseconds())
+	}
+}
+
+func Test_startLoop_poolSize(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	// Pool serves only two queries at once, the loop waits for free connections instead of starting more queries.
+	pool := &sizedDB{SlowDB: db.SlowDB{Delay: 100 * time.Millisecond}, maxConns: 2}
+	st := &stats{}
+	err := startLoop(ctx, pool, log.NewDefaultLogger("error"), Config{Rate: 100}, ratelimit.NewRate(100), ratelimit.NewConstantScheduler(), st)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), pool.MaxInflight())
+	assert.Greater(t, atomic.LoadInt64(&st.queries), int64(0))
+	assert.Greater(t, atomic.LoadInt64(&st.poolWaits), int64(0))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&st.skipped))
 }
 
 func Test_execQuery(t *testing.T) {
 	pool, err := db.NewTestDB()
 	assert.NoError(t, err)
 
-	err = execQuery(context.Background(), pool)
+	err = execQuery(context.Background(), pool, Config{}.settings(), defaultQuery)
 	assert.NoError(t, err)
 }
 
+func Test_execQuery_custom(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	before, err := countTempBytes(context.Background(), db.TestConninfo, db.ConnOptions{})
+	assert.NoError(t, err)
+
+	err = execQuery(context.Background(), pool, Config{}.settings(), "SELECT * FROM generate_series(1, 1000000) ORDER BY random()")
+	assert.NoError(t, err)
+
+	// Statistics is updated asynchronously, wait a bit.
+	time.Sleep(time.Second)
+
+	after, err := countTempBytes(context.Background(), db.TestConninfo, db.ConnOptions{})
+	assert.NoError(t, err)
+	assert.Greater(t, after, before)
+}
+
+func Test_execQueryXact(t *testing.T) {
+	pool := &recordDB{}
+
+	assert.NoError(t, execQueryXact(context.Background(), pool, Config{}.settings(), defaultQuery))
+	assert.Equal(t, []string{
+		"BEGIN",
+		"SET LOCAL work_mem TO '64kB'",
+		"SELECT * FROM pg_class a, pg_class b ORDER BY random()",
+		"COMMIT",
+	}, pool.queries)
+
+	pool = &recordDB{}
+	assert.NoError(t, execQueryXact(context.Background(), pool, Config{ExceedTempLimit: true}.settings(), defaultQuery))
+	assert.Equal(t, []string{
+		"BEGIN",
+		"SET LOCAL work_mem TO '64kB'",
+		"SET LOCAL temp_file_limit TO '1MB'",
+		"SELECT * FROM pg_class a, pg_class b ORDER BY random()",
+		"COMMIT",
+	}, pool.queries)
+}
+
+func Test_execQuery_exceedTempLimit(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	err = execQueryXact(context.Background(), pool, Config{ExceedTempLimit: true}.settings(), defaultQuery)
+	assert.Error(t, err)
+	assert.Equal(t, errTempFileLimit, db.ErrorCode(err))
+}
+
+func TestWorkload_Run_exceedTempLimit(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(
+		Config{Conninfo: db.TestConninfo, Jobs: 1, Rate: 2, ExceedTempLimit: true},
+		log.NewDefaultLogger("error"),
+	)
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["temp_limit_errors"], int64(0))
+}
+
+func TestConfig_query(t *testing.T) {
+	assert.Equal(t, defaultQuery, Config{}.query())
+	assert.Equal(t, "SELECT 1", Config{Query: "SELECT 1"}.query())
+}
+
 func Test_countTempBytes(t *testing.T) {
-	bytes, err := countTempBytes(db.TestConninfo)
+	bytes, err := countTempBytes(context.Background(), db.TestConninfo, db.ConnOptions{})
 	assert.NoError(t, err)
 	assert.Greater(t, bytes, -1)
 }
+
+func Test_countTempBytes_canceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	// Canceled context is honored, no connection attempts are made.
+	start := time.Now()
+	bytes, err := countTempBytes(ctx, db.TestConninfo, db.ConnOptions{})
+	assert.Error(t, err)
+	assert.Equal(t, -1, bytes)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func Test_queryTempBytes_canceled(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Slow query is interrupted when context is done.
+	start := time.Now()
+	bytes, err := queryTempBytes(ctx, hangingConn{})
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.Equal(t, -1, bytes)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+// hangingConn implements db.Conn which queries hang until context is done.
+type hangingConn struct{}
+
+func (c hangingConn) Begin(context.Context) (db.Tx, error) { return nil, nil }
+func (c hangingConn) Exec(ctx context.Context, _ string, _ ...interface{}) (int64, string, error) {
+	<-ctx.Done()
+	return 0, "", ctx.Err()
+}
+func (c hangingConn) Query(ctx context.Context, _ string, _ ...interface{}) (db.Rows, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+func (c hangingConn) Close() error { return nil }
+
+func Test_queryTempBytes(t *testing.T) {
+	bytes, err := queryTempBytes(context.Background(), &statConn{values: []int{123456}})
+	assert.NoError(t, err)
+	assert.Equal(t, 123456, bytes)
+
+	// Errors returned by rows are propagated.
+	bytes, err = queryTempBytes(context.Background(), &statConn{err: fmt.Errorf("example error")})
+	assert.Error(t, err)
+	assert.Equal(t, -1, bytes)
+}
+
+func Test_sampler(t *testing.T) {
+	s := &sampler{}
+	avg, max := s.rate()
+	assert.Equal(t, float64(0), avg)
+	assert.Equal(t, float64(0), max)
+
+	start := time.Now()
+	s.add(start, 1000)
+	s.add(start.Add(time.Second), 3000)
+	s.add(start.Add(2*time.Second), 7000)
+	// Statistics reset, 3000 bytes written after reset.
+	s.add(start.Add(3*time.Second), 3000)
+
+	assert.Equal(t, []float64{2000, 4000, 3000}, s.rates())
+
+	avg, max = s.rate()
+	assert.Equal(t, float64(3000), avg)
+	assert.Equal(t, float64(4000), max)
+}
+
+func Test_runSampler(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	s := &sampler{}
+	runSampler(ctx, log.NewDefaultLogger("error"), &counterConn{step: 8192}, 10*time.Millisecond, s)
+
+	rates := s.rates()
+	assert.NotEmpty(t, rates)
+	for _, r := range rates {
+		assert.GreaterOrEqual(t, r, float64(0))
+	}
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "tempfiles", w.Name())
+}
+
+func TestWorkload_SetRate(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetRate(0))
+	assert.Equal(t, float64(1), wl.rate.Load())
+
+	assert.NoError(t, wl.SetRate(20))
+	assert.Equal(t, float64(20), wl.rate.Load())
+}
+
+func TestWorkload_SetJobs(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 4, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	assert.Error(t, wl.SetJobs(0))
+	assert.Equal(t, 4, wl.workers.Size())
+
+	assert.NoError(t, wl.SetJobs(2))
+	assert.Equal(t, 2, wl.workers.Size())
+}
+
+// recordDB implements db.DB and db.Tx interfaces and records executed queries.
+type recordDB struct {
+	queries []string
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) {
+	d.queries = append(d.queries, "BEGIN")
+	return d, nil
+}
+
+func (d *recordDB) Commit(context.Context) error {
+	d.queries = append(d.queries, "COMMIT")
+	return nil
+}
+
+func (d *recordDB) Rollback(context.Context) error {
+	return nil
+}
+
+func (d *recordDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	d.queries = append(d.queries, sql)
+	return 0, "", nil
+}
+
+func (d *recordDB) Query(_ context.Context, sql string, _ ...interface{}) (db.Rows, error) {
+	d.queries = append(d.queries, sql)
+	return nil, nil
+}
+
+func (d *recordDB) Close() {}
+
+// limitDB implements db.DB and db.Tx interfaces, executed queries fail with temp_file_limit error.
+type limitDB struct {
+	recordDB
+}
+
+func (d *limitDB) Begin(context.Context) (db.Tx, error) {
+	return d, nil
+}
+
+func (d *limitDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	if strings.HasPrefix(sql, "SET") {
+		return 0, "", nil
+	}
+	return 0, "", sqlstateErr{code: errTempFileLimit}
+}
+
+// sqlstateErr implements error with SQLSTATE code, as returned by Postgres.
+type sqlstateErr struct{ code string }
+
+func (e sqlstateErr) Error() string    { return "ERROR: fake error (SQLSTATE " + e.code + ")" }
+func (e sqlstateErr) SQLState() string { return e.code }
+
+// sizedDB implements db.DB and db.Sizer interfaces, queries are executed with delay.
+type sizedDB struct {
+	db.SlowDB
+	maxConns int32
+}
+
+func (d *sizedDB) MaxConns() int32 { return d.maxConns }
+
+// statConn implements db.Conn interface and returns predefined values as query result.
+type statConn struct {
+	values []int
+	err    error
+}
+
+func (c *statConn) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (c *statConn) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (c *statConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	return &intRows{values: c.values, err: c.err, idx: -1}, nil
+}
+
+func (c *statConn) Close() error {
+	return nil
+}
+
+// counterConn implements db.Conn interface and returns counter increased by step on each query.
+type counterConn struct {
+	statConn
+	step  int
+	value int
+}
+
+func (c *counterConn) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	c.value += c.step
+	return &intRows{values: []int{c.value}, idx: -1}, nil
+}
+
+// intRows implements db.Rows interface over list of integers.
+type intRows struct {
+	values []int
+	err    error
+	idx    int
+}
+
+func (r *intRows) Next() bool {
+	r.idx++
+	return r.idx < len(r.values)
+}
+
+func (r *intRows) Scan(dest ...interface{}) error {
+	*dest[0].(*int) = r.values[r.idx]
+	return nil
+}
+
+func (r *intRows) Err() error {
+	return r.err
+}
+
+func (r *intRows) Close() {}
@@ -9,9 +9,14 @@
 // The workload is implemented as single worker which sends cancel/terminate commands
 // with interval based on Config.Rate and Config.Interval. Exact command to be sent is
 // based on Config.SoftMode, depending on it pg_cancel_backend() or pg_terminate_backend()
-// is used.  The workload could be additionally tuned for cancel/terminate processes
-// of exact users, from specific client address, connected to specific databases or
-// which has specific application name.
+// is used. With Config.Escalate, backends are cancelled first and terminated after
+// Config.EscalateDelay, if they are still present. The workload could be additionally
+// tuned for cancel/terminate processes of exact users, from specific client address,
+// connected to specific databases or which has specific application name.
+//
+// By default, each round signals a random backend, so the same long-lived backend might be
+// chosen repeatedly. With Config.SnapshotMode, PIDs of matching backends are snapshotted
+// each Config.Interval and signalled one by one in round-robin manner until the next snapshot.
 package terminate
 
 import (
@@ -19,7 +24,10 @@ import (
 	"fmt"
 	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync/atomic"
 	"time"
 )
 
@@ -31,6 +39,8 @@ type Config struct {
 	Interval time.Duration
 	// Rate defines a rate of how many backends should be terminated (or queries canceled) per interval.
 	Rate uint16
+	// Scheduler defines optional pacing of signals (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
 	// SoftMode defines to use pg_cancel_backend() instead of pg_terminate_backend().
 	SoftMode bool
 	// IgnoreSystemBackends controls whether system background process should be terminated or not.
@@ -43,16 +53,79 @@ type Config struct {
 	Database string
 	// ApplicationName defines patter applied to pg_stat_activity.application_name
 	ApplicationName string
+	// Escalate defines to cancel backend first and terminate it after EscalateDelay if it is still present.
+	Escalate bool
+	// EscalateDelay defines an interval between cancel and terminate when Escalate is enabled.
+	EscalateDelay time.Duration
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// MaxTotal defines max number of backends signalled during the run, when reached the workload stops. Zero means unlimited.
+	MaxTotal int
+	// Force defines to allow rates higher than sanity limit.
+	Force bool
+	// SnapshotMode defines to signal backends round-robin over a snapshot of PIDs taken each Interval instead of random choice.
+	SnapshotMode bool
 }
 
+// identityColumns defines columns of pg_stat_activity which identify signalled backend, they are
+// logged for each signalled backend. System backends have no user and database, empty strings are
+// returned instead.
+const identityColumns = "coalesce(usename, '') AS usename, coalesce(datname, '') AS datname, coalesce(application_name, '') AS application_name"
+
+// maxRate defines sanity limit of signals rate per second, higher rates are allowed only when forced.
+const maxRate = 100
+
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Interval < 10*time.Millisecond {
-		return fmt.Errorf("terminate interval must be greater than 10ms")
+		return noisia.NewConfigError("Interval", noisia.ErrInvalidDuration, "terminate interval must be greater than 10ms")
 	}
 
 	if c.Rate < 1 {
-		return fmt.Errorf("terminate rate must be greater than zero")
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "terminate rate must be greater than zero")
+	}
+
+	if r := float64(c.Rate) / c.Interval.Seconds(); r > maxRate && !c.Force {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate %d per %s exceeds sanity limit of %d signals per second, force is required for higher rates", c.Rate, c.Interval, maxRate)
+	}
+
+	if c.MaxTotal < 0 {
+		return noisia.NewConfigError("MaxTotal", noisia.ErrInvalidValue, "terminate max total must not be negative")
+	}
+
+	if c.Escalate {
+		if c.SoftMode {
+			return noisia.NewConfigError("SoftMode", noisia.ErrInvalidValue, "soft mode and escalate could not be used together")
+		}
+
+		if c.EscalateDelay <= 0 {
+			return noisia.NewConfigError("EscalateDelay", noisia.ErrInvalidDuration, "escalate delay must be greater than zero")
+		}
+	}
+
+	err := db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
 	}
 
 	return nil
@@ -62,6 +135,10 @@ func (c Config) validate() error {
 type workload struct {
 	config Config
 	logger log.Logger
+	// signalled defines number of signalled backends.
+	signalled int64
+	// rate defines current number of signal rounds per second, it could be changed while the workload is running.
+	rate *ratelimit.Rate
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -71,53 +148,261 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger}, nil
+	return &workload{config: config, logger: logger, rate: ratelimit.NewRate(float64(config.Rate) / config.Interval.Seconds())}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "terminate"
+}
+
+// SetRate changes number of signal rounds per interval, new rate takes effect since the next round.
+func (w *workload) SetRate(r float64) error {
+	if r <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "terminate rate must be greater than zero")
+	}
+
+	perSecond := r / w.config.Interval.Seconds()
+	if perSecond > maxRate && !w.config.Force {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate %g per %s exceeds sanity limit of %d signals per second, force is required for higher rates", r, w.config.Interval, maxRate)
+	}
+
+	w.rate.Store(perSecond)
+	return nil
+}
+
+// Stats returns counter of sent cancel/terminate signals.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"signalled": atomic.LoadInt64(&w.signalled),
+	}
 }
 
 // Run method connects to Postgres and starts the workload.
 func (w *workload) Run(ctx context.Context) error {
-	pool, err := db.NewPostgresDB(ctx, w.config.Conninfo)
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
 	if err != nil {
 		return err
 	}
 	defer pool.Close()
 
-	// calculate inter-query interval for per-second rate throttling
-	naptime := w.config.Interval / time.Duration(w.config.Rate)
-	timer := time.NewTimer(naptime)
+	// On hot standby, system backends (startup process, WAL receiver) are required for replication.
+	// Signal client backends only.
+	recovery, err := db.IsInRecovery(ctx, pool)
+	if err != nil {
+		return err
+	}
+	if recovery && !w.config.IgnoreSystemBackends {
+		w.logger.Info("postgres is in recovery (hot standby), signal client backends only")
+		w.config.IgnoreSystemBackends = true
+	}
+
+	w.startLoop(ctx, pool)
+
+	return nil
+}
+
+// startLoop signals backends in a loop with required rate until context is done or
+// max total number of signals is reached.
+func (w *workload) startLoop(ctx context.Context, pool db.DB) {
+	snap := &snapshot{}
+
+	ratelimit.RunScheduler(ctx, w.rate, nil, ratelimit.NewScheduler(w.config.Scheduler, 0), func(ctx context.Context) error {
+		var (
+			n   int
+			err error
+		)
+		if w.config.SnapshotMode {
+			n, err = snap.signal(ctx, w.logger, pool, w.config, time.Now())
+		} else if w.config.Escalate {
+			n, err = escalateProcess(ctx, w.logger, pool, w.config)
+		} else {
+			n, err = signalProcess(ctx, w.logger, pool, w.config)
+		}
+		total := atomic.AddInt64(&w.signalled, int64(n))
+
+		if w.config.MaxTotal > 0 && total >= int64(w.config.MaxTotal) {
+			w.logger.Infof("terminate: max total %d of signalled backends reached, stop", w.config.MaxTotal)
+			return ratelimit.ErrStop
+		}
+
+		if err != nil {
+			return fmt.Errorf("failed terminate: %s", err)
+		}
+
+		return nil
+	}, w.logger)
+}
+
+// signalProcess sends cancel/terminate query to Postgres. Returns number of signalled backends.
+func signalProcess(ctx context.Context, logger log.Logger, pool db.DB, c Config) (int, error) {
+	action := "terminated"
+	if c.SoftMode {
+		action = "cancelled"
+	}
+
+	pids, err := execSignalQuery(ctx, logger, pool, action, buildQuery(c))
+	return len(pids), err
+}
+
+// execSignalQuery executes cancel/terminate query, logs identities of signalled backends and emits
+// events about them. Query must return PID, result of signal function and identity columns.
+// Returns PIDs of signalled backends.
+func execSignalQuery(ctx context.Context, logger log.Logger, pool db.DB, action string, q string, args ...interface{}) ([]int, error) {
+	rows, err := pool.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var (
+		found     int
+		signalled []int
+	)
+	for rows.Next() {
+		var (
+			pid                     int
+			ok                      bool
+			user, database, appname string
+		)
 
-	for {
-		err = signalProcess(ctx, pool, w.config)
+		err = rows.Scan(&pid, &ok, &user, &database, &appname)
 		if err != nil {
-			w.logger.Warnf("failed terminate: %s", err)
+			return signalled, err
 		}
+		found++
 
-		select {
-		case <-timer.C:
-			timer.Reset(naptime)
-			continue
-		case <-ctx.Done():
-			return nil
+		if ok {
+			signalled = append(signalled, pid)
+			logger.Infof("terminate: %s backend pid %d, user %q, database %q, application %q", action, pid, user, database, appname)
+			events.Emit(ctx, "terminate", "%s pid %d", action, pid)
 		}
 	}
+
+	err = rows.Err()
+	if err != nil {
+		return signalled, err
+	}
+
+	if found == 0 {
+		logger.Debug("terminate: no matching backends found")
+	}
+
+	return signalled, nil
+}
+
+// escalateProcess selects backend, cancels its query, waits for escalate delay and then
+// terminates the backend if it is still present.
+func escalateProcess(ctx context.Context, logger log.Logger, pool db.DB, c Config) (int, error) {
+	pids, err := selectPIDs(ctx, pool, buildEscalateQuery(c))
+	if err != nil {
+		return 0, err
+	}
+
+	return escalatePIDs(ctx, logger, pool, c, pids)
 }
 
-// signalProcess sends cancel/terminate query to Postgres.
-func signalProcess(ctx context.Context, pool db.DB, c Config) error {
-	q := buildQuery(c)
+// escalatePIDs cancels queries of passed backends, waits for escalate delay and then terminates
+// the backends which are still present. Returns number of signalled backends, backend which has
+// been both cancelled and terminated is counted once.
+func escalatePIDs(ctx context.Context, logger log.Logger, pool db.DB, c Config, pids []int) (int, error) {
+	if len(pids) == 0 {
+		return 0, nil
+	}
 
-	// Don't care about errors
-	_, _, err := pool.Exec(ctx, q)
+	cancelled, err := execSignalQuery(ctx, logger, pool, "cancelled", "SELECT pid, pg_cancel_backend(pid), "+identityColumns+" FROM pg_stat_activity WHERE pid = ANY($1)", pids)
 	if err != nil {
-		return err
+		return len(cancelled), err
 	}
 
-	return nil
+	// Stop execution if context has been done, otherwise escalate after delay.
+	timer := time.NewTimer(c.EscalateDelay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		return len(cancelled), nil
+	case <-timer.C:
+	}
+
+	// Terminate only survived backends which are still present in pg_stat_activity.
+	terminated, err := execSignalQuery(ctx, logger, pool, "terminated", "SELECT pid, pg_terminate_backend(pid), "+identityColumns+" FROM pg_stat_activity WHERE pid = ANY($1)", pids)
+
+	signalled := map[int]bool{}
+	for _, pid := range append(cancelled, terminated...) {
+		signalled[pid] = true
+	}
+
+	return len(signalled), err
+}
+
+// selectPIDs executes passed query which returns PIDs of backends.
+func selectPIDs(ctx context.Context, pool db.DB, q string, args ...interface{}) ([]int, error) {
+	rows, err := pool.Query(ctx, q, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pids []int
+	for rows.Next() {
+		var pid int
+		err = rows.Scan(&pid)
+		if err != nil {
+			return nil, err
+		}
+		pids = append(pids, pid)
+	}
+
+	return pids, rows.Err()
 }
 
-// buildQuery creates cancel/terminate query depending on passed config.
+// snapshot defines PIDs of matching backends which are signalled one by one in round-robin manner.
+type snapshot struct {
+	pids  []int
+	next  int
+	taken time.Time
+}
+
+// signal signals the next backend of the snapshot. The snapshot is taken again when it is older
+// than interval or has no backends. Returns number of signalled backends.
+func (s *snapshot) signal(ctx context.Context, logger log.Logger, pool db.DB, c Config, now time.Time) (int, error) {
+	if len(s.pids) == 0 || now.Sub(s.taken) >= c.Interval {
+		pids, err := selectPIDs(ctx, pool, buildSnapshotQuery(c))
+		if err != nil {
+			return 0, err
+		}
+
+		s.pids, s.next, s.taken = pids, 0, now
+		events.Emit(ctx, "terminate", "snapshot of %d backends taken", len(pids))
+	}
+
+	if len(s.pids) == 0 {
+		return 0, nil
+	}
+
+	pid := s.pids[s.next]
+	s.next = (s.next + 1) % len(s.pids)
+
+	if c.Escalate {
+		return escalatePIDs(ctx, logger, pool, c, []int{pid})
+	}
+
+	action, fn := "terminated", "pg_terminate_backend(pid)"
+	if c.SoftMode {
+		action, fn = "cancelled", "pg_cancel_backend(pid)"
+	}
+
+	// Filter is applied again, so the PID reused by another backend is not signalled.
+	q := fmt.Sprintf("SELECT pid, %s, %s FROM pg_stat_activity WHERE pid = $1 %s", fn, identityColumns, buildFilter(c))
+
+	signalled, err := execSignalQuery(ctx, logger, pool, action, q, pid)
+	return len(signalled), err
+}
+
+// buildQuery creates cancel/terminate query depending on passed config. Backend is chosen in CTE,
+// so the signal function is called only for the chosen backend, and its identity is returned.
 func buildQuery(c Config) string {
-	var signalFuncname, signalClientBackendsOnly, signalClientAddr, signalUser, signalDatabase, signalAppName string
+	var signalFuncname string
 
 	if c.SoftMode {
 		signalFuncname = "pg_cancel_backend(pid)"
@@ -125,6 +410,33 @@ func buildQuery(c Config) string {
 		signalFuncname = "pg_terminate_backend(pid)"
 	}
 
+	return fmt.Sprintf(
+		"WITH target AS (SELECT pid, %s FROM pg_stat_activity WHERE pid <> pg_backend_pid() %sORDER BY random() LIMIT 1) "+
+			"SELECT pid, %s, usename, datname, application_name FROM target",
+		identityColumns, buildFilter(c), signalFuncname,
+	)
+}
+
+// buildEscalateQuery creates query which selects backend for escalation depending on passed config.
+func buildEscalateQuery(c Config) string {
+	return fmt.Sprintf(
+		"SELECT pid FROM pg_stat_activity WHERE pid <> pg_backend_pid() %sORDER BY random() LIMIT 1",
+		buildFilter(c),
+	)
+}
+
+// buildSnapshotQuery creates query which selects all matching backends depending on passed config.
+func buildSnapshotQuery(c Config) string {
+	return fmt.Sprintf(
+		"SELECT pid FROM pg_stat_activity WHERE pid <> pg_backend_pid() %sORDER BY pid",
+		buildFilter(c),
+	)
+}
+
+// buildFilter creates conditions for selecting backends depending on passed config.
+func buildFilter(c Config) string {
+	var signalClientBackendsOnly, signalClientAddr, signalUser, signalDatabase, signalAppName string
+
 	if c.IgnoreSystemBackends {
 		signalClientBackendsOnly = "AND backend_type = 'client backend' "
 	}
@@ -146,8 +458,7 @@ func buildQuery(c Config) string {
 	}
 
 	return fmt.Sprintf(
-		"SELECT %s FROM pg_stat_activity WHERE pid <> pg_backend_pid() %s%s%s%s%sORDER BY random() LIMIT 1",
-		signalFuncname,
+		"%s%s%s%s%s",
 		signalClientBackendsOnly,
 		signalClientAddr,
 		signalUser,
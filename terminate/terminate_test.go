@@ -1,8 +1,12 @@
 package terminate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
 	"github.com/stretchr/testify/assert"
 	"testing"
@@ -17,6 +21,15 @@ func TestConfig_validate(t *testing.T) {
 		{valid: true, config: Config{Interval: 1 * time.Second, Rate: 1}},
 		{valid: false, config: Config{Interval: 9 * time.Millisecond, Rate: 1}},
 		{valid: false, config: Config{Interval: 1 * time.Second, Rate: 0}},
+		{valid: true, config: Config{Interval: 1 * time.Second, Rate: 1, Escalate: true, EscalateDelay: 1 * time.Second}},
+		{valid: false, config: Config{Interval: 1 * time.Second, Rate: 1, Escalate: true}},
+		{valid: false, config: Config{Interval: 1 * time.Second, Rate: 1, Escalate: true, EscalateDelay: 1 * time.Second, SoftMode: true}},
+		{valid: true, config: Config{Interval: 1 * time.Second, Rate: 1, MaxTotal: 10}},
+		{valid: false, config: Config{Interval: 1 * time.Second, Rate: 1, MaxTotal: -1}},
+		{valid: true, config: Config{Interval: 1 * time.Second, Rate: 100}},
+		{valid: false, config: Config{Interval: 1 * time.Second, Rate: 60000}},
+		{valid: false, config: Config{Interval: 10 * time.Millisecond, Rate: 2}},
+		{valid: true, config: Config{Interval: 1 * time.Second, Rate: 60000, Force: true}},
 	}
 
 	for _, tc := range testcases {
@@ -51,17 +64,280 @@ func Test_buildQuery(t *testing.T) {
 		config Config
 		want   string
 	}{
-		{config: Config{SoftMode: false}, want: "SELECT pg_terminate_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, IgnoreSystemBackends: true}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND backend_type = 'client backend' ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, ClientAddr: "192.168"}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND client_addr::text ~ '192.168' ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, User: "example"}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND usename ~ 'example' ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, Database: "example"}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND datname ~ 'example' ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, ApplicationName: "example"}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND application_name ~ 'example' ORDER BY random() LIMIT 1"},
-		{config: Config{SoftMode: true, ClientAddr: "192.168", User: "example", Database: "example", ApplicationName: "example"}, want: "SELECT pg_cancel_backend(pid) FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND client_addr::text ~ '192.168' AND usename ~ 'example' AND datname ~ 'example' AND application_name ~ 'example' ORDER BY random() LIMIT 1"},
+		{config: Config{SoftMode: false}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() ORDER BY random() LIMIT 1) SELECT pid, pg_terminate_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, IgnoreSystemBackends: true}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND backend_type = 'client backend' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, ClientAddr: "192.168"}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND client_addr::text ~ '192.168' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, User: "example"}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND usename ~ 'example' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, Database: "example"}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND datname ~ 'example' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, ApplicationName: "example"}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND application_name ~ 'example' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
+		{config: Config{SoftMode: true, ClientAddr: "192.168", User: "example", Database: "example", ApplicationName: "example"}, want: "WITH target AS (SELECT pid, " + identityColumns + " FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND client_addr::text ~ '192.168' AND usename ~ 'example' AND datname ~ 'example' AND application_name ~ 'example' ORDER BY random() LIMIT 1) SELECT pid, pg_cancel_backend(pid), usename, datname, application_name FROM target"},
 	}
 
 	for _, tc := range testcases {
 		assert.Equal(t, tc.want, buildQuery(tc.config))
 	}
 }
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Interval: 1 * time.Second, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "terminate", w.Name())
+}
+
+func TestWorkload_startLoop_maxTotal(t *testing.T) {
+	// Each round signals two backends.
+	pool := &recordDB{pids: []int{1234, 5678}}
+	w, err := NewWorkload(Config{Interval: 10 * time.Millisecond, Rate: 1, MaxTotal: 5}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	w.(*workload).startLoop(ctx, pool)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+
+	// Workload stopped after third round when 6 backends have been signalled.
+	assert.Len(t, pool.queries, 3)
+	assert.Equal(t, int64(6), w.Stats()["signalled"])
+}
+
+func TestWorkload_SetRate(t *testing.T) {
+	w, err := NewWorkload(Config{Interval: 100 * time.Millisecond, Rate: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	wl := w.(*workload)
+
+	// Rate is specified per interval and stored per second.
+	assert.Error(t, wl.SetRate(0))
+	assert.Error(t, wl.SetRate(20)) // 200 signals per second exceeds sanity limit
+	assert.Equal(t, float64(10), wl.rate.Load())
+
+	assert.NoError(t, wl.SetRate(5))
+	assert.Equal(t, float64(50), wl.rate.Load())
+}
+
+func TestWorkload_startLoop_setRate(t *testing.T) {
+	pool := &recordDB{pids: []int{1234}}
+	w, err := NewWorkload(Config{Interval: 1 * time.Second, Rate: 2}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// Increase rate of running loop, rounds after the change are executed faster.
+	time.AfterFunc(250*time.Millisecond, func() { assert.NoError(t, w.(*workload).SetRate(40)) })
+
+	w.(*workload).startLoop(ctx, pool)
+	assert.GreaterOrEqual(t, len(pool.queries), 20)
+}
+
+func Test_escalateProcess(t *testing.T) {
+	pool := &recordDB{pids: []int{1234}}
+	config := Config{Escalate: true, EscalateDelay: 10 * time.Millisecond, User: "example"}
+
+	n, err := escalateProcess(context.Background(), log.NewDefaultLogger("error"), pool, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n) // cancelled and then terminated backend is counted once
+	assert.Equal(t, []string{
+		"SELECT pid FROM pg_stat_activity WHERE pid <> pg_backend_pid() AND usename ~ 'example' ORDER BY random() LIMIT 1",
+		"SELECT pid, pg_cancel_backend(pid), " + identityColumns + " FROM pg_stat_activity WHERE pid = ANY($1)",
+		"SELECT pid, pg_terminate_backend(pid), " + identityColumns + " FROM pg_stat_activity WHERE pid = ANY($1)",
+	}, pool.queries)
+
+	// Each of escalated backends is counted once.
+	n, err = escalatePIDs(context.Background(), log.NewDefaultLogger("error"), &recordDB{pids: []int{1234, 5678}}, config, []int{1234, 5678})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	// No backends found, nothing to escalate.
+	pool = &recordDB{}
+	n, err = escalateProcess(context.Background(), log.NewDefaultLogger("error"), pool, config)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Len(t, pool.queries, 1)
+}
+
+func Test_signalProcess_events(t *testing.T) {
+	buf := &bytes.Buffer{}
+	events.SetSink(events.NewJSONSink(buf))
+	defer events.SetSink(nil)
+
+	pool := &recordDB{pids: []int{1234, 5678}}
+	n, err := signalProcess(context.Background(), log.NewDefaultLogger("error"), pool, Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	n, err = signalProcess(context.Background(), log.NewDefaultLogger("error"), pool, Config{SoftMode: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	dec := json.NewDecoder(buf)
+	for _, want := range []string{"terminated pid 1234", "terminated pid 5678", "cancelled pid 1234", "cancelled pid 5678"} {
+		var e events.Event
+		assert.NoError(t, dec.Decode(&e))
+		assert.Equal(t, "terminate", e.Workload)
+		assert.Equal(t, want, e.Action)
+		assert.False(t, e.Time.IsZero())
+	}
+}
+
+// captureLogger implements log.Logger and captures all written messages.
+type captureLogger struct {
+	msgs []string
+}
+
+func (l *captureLogger) write(level string, msg string) { l.msgs = append(l.msgs, level+" "+msg) }
+func (l *captureLogger) Debug(msg string)               { l.write("debug", msg) }
+func (l *captureLogger) Debugf(format string, v ...interface{}) {
+	l.write("debug", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Info(msg string) { l.write("info", msg) }
+func (l *captureLogger) Infof(format string, v ...interface{}) {
+	l.write("info", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Warn(msg string) { l.write("warn", msg) }
+func (l *captureLogger) Warnf(format string, v ...interface{}) {
+	l.write("warn", fmt.Sprintf(format, v...))
+}
+func (l *captureLogger) Error(msg string) { l.write("error", msg) }
+func (l *captureLogger) Errorf(format string, v ...interface{}) {
+	l.write("error", fmt.Sprintf(format, v...))
+}
+
+func Test_signalProcess_logIdentity(t *testing.T) {
+	logger := &captureLogger{}
+
+	// Identity of each signalled backend is logged.
+	pool := &recordDB{pids: []int{1234, 5678}}
+	n, err := signalProcess(context.Background(), logger, pool, Config{})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.Equal(t, []string{
+		`info terminate: terminated backend pid 1234, user "app_user", database "app_db", application "app-1234"`,
+		`info terminate: terminated backend pid 5678, user "app_user", database "app_db", application "app-5678"`,
+	}, logger.msgs)
+
+	// Nothing is signalled when no backends found.
+	logger = &captureLogger{}
+	n, err = signalProcess(context.Background(), logger, &recordDB{}, Config{SoftMode: true})
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+	assert.Equal(t, []string{"debug terminate: no matching backends found"}, logger.msgs)
+}
+
+// recordDB implements db.DB interface and records executed queries.
+type recordDB struct {
+	pids    []int
+	queries []string
+}
+
+func (d *recordDB) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (d *recordDB) Exec(_ context.Context, sql string, _ ...interface{}) (int64, string, error) {
+	d.queries = append(d.queries, sql)
+	return 0, "", nil
+}
+
+func (d *recordDB) Query(_ context.Context, sql string, _ ...interface{}) (db.Rows, error) {
+	d.queries = append(d.queries, sql)
+	return &pidRows{pids: d.pids, idx: -1}, nil
+}
+
+func (d *recordDB) Close() {}
+
+// pidRows implements db.Rows interface over list of PIDs.
+type pidRows struct {
+	pids []int
+	idx  int
+}
+
+func (r *pidRows) Next() bool {
+	r.idx++
+	return r.idx < len(r.pids)
+}
+
+func (r *pidRows) Scan(dest ...interface{}) error {
+	*dest[0].(*int) = r.pids[r.idx]
+	if len(dest) > 1 {
+		*dest[1].(*bool) = true
+	}
+	if len(dest) > 2 {
+		*dest[2].(*string) = "app_user"
+		*dest[3].(*string) = "app_db"
+		*dest[4].(*string) = fmt.Sprintf("app-%d", r.pids[r.idx])
+	}
+	return nil
+}
+
+func (r *pidRows) Err() error {
+	return nil
+}
+
+func (r *pidRows) Close() {}
+
+func Test_snapshot_signal(t *testing.T) {
+	pool := &snapshotDB{pids: []int{101, 102, 103}}
+	c := Config{Interval: time.Second}
+	s := &snapshot{}
+	now := time.Now()
+
+	// Backends of the snapshot are signalled round-robin until the next snapshot.
+	for i := 0; i < 7; i++ {
+		n, err := s.signal(context.Background(), log.NewDefaultLogger("error"), pool, c, now.Add(time.Duration(i)*100*time.Millisecond))
+		assert.NoError(t, err)
+		assert.Equal(t, 1, n)
+	}
+	assert.Equal(t, []int{101, 102, 103, 101, 102, 103, 101}, pool.signalled)
+	assert.Equal(t, 1, pool.snapshots)
+
+	// New backends are signalled after the snapshot has been taken again.
+	pool.pids = []int{201, 202}
+	pool.signalled = nil
+	for i := 0; i < 2; i++ {
+		_, err := s.signal(context.Background(), log.NewDefaultLogger("error"), pool, c, now.Add(time.Second))
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, []int{201, 202}, pool.signalled)
+	assert.Equal(t, 2, pool.snapshots)
+
+	// No matching backends, the snapshot is taken again at the next round.
+	pool.pids = nil
+	s = &snapshot{}
+	for i := 0; i < 2; i++ {
+		n, err := s.signal(context.Background(), log.NewDefaultLogger("error"), pool, c, now)
+		assert.NoError(t, err)
+		assert.Equal(t, 0, n)
+	}
+	assert.Equal(t, 4, pool.snapshots)
+}
+
+// snapshotDB implements db.DB interface. Snapshot queries return all pids, signal queries
+// return passed pid, signalled pids are recorded.
+type snapshotDB struct {
+	pids      []int
+	snapshots int
+	signalled []int
+}
+
+func (d *snapshotDB) Begin(context.Context) (db.Tx, error) {
+	return nil, nil
+}
+
+func (d *snapshotDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (d *snapshotDB) Query(_ context.Context, _ string, args ...interface{}) (db.Rows, error) {
+	if len(args) == 1 {
+		pid := args[0].(int)
+		d.signalled = append(d.signalled, pid)
+		return &pidRows{pids: []int{pid}, idx: -1}, nil
+	}
+
+	d.snapshots++
+	return &pidRows{pids: d.pids, idx: -1}, nil
+}
+
+func (d *snapshotDB) Close() {}
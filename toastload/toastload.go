@@ -0,0 +1,234 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package toastload defines implementation of workload which inserts rows with
+// very large values. Such values don't fit into the table's pages and are moved
+// into TOAST storage. This stresses TOAST subsystem and generates lots of WAL.
+//
+// Before starting the workload, a special working table should be created. Its
+// payload column uses EXTERNAL storage, so values are always moved into TOAST
+// and never compressed. When the workload is finished this table should be
+// dropped. For more info see prepare and cleanup methods.
+// When working table is created, the necessary number of workers is started
+// (accordingly to Config.Jobs). Each worker inserts rows in a loop accordingly
+// to rate specified in Config.Rate. Size of each inserted value is defined by
+// Config.ValueSizeKB. Note, the table grows until the workload is finished, make
+// sure there is enough free space in the database storage.
+package toastload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/adaptive"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/ratelimit"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures at the end.
+	defaultCleanupTimeout = 10 * time.Second
+	// maxValueSizeKB defines upper limit of inserted value size, Postgres doesn't allow values bigger than 1GB.
+	maxValueSizeKB = 1024*1024 - 1
+	// chunkSize defines size of chunk (md5 hash in text form) used for building values.
+	chunkSize = 32
+)
+
+// Config defines configuration settings for toastload workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// Jobs defines how many workers should be created for inserting rows.
+	Jobs uint16
+	// Rate defines inserts rate produced per second (per single worker).
+	Rate float64
+	// Scheduler defines optional pacing of each worker (e.g. Poisson arrivals), if nil Rate is constant.
+	Scheduler ratelimit.SchedulerFactory
+	// Adaptive defines optional limiter which throttles rate accordingly to server load.
+	Adaptive *adaptive.Limiter
+	// ValueSizeKB defines size of inserted values, in kilobytes.
+	ValueSizeKB uint32
+	// CleanupTimeout defines max time allowed for cleanup fixtures at the end, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if c.Jobs < 1 {
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than zero")
+	}
+
+	if c.Rate <= 0 {
+		return noisia.NewConfigError("Rate", noisia.ErrInvalidRate, "rate must be positive")
+	}
+
+	if c.ValueSizeKB < 1 || c.ValueSizeKB > maxValueSizeKB {
+		return noisia.NewConfigError("ValueSizeKB", noisia.ErrInvalidRange, "value size must be between 1 and %d KB", maxValueSizeKB)
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidateSearchPath("", c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	return nil
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	pool   db.DB
+	// inserts defines number of inserted rows.
+	inserts int64
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "toastload"
+}
+
+// Stats returns counters of inserted rows and bytes.
+func (w *workload) Stats() noisia.Stats {
+	inserts := atomic.LoadInt64(&w.inserts)
+	return noisia.Stats{
+		"inserts": inserts,
+		"bytes":   inserts * int64(w.config.ValueSizeKB) * 1024,
+	}
+}
+
+// Run method connects to Postgres and starts the workload.
+func (w *workload) Run(ctx context.Context) error {
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout})
+	if err != nil {
+		return err
+	}
+	w.pool = pool
+	defer w.pool.Close()
+
+	// Prepare working table for workload.
+	err = w.prepare(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Cleanup in the end.
+	defer func() {
+		err = w.cleanup()
+		if err != nil {
+			w.logger.Warnf("toastload cleanup failed: %s", err)
+		}
+	}()
+
+	var wg sync.WaitGroup
+
+	wg.Add(int(w.config.Jobs))
+	for i := 0; i < int(w.config.Jobs); i++ {
+		go func(i int) {
+			err := startLoop(ctx, w.logger, w.pool, w.config, i, &w.inserts)
+			if err != nil {
+				w.logger.Warnf("toastload worker failed: %s", err)
+			}
+			wg.Done()
+		}(i)
+	}
+
+	wg.Wait()
+
+	w.logger.Infof("inserted %d rows with %d KB values", atomic.LoadInt64(&w.inserts), w.config.ValueSizeKB)
+
+	return nil
+}
+
+// prepare method creates working table with large payload column.
+func (w *workload) prepare(ctx context.Context) error {
+	tx, err := w.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, _, err = tx.Exec(ctx, "CREATE TABLE IF NOT EXISTS _noisia_toastload_workload (id bigserial PRIMARY KEY, payload text)")
+	if err != nil {
+		return err
+	}
+
+	// Disable compression, values always moved into TOAST as-is.
+	_, _, err = tx.Exec(ctx, "ALTER TABLE _noisia_toastload_workload ALTER COLUMN payload SET STORAGE EXTERNAL")
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit(ctx)
+}
+
+// cleanup method drops working table after workload has been done.
+func (w *workload) cleanup() error {
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_toastload_workload")
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// startLoop inserts rows with large values in a loop with required rate until context timeout exceeded.
+// Rate is throttled by adaptive limiter, if specified, inserts are paced by scheduler of the worker
+// with passed index. Number of inserted rows is added to passed counter.
+func startLoop(ctx context.Context, log log.Logger, pool db.DB, config Config, worker int, inserts *int64) error {
+	// Value is built on the server side to avoid sending it over network.
+	chunks := int(config.ValueSizeKB) * 1024 / chunkSize
+
+	var loopErr error
+	ratelimit.RunWorkerRate(ctx, ratelimit.NewRate(config.Rate), config.Adaptive, config.Scheduler, worker, func(ctx context.Context) error {
+		_, _, err := pool.Exec(ctx, "INSERT INTO _noisia_toastload_workload (payload) SELECT repeat(md5(random()::text), $1)", chunks)
+		if err != nil {
+			if ctx.Err() == nil {
+				loopErr = err
+			}
+			return ratelimit.ErrStop
+		}
+
+		atomic.AddInt64(inserts, 1)
+		events.Emit(ctx, "toastload", "inserted %d KB value", config.ValueSizeKB)
+		return nil
+	}, log)
+
+	return loopErr
+}
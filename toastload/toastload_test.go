@@ -0,0 +1,90 @@
+package toastload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: 1024}},
+		{valid: true, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: maxValueSizeKB}},
+		{valid: false, config: Config{Jobs: 0, Rate: 1, ValueSizeKB: 1024}},
+		{valid: false, config: Config{Jobs: 1, Rate: 0, ValueSizeKB: 1024}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: 0}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: maxValueSizeKB + 1}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: 1024, SearchPath: "app,,public"}},
+		{valid: false, config: Config{Jobs: 1, Rate: 1, ValueSizeKB: 1024, PoolAcquireTimeout: -1}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	config := Config{Conninfo: db.TestConninfo, Jobs: 2, Rate: 5, ValueSizeKB: 256}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+}
+
+func Test_startLoop(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	w := &workload{config: Config{Jobs: 1, Rate: 10, ValueSizeKB: 64, CleanupTimeout: time.Second}, logger: log.NewDefaultLogger("error"), pool: pool}
+	assert.NoError(t, w.prepare(context.Background()))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
+	defer cancel()
+
+	var n int64
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), pool, Config{Rate: 10, ValueSizeKB: 64}, 0, &n))
+	assert.Greater(t, n, int64(0))
+
+	// Rows must be inserted with values of requested size.
+	var count, size int64
+	rows, err := pool.Query(context.Background(), "SELECT count(*), min(octet_length(payload)) FROM _noisia_toastload_workload")
+	assert.NoError(t, err)
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&count, &size))
+	}
+	rows.Close()
+	assert.Equal(t, n, count)
+	assert.Equal(t, int64(64*1024), size)
+
+	// Working table must be dropped after cleanup.
+	assert.NoError(t, w.cleanup())
+
+	var exists bool
+	rows, err = pool.Query(context.Background(), "SELECT to_regclass('_noisia_toastload_workload') IS NOT NULL")
+	assert.NoError(t, err)
+	for rows.Next() {
+		assert.NoError(t, rows.Scan(&exists))
+	}
+	rows.Close()
+	assert.False(t, exists)
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, Rate: 1, ValueSizeKB: 1}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "toastload", w.Name())
+}
@@ -17,20 +17,40 @@
 // when no tables found. In this mode, special working table is created, which is
 // used for locks. Worker use two goroutines, first used for locking the table, the
 // second used for issuing query to locked table.
+//
+// Before releasing the lock, sessions waiting for the lock are looked up in pg_locks
+// and pg_stat_activity. Number of waiting sessions and their wait times are logged
+// per each lock and reported in workload's stats.
 package waitxacts
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/lesovsky/noisia"
 	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
 	"github.com/lesovsky/noisia/targeting"
 	"math/rand"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+const (
+	// fixtureTable defines name of the working table created by the workload.
+	fixtureTable = "_noisia_waitxacts_workload"
+	// defaultCleanupTimeout defines default max time allowed for cleanup fixtures.
+	defaultCleanupTimeout = 10 * time.Second
+	// fixtureQueryMargin defines extra time allowed for fixture query after the lock is released.
+	fixtureQueryMargin = 1 * time.Second
+)
+
+// ErrNoTargets is returned when no tables for locking have been found and fallback to fixture mode is disabled.
+var ErrNoTargets = errors.New("no tables found for locking and fixture fallback is disabled")
+
 // Config defines configuration settings for waiting transactions workload
 type Config struct {
 	// Conninfo defines connection string used for connecting to Postgres.
@@ -43,20 +63,66 @@ type Config struct {
 	LocktimeMin time.Duration
 	// LocktimeMax defines an upper threshold of locking interval for blocking transactions.
 	LocktimeMax time.Duration
+	// CleanupTimeout defines max time allowed for cleanup fixtures, if zero the default timeout is used.
+	CleanupTimeout time.Duration
+	// PoolerMode defines pooling mode of connection pooler used between noisia and Postgres: session or transaction.
+	PoolerMode string
+	// Role defines role which is set after connecting, connecting user must be a member of the role. Role of connecting user is used if empty.
+	Role string
+	// SearchPath defines comma-separated list of schemas set as search_path after connecting. Default search_path is used if empty.
+	SearchPath string
+	// PoolAcquireTimeout defines max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped.
+	PoolAcquireTimeout time.Duration
+	// Isolation defines isolation level of transactions: read-committed, repeatable-read, serializable. Default isolation level is used if empty.
+	Isolation string
+	// NoFixtureFallback defines to fail instead of switching to fixture mode when no tables for locking have been found.
+	NoFixtureFallback bool
+	// MinConns defines number of connections established in pool before the workload is started, zero means no warmup.
+	MinConns uint16
+	// Seed defines seed of random choices of tables and lock durations, current time is used if zero.
+	Seed int64
 }
 
 // validate method checks workload configuration settings.
 func (c Config) validate() error {
 	if c.Jobs < 1 {
-		return fmt.Errorf("jobs must be greater than 0")
+		return noisia.NewConfigError("Jobs", noisia.ErrInvalidJobs, "jobs must be greater than 0")
 	}
 
 	if c.LocktimeMin == 0 || c.LocktimeMax == 0 {
-		return fmt.Errorf("min and max lock time must be greater than zero")
+		return noisia.NewConfigError("LocktimeMin", noisia.ErrInvalidRange, "min and max lock time must be greater than zero")
 	}
 
 	if c.LocktimeMin > c.LocktimeMax {
-		return fmt.Errorf("min lock time must be less or equal to max lock time")
+		return noisia.NewConfigError("LocktimeMin", noisia.ErrInvalidRange, "min lock time must be less or equal to max lock time")
+	}
+
+	if c.CleanupTimeout < 0 {
+		return noisia.NewConfigError("CleanupTimeout", noisia.ErrInvalidDuration, "cleanup timeout must not be negative")
+	}
+
+	err := db.ValidatePoolerMode(c.PoolerMode)
+	if err != nil {
+		return noisia.NewConfigError("PoolerMode", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateRole(c.PoolerMode, c.Role)
+	if err != nil {
+		return noisia.NewConfigError("Role", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	err = db.ValidateSearchPath(c.PoolerMode, c.SearchPath)
+	if err != nil {
+		return noisia.NewConfigError("SearchPath", noisia.ErrInvalidValue, "%s", err)
+	}
+
+	if c.PoolAcquireTimeout < 0 {
+		return noisia.NewConfigError("PoolAcquireTimeout", noisia.ErrInvalidDuration, "pool acquire timeout must not be negative")
+	}
+
+	err = db.ValidateIsolationLevel(c.Isolation)
+	if err != nil {
+		return noisia.NewConfigError("Isolation", noisia.ErrInvalidValue, "%s", err)
 	}
 
 	return nil
@@ -67,6 +133,27 @@ type workload struct {
 	config Config
 	logger log.Logger
 	pool   db.DB
+	stats  stats
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// locks defines number of tables locks taken.
+	locks int64
+	// waiters defines number of sessions waited for the taken locks.
+	waiters int64
+	// waitTime defines total time sessions waited for the taken locks, in milliseconds.
+	waitTime int64
+}
+
+// waiters defines sessions waited for the lock of the table, observed right before the lock is released.
+type waiters struct {
+	// count defines number of waiting sessions.
+	count int64
+	// total defines total wait time of all waiting sessions.
+	total time.Duration
+	// max defines the longest wait time among waiting sessions.
+	max time.Duration
 }
 
 // NewWorkload creates a new workload with specified config.
@@ -76,7 +163,25 @@ func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
 		return nil, err
 	}
 
-	return &workload{config, logger, nil}, nil
+	if config.CleanupTimeout == 0 {
+		config.CleanupTimeout = defaultCleanupTimeout
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "waitxacts"
+}
+
+// Stats returns counters of taken tables locks and sessions waited for the locks.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"locks":        atomic.LoadInt64(&w.stats.locks),
+		"waiters":      atomic.LoadInt64(&w.stats.waiters),
+		"wait_time_ms": atomic.LoadInt64(&w.stats.waitTime),
+	}
 }
 
 // Run connects to Postgres and starts the workload.
@@ -84,7 +189,7 @@ func (w *workload) Run(ctx context.Context) error {
 	// maxAffectedTables defines max number of tables which will be affected by blocking transactions.
 	maxAffectedTables := 3
 
-	pool, err := db.NewPostgresDB(ctx, w.config.Conninfo)
+	pool, err := db.NewPostgresDBWithOptions(ctx, w.config.Conninfo, db.ConnOptions{PoolerMode: w.config.PoolerMode, Workload: w.Name(), Role: w.config.Role, SearchPath: w.config.SearchPath, AcquireTimeout: w.config.PoolAcquireTimeout, MinConns: int32(w.config.MinConns)})
 	if err != nil {
 		return err
 	}
@@ -92,15 +197,19 @@ func (w *workload) Run(ctx context.Context) error {
 	defer w.pool.Close()
 
 	// Calculate the number of tables which will be used in workload.
-	tables, err := targeting.TopWriteTables(pool, maxAffectedTables)
+	targets, err := targeting.TopWriteTables(ctx, pool, maxAffectedTables)
 	if err != nil {
 		return err
 	}
 
+	tables := targeting.QuotedNames(targets)
+
 	// Enable fixture mode, if no tables found.
-	if len(tables) == 0 {
-		w.config.Fixture = true
+	fixture, err := useFixture(tables, w.config)
+	if err != nil {
+		return err
 	}
+	w.config.Fixture = fixture
 
 	// Prepare stuff for fixture mode if enabled.
 	if w.config.Fixture {
@@ -110,7 +219,7 @@ func (w *workload) Run(ctx context.Context) error {
 			return err
 		}
 
-		tables = []string{"_noisia_waitxacts_workload"}
+		tables = []string{fixtureTable}
 
 		// Cleanup in the end.
 		defer func() {
@@ -121,7 +230,7 @@ func (w *workload) Run(ctx context.Context) error {
 		}()
 	}
 
-	return startLoop(ctx, w.logger, pool, tables, w.config)
+	return startLoop(ctx, w.logger, pool, tables, w.config, &w.stats)
 }
 
 // prepare method creates fixture table for workload.
@@ -142,23 +251,70 @@ func (w *workload) prepare(ctx context.Context) error {
 		return err
 	}
 
-	return tx.Commit(ctx)
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Make sure the table is really there, otherwise all fixture queries would fail.
+	exists, err := db.TableExists(ctx, w.pool, fixtureTable)
+	if err != nil {
+		return fmt.Errorf("check working table failed: %s", err)
+	}
+	if !exists {
+		return fmt.Errorf("working table %s does not exist after prepare", fixtureTable)
+	}
+
+	return nil
 }
 
 // cleanup perform fixtures cleanup after workload has been done.
 func (w *workload) cleanup() error {
-	_, _, err := w.pool.Exec(context.Background(), "DROP TABLE IF EXISTS _noisia_waitxacts_workload")
+	ctx, cancel := context.WithTimeout(context.Background(), w.config.CleanupTimeout)
+	defer cancel()
+
+	_, _, err := w.pool.Exec(ctx, "DROP TABLE IF EXISTS _noisia_waitxacts_workload")
 	if err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("timed out after %s: %s", w.config.CleanupTimeout, err)
+		}
 		return err
 	}
 
+	// Make sure the table has been dropped and not left behind.
+	exists, err := db.TableExists(ctx, w.pool, fixtureTable)
+	if err != nil {
+		return fmt.Errorf("check working table failed: %s", err)
+	}
+	if exists {
+		return fmt.Errorf("working table %s still exists after cleanup", fixtureTable)
+	}
+
 	return nil
 }
 
-// startLoop start workload loop until context timeout exceeded.
-func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string, config Config) error {
-	// Initialize random, used for calculating lock duration.
-	rand.Seed(time.Now().UnixNano())
+// useFixture returns true if workload should run in fixture mode. Fixture mode is used when it is
+// enabled explicitly or when no tables found. The latter is considered as an error if fallback is disabled.
+func useFixture(tables []string, config Config) (bool, error) {
+	if config.Fixture {
+		return true, nil
+	}
+
+	if len(tables) == 0 {
+		if config.NoFixtureFallback {
+			return false, ErrNoTargets
+		}
+		return true, nil
+	}
+
+	return false, nil
+}
+
+// startLoop start workload loop until context timeout exceeded. Number of taken locks and
+// sessions waited for the locks are added to passed stats.
+func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string, config Config, st *stats) error {
+	// Initialize random, used for choosing tables and calculating lock duration.
+	rnd := random.New(config.Seed, 0)
 
 	// Increment maxTime up to 1 second due to rand.Int63n() never return max value.
 	minTime, maxTime := config.LocktimeMin, config.LocktimeMax+1
@@ -166,35 +322,53 @@ func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string,
 	// guardCh defines worker queue - run new workers only there is any free slot
 	guardCh := make(chan struct{}, config.Jobs)
 
-	// lockedCh defines notification channel which tells when table is locked
-	lockedCh := make(chan struct{})
+	// wg tracks running goroutines.
+	var wg sync.WaitGroup
 
 	for {
 		select {
 		// run workers only when it's possible to write into channel (channel is limited by number of jobs)
 		case guardCh <- struct{}{}:
-			var wg sync.WaitGroup
-			table := selectRandomTable(tables)
-			naptime := time.Duration(rand.Int63n(maxTime.Nanoseconds()-minTime.Nanoseconds()) + minTime.Nanoseconds())
+			table := selectRandomTable(rnd, tables)
+			naptime := time.Duration(rnd.Int63n(maxTime.Nanoseconds()-minTime.Nanoseconds()) + minTime.Nanoseconds())
+
+			// lockedCh defines per-iteration notification channel which tells whether table is locked.
+			// Using dedicated channel guarantees the signal is not attributed to other iteration.
+			lockedCh := make(chan bool)
 
 			// Start goroutine which locks target for calculated nap time.
 			wg.Add(1)
 			go func() {
-				err := lockTable(ctx, pool, table, naptime, lockedCh)
+				wt, err := lockTable(ctx, pool, table, naptime, config.Isolation, lockedCh)
 				if err != nil && ctx.Err() == nil {
 					log.Warnf("lock table failed: %s", err)
 				}
+
+				// Waiters are not observed if context has been done before the lock is released.
+				if wt != nil {
+					atomic.AddInt64(&st.waiters, wt.count)
+					atomic.AddInt64(&st.waitTime, wt.total.Milliseconds())
+
+					if wt.count > 0 {
+						log.Infof("table %s locked for %s, %d sessions waited, max wait %s", table, naptime, wt.count, wt.max)
+					} else {
+						log.Infof("table %s locked for %s, no sessions waited", table, naptime)
+					}
+				}
 				wg.Done()
 			}()
 
 			// Waiting for signal when table is locked (needed only in fixtures mode).
-			<-lockedCh
+			locked := <-lockedCh
+			if locked {
+				atomic.AddInt64(&st.locks, 1)
+			}
 
-			// If fixture mode is enabled, issue our own query which becomes blocked.
-			if config.Fixture {
+			// If fixture mode is enabled and table is locked, issue our own query which becomes blocked.
+			if config.Fixture && locked {
 				wg.Add(1)
 				go func() {
-					_, _, err := pool.Exec(ctx, fmt.Sprintf("SELECT * FROM %s", table))
+					err := execFixtureQuery(ctx, pool, table, naptime+fixtureQueryMargin)
 					if err != nil && ctx.Err() == nil {
 						log.Warnf("query failed: %s", err)
 					}
@@ -206,49 +380,108 @@ func startLoop(ctx context.Context, log log.Logger, pool db.DB, tables []string,
 			wg.Wait()
 			<-guardCh
 		case <-ctx.Done():
+			wg.Wait()
 			close(guardCh)
-			close(lockedCh)
 			return nil
 		}
 	}
 }
 
 // lockTable tries to lock specified table for 'idle' amount of time. In case of errors
-// send notify to lockedCh to avoid stuck of reading goroutine.
-func lockTable(ctx context.Context, pool db.DB, table string, idle time.Duration, lockedCh chan struct{}) error {
+// send negative notify to lockedCh to avoid stuck of reading goroutine. Transaction is started
+// with passed isolation level, or with default one if level is empty. Returns sessions which
+// waited for the lock right before it is released, nil is returned if context has been done.
+func lockTable(ctx context.Context, pool db.DB, table string, idle time.Duration, isolation string, lockedCh chan<- bool) (*waiters, error) {
 	tx, err := pool.Begin(ctx)
 	if err != nil {
-		lockedCh <- struct{}{}
-		return fmt.Errorf("begin: %v", err)
+		lockedCh <- false
+		return nil, fmt.Errorf("begin: %v", err)
 	}
 	defer func() { _ = tx.Rollback(ctx) }()
 
+	err = db.SetIsolationLevel(ctx, tx, isolation)
+	if err != nil {
+		lockedCh <- false
+		return nil, fmt.Errorf("set isolation: %v", err)
+	}
+
 	q := fmt.Sprintf("LOCK TABLE %s IN ACCESS EXCLUSIVE MODE", table)
 	_, _, err = tx.Exec(ctx, q)
 	if err != nil {
-		lockedCh <- struct{}{}
-		return fmt.Errorf("lock: %v", err)
+		lockedCh <- false
+		return nil, fmt.Errorf("lock: %v", err)
 	}
 
 	// Table is locked, send a signal to query channel to allow make a query to locked table.
-	lockedCh <- struct{}{}
+	lockedCh <- true
+	events.Emit(ctx, "waitxacts", "locked table %s for %s", table, idle)
 
 	// Stop execution only if context has been done or idle interval is timed out
 	timer := time.NewTimer(idle)
 	select {
 	case <-ctx.Done():
-		return nil
+		return nil, nil
 	case <-timer.C:
-		return nil
 	}
+
+	wt, err := countWaiters(ctx, tx, table)
+	if err != nil {
+		return nil, fmt.Errorf("count waiters: %v", err)
+	}
+
+	return &wt, nil
+}
+
+// countWaiters returns sessions which are waiting for a lock of passed table.
+func countWaiters(ctx context.Context, q db.Querier, table string) (waiters, error) {
+	rows, err := q.Query(ctx,
+		"SELECT count(*), coalesce(sum(w), 0)::bigint, coalesce(max(w), 0)::bigint FROM ("+
+			"SELECT extract(epoch FROM clock_timestamp() - a.query_start) * 1000000 AS w "+
+			"FROM pg_locks l JOIN pg_stat_activity a ON a.pid = l.pid "+
+			"WHERE l.locktype = 'relation' AND l.relation = to_regclass($1) AND NOT l.granted) s",
+		table,
+	)
+	if err != nil {
+		return waiters{}, err
+	}
+	defer rows.Close()
+
+	var (
+		wt         waiters
+		total, max int64
+	)
+	for rows.Next() {
+		err = rows.Scan(&wt.count, &total, &max)
+		if err != nil {
+			return waiters{}, err
+		}
+	}
+
+	wt.total = time.Duration(total) * time.Microsecond
+	wt.max = time.Duration(max) * time.Microsecond
+
+	return wt, rows.Err()
+}
+
+// execFixtureQuery issues query to the locked table. The query could not outlive
+// specified timeout, even if the lock is held longer than expected.
+func execFixtureQuery(ctx context.Context, pool db.DB, table string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	_, _, err := pool.Exec(ctx, fmt.Sprintf("SELECT * FROM %s", table))
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
 // selectRandomTable returns random table from passed list. Empty value returned if empty list.
-func selectRandomTable(tables []string) string {
+func selectRandomTable(rnd *rand.Rand, tables []string) string {
 	if len(tables) == 0 {
 		return ""
 	}
 
-	rand.Seed(time.Now().UnixNano())
-	return tables[rand.Intn(len(tables))]
+	return tables[rnd.Intn(len(tables))]
 }
@@ -2,8 +2,11 @@ package waitxacts
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"github.com/lesovsky/noisia/db"
 	"github.com/lesovsky/noisia/log"
+	"github.com/lesovsky/noisia/random"
 	"github.com/stretchr/testify/assert"
 	"testing"
 	"time"
@@ -20,6 +23,9 @@ func TestConfig_validate(t *testing.T) {
 		{valid: false, config: Config{Jobs: 1, LocktimeMin: 5 * time.Second, LocktimeMax: 0}},
 		{valid: false, config: Config{Jobs: 1, LocktimeMin: 0, LocktimeMax: 5 * time.Second}},
 		{valid: false, config: Config{Jobs: 1, LocktimeMin: 0, LocktimeMax: 0}},
+		{valid: false, config: Config{Jobs: 1, LocktimeMin: 5 * time.Second, LocktimeMax: 10 * time.Second, CleanupTimeout: -1}},
+		{valid: true, config: Config{Jobs: 1, LocktimeMin: 5 * time.Second, LocktimeMax: 10 * time.Second, Isolation: db.IsolationRepeatableRead}},
+		{valid: false, config: Config{Jobs: 1, LocktimeMin: 5 * time.Second, LocktimeMax: 10 * time.Second, Isolation: "invalid"}},
 	}
 
 	for _, tc := range testcases {
@@ -49,6 +55,27 @@ func TestWorkload_Run(t *testing.T) {
 	assert.Nil(t, err)
 }
 
+func Test_useFixture(t *testing.T) {
+	testcases := []struct {
+		tables  []string
+		config  Config
+		want    bool
+		wantErr error
+	}{
+		{tables: []string{"t1"}, config: Config{}, want: false},
+		{tables: []string{"t1"}, config: Config{Fixture: true}, want: true},
+		{tables: nil, config: Config{}, want: true},
+		{tables: nil, config: Config{Fixture: true, NoFixtureFallback: true}, want: true},
+		{tables: nil, config: Config{NoFixtureFallback: true}, want: false, wantErr: ErrNoTargets},
+	}
+
+	for _, tc := range testcases {
+		got, err := useFixture(tc.tables, tc.config)
+		assert.Equal(t, tc.want, got)
+		assert.True(t, errors.Is(err, tc.wantErr))
+	}
+}
+
 func Test_startLoop(t *testing.T) {
 	pool, err := db.NewTestDB()
 	assert.NoError(t, err)
@@ -60,8 +87,12 @@ func Test_startLoop(t *testing.T) {
 	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 	defer cancel()
 
-	cfg := Config{Jobs: 1, Fixture: true, LocktimeMin: 10 * time.Millisecond, LocktimeMax: 100 * time.Millisecond}
-	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("info"), pool, []string{"noisia_test_1"}, cfg))
+	// Fixture query waits for each lock, so waiters are counted.
+	cfg := Config{Jobs: 1, Fixture: true, LocktimeMin: 200 * time.Millisecond, LocktimeMax: 300 * time.Millisecond}
+	st := &stats{}
+	assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("info"), pool, []string{"noisia_test_1"}, cfg, st))
+	assert.Greater(t, st.locks, int64(0))
+	assert.Greater(t, st.waiters, int64(0))
 
 	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_1")
 	assert.NoError(t, err)
@@ -74,16 +105,107 @@ func Test_lockTable(t *testing.T) {
 	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_2 (a int)")
 	assert.NoError(t, err)
 
-	queryCh := make(chan struct{})
+	queryCh := make(chan bool)
 	go func() {
-		assert.NoError(t, lockTable(context.Background(), pool, "noisia_test_2", 10*time.Millisecond, queryCh))
+		_, err := lockTable(context.Background(), pool, "noisia_test_2", 10*time.Millisecond, "", queryCh)
+		assert.NoError(t, err)
 	}()
 
-	<-queryCh
+	assert.True(t, <-queryCh)
 	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_2")
 	assert.NoError(t, err)
 }
 
+func Test_lockTable_iterations(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_4 (a int)")
+	assert.NoError(t, err)
+
+	q := "SELECT count(*) FROM pg_locks WHERE relation = 'noisia_test_4'::regclass AND mode = 'AccessExclusiveLock' AND granted"
+
+	// Each iteration receives signal only from its own lock.
+	for i := 0; i < 20; i++ {
+		lockedCh := make(chan bool)
+		go func() {
+			_, err := lockTable(context.Background(), pool, "noisia_test_4", 20*time.Millisecond, db.IsolationSerializable, lockedCh)
+			assert.NoError(t, err)
+		}()
+
+		assert.True(t, <-lockedCh)
+
+		rows, err := pool.Query(context.Background(), q)
+		assert.NoError(t, err)
+
+		var n int
+		for rows.Next() {
+			assert.NoError(t, rows.Scan(&n))
+		}
+		rows.Close()
+		assert.Equal(t, 1, n)
+	}
+
+	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_4")
+	assert.NoError(t, err)
+}
+
+func Test_lockTable_waiters(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_6 (a int)")
+	assert.NoError(t, err)
+
+	locktime := 500 * time.Millisecond
+
+	// Issue fixture query to the locked table, it waits until the lock is released.
+	lockedCh := make(chan bool)
+	go func() {
+		if <-lockedCh {
+			_ = execFixtureQuery(context.Background(), pool, "noisia_test_6", locktime+fixtureQueryMargin)
+		}
+	}()
+
+	wt, err := lockTable(context.Background(), pool, "noisia_test_6", locktime, "", lockedCh)
+	assert.NoError(t, err)
+	assert.NotNil(t, wt)
+	assert.Equal(t, int64(1), wt.count)
+	assert.Greater(t, int64(wt.max), int64(0))
+	assert.Equal(t, wt.max, wt.total)
+
+	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_6")
+	assert.NoError(t, err)
+}
+
+func Test_execFixtureQuery(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_5 (a int)")
+	assert.NoError(t, err)
+
+	locktime := 100 * time.Millisecond
+
+	// Hold the lock longer than expected.
+	lockedCh := make(chan bool)
+	go func() {
+		_, err := lockTable(context.Background(), pool, "noisia_test_5", locktime+fixtureQueryMargin+time.Second, "", lockedCh)
+		assert.NoError(t, err)
+	}()
+	assert.True(t, <-lockedCh)
+
+	start := time.Now()
+	assert.Error(t, execFixtureQuery(context.Background(), pool, "noisia_test_5", locktime+fixtureQueryMargin))
+	assert.Less(t, int64(time.Since(start)), int64(locktime+fixtureQueryMargin+100*time.Millisecond))
+
+	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_5")
+	assert.NoError(t, err)
+}
+
 func Test_selectRandomTable(t *testing.T) {
 	testcases := []struct {
 		tables []string
@@ -94,6 +216,120 @@ func Test_selectRandomTable(t *testing.T) {
 	}
 
 	for _, tc := range testcases {
-		assert.Equal(t, tc.want, len(selectRandomTable(tc.tables)))
+		assert.Equal(t, tc.want, len(selectRandomTable(random.New(0, 0), tc.tables)))
+	}
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{Jobs: 1, LocktimeMin: 5 * time.Second, LocktimeMax: 10 * time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "waitxacts", w.Name())
+}
+
+func Test_startLoop_cancel(t *testing.T) {
+	pool, err := db.NewTestDB()
+	assert.NoError(t, err)
+	defer pool.Close()
+
+	_, _, err = pool.Exec(context.Background(), "CREATE TABLE noisia_test_3 (a int)")
+	assert.NoError(t, err)
+
+	cfg := Config{Jobs: 2, Fixture: true, LocktimeMin: 10 * time.Millisecond, LocktimeMax: 50 * time.Millisecond}
+
+	// Cancel context repeatedly while workers are in the middle of locking.
+	for i := 0; i < 20; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Duration(i+1)*5*time.Millisecond)
+		assert.NotPanics(t, func() {
+			assert.NoError(t, startLoop(ctx, log.NewDefaultLogger("error"), pool, []string{"noisia_test_3"}, cfg, &stats{}))
+		})
+		cancel()
+	}
+
+	_, _, err = pool.Exec(context.Background(), "DROP TABLE noisia_test_3")
+	assert.NoError(t, err)
+}
+
+func TestWorkload_cleanup(t *testing.T) {
+	w := &workload{config: Config{CleanupTimeout: 100 * time.Millisecond}, logger: log.NewDefaultLogger("error"), pool: &db.SlowDB{}}
+
+	start := time.Now()
+	assert.Error(t, w.cleanup())
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestWorkload_prepare_postcondition(t *testing.T) {
+	// Table is not created, e.g. it has been dropped concurrently.
+	w := &workload{config: Config{CleanupTimeout: time.Second}, logger: log.NewDefaultLogger("error"), pool: &tableDB{exists: false}}
+	assert.EqualError(t, w.prepare(context.Background()), "working table _noisia_waitxacts_workload does not exist after prepare")
+
+	w.pool = &tableDB{exists: true}
+	assert.NoError(t, w.prepare(context.Background()))
+}
+
+func TestWorkload_cleanup_postcondition(t *testing.T) {
+	// Table is not dropped, e.g. DROP has been silently ignored.
+	w := &workload{config: Config{CleanupTimeout: time.Second}, logger: log.NewDefaultLogger("error"), pool: &tableDB{exists: true}}
+	assert.EqualError(t, w.cleanup(), "working table _noisia_waitxacts_workload still exists after cleanup")
+
+	w.pool = &tableDB{exists: false}
+	assert.NoError(t, w.cleanup())
+
+	w.pool = &tableDB{err: fmt.Errorf("connection reset")}
+	assert.Error(t, w.cleanup())
+}
+
+// tableDB implements db.DB interface, all statements succeed but don't affect the working
+// table, existence of the table is reported accordingly to exists.
+type tableDB struct {
+	exists bool
+	err    error
+}
+
+func (d *tableDB) Begin(context.Context) (db.Tx, error) {
+	return tableTx{}, nil
+}
+
+func (d *tableDB) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+
+func (d *tableDB) Query(context.Context, string, ...interface{}) (db.Rows, error) {
+	if d.err != nil {
+		return nil, d.err
 	}
+	return &boolRows{v: d.exists}, nil
 }
+
+func (d *tableDB) Close() {}
+
+// tableTx implements db.Tx interface, all statements succeed.
+type tableTx struct{}
+
+func (tableTx) Commit(context.Context) error   { return nil }
+func (tableTx) Rollback(context.Context) error { return nil }
+func (tableTx) Exec(context.Context, string, ...interface{}) (int64, string, error) {
+	return 0, "", nil
+}
+func (tableTx) Query(context.Context, string, ...interface{}) (db.Rows, error) { return nil, nil }
+
+// boolRows implements db.Rows interface and returns single boolean value.
+type boolRows struct {
+	v    bool
+	done bool
+}
+
+func (r *boolRows) Next() bool {
+	if r.done {
+		return false
+	}
+	r.done = true
+	return true
+}
+
+func (r *boolRows) Scan(dest ...interface{}) error {
+	*dest[0].(*bool) = r.v
+	return nil
+}
+
+func (r *boolRows) Err() error { return nil }
+func (r *boolRows) Close()     {}
@@ -0,0 +1,241 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package walsenderload defines implementation of workload which opens physical replication
+// connection and stalls consuming of WAL stream, like a hung or overloaded standby. This
+// reproduces incidents related to wal_sender_timeout, growing replication lag and WAL
+// retained by replication slots.
+//
+// The workload connects to Postgres using replication protocol, creates temporary physical
+// replication slot with name specified in Config.SlotName and starts streaming from current
+// WAL location. Then it stops reading the stream for Config.StallTime, after that it reads
+// pending messages for a short time and reports the start location back, so the slot keeps
+// WAL and lag of the connection grows. If Config.StallTime exceeds wal_sender_timeout,
+// Postgres terminates the walsender and the workload reconnects.
+//
+// Replication connections require REPLICATION attribute of the role and a replication entry
+// in pg_hba.conf, if connection is rejected the workload is skipped gracefully. Slot is
+// temporary, so it is dropped by Postgres when connection is closed even if the workload
+// has been killed.
+package walsenderload
+
+import (
+	"context"
+	"github.com/lesovsky/noisia"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/events"
+	"github.com/lesovsky/noisia/log"
+	"regexp"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// drainTimeout defines time spent on reading pending messages after the stall.
+	drainTimeout = 1 * time.Second
+	// reconnectDelay defines delay before reconnect after stream has been terminated by Postgres.
+	reconnectDelay = 1 * time.Second
+)
+
+// slotNameRe defines characters allowed in replication slots names.
+var slotNameRe = regexp.MustCompile(`^[a-z0-9_]{1,63}$`)
+
+// Config defines configuration settings for walsender workload.
+type Config struct {
+	// Conninfo defines connection string used for connecting to Postgres.
+	Conninfo string
+	// SlotName defines name of temporary physical replication slot used by the workload.
+	SlotName string
+	// StallTime defines time when replication stream is not consumed.
+	StallTime time.Duration
+}
+
+// validate method checks workload configuration settings.
+func (c Config) validate() error {
+	if !slotNameRe.MatchString(c.SlotName) {
+		return noisia.NewConfigError("SlotName", noisia.ErrInvalidValue, "slot name must contain only lower case letters, numbers and underscores, up to 63 characters")
+	}
+
+	if c.StallTime <= 0 {
+		return noisia.NewConfigError("StallTime", noisia.ErrInvalidDuration, "stall time must be greater than zero")
+	}
+
+	return nil
+}
+
+// stats defines counters of the workload.
+type stats struct {
+	// stalls defines number of stalls of replication stream.
+	stalls int64
+	// disconnects defines number of replication streams terminated by Postgres.
+	disconnects int64
+	// lag defines last observed distance between WAL end on the server and reported location, in bytes.
+	lag int64
+}
+
+// workload implements noisia.Workload interface.
+type workload struct {
+	config Config
+	logger log.Logger
+	stats  stats
+}
+
+// NewWorkload creates a new workload with specified config.
+func NewWorkload(config Config, logger log.Logger) (noisia.Workload, error) {
+	err := config.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	return &workload{config: config, logger: logger}, nil
+}
+
+// Name returns name of the workload.
+func (w *workload) Name() string {
+	return "walsenderload"
+}
+
+// Stats returns counters of stalls, terminated streams and replication lag.
+func (w *workload) Stats() noisia.Stats {
+	return noisia.Stats{
+		"stalls":      atomic.LoadInt64(&w.stats.stalls),
+		"disconnects": atomic.LoadInt64(&w.stats.disconnects),
+		"lag_bytes":   atomic.LoadInt64(&w.stats.lag),
+	}
+}
+
+// Run method connects to Postgres and starts the workload. Streams terminated by Postgres
+// are reopened until context is done.
+func (w *workload) Run(ctx context.Context) error {
+	for {
+		started, err := w.stream(ctx)
+		if ctx.Err() != nil {
+			break
+		}
+
+		if noReplicationAccess(err) {
+			w.logger.Warnf("walsenderload: replication connection is not allowed: %s, skip", err)
+			return nil
+		}
+
+		// Errors before streaming has been started are not expected to go away.
+		if !started {
+			return err
+		}
+
+		atomic.AddInt64(&w.stats.disconnects, 1)
+		events.Emit(ctx, "walsenderload", "replication stream terminated: %s", err)
+		w.logger.Warnf("walsenderload: replication stream terminated: %s, reconnect", err)
+
+		select {
+		case <-ctx.Done():
+		case <-time.After(reconnectDelay):
+		}
+	}
+
+	w.logger.Infof("walsenderload finished: %d stalls, %d streams terminated", atomic.LoadInt64(&w.stats.stalls), atomic.LoadInt64(&w.stats.disconnects))
+
+	return nil
+}
+
+// stream opens replication connection, starts streaming and stalls it until the stream is
+// terminated or context is done. Returns whether streaming has been started.
+func (w *workload) stream(ctx context.Context) (bool, error) {
+	conn, err := db.ConnectReplication(ctx, w.config.Conninfo, db.ConnOptions{Workload: w.Name()})
+	if err != nil {
+		return false, err
+	}
+	defer func() { _ = conn.Close() }()
+
+	lsn, err := conn.IdentifySystem(ctx)
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.CreateTemporarySlot(ctx, w.config.SlotName)
+	if err != nil {
+		return false, err
+	}
+
+	err = conn.StartReplication(ctx, w.config.SlotName, lsn)
+	if err != nil {
+		return false, err
+	}
+
+	w.logger.Infof("walsenderload: streaming started from %s using slot %s", db.FormatLSN(lsn), w.config.SlotName)
+
+	return true, stallLoop(ctx, conn, w.config.StallTime, lsn, &w.stats)
+}
+
+// streamer defines replication stream which is consumed by the workload.
+type streamer interface {
+	Receive(ctx context.Context) (uint64, error)
+	SendStatus(ctx context.Context, lsn uint64) error
+}
+
+// stallLoop stalls consuming of the stream for stall time, then drains pending messages and
+// reports passed location as consumed. Loop is repeated until context is done or stream fails.
+func stallLoop(ctx context.Context, s streamer, stall time.Duration, lsn uint64, st *stats) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(stall):
+		}
+
+		atomic.AddInt64(&st.stalls, 1)
+
+		walEnd, err := drain(ctx, s)
+		if err != nil {
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return nil
+		}
+
+		if walEnd > lsn {
+			atomic.StoreInt64(&st.lag, int64(walEnd-lsn))
+		}
+		events.Emit(ctx, "walsenderload", "replication stream stalled for %s, lag %d bytes", stall, atomic.LoadInt64(&st.lag))
+
+		err = s.SendStatus(ctx, lsn)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// drain reads messages of the stream during drain timeout and returns the highest observed
+// WAL end on the server.
+func drain(ctx context.Context, s streamer) (uint64, error) {
+	dctx, cancel := context.WithTimeout(ctx, drainTimeout)
+	defer cancel()
+
+	var walEnd uint64
+	for {
+		end, err := s.Receive(dctx)
+		if err != nil {
+			// Timeout of reading is expected, the stream is still alive.
+			if dctx.Err() != nil {
+				return walEnd, nil
+			}
+			return walEnd, err
+		}
+
+		if end > walEnd {
+			walEnd = end
+		}
+	}
+}
+
+// noReplicationAccess returns true if error means the role or pg_hba.conf doesn't allow replication connections.
+func noReplicationAccess(err error) bool {
+	switch db.ErrorCode(err) {
+	case "42501", "28000":
+		return true
+	default:
+		return false
+	}
+}
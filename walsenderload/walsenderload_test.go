@@ -0,0 +1,121 @@
+package walsenderload
+
+import (
+	"context"
+	"errors"
+	"github.com/lesovsky/noisia/db"
+	"github.com/lesovsky/noisia/log"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"testing"
+	"time"
+)
+
+func TestConfig_validate(t *testing.T) {
+	testcases := []struct {
+		valid  bool
+		config Config
+	}{
+		{valid: true, config: Config{SlotName: "noisia_walsenderload", StallTime: time.Second}},
+		{valid: false, config: Config{SlotName: "", StallTime: time.Second}},
+		{valid: false, config: Config{SlotName: "Noisia-slot", StallTime: time.Second}},
+		{valid: false, config: Config{SlotName: "noisia_walsenderload", StallTime: 0}},
+	}
+
+	for _, tc := range testcases {
+		if tc.valid {
+			assert.NoError(t, tc.config.validate())
+		} else {
+			assert.Error(t, tc.config.validate())
+		}
+	}
+}
+
+func TestWorkload_Run(t *testing.T) {
+	// Replication connections require privileges, skip if not allowed.
+	conn, err := db.ConnectReplication(context.Background(), db.TestConninfo, db.ConnOptions{})
+	if noReplicationAccess(err) {
+		t.Skipf("replication connection is not allowed: %s", err)
+	}
+	require.NoError(t, err)
+	assert.NoError(t, conn.Close())
+
+	config := Config{Conninfo: db.TestConninfo, SlotName: "noisia_walsenderload_test", StallTime: 100 * time.Millisecond}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	w, err := NewWorkload(config, log.NewDefaultLogger("info"))
+	assert.NoError(t, err)
+	assert.NoError(t, w.Run(ctx))
+	assert.Greater(t, w.Stats()["stalls"], int64(0))
+}
+
+func TestWorkload_Name(t *testing.T) {
+	w, err := NewWorkload(Config{SlotName: "noisia_walsenderload", StallTime: time.Second}, log.NewDefaultLogger("error"))
+	assert.NoError(t, err)
+	assert.Equal(t, "walsenderload", w.Name())
+}
+
+// fakeStream implements streamer interface. It returns queued WAL ends or error, and then
+// blocks until context is done. Reported locations are recorded.
+type fakeStream struct {
+	ends     []uint64
+	err      error
+	reported []uint64
+}
+
+func (s *fakeStream) Receive(ctx context.Context) (uint64, error) {
+	if len(s.ends) > 0 {
+		end := s.ends[0]
+		s.ends = s.ends[1:]
+		return end, nil
+	}
+
+	if s.err != nil {
+		return 0, s.err
+	}
+
+	<-ctx.Done()
+	return 0, ctx.Err()
+}
+
+func (s *fakeStream) SendStatus(_ context.Context, lsn uint64) error {
+	s.reported = append(s.reported, lsn)
+	return nil
+}
+
+func Test_stallLoop(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+
+	// The first stall is followed by draining the stream and reporting start location.
+	s := &fakeStream{ends: []uint64{150, 300, 200}}
+	st := &stats{}
+	assert.NoError(t, stallLoop(ctx, s, 10*time.Millisecond, 100, st))
+	assert.Equal(t, int64(2), st.stalls)
+	assert.Equal(t, int64(200), st.lag)
+	assert.Equal(t, []uint64{100}, s.reported)
+}
+
+func Test_stallLoop_terminated(t *testing.T) {
+	s := &fakeStream{ends: []uint64{150}, err: errors.New("unexpected EOF")}
+	st := &stats{}
+	assert.Error(t, stallLoop(context.Background(), s, 10*time.Millisecond, 100, st))
+	assert.Equal(t, int64(1), st.stalls)
+	assert.Len(t, s.reported, 0)
+}
+
+func Test_noReplicationAccess(t *testing.T) {
+	assert.True(t, noReplicationAccess(sqlstateErr{code: "42501"}))
+	assert.True(t, noReplicationAccess(sqlstateErr{code: "28000"}))
+	assert.False(t, noReplicationAccess(sqlstateErr{code: "53300"}))
+	assert.False(t, noReplicationAccess(errors.New("connection refused")))
+	assert.False(t, noReplicationAccess(nil))
+}
+
+// sqlstateErr implements error with SQLSTATE code, as returned by Postgres.
+type sqlstateErr struct{ code string }
+
+func (e sqlstateErr) Error() string    { return "FATAL: fake error (SQLSTATE " + e.code + ")" }
+func (e sqlstateErr) SQLState() string { return e.code }
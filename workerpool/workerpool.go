@@ -0,0 +1,103 @@
+// Copyright 2021 The Noisia Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package workerpool implements pool of workers which size could be changed while
+// the workers are running. It is shared by workloads with per-worker loops, so
+// number of jobs could be tuned without restarting the workload.
+//
+// Each worker gets its own context and index. When the pool grows, new workers are
+// started with next indexes. When the pool shrinks, contexts of the workers with the
+// highest indexes are cancelled and the workers are expected to exit.
+package workerpool
+
+import (
+	"context"
+	"sync"
+)
+
+// Pool defines pool of workers. It is safe for concurrent use.
+type Pool struct {
+	mu   sync.Mutex
+	size int
+	// ctx defines context of the running pool, it is nil until the pool is started.
+	ctx context.Context
+	fn  func(ctx context.Context, i int)
+	// cancels defines cancel functions of current workers, indexed by workers indexes.
+	cancels []context.CancelFunc
+	// running defines number of workers which are not finished yet, including stopped by shrinking.
+	running int
+	stopped bool
+	done    chan struct{}
+}
+
+// New creates a new pool with specified number of workers.
+func New(size int) *Pool {
+	return &Pool{size: size}
+}
+
+// Size returns required number of workers.
+func (p *Pool) Size() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.size
+}
+
+// Resize changes number of workers. If the pool is running, missing workers are started and
+// extra workers are stopped, otherwise the size is used when the pool is started.
+func (p *Pool) Resize(size int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.size = size
+	if p.ctx == nil || p.stopped {
+		return
+	}
+
+	for len(p.cancels) < p.size {
+		p.spawn(len(p.cancels))
+	}
+
+	for len(p.cancels) > p.size {
+		last := len(p.cancels) - 1
+		p.cancels[last]()
+		p.cancels = p.cancels[:last]
+	}
+}
+
+// Run starts workers which call fn and waits until all workers are finished.
+func (p *Pool) Run(ctx context.Context, fn func(ctx context.Context, i int)) {
+	p.mu.Lock()
+	p.ctx, p.fn, p.done = ctx, fn, make(chan struct{})
+	for i := 0; i < p.size; i++ {
+		p.spawn(i)
+	}
+	if p.running == 0 {
+		p.stopped = true
+		close(p.done)
+	}
+	p.mu.Unlock()
+
+	<-p.done
+}
+
+// spawn starts worker with passed index, it must be called with locked mutex.
+func (p *Pool) spawn(i int) {
+	ctx, cancel := context.WithCancel(p.ctx)
+	p.cancels = append(p.cancels, cancel)
+	p.running++
+
+	go func() {
+		p.fn(ctx, i)
+		cancel()
+
+		p.mu.Lock()
+		p.running--
+		if p.running == 0 {
+			p.stopped = true
+			close(p.done)
+		}
+		p.mu.Unlock()
+	}()
+}
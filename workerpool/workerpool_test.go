@@ -0,0 +1,64 @@
+package workerpool
+
+import (
+	"context"
+	"github.com/stretchr/testify/assert"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// waitRunning waits until number of running workers reaches expected value.
+func waitRunning(running *int64, want int64) bool {
+	for i := 0; i < 100; i++ {
+		if atomic.LoadInt64(running) == want {
+			return true
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	return false
+}
+
+func TestPool_Resize(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var running int64
+	p := New(2)
+	done := make(chan struct{})
+	go func() {
+		p.Run(ctx, func(ctx context.Context, i int) {
+			atomic.AddInt64(&running, 1)
+			<-ctx.Done()
+			atomic.AddInt64(&running, -1)
+		})
+		close(done)
+	}()
+
+	assert.True(t, waitRunning(&running, 2))
+
+	p.Resize(5)
+	assert.Equal(t, 5, p.Size())
+	assert.True(t, waitRunning(&running, 5))
+
+	p.Resize(1)
+	assert.True(t, waitRunning(&running, 1))
+
+	cancel()
+	<-done
+	assert.Equal(t, int64(0), atomic.LoadInt64(&running))
+
+	// Finished pool is not grown.
+	p.Resize(3)
+	assert.Equal(t, int64(0), atomic.LoadInt64(&running))
+}
+
+func TestPool_Run_finished(t *testing.T) {
+	// Run returns when all workers are finished, even if context is not done.
+	var calls int64
+	p := New(3)
+	p.Resize(4)
+	p.Run(context.Background(), func(ctx context.Context, i int) {
+		atomic.AddInt64(&calls, 1)
+	})
+	assert.Equal(t, int64(4), calls)
+}
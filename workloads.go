@@ -0,0 +1,385 @@
+package noisia
+
+// WorkloadDescriptor describes a workload and configuration settings it accepts.
+type WorkloadDescriptor struct {
+	// Name defines workload name, the same as returned by Workload.Name().
+	Name string
+	// Description defines short human-readable description of the workload.
+	Description string
+	// PoolerSafe defines whether workload works properly through connection pooler in transaction pooling mode.
+	PoolerSafe bool
+	// SessionDependent defines whether workload relies on session state (advisory locks, LISTEN, temporary
+	// objects, prepared statements, long-living sessions), such workloads can't be run through connection
+	// pooler in transaction pooling mode.
+	SessionDependent bool
+	// ReadOnly defines whether workload doesn't modify data and could be run against hot standby.
+	ReadOnly bool
+	// Destructive defines whether workload affects other clients of Postgres or the whole server, such
+	// workloads are run only when explicitly acknowledged.
+	Destructive bool
+	// Fields defines configuration settings accepted by the workload.
+	Fields []FieldDescriptor
+	// Fixtures defines tables created by the workload, these tables are dropped at cleanup.
+	Fixtures []string
+}
+
+// FieldDescriptor describes a single workload configuration setting.
+type FieldDescriptor struct {
+	// Name defines name of the field in workload's Config.
+	Name string
+	// Type defines Go type of the field.
+	Type string
+	// Default defines default value of the field used by noisia tool.
+	Default string
+	// Description defines short human-readable description of the field.
+	Description string
+}
+
+// Workloads returns descriptors of all available workloads.
+func Workloads() []WorkloadDescriptor {
+	conninfo := FieldDescriptor{Name: "Conninfo", Type: "string", Default: "", Description: "Postgres connection string (DSN or URL)"}
+	jobs := FieldDescriptor{Name: "Jobs", Type: "uint16", Default: "1", Description: "Number of workers"}
+	poolerMode := FieldDescriptor{Name: "PoolerMode", Type: "string", Default: "", Description: "Pooling mode of connection pooler: session, transaction"}
+	cleanupTimeout := FieldDescriptor{Name: "CleanupTimeout", Type: "time.Duration", Default: "10s", Description: "Max time allowed for fixtures cleanup"}
+	isolation := FieldDescriptor{Name: "Isolation", Type: "string", Default: "", Description: "Isolation level of transactions: read-committed, repeatable-read, serializable"}
+	workerDatabases := FieldDescriptor{Name: "Databases", Type: "[]string", Default: "", Description: "Databases which workers connect to accordingly to workers indexes"}
+	adaptiveLimiter := FieldDescriptor{Name: "Adaptive", Type: "*adaptive.Limiter", Default: "nil", Description: "Optional limiter which throttles rate accordingly to server load"}
+	scheduler := FieldDescriptor{Name: "Scheduler", Type: "ratelimit.SchedulerFactory", Default: "nil", Description: "Optional pacing of each worker, e.g. Poisson arrivals or bursts; constant Rate is used if nil"}
+	role := FieldDescriptor{Name: "Role", Type: "string", Default: "", Description: "Role set after connecting, connecting user must be a member of the role"}
+	searchPath := FieldDescriptor{Name: "SearchPath", Type: "string", Default: "", Description: "Comma-separated list of schemas set as search_path after connecting"}
+	poolAcquireTimeout := FieldDescriptor{Name: "PoolAcquireTimeout", Type: "time.Duration", Default: "0s", Description: "Max time of waiting for a free connection of the pool, zero means waiting until the workload is stopped"}
+	seed := FieldDescriptor{Name: "Seed", Type: "int64", Default: "0", Description: "Seed of random decisions, runs with the same seed make the same decisions; current time is used if zero"}
+
+	return []WorkloadDescriptor{
+		{
+			Name:             "advisorylocks",
+			Description:      "Many workers contending on a small pool of advisory locks that reproduce application-level lock contention",
+			SessionDependent: true,
+			ReadOnly:         true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, workerDatabases, role, searchPath,
+				{Name: "KeySpace", Type: "uint16", Default: "4", Description: "Number of distinct lock keys, the smaller the key space the higher the contention"},
+				{Name: "HoldTime", Type: "time.Duration", Default: "100ms", Description: "Time acquired lock is held before release"},
+				seed,
+			},
+		},
+		{
+			Name:        "analyzeload",
+			Description: "ANALYZE of tables in a tight loop that stresses statistics collection and causes plan churn",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "ANALYZE rate per second (per worker)"},
+				{Name: "Tables", Type: "[]string", Default: "", Description: "Names of analyzed tables, the most written tables are analyzed if empty"},
+				seed,
+			},
+		},
+		{
+			Name:        "checksumload",
+			Description: "Read-only checks of data checksums failures counters and pages headers that exercise checksums monitoring",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Interval", Type: "time.Duration", Default: "1s", Description: "Interval between checks"},
+				{Name: "PageInspect", Type: "bool", Default: "false", Description: "Inspect pages of fixture table using pageinspect extension"},
+			},
+			Fixtures: []string{"_noisia_checksumload_workload"},
+		},
+		{
+			Name:        "clientcancel",
+			Description: "Long queries cancelled from the client side after random delay that reproduce queries cancelled by client timeouts",
+			PoolerSafe:  true,
+			ReadOnly:    true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Queries rate per second (per worker)"},
+				scheduler,
+				{Name: "CancelAfterMin", Type: "time.Duration", Default: "100ms", Description: "Min delay before query is cancelled"},
+				{Name: "CancelAfterMax", Type: "time.Duration", Default: "1s", Description: "Max delay before query is cancelled"},
+				seed,
+			},
+		},
+		{
+			Name:        "customsql",
+			Description: "User-provided SQL statements executed at specified rate, optionally within transactions",
+			Fields: []FieldDescriptor{
+				conninfo, jobs,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Executions of all statements per second (per worker)"},
+				scheduler,
+				{Name: "Statements", Type: "[]string", Default: "", Description: "SQL statements executed in specified order"},
+				{Name: "InTransaction", Type: "bool", Default: "false", Description: "Execute statements within single transaction"},
+				role, searchPath, poolAcquireTimeout,
+			},
+		},
+		{
+			Name:        "deadlocks",
+			Description: "Simultaneous transactions where each holds locks that the other transactions want",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout,
+				{Name: "LockDelay", Type: "time.Duration", Default: "10ms", Description: "Initial (and minimal) delay between updates in deadlock transactions, tuned automatically accordingly to rate of missed deadlocks"},
+				poolerMode, role, searchPath, poolAcquireTimeout, isolation,
+				seed,
+				{Name: "TableName", Type: "string", Default: "_noisia_deadlocks_workload", Description: "Name of the working table created by the workload"},
+				{Name: "PayloadSize", Type: "int", Default: "32", Description: "Size of random text payload of rows in bytes"},
+			},
+			Fixtures: []string{"_noisia_deadlocks_workload"},
+		},
+		{
+			Name:        "diskfill",
+			Description: "Writes of uncompressed data into unlogged table up to specified budget that exercise disk usage alerting",
+			PoolerSafe:  true,
+			Destructive: true,
+			Fields: []FieldDescriptor{
+				conninfo, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "TargetBytes", Type: "int64", Default: "1073741824", Description: "Growth of the database, in bytes; could not exceed 10GB unless AllowFull is set"},
+				{Name: "Rate", Type: "float64", Default: "10", Description: "Inserts rate per second, each insert writes up to 1MB"},
+				{Name: "AllowFull", Type: "bool", Default: "false", Description: "Allow exceeding safety cap and filling the volume, zero TargetBytes means until disk is full"},
+			},
+			Fixtures: []string{"_noisia_diskfill_workload"},
+		},
+		{
+			Name:        "failconns",
+			Description: "Exhaust all available connections",
+			ReadOnly:    true,
+			Destructive: true,
+			Fields: []FieldDescriptor{
+				conninfo, cleanupTimeout, role, searchPath,
+				{Name: "HoldTime", Type: "time.Duration", Default: "0s", Description: "Interval after which a part of held connections is released, zero means hold until the end"},
+				{Name: "ReleaseRatio", Type: "float64", Default: "0", Description: "Fraction of held connections released every hold time"},
+				{Name: "Interval", Type: "time.Duration", Default: "50ms", Description: "Base interval between making new connections"},
+				{Name: "MinInterval", Type: "time.Duration", Default: "0s", Description: "Lower limit of interval reduced after successful connections, zero means base interval"},
+				{Name: "GrowFactor", Type: "float64", Default: "2", Description: "Factor of increasing interval after failed connection"},
+				{Name: "ShrinkFactor", Type: "float64", Default: "2", Description: "Factor of reducing interval after successful connection"},
+				{Name: "Capacity", Type: "int", Default: "0", Description: "Initial capacity of held connections list, zero means derived from max_connections"},
+			},
+		},
+		{
+			Name:        "forkconns",
+			Description: "Execute single, short query in a dedicated connection",
+			ReadOnly:    true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, workerDatabases, role, searchPath,
+				{Name: "Rate", Type: "uint16", Default: "1", Description: "Number of connections made per second"},
+				adaptiveLimiter,
+				{Name: "Force", Type: "bool", Default: "false", Description: "Allow rates higher than 100 connections per second"},
+			},
+		},
+		{
+			Name:        "hotrow",
+			Description: "Repeated updates of the same single row that produce dead rows and index bloat",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "10", Description: "Hot row updates rate per second (per worker)"},
+			},
+			Fixtures: []string{"_noisia_hotrow_workload"},
+		},
+		{
+			Name:             "idleconns",
+			Description:      "Many connections held idle (not in transaction) that consume server memory",
+			SessionDependent: true,
+			ReadOnly:         true,
+			Fields: []FieldDescriptor{
+				conninfo, role, searchPath,
+				{Name: "Count", Type: "uint16", Default: "100", Description: "Number of held idle connections"},
+				{Name: "KeepaliveInterval", Type: "time.Duration", Default: "30s", Description: "Interval between keepalive queries in held connections"},
+			},
+		},
+		{
+			Name:        "idlexacts",
+			Description: "Active transactions on hot-write tables that do nothing during their lifetime",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout,
+				{Name: "NaptimeMin", Type: "time.Duration", Default: "5s", Description: "Min transactions naptime"},
+				{Name: "NaptimeMax", Type: "time.Duration", Default: "20s", Description: "Max transactions naptime"},
+				{Name: "Distribution", Type: "string", Default: "uniform", Description: "Distribution of transactions naptime: uniform, exponential"},
+				poolerMode, role, searchPath, poolAcquireTimeout,
+				{Name: "HoldLock", Type: "bool", Default: "false", Description: "Lock a row of victim table during transaction"},
+				isolation,
+				{Name: "WakeInterval", Type: "time.Duration", Default: "0s", Description: "Interval of executing short statement during transactions naptime, zero means idle all the time"},
+				{Name: "CommitTempTables", Type: "bool", Default: "false", Description: "Commit transactions keeping temporary tables in workers sessions"},
+				seed,
+			},
+		},
+		{
+			Name:        "logicaldecode",
+			Description: "Changes decoded using logical replication slots that stress CPU and memory of logical decoding",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "SlotName", Type: "string", Default: "noisia_logicaldecode", Description: "Prefix of logical replication slots names, each worker uses its own slot"},
+				jobs,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Changes generated and decoded per second (per worker)"},
+				scheduler,
+			},
+			Fixtures: []string{"_noisia_logicaldecode_workload"},
+		},
+		{
+			Name:             "notifyload",
+			Description:      "High-volume notifications held in the queue by idle listener that stress asynchronous notifications queue",
+			SessionDependent: true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "100", Description: "Notifications rate per second (per worker)"},
+				scheduler,
+				{Name: "PayloadSize", Type: "uint16", Default: "1024", Description: "Size of notification payload, in bytes"},
+				{Name: "Channel", Type: "string", Default: "noisia", Description: "Name of the channel notifications are sent to"},
+			},
+		},
+		{
+			Name:             "orphanload",
+			Description:      "Sessions holding temporary objects terminated abruptly that leave temporary schemas behind",
+			SessionDependent: true,
+			PoolerSafe:       false,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Terminated sessions rate per second (per worker)"},
+			},
+		},
+		{
+			Name:             "plancacheload",
+			Description:      "Many uniquely-named prepared statements per session that stress plans cache",
+			SessionDependent: true,
+			PoolerSafe:       false,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath,
+				{Name: "StatementsPerSession", Type: "uint16", Default: "100", Description: "Number of prepared statements created in each session"},
+				{Name: "Rate", Type: "float64", Default: "10", Description: "Prepared statements executions rate per second (per worker)"},
+				{Name: "Replan", Type: "bool", Default: "false", Description: "Execute DDL after each round of executions for forcing replanning"},
+				seed,
+			},
+		},
+		{
+			Name:        "poolerload",
+			Description: "More clients than connection pooler's pool size that overflow the pool and queue clients in the pooler",
+			PoolerSafe:  true,
+			ReadOnly:    true,
+			Destructive: true,
+			Fields: []FieldDescriptor{
+				conninfo,
+				{Name: "Clients", Type: "uint16", Default: "100", Description: "Number of client connections opened to the pooler, should be greater than pool size"},
+				{Name: "HoldTime", Type: "time.Duration", Default: "1s", Description: "Duration of queries which hold server connections of the pool"},
+				{Name: "AdminDatabase", Type: "string", Default: "pgbouncer", Description: "Database of the pooler's admin console used for SHOW POOLS"},
+			},
+		},
+		{
+			Name:        "rollbacks",
+			Description: "Fake invalid queries that generate errors and increase rollbacks counter",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, workerDatabases, cleanupTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Rollbacks rate per second (per worker)"},
+				poolerMode, role, searchPath, poolAcquireTimeout, adaptiveLimiter,
+				{Name: "SQLStates", Type: "[]string", Default: "", Description: "SQLSTATE codes or condition names of errors to produce, all if empty"},
+				{Name: "Strict", Type: "bool", Default: "false", Description: "Check produced errors have expected SQLSTATE codes"},
+				seed,
+			},
+			Fixtures: []string{"_noisia_rollbacks_workload"},
+		},
+		{
+			Name:        "serialfailures",
+			Description: "Concurrent serializable transactions with overlapping read/write sets that fail with serialization failures",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Pairs of conflicting transactions executed per second (per worker)"},
+			},
+			Fixtures: []string{"_noisia_serialfailures_workload"},
+		},
+		{
+			Name:        "statsload",
+			Description: "Tight loop of statistics views reads and optional statistics resets that stress statistics subsystem",
+			PoolerSafe:  true,
+			ReadOnly:    true,
+			Destructive: true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "10", Description: "Queries rate per second (per worker)"},
+				scheduler,
+				{Name: "ResetRatio", Type: "float64", Default: "0", Description: "Probability of resetting statistics of the database instead of reading, from 0 to 1"},
+				{Name: "AllowReset", Type: "bool", Default: "false", Description: "Allow resetting statistics of the whole database"},
+				seed,
+			},
+		},
+		{
+			Name:        "tempfiles",
+			Description: "Queries that produce on-disk temporary files due to lack of work_mem",
+			PoolerSafe:  true,
+			ReadOnly:    true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, workerDatabases, cleanupTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Number of queries per second (per worker)"},
+				{Name: "Query", Type: "string", Default: "SELECT * FROM pg_class a, pg_class b ORDER BY random()", Description: "SELECT query which produces temp files"},
+				{Name: "SampleInterval", Type: "time.Duration", Default: "1s", Description: "Interval between samples of temp bytes statistics used for reporting temp bytes rate"},
+				poolerMode, role, searchPath, poolAcquireTimeout, adaptiveLimiter,
+				{Name: "MinConns", Type: "uint16", Default: "0", Description: "Number of connections established in pool of each worker before queries are started, zero means no warmup"},
+				{Name: "ExceedTempLimit", Type: "bool", Default: "false", Description: "Set low temp_file_limit for queries, so they fail with temp_file_limit errors"},
+				{Name: "MaxInflight", Type: "uint16", Default: "0", Description: "Max number of queries executed concurrently by each worker, queries are skipped when the limit is reached, zero means no limit"},
+			},
+		},
+		{
+			Name:        "terminate",
+			Description: "Terminate random backends (or cancel queries)",
+			PoolerSafe:  true,
+			ReadOnly:    true,
+			Destructive: true,
+			Fields: []FieldDescriptor{
+				conninfo,
+				{Name: "Interval", Type: "time.Duration", Default: "1s", Description: "Time interval of single round of termination"},
+				{Name: "Rate", Type: "uint16", Default: "1", Description: "Number of backends/queries terminate per interval"},
+				{Name: "Force", Type: "bool", Default: "false", Description: "Allow rates higher than 100 signals per second"},
+				{Name: "SoftMode", Type: "bool", Default: "false", Description: "Use queries cancel mode"},
+				{Name: "IgnoreSystemBackends", Type: "bool", Default: "false", Description: "Don't terminate postgres system processes"},
+				{Name: "ClientAddr", Type: "string", Default: "", Description: "Terminate backends created from specific client addresses"},
+				{Name: "User", Type: "string", Default: "", Description: "Terminate backends handled by specific user"},
+				{Name: "Database", Type: "string", Default: "", Description: "Terminate backends connected to specific database"},
+				{Name: "ApplicationName", Type: "string", Default: "", Description: "Terminate backends created from specific applications"},
+				{Name: "Escalate", Type: "bool", Default: "false", Description: "Cancel queries first and terminate backends if they are still present after delay"},
+				{Name: "EscalateDelay", Type: "time.Duration", Default: "1s", Description: "Time interval between cancel and terminate in escalate mode"},
+				{Name: "MaxTotal", Type: "int", Default: "0", Description: "Max number of signalled backends, when reached the workload stops; zero means unlimited"},
+				{Name: "SnapshotMode", Type: "bool", Default: "false", Description: "Signal backends round-robin over snapshot of PIDs taken each interval instead of random choice"},
+				poolerMode, role, searchPath, poolAcquireTimeout,
+			},
+		},
+		{
+			Name:        "toastload",
+			Description: "Inserts of very large values that stress TOAST subsystem and generate lots of WAL",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout, role, searchPath, poolAcquireTimeout,
+				{Name: "Rate", Type: "float64", Default: "1", Description: "Large values inserts rate per second (per worker)"},
+				{Name: "ValueSizeKB", Type: "uint32", Default: "1024", Description: "Size of inserted values, in kilobytes"},
+			},
+			Fixtures: []string{"_noisia_toastload_workload"},
+		},
+		{
+			Name:        "waitxacts",
+			Description: "Transactions that lock hot-write tables and then idle, leading to other transactions getting stuck",
+			PoolerSafe:  true,
+			Fields: []FieldDescriptor{
+				conninfo, jobs, cleanupTimeout,
+				{Name: "Fixture", Type: "bool", Default: "false", Description: "Run workload using fixture table"},
+				{Name: "NoFixtureFallback", Type: "bool", Default: "false", Description: "Fail instead of switching to fixture table when no tables found"},
+				{Name: "LocktimeMin", Type: "time.Duration", Default: "5s", Description: "Min transactions locking time"},
+				{Name: "LocktimeMax", Type: "time.Duration", Default: "20s", Description: "Max transactions locking time"},
+				cleanupTimeout, poolerMode, role, searchPath, poolAcquireTimeout, isolation,
+				{Name: "MinConns", Type: "uint16", Default: "0", Description: "Number of connections established in pool before the workload is started, zero means no warmup"},
+				seed,
+			},
+			Fixtures: []string{"_noisia_waitxacts_workload"},
+		},
+		{
+			Name:             "walsenderload",
+			Description:      "Physical replication connection which stalls consuming of WAL stream and reproduces replication timeouts and lag",
+			SessionDependent: true,
+			ReadOnly:         true,
+			Fields: []FieldDescriptor{
+				conninfo,
+				{Name: "SlotName", Type: "string", Default: "noisia_walsenderload", Description: "Name of temporary physical replication slot"},
+				{Name: "StallTime", Type: "time.Duration", Default: "90s", Description: "Time when replication stream is not consumed"},
+			},
+		},
+	}
+}